@@ -0,0 +1,205 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+)
+
+// emitExtensions are the extensions of the extra artifacts --emit writes
+// next to the compiled program
+var emitExtensions = map[string]string{
+	"json":     ".json",
+	"disasm":   ".disasm",
+	"metadata": ".meta.json",
+}
+
+// programJSON is the compiled program as --emit=json writes it
+type programJSON struct {
+	Version      uint16            `json:"version"`
+	Constants    []constantJSON    `json:"constants"`
+	Functions    []vm.Function     `json:"functions"`
+	Instructions []instructionJSON `json:"instructions"`
+}
+
+type constantJSON struct {
+	Type  string   `json:"type"`
+	Value vm.Value `json:"value"`
+}
+
+type instructionJSON struct {
+	Op      string `json:"op"`
+	Operand int    `json:"operand"`
+}
+
+// buildMetadata describes a build, as --emit=metadata writes it
+type buildMetadata struct {
+	Sources         []sourceMetadata `json:"sources"`
+	BytecodeVersion uint16           `json:"bytecodeVersion"`
+	BuiltAt         time.Time        `json:"builtAt"`
+	Agents          []string         `json:"agents"`
+	Functions       []string         `json:"functions"`
+	Instructions    int              `json:"instructions"`
+	Constants       int              `json:"constants"`
+}
+
+// sourceMetadata identifies a source file of a build
+type sourceMetadata struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// parseEmit checks the artifacts asked for with --emit
+func parseEmit(kinds []string) error {
+	for _, kind := range kinds {
+		if _, ok := emitExtensions[kind]; !ok {
+			return fmt.Errorf("unknown artifact %q, expected json, disasm or metadata", kind)
+		}
+	}
+	return nil
+}
+
+// writeArtifacts writes the compiled program to path in the .mindc format
+// and the extra artifacts of emit next to it, named after path
+func writeArtifacts(path string, sourcePaths []string, program *parser.Program, bytecode *vm.Program, emit []string) error {
+	if err := writeFile(path, func(f *os.File) error {
+		_, err := bytecode.WriteTo(f)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, kind := range emit {
+		var data []byte
+		var err error
+		switch kind {
+		case "json":
+			data, err = json.MarshalIndent(newProgramJSON(bytecode), "", "  ")
+		case "disasm":
+			data = []byte(vm.Disassemble(bytecode))
+		case "metadata":
+			var metadata buildMetadata
+			metadata, err = newBuildMetadata(sourcePaths, program, bytecode)
+			if err == nil {
+				data, err = json.MarshalIndent(metadata, "", "  ")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s artifact: %w", kind, err)
+		}
+		if kind != "disasm" {
+			data = append(data, '\n')
+		}
+		if err := os.WriteFile(base+emitExtensions[kind], data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile creates path and writes it with write, removing it on failure
+// so no truncated program is left behind
+func writeFile(path string, write func(f *os.File) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func newProgramJSON(bytecode *vm.Program) programJSON {
+	p := programJSON{
+		Version:      vm.BytecodeVersion,
+		Constants:    make([]constantJSON, len(bytecode.Constants)),
+		Functions:    bytecode.Functions,
+		Instructions: make([]instructionJSON, len(bytecode.Instructions)),
+	}
+	for i, constant := range bytecode.Constants {
+		p.Constants[i] = constantJSON{Type: constantType(constant), Value: constant}
+	}
+	for i, instr := range bytecode.Instructions {
+		p.Instructions[i] = instructionJSON{Op: instr.Opcode.String(), Operand: instr.Operand}
+	}
+	return p
+}
+
+// constantType names the type of a constant, the constant pool only holds
+// ints, floats and strings
+func constantType(constant vm.Value) string {
+	switch constant.(type) {
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	}
+	return "string"
+}
+
+func newBuildMetadata(sourcePaths []string, program *parser.Program, bytecode *vm.Program) (buildMetadata, error) {
+	metadata := buildMetadata{
+		Sources:         make([]sourceMetadata, len(sourcePaths)),
+		BytecodeVersion: vm.BytecodeVersion,
+		BuiltAt:         time.Now().UTC(),
+		Agents:          []string{},
+		Functions:       make([]string, len(bytecode.Functions)),
+		Instructions:    len(bytecode.Instructions),
+		Constants:       len(bytecode.Constants),
+	}
+	for i, path := range sourcePaths {
+		source, err := newSourceMetadata(path)
+		if err != nil {
+			return buildMetadata{}, err
+		}
+		metadata.Sources[i] = source
+	}
+	for _, stmt := range program.Statements {
+		if agent, ok := stmt.(*parser.AgentStatement); ok {
+			metadata.Agents = append(metadata.Agents, agent.Name.Value)
+		}
+	}
+	for i, function := range bytecode.Functions {
+		metadata.Functions[i] = function.Name
+	}
+	return metadata, nil
+}
+
+func newSourceMetadata(path string) (sourceMetadata, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return sourceMetadata{}, err
+	}
+	sum := sha256.Sum256(source)
+	return sourceMetadata{Path: path, SHA256: hex.EncodeToString(sum[:])}, nil
+}
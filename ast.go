@@ -0,0 +1,125 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var astFormat string
+
+func newASTCmd() *cobra.Command {
+	astCmd := &cobra.Command{
+		Use:   "ast file.ms",
+		Short: "Print the syntax tree of a source file",
+		Long: `Ast parses a MindScript source file and prints its syntax tree as JSON, YAML
+or, with --format dot, as a graph for Graphviz:
+
+  msc ast agents.ms --format dot | dot -Tsvg > agents.svg`,
+		Args: cobra.ExactArgs(1),
+		Run:  runAST,
+	}
+	astCmd.Flags().StringVar(&astFormat, "format", "json", "Output format (json, yaml, dot)")
+	astCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write the tree to this file instead of stdout")
+	return astCmd
+}
+
+func runAST(cmd *cobra.Command, args []string) {
+	initLogger()
+	if astFormat != "json" && astFormat != "yaml" && astFormat != "dot" {
+		logger.Log.Errorw("Unknown AST format, expected json, yaml or dot", zap.String("format", astFormat))
+		os.Exit(exitUsage)
+	}
+	input, err := os.ReadFile(args[0])
+	if err != nil {
+		logger.Log.Errorw("Error reading source file", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	p := parser.New(lexer.New(string(input)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		logger.Log.Errorw("Error parsing program", zap.String("errors", strings.Join(p.Errors(), "; ")))
+		os.Exit(exitParse)
+	}
+
+	var w io.Writer = os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			logger.Log.Errorw("Error creating output file", zap.Error(err))
+			os.Exit(exitFailure)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeAST(w, program, astFormat); err != nil {
+		logger.Log.Errorw("Error writing the syntax tree", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+}
+
+// writeAST writes the syntax tree of program in format
+func writeAST(w io.Writer, program *parser.Program, format string) error {
+	if format == "dot" {
+		return parser.WriteDot(w, program)
+	}
+	data, err := json.MarshalIndent(program, "", "  ")
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		_, err := fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	// JSON is YAML, decoding it into a node keeps the order of the fields
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// blockStyle makes a node decoded from JSON encode in YAML's block style
+func blockStyle(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode {
+		node.Style = 0
+	}
+	if node.Kind == yaml.ScalarNode && node.Style == yaml.DoubleQuotedStyle {
+		node.Style = 0
+	}
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
@@ -0,0 +1,151 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	benchFilter string
+	benchTime   time.Duration
+)
+
+// maxBenchIterations bounds how often a benchmark runs in one round
+const maxBenchIterations = 1_000_000_000
+
+func newBenchCmd() *cobra.Command {
+	benchCmd := &cobra.Command{
+		Use:   "bench [paths...]",
+		Short: "Run the benchmarks of MindScript programs",
+		Long: `Bench runs the functions whose names start with bench in the *_test.ms files
+of the given files and directories, the current directory by default. Each
+benchmark is called repeatedly in a sandboxed VM like those of msc test,
+more often every round until a round takes --benchtime, and the last round
+is reported in nanoseconds and instructions per call.`,
+		Run: runBenchmarks,
+	}
+	benchCmd.Flags().StringVar(&benchFilter, "bench", "", "Only run the benchmarks whose names match this regular expression")
+	benchCmd.Flags().DurationVar(&benchTime, "benchtime", time.Second, "How long the last round of each benchmark runs for")
+	benchCmd.Flags().Uint64Var(&testSeed, "seed", 1, "Seed of random, randomInt, choice and uuid in benchmarks")
+	benchCmd.Flags().DurationVar(&testTimeout, "timeout", 10*time.Second, "Maximum time each call may take (0 for unlimited)")
+	return benchCmd
+}
+
+// benchResult is the last round of a benchmark
+type benchResult struct {
+	iterations   int
+	elapsed      time.Duration
+	instructions int
+}
+
+func runBenchmarks(cmd *cobra.Command, args []string) {
+	if !cmd.Flags().Changed("loglevel") {
+		// The VM logs every run at info level
+		logLevel = "warn"
+	}
+	initLogger()
+
+	var filter *regexp.Regexp
+	if benchFilter != "" {
+		var err error
+		if filter, err = regexp.Compile(benchFilter); err != nil {
+			logger.Log.Errorw("Error parsing --bench", zap.Error(err))
+			os.Exit(exitUsage)
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	files, err := findFiles(args, "_test.ms")
+	if err != nil {
+		logger.Log.Errorw("Error finding test files", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for _, file := range files {
+		program, bytecode, err := compileSource(file)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL\t%s\t%s\t\n", file, err)
+			failed = true
+			continue
+		}
+		for _, name := range namedFunctions(program, "bench") {
+			if filter != nil && !filter.MatchString(name) {
+				continue
+			}
+			result, err := runBenchmark(bytecode, name)
+			if err != nil {
+				fmt.Fprintf(w, "FAIL\t%s\t%s\t\n", name, err)
+				failed = true
+				continue
+			}
+			nsPerOp := result.elapsed.Nanoseconds() / int64(result.iterations)
+			instructionsPerOp := result.instructions / result.iterations
+			fmt.Fprintf(w, "%s\t%d\t%d ns/op\t%d instructions/op\t\n", name, result.iterations, nsPerOp, instructionsPerOp)
+		}
+		w.Flush()
+	}
+	w.Flush()
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// runBenchmark calls a benchmark in rounds, predicting from each round how
+// many calls make the next one take --benchtime, and returns the round that
+// did
+func runBenchmark(bytecode *vm.Program, name string) (benchResult, error) {
+	machine, err := newTestVM(bytecode)
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer machine.Shutdown()
+
+	n := 1
+	for {
+		before := machine.Metrics().Instructions
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if _, err := machine.CallFunction(name); err != nil {
+				return benchResult{}, err
+			}
+		}
+		result := benchResult{
+			iterations:   n,
+			elapsed:      time.Since(start),
+			instructions: machine.Metrics().Instructions - before,
+		}
+		if result.elapsed >= benchTime || n >= maxBenchIterations {
+			return result, nil
+		}
+		// Aim 20% past --benchtime, growing at most a hundredfold a round
+		predicted := int(1.2 * float64(n) * float64(benchTime) / float64(max(result.elapsed, 1)))
+		n = min(max(predicted, n+1), 100*n, maxBenchIterations)
+	}
+}
@@ -0,0 +1,110 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/robert-cronin/mindscript-go/pkg/codegen"
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/repl"
+	"github.com/robert-cronin/mindscript-go/pkg/semantic"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func newEvalCmd() *cobra.Command {
+	evalCmd := &cobra.Command{
+		Use:   "eval code [-- args...]",
+		Short: "Run a line of MindScript and print its result",
+		Long: `Eval compiles and runs MindScript code given as an argument, or read from
+stdin when it is -, and prints the value of its last expression like the
+REPL does:
+
+  msc eval 'log("hi"); 1 + 2'
+
+Nothing is printed for statements and void calls such as print. Logs are
+only written from the warn level unless --loglevel is given, so messages of
+log appear with -l info. Arguments after the code are passed to it, which
+reads them with args(). The exit code tells parse, semantic and runtime
+errors apart like for msc build.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runEval,
+	}
+	addRuntimeFlags(evalCmd.Flags())
+	return evalCmd
+}
+
+func runEval(cmd *cobra.Command, args []string) {
+	if !cmd.Flags().Changed("loglevel") {
+		// The VM logs every run at info level, which would bury the result
+		logLevel = "warn"
+	}
+	initLogger()
+
+	code := args[0]
+	if code == "-" {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			logger.Log.Errorw("Error reading the code", zap.Error(err))
+			os.Exit(exitFailure)
+		}
+		code = string(input)
+	}
+	result, err := evalCode(code, args[1:])
+	if err != nil {
+		logger.Log.Errorw("Error evaluating the code", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	if result != "" {
+		fmt.Println(result)
+	}
+}
+
+// evalCode compiles and runs code on a VM configured by the flags, like an
+// input of a new REPL session, and returns its formatted result
+func evalCode(code string, args []string) (string, error) {
+	opts, closeOptions, err := newVMOptions()
+	if err != nil {
+		return "", fmt.Errorf("configuring the VM: %w", err)
+	}
+	defer closeOptions()
+
+	opts = append(opts, vm.WithArgs(args))
+	machine := vm.New(&vm.Program{}, opts...)
+	symbolTable := semantic.NewSymbolTable(lexer.New(""))
+	evaluator := repl.NewEvaluator(machine, symbolTable, codegen.NewCodeGenerator(symbolTable))
+	result, err := evaluator.Eval(code)
+	var compileErr *repl.CompileError
+	switch {
+	case errors.As(err, &compileErr) && compileErr.Parse:
+		return "", withExitCode(exitParse, err)
+	case errors.As(err, &compileErr):
+		return "", withExitCode(exitSemantic, err)
+	case err != nil:
+		return "", withExitCode(exitRuntime, err)
+	}
+	if err := machine.Shutdown(); err != nil {
+		return "", withExitCode(exitRuntime, fmt.Errorf("stopping agents: %w", err))
+	}
+	return result, nil
+}
@@ -0,0 +1,69 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "errors"
+
+// Exit codes of msc, listed in exitCodesHelp
+const (
+	// exitFailure is for errors of no other kind, such as files that
+	// cannot be read, failed tests and unformatted files
+	exitFailure = 1
+	// exitUsage is for invalid commands, flags and arguments
+	exitUsage = 2
+	// exitParse is for source that does not parse
+	exitParse = 3
+	// exitSemantic is for source that parses but fails analysis, such as
+	// type errors and undeclared names
+	exitSemantic = 4
+	// exitRuntime is for programs that fail while running
+	exitRuntime = 5
+)
+
+// exitCodesHelp documents the exit codes in the help of msc
+const exitCodesHelp = `Exit codes:
+  0  success
+  1  other errors, failed tests and unformatted files
+  2  invalid commands, flags or arguments
+  3  parse errors
+  4  semantic errors, such as type errors and undeclared names
+  5  runtime errors`
+
+// exitError is an error that makes msc exit with code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode makes msc exit with code when it fails with err
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the code msc exits with when it fails with err,
+// exitFailure unless err was given another with withExitCode
+func exitCode(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitFailure
+}
@@ -0,0 +1,96 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/robert-cronin/mindscript-go/pkg/format"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	fmtWrite bool
+	fmtCheck bool
+)
+
+func newFmtCmd() *cobra.Command {
+	fmtCmd := &cobra.Command{
+		Use:   "fmt files...",
+		Short: "Format MindScript source files",
+		Long: `Fmt reprints MindScript source files in the canonical style, keeping their
+comments and blank lines. The formatted source is written to stdout unless
+-w rewrites the files in place. With --check nothing is written, the files
+that are not formatted are listed and msc exits with status 1 if there are
+any, for use in CI.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runFmt,
+	}
+	fmtCmd.Flags().BoolVarP(&fmtWrite, "write", "w", false, "Rewrite the files instead of printing them")
+	fmtCmd.Flags().BoolVar(&fmtCheck, "check", false, "List the files that are not formatted and fail if there are any")
+	return fmtCmd
+}
+
+func runFmt(cmd *cobra.Command, args []string) {
+	initLogger()
+	failed, unformatted := false, false
+	for _, path := range args {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			logger.Log.Errorw("Error reading source file", zap.Error(err))
+			failed = true
+			continue
+		}
+		formatted, err := format.Source(src)
+		if err != nil {
+			logger.Log.Errorw("Error formatting source file", zap.String("file", path), zap.Error(err))
+			failed = true
+			continue
+		}
+		changed := !bytes.Equal(src, formatted)
+		switch {
+		case fmtCheck:
+			if changed {
+				fmt.Println(path)
+				unformatted = true
+			}
+		case fmtWrite:
+			if !changed {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				logger.Log.Errorw("Error writing source file", zap.Error(err))
+				failed = true
+				continue
+			}
+			if err := os.WriteFile(path, formatted, info.Mode().Perm()); err != nil {
+				logger.Log.Errorw("Error writing source file", zap.Error(err))
+				failed = true
+			}
+		default:
+			os.Stdout.Write(formatted)
+		}
+	}
+	if failed || unformatted {
+		os.Exit(exitFailure)
+	}
+}
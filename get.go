@@ -0,0 +1,391 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/toml"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// lockName is the name of the lockfile next to the manifest, recording the
+// commit every dependency was fetched at
+const lockName = "mindscript.lock"
+
+// envModuleCache overrides the directory modules are fetched into
+const envModuleCache = "MINDSCRIPT_CACHE"
+
+// latestVersion is the version of modules fetched without one, the
+// default branch of their repository
+const latestVersion = "latest"
+
+// modulePath matches the paths of modules, the repositories they are
+// cloned from over https without the scheme
+var modulePath = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)+(/[A-Za-z0-9_~-][A-Za-z0-9_.~-]*)+$`)
+
+// moduleVersion matches the versions of modules, tags, branches and commits
+// that cannot be taken for an option of git
+var moduleVersion = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./+-]*$`)
+
+// moduleCommit matches the commits of the lockfile, SHA-1 or SHA-256
+// object names
+var moduleCommit = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// checkModule checks the path and version of a module, which are passed to
+// git and name its directory in the cache
+func checkModule(path, version string) error {
+	if !modulePath.MatchString(path) {
+		return fmt.Errorf("%s is not a module path such as github.com/org/repo", path)
+	}
+	if !moduleVersion.MatchString(version) || strings.Contains(version, "..") {
+		return fmt.Errorf("%q is not a version of %s, such as a tag, branch or commit", version, path)
+	}
+	return nil
+}
+
+// lockedModule is a dependency as recorded in the lockfile
+type lockedModule struct {
+	path    string
+	version string
+	commit  string
+	// sum is the SHA-256 of the module's files, see moduleSum
+	sum string
+}
+
+func newGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get [module[@version]...]",
+		Short: "Fetch the modules a project depends on",
+		Long: `Get fetches MindScript modules, such as github.com/org/agents-lib@v1, into the
+module cache and records them in the [dependencies] of the project's
+` + manifestName + ` and the commit they resolved to in its ` + lockName + `.
+A module is a git repository cloned over https, its version a tag, branch
+or commit, the default branch when left out. Without modules, get fetches
+the dependencies of the manifest missing from the cache at the commits of
+the lockfile.
+
+The source files of dependencies, those of a module's own ` + manifestName + `
+or the ones at its root, are linked before the project's when it is built
+or served. The cache is in $` + envModuleCache + `, or the user's cache
+directory by default.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			initLogger()
+			m, err := findManifest()
+			if err == nil && m == nil {
+				err = errors.New("no " + manifestName + " found in this directory or its parents")
+			}
+			if err != nil {
+				logger.Log.Errorw("Error reading the project manifest", zap.Error(err))
+				os.Exit(exitUsage)
+			}
+			if err := getModules(cmd.Context(), m, args); err != nil {
+				logger.Log.Errorw("Error fetching modules", zap.Error(err))
+				os.Exit(exitCode(err))
+			}
+		},
+	}
+}
+
+// getModules fetches the modules given as path@version and adds them to
+// the project's dependencies, or the dependencies missing from the cache
+// when none are given, then writes the lockfile
+func getModules(ctx context.Context, m *manifest, args []string) error {
+	cache, err := moduleCache()
+	if err != nil {
+		return err
+	}
+	lock, err := m.lock()
+	if err != nil {
+		return err
+	}
+
+	requested := make(map[string]string)
+	for _, arg := range args {
+		path, version, _ := strings.Cut(arg, "@")
+		if version == "" {
+			version = latestVersion
+		}
+		if err := checkModule(path, version); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		requested[path] = version
+	}
+	if len(args) == 0 {
+		requested = m.dependencies
+	}
+
+	paths := make([]string, 0, len(requested))
+	for path := range requested {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		version := requested[path]
+		locked, ok := lock[path]
+		if ok && locked.version == version {
+			if _, err := os.Stat(locked.dir(cache)); err == nil {
+				logger.Log.Infow("Module already fetched", zap.String("module", path), zap.String("commit", locked.commit))
+				continue
+			}
+			// Fetch the locked commit again rather than what the version
+			// refers to now
+			if _, err := fetchModule(ctx, cache, path, locked.commit, locked.sum); err != nil {
+				return err
+			}
+			continue
+		}
+		ref := version
+		if version == latestVersion {
+			ref = "HEAD"
+		}
+		fetched, err := fetchModule(ctx, cache, path, ref, "")
+		if err != nil {
+			return err
+		}
+		fetched.version = version
+		lock[path] = fetched
+		logger.Log.Infow("Fetched module", zap.String("module", path), zap.String("version", version), zap.String("commit", fetched.commit))
+		if m.dependencies[path] != version {
+			if err := addDependency(m.path, path, version); err != nil {
+				return fmt.Errorf("recording %s in %s: %w", path, m.path, err)
+			}
+			m.dependencies[path] = version
+		}
+	}
+
+	for path := range lock {
+		if _, ok := m.dependencies[path]; !ok {
+			delete(lock, path)
+		}
+	}
+	return writeLock(m.resolve(lockName), lock)
+}
+
+// moduleCache returns the directory modules are fetched into
+func moduleCache() (string, error) {
+	if dir := os.Getenv(envModuleCache); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("finding the module cache, set $%s: %w", envModuleCache, err)
+	}
+	return filepath.Join(dir, "mindscript", "modules"), nil
+}
+
+// dir returns the directory of the module in the cache
+func (l lockedModule) dir(cache string) string {
+	return filepath.Join(cache, filepath.FromSlash(l.path)+"@"+l.commit)
+}
+
+// fetchModule clones a module at a tag, branch or commit into the cache,
+// unless its files do not match sum when it is not empty. Its version is
+// left for the caller to set.
+func fetchModule(ctx context.Context, cache, path, ref, sum string) (lockedModule, error) {
+	if err := os.MkdirAll(cache, 0o755); err != nil {
+		return lockedModule{}, err
+	}
+	tmp, err := os.MkdirTemp(cache, ".fetch-")
+	if err != nil {
+		return lockedModule{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", tmp}, args...)...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	steps := [][]string{
+		{"init", "-q"},
+		{"fetch", "-q", "--depth", "1", "--", "https://" + path, ref},
+		{"checkout", "-q", "--detach", "FETCH_HEAD"},
+	}
+	for _, step := range steps {
+		if _, err := git(step...); err != nil {
+			return lockedModule{}, fmt.Errorf("fetching %s@%s: %w", path, ref, err)
+		}
+	}
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return lockedModule{}, fmt.Errorf("fetching %s@%s: %w", path, ref, err)
+	}
+	if err := os.RemoveAll(filepath.Join(tmp, ".git")); err != nil {
+		return lockedModule{}, err
+	}
+	fetchedSum, err := moduleSum(tmp)
+	if err != nil {
+		return lockedModule{}, err
+	}
+	if sum != "" && fetchedSum != sum {
+		return lockedModule{}, fmt.Errorf("%s@%s does not match the sum in %s, the repository changed", path, ref, lockName)
+	}
+
+	fetched := lockedModule{path: path, commit: commit, sum: fetchedSum}
+	dir := fetched.dir(cache)
+	if _, err := os.Stat(dir); err == nil {
+		return fetched, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return lockedModule{}, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return lockedModule{}, err
+	}
+	return fetched, nil
+}
+
+// moduleSum hashes the paths and contents of the files in a module's
+// directory, in lexical order
+func moduleSum(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(h, "%s %s\n", hex.EncodeToString(sum[:]), filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lock reads the project's lockfile, which may not exist yet
+func (m *manifest) lock() (map[string]lockedModule, error) {
+	path := m.resolve(lockName)
+	lock := make(map[string]lockedModule)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toml.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	modules, _ := doc["module"].([]any)
+	for _, item := range modules {
+		table, _ := item.(map[string]any)
+		var l lockedModule
+		for key, field := range map[string]*string{"path": &l.path, "version": &l.version, "commit": &l.commit, "sum": &l.sum} {
+			if *field, err = manifestString(key, table[key]); err != nil {
+				return nil, fmt.Errorf("%s: module %w", path, err)
+			}
+		}
+		if err := checkModule(l.path, l.version); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !moduleCommit.MatchString(l.commit) {
+			return nil, fmt.Errorf("%s: %q is not the commit of %s", path, l.commit, l.path)
+		}
+		lock[l.path] = l
+	}
+	return lock, nil
+}
+
+// writeLock writes the lockfile, its modules ordered by path
+func writeLock(path string, lock map[string]lockedModule) error {
+	paths := make([]string, 0, len(lock))
+	for path := range lock {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	b.WriteString("# Written by msc get, do not edit.\n")
+	for _, path := range paths {
+		l := lock[path]
+		fmt.Fprintf(&b, "\n[[module]]\npath = %s\nversion = %s\ncommit = %s\nsum = %s\n",
+			strconv.Quote(l.path), strconv.Quote(l.version), strconv.Quote(l.commit), strconv.Quote(l.sum))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// addDependency sets the version of a module in the [dependencies] table
+// of a manifest, editing its text so that comments and layout are kept
+func addDependency(path, module, version string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	entry := fmt.Sprintf("%s = %s", strconv.Quote(module), strconv.Quote(version))
+
+	section, end := -1, len(lines)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if section < 0 {
+			if line == "[dependencies]" {
+				section = i
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end = i
+			break
+		}
+		key, _, ok := strings.Cut(line, "=")
+		if ok && strings.Trim(strings.TrimSpace(key), `"`) == module {
+			lines[i] = entry
+			return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+		}
+	}
+	if section < 0 {
+		lines = append(lines, "", "[dependencies]", entry)
+	} else {
+		// After the last entry of the table, before the blank lines
+		// separating it from the next
+		for end > section+1 && strings.TrimSpace(lines[end-1]) == "" {
+			end--
+		}
+		lines = append(lines[:end], append([]string{entry}, lines[end:]...)...)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
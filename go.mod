@@ -4,11 +4,23 @@ go 1.22.3
 
 replace github.com/mindcript-go => .
 
-require github.com/spf13/cobra v1.8.0
+require (
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/peterh/liner v1.2.2
+	github.com/spf13/cobra v1.8.0
+	github.com/spf13/pflag v1.0.5
+	go.uber.org/zap v1.27.0
+	google.golang.org/grpc v1.67.3
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/mattn/go-runewidth v0.0.3 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	go.uber.org/zap v1.27.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )
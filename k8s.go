@@ -0,0 +1,109 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/robert-cronin/mindscript-go/pkg/k8s"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var k8sOptions k8s.Options
+
+func newK8sCmd() *cobra.Command {
+	k8sCmd := &cobra.Command{
+		Use:   "k8s",
+		Short: "Run MindScript programs on Kubernetes",
+	}
+
+	generateCmd := &cobra.Command{
+		Use:   "generate program",
+		Short: "Render the Kubernetes manifests running a program",
+		Long: `Generate compiles a MindScript source file and writes the manifests running
+it with msc serve: the MindScript custom resource describing its agents,
+whose status the server keeps up to date, a ConfigMap with the source, a
+Deployment, a Service for the control API and the RBAC objects allowing
+the status updates. The custom resource definition comes first, apply it
+before the rest when it is not installed yet:
+
+  msc k8s generate agents.ms > agents.yaml
+  kubectl apply -f agents.yaml`,
+		Args: cobra.ExactArgs(1),
+		Run:  runK8sGenerate,
+	}
+	generateCmd.Flags().StringVar(&k8sOptions.Name, "name", "", "Name of the resources, derived from the file name by default")
+	generateCmd.Flags().StringVarP(&k8sOptions.Namespace, "namespace", "n", "", "Namespace of the resources")
+	generateCmd.Flags().StringVar(&k8sOptions.Image, "image", k8s.DefaultImage, "Container image running msc")
+	generateCmd.Flags().IntVar(&k8sOptions.ControlPort, "control-port", k8s.DefaultControlPort, "Port of the control API")
+	generateCmd.Flags().StringArrayVar(&k8sOptions.Args, "serve-arg", nil, "Pass an argument to msc serve, such as --state-dir=/data (repeatable)")
+	generateCmd.Flags().StringVar(&k8sOptions.TraceEndpoint, "trace-endpoint", "", "Export OpenTelemetry spans of the handlers to this OTLP/HTTP traces URL")
+	generateCmd.Flags().BoolVar(&k8sOptions.CRD, "crd", true, "Include the custom resource definition")
+	generateCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write the manifests to this file instead of stdout")
+
+	k8sCmd.AddCommand(generateCmd)
+	return k8sCmd
+}
+
+func runK8sGenerate(cmd *cobra.Command, args []string) {
+	initLogger()
+	path := args[0]
+	_, bytecode, err := compileSource(path)
+	if err != nil {
+		logger.Log.Errorw("Error compiling program", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	agents, err := bytecode.Agents()
+	if err != nil {
+		logger.Log.Errorw("Error reading the program's agents", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		logger.Log.Errorw("Error reading input file", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+
+	opts := k8sOptions
+	if opts.Name == "" {
+		opts.Name = k8s.NameFor(path)
+	}
+	opts.File = filepath.Base(path)
+	opts.Source = string(source)
+	opts.Agents = agents
+	objects, err := k8s.Manifests(opts)
+	if err != nil {
+		logger.Log.Errorw("Error generating manifests", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+
+	out := os.Stdout
+	if outputFile != "" {
+		if out, err = os.Create(outputFile); err != nil {
+			logger.Log.Errorw("Error creating output file", zap.Error(err))
+			os.Exit(exitFailure)
+		}
+		defer out.Close()
+	}
+	if err := k8s.Render(out, objects); err != nil {
+		logger.Log.Errorw("Error writing manifests", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+}
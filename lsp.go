@@ -0,0 +1,52 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/lsp"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func newLSPCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "lsp",
+		Short: "Start the MindScript language server",
+		Long: `Lsp starts the language server, talking the Language Server Protocol over
+stdin and stdout, for editors to launch as the server of .ms files. It
+reports parse and semantic errors as diagnostics, formats documents like
+msc fmt and lists their agents, functions and variables as symbols. Logs
+are written to stderr.`,
+		Args: cobra.NoArgs,
+		Run:  runLSP,
+	}
+}
+
+func runLSP(cmd *cobra.Command, args []string) {
+	if !cmd.Flags().Changed("loglevel") {
+		// The parser logs every error it finds while the user types
+		logLevel = "warn"
+	}
+	initLogger()
+	if err := lsp.NewServer().Serve(os.Stdin, os.Stdout); err != nil {
+		logger.Log.Errorw("Language server stopped", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+}
@@ -17,59 +17,247 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/robert-cronin/mindscript-go/pkg/codegen"
-	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/control"
+	"github.com/robert-cronin/mindscript-go/pkg/k8s"
+	"github.com/robert-cronin/mindscript-go/pkg/llm"
 	"github.com/robert-cronin/mindscript-go/pkg/logger"
-	"github.com/robert-cronin/mindscript-go/pkg/parser"
 	"github.com/robert-cronin/mindscript-go/pkg/repl"
-	"github.com/robert-cronin/mindscript-go/pkg/semantic"
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
 	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/robert-cronin/mindscript-go/pkg/watch"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 var (
-	inputFile  string
-	outputFile string
-	logLevel   string
+	inputFiles      []string
+	outputFile      string
+	logLevel        string
+	logFormat       string
+	logFile         string
+	maxInstructions int
+	timeout         time.Duration
+	maxMemory       int
+	quotaSpec       string
+	agentQuotas     []string
+	traceEndpoint   string
+	traceService    string
+	noExec          bool
+	noEnv           bool
+	readableEnv     []string
+	allowedBinaries []string
+	commandEnv      []string
+	workDir         string
+	execTimeout     time.Duration
+	maxExecOutput   int
+	backendName     string
+	disassemble     bool
+	emit            []string
+	stateDir        string
+	llmProvider     string
+	llmModel        string
+	llmURL          string
+	llmTimeout      time.Duration
+	askTimeout      time.Duration
+	sessionTimeout  time.Duration
+	seed            uint64
+	embeddingModel  string
+	brokerURLs      []string
+	watchDirs       []string
+	watchInterval   time.Duration
+	listenAddr      string
+	peerAddrs       []string
+	mcpServers      []string
+	sqlConnections  []string
+	sqlTimeout      time.Duration
+	mcpListenAddr   string
+	mcpStdio        bool
+	controlAddr     string
+	shutdownTimeout time.Duration
+	reload          bool
+	watchInputs     bool
+	entryName       string
+	preloadFiles    []string
+	k8sStatus       string
+	k8sInterval     time.Duration
+	activityLog     int
+	allowAttach     bool
+	allowOrigins    []string
+	attachAddr      string
 )
 
 func main() {
 	var rootCmd = &cobra.Command{
 		Use:   "msc",
 		Short: "MindScript Compiler",
-		Long:  `MindScript Compiler is a tool for compiling and running MindScript code.`,
+		Long:  "MindScript Compiler is a tool for compiling and running MindScript code.\n\n" + exitCodesHelp,
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&logLevel, "loglevel", "l", "info", "Log level (debug, info, warn, error)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", logger.FormatJSON, "Log format (json, console)")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Append logs to this file instead of writing them to stderr")
 
 	buildCmd := &cobra.Command{
-		Use:   "build",
+		Use:   "build [-- args...]",
 		Short: "Build MindScript code",
-		Run:   runBuild,
+		Long: `Build compiles the input files, writes the compiled .mindc program and runs it.
+msc serve and msc exec run compiled programs without compiling them again.
+Every --input is a source file, a directory whose source files other than
+tests are taken in lexical order, or a glob pattern. Several files are
+linked into one program in the order given, each using what the files
+before it declare. --emit writes the program as JSON, its disassembly and
+metadata about the build next to it. Arguments after -- are passed to the
+program, which reads them with args(). With --watch, build keeps watching
+the inputs and compiles and runs them again after every change, stopping
+the previous run first.
+
+Without --input, build reads the ` + manifestName + ` of the project the
+current directory is in:
+
+  name = "support-desk"
+  sources = ["lib/*.ms"]      # linked before the entrypoint
+  entrypoint = "main.ms"      # the entrypoint named main
+
+  [entrypoints]
+  ingest = "ingest.ms"        # chosen with --entry ingest
+
+  [build]                     # output, emit
+  [permissions]               # exec, binaries, env, readable-env, workdir, exec-timeout
+  [llm]                       # provider, model, url, embedding-model, timeout, ask-timeout
+  [runtime]                   # vm, max-instructions, timeout, max-memory, quota, seed, ...
+  [serve]                     # control, reload, allow-attach, allow-origin, ...
+
+Keys of the tables set the flag of the same name, flags given on the
+command line take precedence. Paths are relative to the manifest.`,
+		Run: runBuild,
 	}
 
-	buildCmd.Flags().StringVarP(&inputFile, "input", "i", "", "Input file")
-	buildCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Output file")
-	buildCmd.MarkFlagRequired("input")
+	buildCmd.Flags().StringArrayVarP(&inputFiles, "input", "i", nil, "Source file, directory or glob pattern to compile (repeatable), the project's entrypoint by default")
+	buildCmd.Flags().StringVar(&entryName, "entry", "", "Entrypoint of the project to build, main or the only one by default")
+	buildCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write the compiled program to this file, named after the input with a .mindc extension by default")
+	buildCmd.Flags().StringSliceVar(&emit, "emit", nil, "Also write these artifacts next to the compiled program: json, disasm, metadata")
+	buildCmd.Flags().BoolVar(&disassemble, "disassemble", false, "Print the compiled bytecode on stderr before running it")
+	buildCmd.Flags().VarPF(buildWatchFlag{}, "watch", "", "Compile and run the program again whenever the inputs change, checked every --watch-interval").NoOptDefVal = "true"
+	addRuntimeFlags(buildCmd.Flags())
 
 	replCmd := &cobra.Command{
 		Use:   "repl",
 		Short: "Start MindScript REPL",
-		Run:   runRepl,
+		Long: `Repl starts an interactive session. The files of --preload are compiled and
+run into the session before the prompt, like :load, so their agents and
+functions are at hand. With --attach, inputs are evaluated by a msc serve
+instance started with --allow-attach instead, in the context of the agents
+it runs. They are sent with the token of its control API, which is read
+from the file msc serve wrote on this machine or $` + control.EnvToken + `.`,
+		Run: runRepl,
 	}
+	replCmd.Flags().StringVar(&attachAddr, "attach", "", "Evaluate inputs on the msc serve instance with its control API on this host:port")
+	replCmd.Flags().StringSliceVar(&preloadFiles, "preload", nil, "Compile and run these source files into the session before the prompt, in order")
+	replCmd.MarkFlagsMutuallyExclusive("attach", "preload")
 
-	rootCmd.AddCommand(buildCmd, replCmd)
+	execCmd := &cobra.Command{
+		Use:   "exec program.mindc [-- args...]",
+		Short: "Run a compiled program",
+		Long: `Exec runs a program compiled with msc build, so agents are built once and run
+many times without compiling their source. Programs compiled by another
+version of msc with a different bytecode version are rejected. Arguments
+after the program are passed to it, which reads them with args().`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runExec,
+	}
+	execCmd.Flags().BoolVar(&disassemble, "disassemble", false, "Print the program's bytecode on stderr before running it")
+	addRuntimeFlags(execCmd.Flags())
+
+	serveCmd := &cobra.Command{
+		Use:   "serve [program] [-- args...]",
+		Short: "Run the agents of a program until interrupted",
+		Long: `Serve runs the agents of a MindScript source file or compiled .mindc program
+as a daemon. Their events are dispatched until the process is interrupted,
+when every agent is stopped. The control API on --control lists agents,
+emits events and stops agents, and offers the agents' functions as MCP
+tools under /mcp. Requests emitting events, stopping agents or made to
+/mcp must carry the bearer token written to a file of the user's cache
+directory, or $` + control.EnvToken + ` when it is set, and web pages may only make them
+from the origins of --allow-origin. With --reload, edits to the source
+files replace the agents' handlers and functions without restarting them. Arguments after
+the program are passed to it, which reads them with args(). Without a
+program, the entrypoint of the project's ` + manifestName + ` is served.`,
+		Run: runServe,
+	}
+	serveCmd.Flags().StringVar(&controlAddr, "control", "localhost:7420", "Serve the control API on this address")
+	serveCmd.Flags().StringVar(&entryName, "entry", "", "Entrypoint of the project to serve when no program is given, main or the only one by default")
+	serveCmd.Flags().BoolVar(&reload, "reload", false, "Reload the agents' code when the source files change, checked every --watch-interval")
+	serveCmd.Flags().StringVar(&k8sStatus, "k8s-status", "", "Report the agents' status to this MindScript resource, as namespace/name, when running in a Kubernetes pod")
+	serveCmd.Flags().DurationVar(&k8sInterval, "k8s-status-interval", k8s.DefaultStatusInterval, "How often the status is reported to Kubernetes")
+	serveCmd.Flags().IntVar(&activityLog, "activity-log", vm.DefaultActivityLogSize, "Entries of each agent's activity log served by the control API (0 to disable)")
+	serveCmd.Flags().BoolVar(&allowAttach, "allow-attach", false, "Let msc repl --attach evaluate code in the program through the control API")
+	serveCmd.Flags().StringSliceVar(&allowOrigins, "allow-origin", nil, "Let web pages on these origins, such as http://localhost:3000, emit events, stop agents and call MCP tools")
+	serveCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "Maximum time to wait for control requests in progress when stopping")
+	addRuntimeFlags(serveCmd.Flags())
+
+	rootCmd.AddCommand(buildCmd, execCmd, replCmd, serveCmd, newFmtCmd(), newASTCmd(), newTestCmd(), newBenchCmd(), newTraceCmd(), newProfileCmd(), newEvalCmd(), newLSPCmd(), newGetCmd(), newK8sCmd())
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+}
+
+// addRuntimeFlags adds the flags configuring the VM and the sources of
+// external events, which build and serve share
+func addRuntimeFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&maxInstructions, "max-instructions", 0, "Maximum number of instructions to execute (0 for unlimited)")
+	flags.DurationVar(&timeout, "timeout", 0, "Maximum execution time (0 for unlimited)")
+	flags.IntVar(&maxMemory, "max-memory", 0, "Maximum memory in bytes a program may hold (0 for unlimited)")
+	flags.StringVar(&quotaSpec, "quota", "", "Limit every agent's resources, such as \"instructions=10000 memory=65536 execs=5 tokens=2000\"")
+	flags.StringArrayVar(&agentQuotas, "agent-quota", nil, "Limit the resources of the agents of a declaration instead, as Name=quota (repeatable)")
+	flags.BoolVar(&noExec, "no-exec", false, "Deny running external commands")
+	flags.StringSliceVar(&allowedBinaries, "allow-binary", nil, "Only allow running these external commands")
+	flags.StringSliceVar(&commandEnv, "command-env", nil, "Environment variables programs may set for external commands when --allow-binary is given")
+	flags.BoolVar(&noEnv, "no-env", false, "Deny reading environment variables with env")
+	flags.StringSliceVar(&readableEnv, "readable-env", nil, "Only allow env to read these environment variables")
+	flags.StringVar(&workDir, "workdir", "", "Confine external commands to this directory")
+	flags.DurationVar(&execTimeout, "exec-timeout", 0, "Kill external commands running for longer (0 for unlimited)")
+	flags.IntVar(&maxExecOutput, "max-exec-output", vm.DefaultMaxOutput, "Maximum bytes exec captures from each of a command's stdout and stderr")
+	flags.Uint64Var(&seed, "seed", 0, "Seed random, randomInt, choice and uuid so that runs are reproducible (0 seeds randomly)")
+	flags.StringVar(&backendName, "vm", "stack", "Execution backend (stack, register)")
+	flags.StringVar(&stateDir, "state-dir", "", "Persist agent state in this directory across runs")
+	flags.StringVar(&llmProvider, "llm-provider", "", "Language model provider for llm (openai, anthropic, ollama), defaults to $"+llm.EnvProvider)
+	flags.StringVar(&llmModel, "llm-model", "", "Model used by llm, defaults to $"+llm.EnvModel)
+	flags.StringVar(&llmURL, "llm-url", "", "Endpoint of the llm provider, defaults to $"+llm.EnvBaseURL)
+	flags.StringVar(&embeddingModel, "embedding-model", "", "Model used by embed, index and search, defaults to $"+llm.EnvEmbeddingModel)
+	flags.DurationVar(&llmTimeout, "llm-timeout", vm.DefaultLLMTimeout, "Maximum time a single llm call may take (0 for unlimited)")
+	flags.DurationVar(&askTimeout, "ask-timeout", vm.DefaultAskTimeout, "Maximum time an agent waits for the reply to an ask (0 for unlimited)")
+	flags.DurationVar(&sessionTimeout, "session-timeout", vm.DefaultSessionTimeout, "End sessions without events for this long (0 to keep them)")
+	flags.StringArrayVar(&brokerURLs, "broker", nil, "Deliver the messages of a NATS or MQTT broker as topic events, such as mqtt://localhost:1883?topic=sensors/%23 (repeatable)")
+	flags.StringArrayVar(&watchDirs, "watch-dir", nil, "Deliver file:changed events for the files in this directory (repeatable)")
+	// --watch-dir used to be --watch, which build now uses for its watch
+	// mode, see buildWatchFlag
+	if flags.Lookup("watch") == nil {
+		flags.StringArrayVar(&watchDirs, "watch", nil, "Deliver file:changed events for the files in this directory (repeatable)")
+		flags.MarkDeprecated("watch", "use --watch-dir instead")
 	}
+	flags.DurationVar(&watchInterval, "watch-interval", watch.DefaultInterval, "How often watched directories are scanned")
+	flags.StringVar(&listenAddr, "listen", "", "Accept events for this program's agents from other msc processes on this address")
+	flags.StringArrayVar(&peerAddrs, "peer", nil, "Deliver events emitted to agents of another msc process listening on this address (repeatable)")
+	flags.StringVar(&traceEndpoint, "trace-endpoint", "", "Export OpenTelemetry spans of the handlers to this OTLP/HTTP traces URL, such as http://localhost:4318/v1/traces, defaults to $"+tracing.EnvTracesEndpoint)
+	flags.StringVar(&traceService, "trace-service", "", "Service name of the exported spans, defaults to $"+tracing.EnvServiceName+" or "+tracing.DefaultService)
+	flags.StringArrayVar(&mcpServers, "mcp", nil, "Make the tools of an MCP server callable with mcp, as name=command or name=url (repeatable)")
+	flags.StringArrayVar(&sqlConnections, "sql", nil, "Make a database queryable with sqlQuery, as name=driver:dsn where the DSN may be $VAR to read it from the environment, such as reports=sqlite3:reports.db (repeatable)")
+	flags.DurationVar(&sqlTimeout, "sql-timeout", vm.DefaultSQLTimeout, "Maximum time a single sqlQuery may take (0 for unlimited)")
+	flags.StringVar(&mcpListenAddr, "mcp-listen", "", "Offer the functions of this program's agents as MCP tools over HTTP on this address")
+	flags.BoolVar(&mcpStdio, "mcp-stdio", false, "Offer the functions of this program's agents as MCP tools over stdin and stdout, the program's output goes to stderr")
 }
 
 func initLogger() {
@@ -86,73 +274,214 @@ func initLogger() {
 	default:
 		zapLevel = zap.InfoLevel
 	}
-	logger.Init(zapLevel)
+	opts := []logger.Option{logger.WithFormat(logFormat)}
+	if logFile != "" {
+		opts = append(opts, logger.WithFile(logFile))
+	}
+	if err := logger.Init(zapLevel, opts...); err != nil {
+		fmt.Fprintln(os.Stderr, "msc: configuring logs:", err)
+		os.Exit(exitUsage)
+	}
 }
 
 func runBuild(cmd *cobra.Command, args []string) {
 	initLogger()
 	logger.Log.Info("msc: Starting build")
 
+	if len(inputFiles) == 0 {
+		if err := loadProject(cmd.Flags()); err != nil {
+			logger.Log.Errorw("Error reading the project manifest", zap.Error(err))
+			os.Exit(exitUsage)
+		}
+		logger.Log.Infow("Using project manifest", zap.String("path", project.path), zap.String("name", project.name))
+	}
+	if err := parseEmit(emit); err != nil {
+		logger.Log.Errorw("Error parsing --emit", zap.Error(err))
+		os.Exit(exitUsage)
+	}
+	files, err := buildFiles()
+	if err != nil {
+		logger.Log.Errorw("Error reading the inputs", zap.Error(err))
+		os.Exit(exitUsage)
+	}
 	if outputFile == "" {
-		outputFile = inputFile[:len(inputFile)-3] + ".mind"
+		if project != nil {
+			// Named after the entrypoint, which comes last
+			outputFile = strings.TrimSuffix(files[len(files)-1], ".ms") + ".mindc"
+		} else if outputFile, err = defaultOutput(inputFiles, files); err != nil {
+			logger.Log.Errorw("Error naming the compiled program", zap.Error(err))
+			os.Exit(exitUsage)
+		}
+	}
+	logger.Log.Infow("Processing files", zap.Strings("input", files), zap.String("output", outputFile))
+	if watchInputs {
+		rebuildOnChange(files, args)
+		return
 	}
-	logger.Log.Info("Processing files", zap.String("input", inputFile), zap.String("output", outputFile))
 
-	input, err := os.ReadFile(inputFile)
+	bytecode, err := buildProgram(files)
 	if err != nil {
-		logger.Log.Error("Error reading input file", zap.Error(err))
-		os.Exit(1)
+		logger.Log.Errorw("Error building program", zap.Error(err))
+		os.Exit(exitCode(err))
 	}
+	runProgram(bytecode, args)
+	logger.Log.Info("msc: Build finished")
+}
 
-	inputStr := string(input)
-	l := lexer.New(inputStr)
-	p := parser.New(l)
-	program := p.ParseProgram()
+// buildFiles returns the source files build compiles, those of --input or
+// of the project's entrypoint
+func buildFiles() ([]string, error) {
+	if project != nil {
+		return project.files(entryName)
+	}
+	return expandInputs(inputFiles)
+}
 
-	if len(p.Errors()) != 0 {
-		logger.Log.Error("Parser errors", zap.Strings("errors", p.Errors()))
-		os.Exit(1)
+// buildProgram compiles the source files and writes the compiled program
+// and the artifacts of --emit
+func buildProgram(files []string) (*vm.Program, error) {
+	program, bytecode, err := compileSource(files...)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeArtifacts(outputFile, files, program, bytecode, emit); err != nil {
+		return nil, fmt.Errorf("writing the compiled program: %w", err)
+	}
+	if disassemble {
+		fmt.Fprint(os.Stderr, vm.Disassemble(bytecode))
 	}
+	return bytecode, nil
+}
+
+// runExec runs a program compiled by msc build without compiling it again
+func runExec(cmd *cobra.Command, args []string) {
+	initLogger()
+	logger.Log.Infow("msc: Running compiled program", zap.String("program", args[0]))
 
-	st := semantic.NewSymbolTable(l)
-	err = st.Analyse(program)
+	bytecode, err := readProgram(args[0])
 	if err != nil {
-		logger.Log.Error("Error analyzing program", zap.Error(err))
-		os.Exit(1)
+		msg := "Error loading compiled program"
+		if errors.Is(err, vm.ErrInvalidBytecode) {
+			msg += ", compile it again with msc build"
+		}
+		logger.Log.Errorw(msg, zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	if disassemble {
+		fmt.Fprint(os.Stderr, vm.Disassemble(bytecode))
 	}
 
-	instructions := codegen.GenerateBytecode(program, st)
+	runProgram(bytecode, args[1:])
+	logger.Log.Info("msc: Program finished")
+}
 
-	virtualMachine := vm.New(instructions)
-	virtualMachine.Run()
+// runProgram runs a compiled program, then keeps dispatching external
+// events or waits for its timers, if it has any, until interrupted
+func runProgram(bytecode *vm.Program, args []string) {
+	interrupted := func() (context.Context, context.CancelFunc) {
+		return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	}
+	if err := executeProgram(bytecode, args, interrupted); err != nil {
+		logger.Log.Errorw("Error running program", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+}
 
-	jsonOutput, err := dumpProgramToJson(program)
+// executeProgram runs a compiled program like runProgram, returning its
+// errors. Dispatching external events and waiting for timers end when the
+// context returned by wait is done, wait is only called once the top level
+// has run. The extra options apply after those of the flags.
+func executeProgram(bytecode *vm.Program, args []string, wait func() (context.Context, context.CancelFunc), extra ...vm.Option) error {
+	opts, closeOptions, err := newVMOptions()
 	if err != nil {
-		logger.Log.Error("Error dumping program to JSON", zap.Error(err))
-		os.Exit(1)
+		return fmt.Errorf("configuring the VM: %w", err)
 	}
-
-	jsonDumpFile := outputFile + ".json"
-	err = os.WriteFile(jsonDumpFile, []byte(jsonOutput), 0644)
+	opts = append(opts, extra...)
+	defer closeOptions()
+	sources, err := openEventSources()
 	if err != nil {
-		logger.Log.Error("Error writing JSON dump file", zap.Error(err))
-		os.Exit(1)
+		return fmt.Errorf("configuring external events: %w", err)
 	}
 
-	logger.Log.Info("msc: Build finished")
+	opts = append(opts, vm.WithArgs(args))
+	virtualMachine := vm.New(bytecode, opts...)
+	if err := virtualMachine.Run(); err != nil {
+		sources.close()
+		return withExitCode(exitRuntime, err)
+	}
+	if sources.active() {
+		logger.Log.Info("Listening for external events, interrupt to stop")
+		ctx, stop := wait()
+		sources.run(ctx, stop, virtualMachine).Wait()
+		stop()
+	} else if virtualMachine.Timers() > 0 {
+		logger.Log.Info("Waiting for scheduled timers, interrupt to stop")
+		ctx, stop := wait()
+		virtualMachine.WaitTimers(ctx)
+		stop()
+	}
+	if err := virtualMachine.Shutdown(); err != nil {
+		return withExitCode(exitRuntime, fmt.Errorf("stopping agents: %w", err))
+	}
+	return nil
 }
 
 func runRepl(cmd *cobra.Command, args []string) {
 	initLogger()
 	logger.Log.Info("msc: Starting REPL")
-	repl.Start()
+	if attachAddr != "" {
+		token, err := attachToken(attachAddr)
+		if err != nil {
+			logger.Log.Errorw("Error reading the control API token", zap.Error(err))
+			os.Exit(exitFailure)
+		}
+		if err := repl.Attach(attachAddr, token); err != nil {
+			logger.Log.Errorw("Error attaching to the server", zap.Error(err))
+			os.Exit(exitFailure)
+		}
+		return
+	}
+	repl.Start(preloadFiles...)
 	logger.Log.Info("msc: REPL finished")
 }
 
-func dumpProgramToJson(program *parser.Program) (string, error) {
-	jsonData, err := json.MarshalIndent(program, "", "  ")
+// attachToken returns the token of the control API on addr, $MSC_CONTROL_TOKEN
+// or the one msc serve wrote for its port
+func attachToken(addr string) (string, error) {
+	if token := os.Getenv(control.EnvToken); token != "" {
+		return token, nil
+	}
+	path, err := controlTokenFile(addr)
 	if err != nil {
 		return "", err
 	}
-	return string(jsonData), nil
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w, set $%s to the token of the server", err, control.EnvToken)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// newLLMConfig configures the llm provider from the environment, with the
+// command line flags taking precedence
+func newLLMConfig() (llm.Config, error) {
+	cfg, err := llm.ConfigFromEnv(llmProvider)
+	if err != nil {
+		return cfg, err
+	}
+	if llmModel != "" {
+		cfg.Model = llmModel
+	}
+	if llmURL != "" {
+		cfg.BaseURL = llmURL
+	}
+	if embeddingModel != "" {
+		cfg.EmbeddingModel = embeddingModel
+	}
+	return cfg, nil
+}
+
+// logInstruction traces every executed instruction at debug level
+func logInstruction(pc int, instr vm.Instruction, stackDepth int) {
+	logger.Log.Debugw("Executing instruction", zap.Int("pc", pc), zap.Stringer("instruction", instr), zap.Int("stackDepth", stackDepth))
 }
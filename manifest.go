@@ -0,0 +1,446 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/toml"
+	"github.com/spf13/pflag"
+)
+
+// manifestName is the name of the manifest of a project, which build and
+// serve read when no program is given on the command line
+const manifestName = "mindscript.toml"
+
+// project is the manifest build or serve read, nil if the program was
+// given on the command line
+var project *manifest
+
+// errNoManifest is returned when no program is given outside a project
+var errNoManifest = errors.New("no program given and no " + manifestName + " found in this directory or its parents")
+
+// loadProject reads the manifest of the current project into project and
+// sets the flags it configures, except those given on the command line
+func loadProject(flags *pflag.FlagSet) error {
+	m, err := findManifest()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errNoManifest
+	}
+	if err := m.apply(flags); err != nil {
+		return fmt.Errorf("%s: %w", m.path, err)
+	}
+	project = m
+	return nil
+}
+
+// manifestFlag is the flag a key of the manifest's tables sets
+type manifestFlag struct {
+	name string
+	// invert sets a boolean flag to the opposite of the key, for keys that
+	// allow what the flag denies
+	invert bool
+	// path resolves the value against the manifest's directory
+	path bool
+}
+
+// manifestTables are the tables of the manifest and the flags their keys
+// set. Keys of flags a command does not have are ignored by it.
+var manifestTables = map[string]map[string]manifestFlag{
+	"build": {
+		"output": {name: "output", path: true},
+		"emit":   {name: "emit"},
+	},
+	"permissions": {
+		"exec":            {name: "no-exec", invert: true},
+		"binaries":        {name: "allow-binary"},
+		"command-env":     {name: "command-env"},
+		"env":             {name: "no-env", invert: true},
+		"readable-env":    {name: "readable-env"},
+		"workdir":         {name: "workdir", path: true},
+		"exec-timeout":    {name: "exec-timeout"},
+		"max-exec-output": {name: "max-exec-output"},
+	},
+	"llm": {
+		"provider":        {name: "llm-provider"},
+		"model":           {name: "llm-model"},
+		"url":             {name: "llm-url"},
+		"embedding-model": {name: "embedding-model"},
+		"timeout":         {name: "llm-timeout"},
+		"ask-timeout":     {name: "ask-timeout"},
+	},
+	"runtime": {
+		"vm":               {name: "vm"},
+		"max-instructions": {name: "max-instructions"},
+		"timeout":          {name: "timeout"},
+		"max-memory":       {name: "max-memory"},
+		"quota":            {name: "quota"},
+		"agent-quota":      {name: "agent-quota"},
+		"seed":             {name: "seed"},
+		"state-dir":        {name: "state-dir", path: true},
+		"session-timeout":  {name: "session-timeout"},
+	},
+	"events": {
+		"brokers":        {name: "broker"},
+		"watch-dirs":     {name: "watch-dir", path: true},
+		"watch-interval": {name: "watch-interval"},
+		"listen":         {name: "listen"},
+		"peers":          {name: "peer"},
+	},
+	"tracing": {
+		"endpoint": {name: "trace-endpoint"},
+		"service":  {name: "trace-service"},
+	},
+	"mcp": {
+		"servers": {name: "mcp"},
+		"listen":  {name: "mcp-listen"},
+		"stdio":   {name: "mcp-stdio"},
+	},
+	"sql": {
+		"connections": {name: "sql"},
+		"timeout":     {name: "sql-timeout"},
+	},
+	"serve": {
+		"control":          {name: "control"},
+		"reload":           {name: "reload"},
+		"allow-attach":     {name: "allow-attach"},
+		"allow-origin":     {name: "allow-origin"},
+		"activity-log":     {name: "activity-log"},
+		"shutdown-timeout": {name: "shutdown-timeout"},
+	},
+}
+
+// manifest is a decoded mindscript.toml:
+//
+//	name = "support-desk"
+//	sources = ["lib/*.ms"]
+//	entrypoint = "main.ms"
+//
+//	[entrypoints]
+//	ingest = "ingest.ms"
+//
+//	[dependencies]
+//	"github.com/org/agents-lib" = "v1"
+//
+//	[permissions]
+//	exec = false
+//
+//	[llm]
+//	provider = "anthropic"
+//
+// The source files of the dependencies and then those matched by sources
+// are linked before the entrypoint, entrypoint is short for the entrypoint
+// named main. The other tables are
+// listed in manifestTables.
+type manifest struct {
+	path string
+	// dir is the directory of the manifest, relative to the current one
+	dir         string
+	name        string
+	sources     []string
+	entrypoints map[string]string
+	// dependencies are the versions of the modules msc get fetched
+	dependencies map[string]string
+	tables       map[string]map[string]any
+}
+
+// findManifest reads the manifest of the project the current directory is
+// in, looking in its parents too. It returns nil if there is none.
+func findManifest() (*manifest, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for dir := cwd; ; dir = filepath.Dir(dir) {
+		path := filepath.Join(dir, manifestName)
+		if _, err := os.Stat(path); err == nil {
+			rel, err := filepath.Rel(cwd, dir)
+			if err != nil {
+				rel = dir
+			}
+			m, err := readManifest(path, rel)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			return m, nil
+		}
+		if filepath.Dir(dir) == dir {
+			return nil, nil
+		}
+	}
+}
+
+// readManifest decodes and checks the manifest at path, in dir
+func readManifest(path, dir string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toml.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{path: path, dir: dir, entrypoints: map[string]string{}, dependencies: map[string]string{}, tables: map[string]map[string]any{}}
+	for key, value := range doc {
+		switch key {
+		case "name":
+			if m.name, err = manifestString(key, value); err != nil {
+				return nil, err
+			}
+		case "entrypoint":
+			if m.entrypoints["main"], err = manifestString(key, value); err != nil {
+				return nil, err
+			}
+		case "sources":
+			if m.sources, err = manifestStrings(key, value); err != nil {
+				return nil, err
+			}
+		case "entrypoints":
+			table, ok := value.(map[string]any)
+			if !ok {
+				return nil, errors.New("entrypoints is not a table")
+			}
+			for name, path := range table {
+				if m.entrypoints[name], err = manifestString("entrypoints."+name, path); err != nil {
+					return nil, err
+				}
+			}
+		case "dependencies":
+			table, ok := value.(map[string]any)
+			if !ok {
+				return nil, errors.New("dependencies is not a table")
+			}
+			for module, version := range table {
+				if m.dependencies[module], err = manifestString("dependencies."+module, version); err != nil {
+					return nil, err
+				}
+				if err := checkModule(module, m.dependencies[module]); err != nil {
+					return nil, fmt.Errorf("dependencies: %w", err)
+				}
+			}
+		default:
+			flags, ok := manifestTables[key]
+			table, isTable := value.(map[string]any)
+			if !ok || !isTable {
+				return nil, fmt.Errorf("unknown key %s", key)
+			}
+			for name := range table {
+				if _, ok := flags[name]; !ok {
+					return nil, fmt.Errorf("unknown key %s.%s", key, name)
+				}
+			}
+			m.tables[key] = table
+		}
+	}
+	return m, nil
+}
+
+func manifestString(key string, value any) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string", key)
+	}
+	return s, nil
+}
+
+func manifestStrings(key string, value any) ([]string, error) {
+	items, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an array", key)
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s holds %v, which is not a string", key, item)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// files returns the source files of an entrypoint, named or the default
+// one when name is empty: those of the dependencies, the files matched by
+// sources other than entrypoints, and the entrypoint itself
+func (m *manifest) files(name string) ([]string, error) {
+	if len(m.entrypoints) == 0 {
+		return nil, fmt.Errorf("%s has no entrypoint", m.path)
+	}
+	if name == "" {
+		name = "main"
+		if len(m.entrypoints) == 1 {
+			for only := range m.entrypoints {
+				name = only
+			}
+		}
+	}
+	entrypoint, ok := m.entrypoints[name]
+	if !ok {
+		names := make([]string, 0, len(m.entrypoints))
+		for name := range m.entrypoints {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("no entrypoint named %s, expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	files, err := m.dependencyFiles()
+	if err != nil {
+		return nil, err
+	}
+	sources, err := m.sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+	return append(append(files, sources...), m.resolve(entrypoint)), nil
+}
+
+// sourceFiles returns the files matched by sources other than entrypoints
+func (m *manifest) sourceFiles() ([]string, error) {
+	var patterns []string
+	for _, source := range m.sources {
+		patterns = append(patterns, m.resolve(source))
+	}
+	sources, err := expandInputs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	var entrypoints []string
+	for _, path := range m.entrypoints {
+		entrypoints = append(entrypoints, filepath.Clean(m.resolve(path)))
+	}
+	return slices.DeleteFunc(sources, func(path string) bool {
+		return slices.Contains(entrypoints, filepath.Clean(path))
+	}), nil
+}
+
+// dependencyFiles returns the source files of the dependencies, ordered by
+// module path, from the cache msc get fetched them into
+func (m *manifest) dependencyFiles() ([]string, error) {
+	if len(m.dependencies) == 0 {
+		return nil, nil
+	}
+	lock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	cache, err := moduleCache()
+	if err != nil {
+		return nil, err
+	}
+	modules := make([]string, 0, len(m.dependencies))
+	for module := range m.dependencies {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+
+	var files []string
+	for _, module := range modules {
+		locked, ok := lock[module]
+		if !ok || locked.version != m.dependencies[module] {
+			return nil, fmt.Errorf("%s@%s is not in %s, run msc get", module, m.dependencies[module], lockName)
+		}
+		dir := locked.dir(cache)
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("%s@%s has not been fetched, run msc get", module, m.dependencies[module])
+		}
+		moduleFiles, err := moduleSourceFiles(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", module, err)
+		}
+		files = append(files, moduleFiles...)
+	}
+	return files, nil
+}
+
+// moduleSourceFiles returns the source files of a fetched module, the
+// sources of its own manifest or else the source files at its root
+func moduleSourceFiles(dir string) ([]string, error) {
+	path := filepath.Join(dir, manifestName)
+	if _, err := os.Stat(path); err != nil {
+		return expandInputs([]string{dir})
+	}
+	m, err := readManifest(path, dir)
+	if err != nil {
+		return nil, err
+	}
+	return m.sourceFiles()
+}
+
+// resolve returns a path of the manifest relative to the current directory
+func (m *manifest) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(m.dir, path)
+}
+
+// apply sets the flags the manifest's tables configure, except those given
+// on the command line
+func (m *manifest) apply(flags *pflag.FlagSet) error {
+	for tableName, table := range m.tables {
+		for key, value := range table {
+			mapping := manifestTables[tableName][key]
+			flag := flags.Lookup(mapping.name)
+			if flag == nil || flag.Changed {
+				continue
+			}
+			values := []any{value}
+			if items, ok := value.([]any); ok {
+				values = items
+			}
+			for _, item := range values {
+				s, err := m.value(item, mapping)
+				if err == nil {
+					err = flags.Set(mapping.name, s)
+				}
+				if err != nil {
+					return fmt.Errorf("%s.%s: %w", tableName, key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// value returns a value of the manifest as the argument of its flag
+func (m *manifest) value(value any, mapping manifestFlag) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if mapping.path && v != "" {
+			return m.resolve(v), nil
+		}
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v != mapping.invert), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
@@ -0,0 +1,195 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the broker package subscribes to message brokers such as NATS and MQTT
+// and delivers their messages to agents as topic events
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
+)
+
+// Message is a message received from a broker
+type Message struct {
+	Topic string
+	Data  []byte
+}
+
+// Source is a connection to a message broker
+type Source interface {
+	// Subscribe delivers the messages published to topics until ctx is
+	// done or the connection fails. Topics use the broker's own syntax,
+	// including its wildcards.
+	Subscribe(ctx context.Context, topics []string, deliver func(Message)) error
+}
+
+// Factory creates the source for a broker URL
+type Factory func(u *url.URL) (Source, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{
+		"nats": newNATS,
+		"mqtt": newMQTT,
+	}
+)
+
+// Register adds the adapter for brokers with URLs of the given scheme, such
+// as kafka, which has no built in adapter. It panics if the scheme is
+// already registered.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[scheme]; ok {
+		panic(fmt.Sprintf("broker: scheme %q is already registered", scheme))
+	}
+	factories[scheme] = factory
+}
+
+// Subscription is a broker and the topics to subscribe to on it
+type Subscription struct {
+	URL    *url.URL
+	Topics []string
+}
+
+// ParseSubscription parses a broker URL listing its topics in topic query
+// parameters. The URL's scheme selects the adapter, such as mqtt://localhost:1883?topic=sensors/%23 or
+// nats://localhost:4222?topic=orders.>&topic=payments.*
+func ParseSubscription(raw string) (Subscription, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Subscription{}, err
+	}
+	factoriesMu.RLock()
+	_, ok := factories[u.Scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return Subscription{}, fmt.Errorf("no broker adapter for scheme %q, expected one of %s", u.Scheme, strings.Join(schemes(), ", "))
+	}
+	query := u.Query()
+	sub := Subscription{Topics: query["topic"]}
+	if len(sub.Topics) == 0 {
+		return sub, fmt.Errorf("broker %s has no topic to subscribe to", u.Redacted())
+	}
+	query.Del("topic")
+	u.RawQuery = query.Encode()
+	sub.URL = u
+	return sub, nil
+}
+
+// Open returns the source for the subscription's broker
+func Open(sub Subscription) (Source, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[sub.URL.Scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no broker adapter for scheme %q, expected one of %s", sub.URL.Scheme, strings.Join(schemes(), ", "))
+	}
+	return factory(sub.URL)
+}
+
+func schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EventName returns the topic event a message is delivered as. MQTT's /
+// separators become dots, so sensors/kitchen/temp is delivered as
+// topic:sensors.kitchen.temp like the NATS subject sensors.kitchen.temp.
+func EventName(topic string) string {
+	return vm.TopicEventPrefix + strings.ReplaceAll(strings.Trim(topic, "/"), "/", ".")
+}
+
+// Payload decodes a message for agents. JSON is decoded into maps, lists
+// and scalars, other messages are delivered as strings.
+func Payload(data []byte) vm.Value {
+	value, err := vm.ParseJSON(data)
+	if err != nil {
+		return string(data)
+	}
+	return value
+}
+
+// Reconnection backoff of Run
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// Run subscribes to the broker and emits its messages to every agent of
+// machine until ctx is done, reconnecting when the connection fails
+func Run(ctx context.Context, machine *vm.VM, sub Subscription) error {
+	source, err := Open(sub)
+	if err != nil {
+		return err
+	}
+	broker := sub.URL.Redacted()
+	forward := func(msg Message) {
+		event := EventName(msg.Topic)
+		if err := machine.Emit("", event, Payload(msg.Data)); err != nil {
+			logger.Log.Warnw("Error delivering broker message", zap.String("broker", broker), zap.String("event", event), zap.Error(err))
+		}
+	}
+	delay := minReconnectDelay
+	for {
+		logger.Log.Infow("Subscribing to broker", zap.String("broker", broker), zap.Strings("topics", sub.Topics))
+		start := time.Now()
+		err := source.Subscribe(ctx, sub.Topics, forward)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(start) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		logger.Log.Warnw("Broker connection lost, reconnecting", zap.String("broker", broker), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// closeOnDone closes c when ctx is done, until the returned function is
+// called, so blocking reads return
+func closeOnDone(ctx context.Context, c interface{ Close() error }) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,248 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttDisconnect = 14
+)
+
+const (
+	mqttKeepAlive   = 60 * time.Second
+	mqttMaxPacket   = 256 << 20
+	mqttSubscribeID = 1
+)
+
+// mqttSource subscribes to topics with MQTT 3.1.1 at QoS 0. The URL may
+// carry a user and password and set the client id with client_id.
+type mqttSource struct {
+	addr     string
+	user     *url.Userinfo
+	clientID string
+}
+
+func newMQTT(u *url.URL) (Source, error) {
+	s := &mqttSource{addr: u.Host, user: u.User, clientID: u.Query().Get("client_id")}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	if s.clientID == "" {
+		id := make([]byte, 6)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		s.clientID = "msc-" + hex.EncodeToString(id)
+	}
+	return s, nil
+}
+
+func (s *mqttSource) Subscribe(ctx context.Context, topics []string, deliver func(Message)) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	var mu sync.Mutex
+	write := func(packetType, flags byte, body []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := conn.Write(mqttPacket(packetType, flags, body))
+		return err
+	}
+
+	var connect []byte
+	connect = appendString(connect, "MQTT")
+	flags := byte(0x02) // clean session
+	if s.user != nil {
+		flags |= 0x80
+		if _, ok := s.user.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	connect = append(connect, 4, flags)
+	connect = binary.BigEndian.AppendUint16(connect, uint16(mqttKeepAlive/time.Second))
+	connect = appendString(connect, s.clientID)
+	if s.user != nil {
+		connect = appendString(connect, s.user.Username())
+		if password, ok := s.user.Password(); ok {
+			connect = appendString(connect, password)
+		}
+	}
+	if err := write(mqttConnect, 0, connect); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	packetType, _, body, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if packetType != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("mqtt: expected CONNACK, got packet type %d", packetType)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("mqtt: connection refused with code %d", body[1])
+	}
+
+	subscribe := binary.BigEndian.AppendUint16(nil, mqttSubscribeID)
+	for _, topic := range topics {
+		subscribe = append(appendString(subscribe, topic), 0)
+	}
+	if err := write(mqttSubscribe, 0x02, subscribe); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if write(mqttPingreq, 0, nil) != nil {
+					return
+				}
+			case <-done:
+				write(mqttDisconnect, 0, nil)
+				return
+			}
+		}
+	}()
+
+	for {
+		packetType, flags, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		switch packetType {
+		case mqttSuback:
+			for _, code := range body[min(2, len(body)):] {
+				if code == 0x80 {
+					return errors.New("mqtt: subscription refused")
+				}
+			}
+		case mqttPublish:
+			topic, rest, err := readString(body)
+			if err != nil {
+				return err
+			}
+			if qos := flags >> 1 & 3; qos > 0 {
+				if len(rest) < 2 {
+					return errors.New("mqtt: publish without packet id")
+				}
+				if qos == 1 {
+					if err := write(mqttPuback, 0, rest[:2]); err != nil {
+						return err
+					}
+				}
+				rest = rest[2:]
+			}
+			deliver(Message{Topic: topic, Data: rest})
+		}
+	}
+}
+
+// mqttPacket encodes a control packet with its fixed header
+func mqttPacket(packetType, flags byte, body []byte) []byte {
+	packet := []byte{packetType<<4 | flags}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// readMQTTPacket reads a control packet, returning its type, the flags of
+// its fixed header and its body
+func readMQTTPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	if length > mqttMaxPacket {
+		return 0, 0, nil, fmt.Errorf("mqtt: packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: truncated string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: truncated string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
@@ -0,0 +1,133 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// natsSource subscribes to subjects with the NATS client protocol. The URL
+// may carry a user and password, or a token as its user.
+type natsSource struct {
+	addr     string
+	user     string
+	password string
+	token    string
+}
+
+func newNATS(u *url.URL) (Source, error) {
+	s := &natsSource{addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			s.user, s.password = u.User.Username(), password
+		} else {
+			s.token = u.User.Username()
+		}
+	}
+	return s, nil
+}
+
+func (s *natsSource) Subscribe(ctx context.Context, topics []string, deliver func(Message)) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	r := bufio.NewReader(conn)
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: unexpected greeting %q", line)
+	}
+	connect, err := json.Marshal(struct {
+		Verbose  bool   `json:"verbose"`
+		Pedantic bool   `json:"pedantic"`
+		Name     string `json:"name"`
+		Lang     string `json:"lang"`
+		User     string `json:"user,omitempty"`
+		Password string `json:"pass,omitempty"`
+		Token    string `json:"auth_token,omitempty"`
+	}{Name: "msc", Lang: "go", User: s.user, Password: s.password, Token: s.token})
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CONNECT %s\r\n", connect)
+	for i, topic := range topics {
+		fmt.Fprintf(&sb, "SUB %s %d\r\n", topic, i+1)
+	}
+	sb.WriteString("PING\r\n")
+	if _, err := io.WriteString(conn, sb.String()); err != nil {
+		return err
+	}
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <size>
+			fields := strings.Fields(line)
+			if len(fields) != 4 && len(fields) != 5 {
+				return fmt.Errorf("nats: malformed message header %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("nats: malformed message size in %q", line)
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			deliver(Message{Topic: fields[1], Data: data[:size]})
+		case line == "PING":
+			if _, err := io.WriteString(conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// readLine reads a line of a text protocol without its line ending
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
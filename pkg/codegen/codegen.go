@@ -28,10 +28,23 @@ import (
 )
 
 type CodeGenerator struct {
-	instructions     []vm.Instruction
-	symbolTable      *semantic.SymbolTable
-	functions        map[string]int
-	symbols          map[string]int
+	instructions    []vm.Instruction
+	constants       []vm.Value
+	constantIndices map[vm.Value]int
+	symbolTable     *semantic.SymbolTable
+	functions       map[string]int
+	functionTable   []vm.Function
+	functionBodies  []*parser.Function
+	symbols         map[string]int
+	// locals maps the variables of the function being generated to their
+	// frame slots, it is nil while generating top level code
+	locals map[string]int
+	// state holds the state variables of the agent whose function is being
+	// generated, bodyState those of the agent declaring each function body
+	// and agentState those of the agent being declared
+	state            map[string]bool
+	bodyState        map[*parser.Function]map[string]bool
+	agentState       map[string]bool
 	nextFuncIndex    int
 	nextSymbolIndex  int
 	builtinFunctions map[string]vm.Opcode
@@ -40,20 +53,71 @@ type CodeGenerator struct {
 func NewCodeGenerator(symbolTable *semantic.SymbolTable) *CodeGenerator {
 	cg := &CodeGenerator{
 		instructions:    []vm.Instruction{},
+		constants:       []vm.Value{},
+		constantIndices: make(map[vm.Value]int),
 		symbolTable:     symbolTable,
 		functions:       make(map[string]int),
 		symbols:         make(map[string]int),
+		bodyState:       make(map[*parser.Function]map[string]bool),
 		nextFuncIndex:   0,
 		nextSymbolIndex: 0,
 		builtinFunctions: map[string]vm.Opcode{
-			"log":     vm.OpLog,
-			"syscall": vm.OpSyscall,
-			"exec":    vm.OpExec,
+			"log":             vm.OpLog,
+			"print":           vm.OpPrint,
+			"syscall":         vm.OpSyscall,
+			"exec":            vm.OpExec,
+			"len":             vm.OpStringLength,
+			"send":            vm.OpSend,
+			"receive":         vm.OpReceive,
+			"emit":            vm.OpEmit,
+			"ask":             vm.OpAsk,
+			"reply":           vm.OpReply,
+			"spawn":           vm.OpSpawn,
+			"self":            vm.OpSelf,
+			"llm":             vm.OpLLM,
+			"prompt":          vm.OpPrompt,
+			"remember":        vm.OpRemember,
+			"recall":          vm.OpRecall,
+			"forget":          vm.OpForget,
+			"observe":         vm.OpObserve,
+			"recent":          vm.OpRecent,
+			"session":         vm.OpSession,
+			"sessionRemember": vm.OpSessionRemember,
+			"sessionRecall":   vm.OpSessionRecall,
+			"sessionHistory":  vm.OpSessionHistory,
+			"embed":           vm.OpEmbed,
+			"index":           vm.OpIndex,
+			"search":          vm.OpSearch,
+			"mcp":             vm.OpMCP,
+			"sort":            vm.OpSort,
+			"reduce":          vm.OpReduce,
+			"filter":          vm.OpFilter,
+			"map":             vm.OpMapList,
+			"tomlParse":       vm.OpTOMLParse,
+			"yamlParse":       vm.OpYAMLParse,
+			"queryParam":      vm.OpQueryParam,
+			"urlEncode":       vm.OpURLEncode,
+			"urlParse":        vm.OpURLParse,
+			"format":          vm.OpFormat,
+			"sqlQuery":        vm.OpSQLQuery,
+			"uuid":            vm.OpUUID,
+			"assert":          vm.OpAssert,
+			"typeof":          vm.OpTypeOf,
+			"bool":            vm.OpToBool,
+			"string":          vm.OpToString,
+			"float":           vm.OpToFloat,
+			"int":             vm.OpToInt,
+			"choice":          vm.OpChoice,
+			"randomInt":       vm.OpRandomInt,
+			"random":          vm.OpRandom,
+			"args":            vm.OpArgs,
+			"env":             vm.OpEnv,
 		},
 	}
 	return cg
 }
 
+// declareSymbol returns the global slot of name, allocating it on first use
 func (cg *CodeGenerator) declareSymbol(name string) int {
 	if index, exists := cg.symbols[name]; exists {
 		return index
@@ -64,18 +128,43 @@ func (cg *CodeGenerator) declareSymbol(name string) int {
 	return index
 }
 
+// declareLocal returns the slot of name in the current function's frame,
+// allocating it on first use
+func (cg *CodeGenerator) declareLocal(name string) int {
+	if index, exists := cg.locals[name]; exists {
+		return index
+	}
+	index := len(cg.locals)
+	cg.locals[name] = index
+	return index
+}
+
+// addConstant adds a value to the constant pool, reusing the existing slot
+// when the same value has already been added
+func (cg *CodeGenerator) addConstant(value vm.Value) int {
+	if index, exists := cg.constantIndices[value]; exists {
+		return index
+	}
+	cg.constants = append(cg.constants, value)
+	index := len(cg.constants) - 1
+	cg.constantIndices[value] = index
+	return index
+}
+
 func (cg *CodeGenerator) declareFunction(name string) int {
 	if index, exists := cg.functions[name]; exists {
 		return index
 	}
 	index := cg.nextFuncIndex
 	cg.functions[name] = index
+	cg.functionTable = append(cg.functionTable, vm.Function{Name: name, Address: -1})
 	cg.nextFuncIndex++
 	return index
 }
 
 func (cg *CodeGenerator) generateAgentStatement(agent *parser.AgentStatement) {
 	agentIndex := cg.declareSymbol(agent.Name.Value)
+	cg.generateStringLiteral(agent.Name.Value)
 	cg.emit(vm.OpCreateAgent, agentIndex)
 
 	if agent.Goal != nil {
@@ -90,29 +179,67 @@ func (cg *CodeGenerator) generateAgentStatement(agent *parser.AgentStatement) {
 		}
 	}
 
+	if agent.Supervision != nil {
+		cg.generateStringLiteral(agent.Supervision.Value)
+		cg.emit(vm.OpSetAgentSupervision, agentIndex)
+	}
+
+	cg.agentState = make(map[string]bool)
+	for _, state := range agent.State {
+		cg.generateExpression(*state.Value)
+		cg.generateStringLiteral(state.Name.Value)
+		cg.emit(vm.OpDefineState, agentIndex)
+		cg.agentState[state.Name.Value] = true
+	}
+
 	for _, behavior := range agent.Behaviors {
-		cg.generateBehavior(behavior, agentIndex)
+		cg.generateBehavior(behavior, agent.Name.Value, agentIndex)
 	}
 
 	for _, function := range agent.Functions {
 		cg.generateFunction(function, agentIndex)
 	}
+	cg.agentState = nil
 }
 
-func (cg *CodeGenerator) generateBehavior(behavior *parser.Behavior, agentIndex int) {
-	for _, eventHandler := range behavior.EventHandlers {
-		eventHandlerIndex := cg.nextSymbolIndex
-		cg.nextSymbolIndex++
+// addFunctionBody queues a function to be generated after the main program,
+// remembering the state variables of the agent declaring it
+func (cg *CodeGenerator) addFunctionBody(function *parser.Function) {
+	cg.functionBodies = append(cg.functionBodies, function)
+	if cg.agentState != nil {
+		cg.bodyState[function] = cg.agentState
+	}
+}
 
-		cg.emit(vm.OpCreateEventHandler, eventHandlerIndex)
+// generateBehavior registers the agent's event handlers. Handler bodies are
+// compiled out of line like functions and run when the VM dispatches a
+// matching event.
+func (cg *CodeGenerator) generateBehavior(behavior *parser.Behavior, agentName string, agentIndex int) {
+	for _, eventHandler := range behavior.EventHandlers {
+		body := &parser.Function{
+			Name:      &parser.Identifier{Value: cg.handlerName(agentName, eventHandler.Event.Name.Value)},
+			Arguments: eventHandler.Arguments,
+			Body:      eventHandler.BlockStatement,
+		}
+		functionIndex := cg.declareFunction(body.Name.Value)
+		cg.addFunctionBody(body)
 
+		cg.emit(vm.OpCreateEventHandler, functionIndex)
 		cg.generateStringLiteral(eventHandler.Event.Name.Value)
-		cg.emit(vm.OpSetEventHandlerEvent, eventHandlerIndex)
-
-		cg.generateBlockStatement(eventHandler.BlockStatement)
-
+		cg.emit(vm.OpSetEventHandlerEvent, 0)
 		cg.emit(vm.OpAddAgentEventHandler, agentIndex)
-		cg.emit(vm.OpPush, eventHandlerIndex)
+	}
+}
+
+// handlerName returns the function name of an event handler, such as
+// Agent.on("start"), numbering agents' further handlers for the same event
+func (cg *CodeGenerator) handlerName(agentName, event string) string {
+	name := fmt.Sprintf("%s.on(%q)", agentName, event)
+	for n := 2; ; n++ {
+		if _, exists := cg.functions[name]; !exists {
+			return name
+		}
+		name = fmt.Sprintf("%s.on(%q)#%d", agentName, event, n)
 	}
 }
 
@@ -126,15 +253,55 @@ func (cg *CodeGenerator) generateFunction(function *parser.Function, agentIndex
 		cg.emit(vm.OpAddFunctionArgument, functionIndex)
 	}
 
-	cg.generateBlockStatement(function.Body)
+	cg.addFunctionBody(function)
 
-	cg.emit(vm.OpAddAgentFunction, agentIndex)
 	cg.emit(vm.OpPush, functionIndex)
+	cg.emit(vm.OpAddAgentFunction, agentIndex)
+}
+
+// generateFunctionBody emits a function out of line and records its address.
+// Arguments are on the stack in call order, so they are stored last first.
+func (cg *CodeGenerator) generateFunctionBody(function *parser.Function) {
+	functionIndex := cg.declareFunction(function.Name.Value)
+	cg.functionTable[functionIndex].Address = len(cg.instructions)
+	cg.functionTable[functionIndex].Arity = len(function.Arguments)
+	cg.functionTable[functionIndex].Arguments = functionArguments(function)
+
+	cg.locals = make(map[string]int)
+	cg.state = cg.bodyState[function]
+	for _, arg := range function.Arguments {
+		cg.declareLocal(arg.Name.Value)
+	}
+	for i := len(function.Arguments) - 1; i >= 0; i-- {
+		cg.emit(vm.OpSetLocal, cg.locals[function.Arguments[i].Name.Value])
+	}
+
+	cg.generateBlockStatement(function.Body)
+	cg.emit(vm.OpReturn, 0)
+
+	cg.functionTable[functionIndex].Locals = len(cg.locals)
+	cg.locals = nil
+	cg.state = nil
+}
+
+// functionArguments returns the names and declared types of a function's
+// arguments
+func functionArguments(function *parser.Function) []vm.Argument {
+	arguments := make([]vm.Argument, len(function.Arguments))
+	for i, arg := range function.Arguments {
+		arguments[i].Name = arg.Name.Value
+		if arg.Type != nil {
+			arguments[i].Type = arg.Type.TokenLiteral()
+		}
+	}
+	return arguments
 }
 
 func (cg *CodeGenerator) generateBlockStatement(block *parser.BlockStatement) {
-	for _, stmt := range block.Statements {
-		cg.generateStatement(*stmt)
+	// Statements is a map keyed by position, ranging over it would
+	// generate the statements in random order
+	for i := 0; i < len(block.Statements); i++ {
+		cg.generateStatement(*block.Statements[i])
 	}
 }
 
@@ -146,12 +313,17 @@ func (cg *CodeGenerator) generateStatement(stmt parser.Statement) {
 		cg.generateExpression(*s.Expression)
 	case *parser.VarStatement:
 		cg.generateVarStatement(s)
+	case *parser.AssignStatement:
+		cg.generateAssignStatement(s)
+	case *parser.Function:
+		cg.declareFunction(s.Name.Value)
+		cg.functionBodies = append(cg.functionBodies, s)
 	case *parser.ReturnStatement:
 		cg.generateExpression(*s.Value)
 		cg.emit(vm.OpReturn, 0)
 	default:
 		// Handle unknown statement types
-		logger.Log.Panic("Unsupported statement type", zap.String("type", fmt.Sprintf("%T", s)))
+		logger.Log.Panicw("Unsupported statement type", zap.String("type", fmt.Sprintf("%T", s)))
 	}
 }
 
@@ -160,78 +332,272 @@ func (cg *CodeGenerator) generateExpression(expr parser.Expression) {
 	case *parser.IntegerLiteral:
 		cg.emit(vm.OpPush, int(e.Value))
 	case *parser.FloatLiteral:
-		// TODO: handle float literals and not just cast to int
-		cg.emit(vm.OpPush, int(e.Value))
+		cg.emit(vm.OpConstant, cg.addConstant(e.Value))
 	case *parser.StringLiteral:
 		cg.generateStringLiteral(e.Value)
 	case *parser.BooleanLiteral:
 		if e.Value {
-			cg.emit(vm.OpPush, 1)
+			cg.emit(vm.OpTrue, 0)
 		} else {
-			cg.emit(vm.OpPush, 0)
+			cg.emit(vm.OpFalse, 0)
 		}
 	case *parser.IdentifierLiteral:
-		varIndex, exists := cg.symbols[e.Value]
-		if !exists {
-			logger.Log.Panic("Undefined variable", zap.String("variable", e.Value))
+		if varIndex, exists := cg.locals[e.Value]; exists {
+			cg.emit(vm.OpGetLocal, varIndex)
+		} else if cg.state[e.Value] {
+			cg.emit(vm.OpGetState, cg.addConstant(e.Value))
+		} else if varIndex, exists := cg.symbols[e.Value]; exists {
+			cg.emit(vm.OpGetGlobal, varIndex)
+		} else {
+			logger.Log.Panicw("Undefined variable", zap.String("variable", e.Value))
+		}
+	case *parser.ListLiteral:
+		for _, element := range e.Elements {
+			cg.generateExpression(*element)
+		}
+		cg.emit(vm.OpCreateList, len(e.Elements))
+	case *parser.MapLiteral:
+		for i, key := range e.Keys {
+			cg.generateExpression(*key)
+			cg.generateExpression(*e.Values[i])
+		}
+		cg.emit(vm.OpCreateMap, len(e.Keys))
+	case *parser.PrefixExpression:
+		cg.generateExpression(*e.Right)
+		switch e.Operator.Type {
+		case lexer.BANG:
+			cg.emit(vm.OpNot, 0)
+		default:
+			logger.Log.Panicw("Unknown operator", zap.String("operator", e.Operator.Literal))
 		}
-		cg.emit(vm.OpGetLocal, varIndex)
 	case *parser.InfixExpression:
+		if e.Operator.Type == lexer.AND || e.Operator.Type == lexer.OR {
+			cg.generateLogicalExpression(e)
+			return
+		}
 		cg.generateExpression(*e.Left)
 		cg.generateExpression(*e.Right)
 		switch e.Operator.Type {
 		case lexer.PLUS:
-			cg.emit(vm.OpAdd, 0)
+			if cg.symbolTable.ExpressionType(e) == "string" {
+				cg.emit(vm.OpConcatString, 0)
+			} else {
+				cg.emit(vm.OpAdd, 0)
+			}
 		case lexer.MINUS:
 			cg.emit(vm.OpSub, 0)
 		case lexer.ASTERISK:
 			cg.emit(vm.OpMul, 0)
 		case lexer.SLASH:
 			cg.emit(vm.OpDiv, 0)
+		case lexer.EQ:
+			cg.emit(vm.OpEqual, 0)
+		case lexer.NOT_EQ:
+			cg.emit(vm.OpNotEqual, 0)
+		case lexer.LT:
+			cg.emit(vm.OpLessThan, 0)
+		case lexer.GT:
+			cg.emit(vm.OpGreaterThan, 0)
 		default:
-			logger.Log.Panic("Unknown operator", zap.String("operator", e.Operator.Literal))
+			logger.Log.Panicw("Unknown operator", zap.String("operator", e.Operator.Literal))
+		}
+	case *parser.IndexExpression:
+		cg.generateExpression(*e.Left)
+		cg.generateExpression(*e.Index)
+		switch cg.symbolTable.ExpressionType(*e.Left) {
+		case "map":
+			cg.emit(vm.OpGetMapItem, 0)
+		case "list":
+			cg.emit(vm.OpGetListItem, 0)
+		case "string":
+			cg.emit(vm.OpGetStringItem, 0)
+		default:
+			// Values of unknown type are indexed by what they are at runtime
+			cg.emit(vm.OpGetItem, 0)
 		}
 	case *parser.CallExpression:
 		for _, arg := range e.Arguments {
+			if cg.symbolTable.ExpressionType(*arg) == "function" {
+				// Functions are passed to builtins by name
+				cg.generateStringLiteral((*arg).(*parser.IdentifierLiteral).Value)
+				continue
+			}
 			cg.generateExpression(*arg)
 		}
 		funcName := (*e.Function).(*parser.IdentifierLiteral).Value
 		if opcode, isBuiltin := cg.builtinFunctions[funcName]; isBuiltin {
-			cg.emit(opcode, len(e.Arguments))
-		} else {
-			funcIndex, exists := cg.functions[funcName]
-			if !exists {
-				logger.Log.Panic("Undefined function", zap.String("function", funcName))
+			if opcode == vm.OpSyscall {
+				// Everything after the command name is passed as a list, so
+				// each argument reaches the process unchanged
+				cg.emit(vm.OpCreateList, len(e.Arguments)-1)
+				cg.emit(opcode, 0)
+			} else {
+				cg.emit(opcode, len(e.Arguments))
 			}
-			cg.emit(vm.OpCall, funcIndex)
+		} else if vm.IsBuiltin(funcName) {
+			cg.emit(vm.OpConstant, cg.addConstant(funcName))
+			cg.emit(vm.OpCallBuiltin, len(e.Arguments))
+		} else {
+			// Functions may be called before their declaration has been
+			// generated, the address is resolved once the body is emitted
+			cg.emit(vm.OpCall, cg.declareFunction(funcName))
 		}
 	default:
-		logger.Log.Panic("Unsupported expression type", zap.String("type", fmt.Sprintf("%T", e)))
+		logger.Log.Panicw("Unsupported expression type", zap.String("type", fmt.Sprintf("%T", e)))
+	}
+}
+
+// generateLogicalExpression emits && and ||. When the right operand is a
+// literal or a variable both sides are evaluated and combined with
+// OpAnd/OpOr, which is cheaper than branching; otherwise the right operand is
+// guarded by jumps so that it only runs when it can change the result, as in
+// d != 0 && 10 / d > 1.
+func (cg *CodeGenerator) generateLogicalExpression(e *parser.InfixExpression) {
+	cg.generateExpression(*e.Left)
+
+	if isPure(*e.Right) {
+		cg.generateExpression(*e.Right)
+		if e.Operator.Type == lexer.AND {
+			cg.emit(vm.OpAnd, 0)
+		} else {
+			cg.emit(vm.OpOr, 0)
+		}
+		return
+	}
+
+	if e.Operator.Type == lexer.AND {
+		// left && right: false as soon as left is false
+		jumpToFalse := cg.emit(vm.OpJumpIfFalse, 0)
+		cg.generateExpression(*e.Right)
+		jumpToEnd := cg.emit(vm.OpJump, 0)
+		cg.patch(jumpToFalse, cg.emit(vm.OpFalse, 0))
+		cg.patch(jumpToEnd, len(cg.instructions))
+		return
+	}
+
+	// left || right: true as soon as left is true
+	jumpToRight := cg.emit(vm.OpJumpIfFalse, 0)
+	cg.emit(vm.OpTrue, 0)
+	jumpToEnd := cg.emit(vm.OpJump, 0)
+	cg.patch(jumpToRight, len(cg.instructions))
+	cg.generateExpression(*e.Right)
+	cg.patch(jumpToEnd, len(cg.instructions))
+}
+
+// isPure reports whether evaluating an expression can neither fail nor have
+// side effects. Operators are left out as they fail on division by zero,
+// overflow and operands of the wrong type.
+func isPure(expr parser.Expression) bool {
+	switch expr.(type) {
+	case *parser.IntegerLiteral, *parser.FloatLiteral, *parser.StringLiteral, *parser.BooleanLiteral, *parser.IdentifierLiteral:
+		return true
+	default:
+		return false
 	}
 }
 
 func (cg *CodeGenerator) generateStringLiteral(value string) {
-	// TODO: maybe store string literals in a separate table
-	stringIndex := cg.declareSymbol(value)
-	cg.emit(vm.OpPushString, stringIndex)
+	cg.emit(vm.OpConstant, cg.addConstant(value))
 }
 
 func (cg *CodeGenerator) generateVarStatement(stmt *parser.VarStatement) {
 	cg.generateExpression(*stmt.Value)
-	varIndex := cg.declareSymbol(stmt.Name.Value)
-	cg.emit(vm.OpSetLocal, varIndex)
+	if cg.locals != nil {
+		cg.emit(vm.OpSetLocal, cg.declareLocal(stmt.Name.Value))
+	} else {
+		cg.emit(vm.OpSetGlobal, cg.declareSymbol(stmt.Name.Value))
+	}
 }
 
-func (cg *CodeGenerator) emit(opcode vm.Opcode, operand int) {
+// generateAssignStatement stores a value in a local, a state variable of the
+// current agent or a global, in that order of precedence
+func (cg *CodeGenerator) generateAssignStatement(stmt *parser.AssignStatement) {
+	cg.generateExpression(*stmt.Value)
+	name := stmt.Name.Value
+	if varIndex, exists := cg.locals[name]; exists {
+		cg.emit(vm.OpSetLocal, varIndex)
+	} else if cg.state[name] {
+		cg.emit(vm.OpSetState, cg.addConstant(name))
+	} else if varIndex, exists := cg.symbols[name]; exists {
+		cg.emit(vm.OpSetGlobal, varIndex)
+	} else {
+		logger.Log.Panicw("Undefined variable", zap.String("variable", name))
+	}
+}
+
+// emit appends an instruction and returns its position
+func (cg *CodeGenerator) emit(opcode vm.Opcode, operand int) int {
 	cg.instructions = append(cg.instructions, vm.Instruction{Opcode: opcode, Operand: operand})
+	return len(cg.instructions) - 1
+}
+
+// patch replaces the operand of a previously emitted instruction, used to
+// fill in jump targets once they are known
+func (cg *CodeGenerator) patch(position int, operand int) {
+	cg.instructions[position].Operand = operand
 }
 
 // GenerateBytecode is the main function to generate bytecode from the AST
-func GenerateBytecode(program *parser.Program, symbolTable *semantic.SymbolTable) []vm.Instruction {
-	cg := NewCodeGenerator(symbolTable)
+func GenerateBytecode(program *parser.Program, symbolTable *semantic.SymbolTable) *vm.Program {
+	return NewCodeGenerator(symbolTable).Generate(program)
+}
+
+// Generate generates the code of a whole program like GenerateBytecode.
+// Code generated afterwards with Append continues the fused code, as the
+// inputs of REPLs attached to a served program do.
+func (cg *CodeGenerator) Generate(program *parser.Program) *vm.Program {
+	for _, stmt := range program.Statements {
+		cg.generateStatement(stmt)
+	}
+	cg.emit(vm.OpHalt, 0)
+
+	// Function bodies live after the main program so they only run when called
+	for i := 0; i < len(cg.functionBodies); i++ {
+		cg.generateFunctionBody(cg.functionBodies[i])
+	}
+	for _, function := range cg.functionTable {
+		if function.Address < 0 {
+			logger.Log.Panicw("Undefined function", zap.String("function", function.Name))
+		}
+	}
+
+	bytecode := &vm.Program{
+		Instructions: cg.instructions,
+		Constants:    cg.constants,
+		Functions:    cg.functionTable,
+	}
+	bytecode.Fuse()
+	// Fusing moves the function addresses in the table in place
+	cg.instructions = bytecode.Instructions
+	return bytecode
+}
+
+// Append generates the code of program after the code generated so far, so
+// that it can use the variables and functions of the programs before it, as
+// the REPL does with every input. It returns everything generated so far and
+// the address the new code starts at, for vm.VM.Extend. Unlike
+// GenerateBytecode it does not fuse instructions, which would move the code
+// the VM already runs.
+func (cg *CodeGenerator) Append(program *parser.Program) (*vm.Program, int) {
+	entry := len(cg.instructions)
+	cg.functionBodies = nil
 	for _, stmt := range program.Statements {
 		cg.generateStatement(stmt)
 	}
 	cg.emit(vm.OpHalt, 0)
-	return cg.instructions
+
+	for i := 0; i < len(cg.functionBodies); i++ {
+		cg.generateFunctionBody(cg.functionBodies[i])
+	}
+	for _, function := range cg.functionTable {
+		if function.Address < 0 {
+			logger.Log.Panicw("Undefined function", zap.String("function", function.Name))
+		}
+	}
+
+	return &vm.Program{
+		Instructions: cg.instructions,
+		Constants:    cg.constants,
+		Functions:    cg.functionTable,
+	}, entry
 }
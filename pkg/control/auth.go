@@ -0,0 +1,102 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package control
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// EnvToken is the environment variable holding the bearer token of a
+// control API, used instead of a random one by msc serve and sent by
+// msc repl --attach
+const EnvToken = "MSC_CONTROL_TOKEN"
+
+// NewToken returns a random bearer token
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// WithToken requires the requests changing the VM's state, which emit
+// events, stop agents, end sessions or evaluate source, to carry token as
+// a bearer token in their Authorization header
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// WithAllowedOrigins lets web pages on these origins, such as
+// http://localhost:3000, make the requests changing the VM's state.
+// Browsers send any other page's requests with its origin, which are
+// refused so that pages cannot reach a server on the visitor's machine.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) {
+		s.origins = append(s.origins, origins...)
+	}
+}
+
+// guard refuses requests from origins that are not allowed, without the
+// token or, for POST, whose body is not JSON. Browsers send text/plain
+// POSTs to any origin without asking it first, unlike JSON ones.
+func (s *Server) guard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !s.allowedOrigin(origin) {
+			writeError(w, http.StatusForbidden, errors.New("origin not allowed: "+origin))
+			return
+		}
+		if s.token != "" && !validToken(r, s.token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		if r.Method == http.MethodPost {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("the request body must be application/json"))
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) allowedOrigin(origin string) bool {
+	for _, allowed := range s.origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func validToken(r *http.Request, token string) bool {
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(credentials)), []byte(token)) == 1
+}
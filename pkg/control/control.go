@@ -0,0 +1,322 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the control package serves the HTTP API the agents of a running VM are
+// managed with:
+//
+//	GET  /agents                        lists the agents
+//	GET  /agents/{name}                 describes an agent
+//	GET  /agents/{name}/activity        returns an agent's activity log
+//	POST /agents/{name}/events/{event}  emits an event to an agent
+//	POST /agents/{name}/stop            stops an agent
+//	POST /events/{event}                emits an event to every agent
+//	GET  /sessions                      lists the open sessions
+//	DELETE /sessions/{id}               ends a session
+//	GET  /metrics                       returns the VM's metrics
+//	POST /eval                          evaluates MindScript, see WithEvaluator
+//
+// Metrics are returned as JSON, or in the Prometheus text format to
+// clients accepting text/plain, such as Prometheus itself, and when the
+// format query parameter is prometheus. Agents' metrics are labelled with
+// their names.
+// The activity log is filtered with the query parameters kind, since (an
+// RFC 3339 time), after (a sequence number) and limit, see vm.ActivityQuery.
+// Emitted events take the JSON request body, if any, as their payload, join
+// the trace of the request's traceparent header and belong to the session
+// named by the session query parameter, if any.
+// Requests changing the VM's state, the POSTs and DELETEs, and those of the
+// handlers added with WithHandler must carry the token of WithToken, JSON
+// bodies and no Origin header unless it is allowed with WithAllowedOrigins,
+// so that web pages cannot make them.
+// Errors are returned as a JSON object with an "error" message.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
+)
+
+// maxPayloadSize bounds the payloads of emitted events
+const maxPayloadSize = 4 << 20
+
+// AgentInfo describes an agent
+type AgentInfo struct {
+	Name         string   `json:"name"`
+	Declaration  string   `json:"declaration"`
+	Goal         string   `json:"goal,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	// Events are the events the agent has handlers for
+	Events    []string `json:"events"`
+	Functions []string `json:"functions"`
+	Stopped   bool     `json:"stopped"`
+	// Pending is the number of messages waiting in its mailbox
+	Pending int `json:"pending"`
+}
+
+// Server is an http.Handler serving the control API of a VM
+type Server struct {
+	machine   *vm.VM
+	mux       *http.ServeMux
+	evaluator Evaluator
+	token     string
+	origins   []string
+	handlers  map[string]http.Handler
+}
+
+// Evaluator evaluates MindScript in the context of the program the VM runs,
+// returning the result formatted for display, or "" if there is none
+type Evaluator interface {
+	Eval(source string) (string, error)
+}
+
+// EvalRequest is the body of POST /eval
+type EvalRequest struct {
+	Source string `json:"source"`
+}
+
+// EvalResult is the response to POST /eval
+type EvalResult struct {
+	Result string `json:"result,omitempty"`
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithEvaluator serves POST /eval, which evaluates the MindScript source of
+// the EvalRequest in the request body with e, as msc repl --attach does. The
+// source runs with the full privileges of the program, so it is only served
+// when asked for.
+func WithEvaluator(e Evaluator) Option {
+	return func(s *Server) {
+		s.evaluator = e
+	}
+}
+
+// WithHandler serves handler under pattern, such as the MCP server under
+// /mcp, with the checks of the requests changing the VM's state applied to
+// all of its requests
+func WithHandler(pattern string, handler http.Handler) Option {
+	return func(s *Server) {
+		if s.handlers == nil {
+			s.handlers = make(map[string]http.Handler)
+		}
+		s.handlers[pattern] = handler
+	}
+}
+
+// NewServer returns a server controlling the agents of machine
+func NewServer(machine *vm.VM, opts ...Option) *Server {
+	s := &Server{machine: machine, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("GET /agents", s.listAgents)
+	s.mux.HandleFunc("GET /agents/{name}", s.getAgent)
+	s.mux.HandleFunc("GET /agents/{name}/activity", s.activity)
+	s.mux.HandleFunc("POST /agents/{name}/events/{event}", s.guard(s.emit))
+	s.mux.HandleFunc("POST /agents/{name}/stop", s.guard(s.stopAgent))
+	s.mux.HandleFunc("POST /events/{event}", s.guard(s.emit))
+	s.mux.HandleFunc("GET /sessions", s.listSessions)
+	s.mux.HandleFunc("DELETE /sessions/{id}", s.guard(s.endSession))
+	s.mux.HandleFunc("GET /metrics", s.metrics)
+	if s.evaluator != nil {
+		s.mux.HandleFunc("POST /eval", s.guard(s.eval))
+	}
+	for pattern, handler := range s.handlers {
+		s.mux.HandleFunc(pattern, s.guard(handler.ServeHTTP))
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func describe(agent *vm.Agent) AgentInfo {
+	info := AgentInfo{
+		Name:         agent.Name,
+		Declaration:  agent.Declaration,
+		Goal:         agent.Goal,
+		Capabilities: append([]string{}, agent.Capabilities...),
+		Events:       []string{},
+		Functions:    append([]string{}, agent.Functions...),
+		Stopped:      agent.Stopped(),
+		Pending:      agent.Pending(),
+	}
+	for _, handler := range agent.Handlers {
+		info.Events = append(info.Events, handler.Event)
+	}
+	return info
+}
+
+func (s *Server) listAgents(w http.ResponseWriter, r *http.Request) {
+	agents := s.machine.Agents()
+	infos := make([]AgentInfo, len(agents))
+	for i, agent := range agents {
+		infos[i] = describe(agent)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) getAgent(w http.ResponseWriter, r *http.Request) {
+	agent, ok := s.machine.Agent(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", vm.ErrUnknownAgent, r.PathValue("name")))
+		return
+	}
+	writeJSON(w, http.StatusOK, describe(agent))
+}
+
+func (s *Server) activity(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := vm.ActivityQuery{Kind: params.Get("kind")}
+	var err error
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since: %w", err))
+			return
+		}
+	}
+	for name, n := range map[string]*int{"after": &query.After, "limit": &query.Limit} {
+		if value := params.Get(name); value != "" {
+			if *n, err = strconv.Atoi(value); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+		}
+	}
+	entries, err := s.machine.Activity(r.PathValue("name"), query)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// emit emits an event to the agent in the path, or to every agent. The
+// handlers have run once the response is sent unless the VM is still
+// running its program, in which case the event is only queued.
+func (s *Server) emit(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var payload vm.Value
+	if len(data) > 0 {
+		if payload, err = vm.ParseJSON(data); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("payload: %w", err))
+			return
+		}
+	}
+	agent, event := r.PathValue("name"), r.PathValue("event")
+	logger.Log.Debugw("Emitting event for a control client", zap.String("agent", agent), zap.String("event", event))
+	ctx := tracing.ContextWithSpanContext(r.Context(), tracing.Extract(r.Header))
+	ctx = vm.ContextWithSession(ctx, r.URL.Query().Get("session"))
+	if err := s.machine.EmitContext(ctx, agent, event, payload); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) stopAgent(w http.ResponseWriter, r *http.Request) {
+	if err := s.machine.StopAgent(r.PathValue("name")); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := s.machine.Sessions()
+	if sessions == nil {
+		sessions = []vm.SessionInfo{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) endSession(w http.ResponseWriter, r *http.Request) {
+	if err := s.machine.EndSession(r.PathValue("id")); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	if !wantsPrometheus(r) {
+		writeJSON(w, http.StatusOK, s.machine.Metrics())
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	if err := writePrometheus(w, s.machine.Metrics()); err != nil {
+		logger.Log.Warnw("Error writing control response", zap.Error(err))
+	}
+}
+
+// eval evaluates the source in the request body. Compile errors are bad
+// requests while runtime errors are internal errors, like those of emit.
+func (s *Server) eval(w http.ResponseWriter, r *http.Request) {
+	var req EvalRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPayloadSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("request: %w", err))
+		return
+	}
+	logger.Log.Infow("Evaluating source for a control client", zap.String("remote", r.RemoteAddr))
+	result, err := s.evaluator.Eval(req.Source)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, EvalResult{Result: result})
+}
+
+// errorStatus returns the status of an error of the VM: unknown agents and
+// sessions are not found, failing handlers are errors of the server and
+// anything else, such as an invalid event name, is the client's
+func errorStatus(err error) int {
+	var runtimeErr *vm.RuntimeError
+	switch {
+	case errors.Is(err, vm.ErrUnknownAgent), errors.Is(err, vm.ErrUnknownSession):
+		return http.StatusNotFound
+	case errors.As(err, &runtimeErr):
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Log.Warnw("Error writing control response", zap.Error(err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
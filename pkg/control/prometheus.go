@@ -0,0 +1,158 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package control
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+)
+
+// prometheusContentType is the content type of the Prometheus text format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// wantsPrometheus reports whether a metrics request accepts the Prometheus
+// text format, as scrapers do, rather than JSON
+func wantsPrometheus(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text") ||
+		r.URL.Query().Get("format") == "prometheus"
+}
+
+// labelEscaper escapes label values as the text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes metrics in the Prometheus text format
+type promWriter struct {
+	w *bufio.Writer
+}
+
+// family starts a metric family
+func (p promWriter) family(name, kind, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample with labels given as name, value pairs
+func (p promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			fmt.Fprintf(p.w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		p.w.WriteByte('}')
+	}
+	fmt.Fprintf(p.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// metric writes a family with a single unlabelled sample
+func (p promWriter) metric(name, kind, help string, value float64) {
+	p.family(name, kind, help)
+	p.sample(name, value)
+}
+
+// writePrometheus writes the VM's metrics in the Prometheus text format,
+// the work of each agent labelled with its name
+func writePrometheus(out io.Writer, metrics vm.Metrics) error {
+	p := promWriter{w: bufio.NewWriter(out)}
+	p.metric("mindscript_instructions_total", "counter", "Instructions executed.", float64(metrics.Instructions))
+	p.metric("mindscript_calls_total", "counter", "Function calls, including handler invocations.", float64(metrics.Calls))
+	p.metric("mindscript_events_dispatched_total", "counter", "Events delivered to the agents' handlers.", float64(metrics.EventsDispatched))
+	p.metric("mindscript_execs_total", "counter", "External commands started.", float64(metrics.Execs))
+	p.metric("mindscript_exec_failures_total", "counter", "External commands that failed or timed out.", float64(metrics.ExecFailures))
+	p.metric("mindscript_throttles_total", "counter", "Handlers stopped for exceeding their agent's quota.", float64(metrics.Throttles))
+	p.metric("mindscript_peak_stack_depth", "gauge", "Largest number of values the stack has held.", float64(metrics.PeakStackDepth))
+	p.metric("mindscript_llm_calls_total", "counter", "Calls made to the language model.", float64(metrics.LLM.Calls))
+	p.metric("mindscript_llm_embeddings_total", "counter", "Requests made to the embedder.", float64(metrics.LLM.Embeddings))
+	p.metric("mindscript_llm_failures_total", "counter", "Failed language model and embedder requests.", float64(metrics.LLM.Failures))
+	p.metric("mindscript_llm_prompt_tokens_total", "counter", "Prompt tokens reported by the provider.", float64(metrics.LLM.PromptTokens))
+	p.metric("mindscript_llm_completion_tokens_total", "counter", "Completion tokens reported by the provider.", float64(metrics.LLM.CompletionTokens))
+	p.metric("mindscript_llm_latency_seconds_total", "counter", "Time spent waiting for the provider.", metrics.LLM.Latency.Seconds())
+
+	topics := sortedKeys(metrics.Topics)
+	for _, family := range []struct {
+		name, help string
+		value      func(vm.TopicMetrics) int
+	}{
+		{"mindscript_topic_published_total", "Messages published to a topic.", func(m vm.TopicMetrics) int { return m.Published }},
+		{"mindscript_topic_delivered_total", "Handlers a topic's messages were delivered to.", func(m vm.TopicMetrics) int { return m.Delivered }},
+		{"mindscript_topic_undelivered_total", "Messages of a topic no handler subscribed to.", func(m vm.TopicMetrics) int { return m.Undelivered }},
+	} {
+		if len(topics) == 0 {
+			break
+		}
+		p.family(family.name, "counter", family.help)
+		for _, topic := range topics {
+			p.sample(family.name, float64(family.value(metrics.Topics[topic])), "topic", topic)
+		}
+	}
+
+	agents := sortedKeys(metrics.Agents)
+	if len(agents) == 0 {
+		return p.w.Flush()
+	}
+	for _, family := range []struct {
+		name, help string
+		value      func(vm.AgentMetrics) int
+	}{
+		{"mindscript_agent_events_total", "Events delivered to an agent's handlers.", func(m vm.AgentMetrics) int { return m.Events }},
+		{"mindscript_agent_handlers_total", "Handler runs of an agent.", func(m vm.AgentMetrics) int { return m.Handlers }},
+		{"mindscript_agent_handler_failures_total", "Failed handler runs of an agent.", func(m vm.AgentMetrics) int { return m.HandlerFailures }},
+		{"mindscript_agent_instructions_total", "Instructions executed by an agent's handlers.", func(m vm.AgentMetrics) int { return m.Instructions }},
+		{"mindscript_agent_execs_total", "External commands started by an agent.", func(m vm.AgentMetrics) int { return m.Execs }},
+		{"mindscript_agent_exec_failures_total", "External commands of an agent that failed or timed out.", func(m vm.AgentMetrics) int { return m.ExecFailures }},
+	} {
+		p.family(family.name, "counter", family.help)
+		for _, agent := range agents {
+			p.sample(family.name, float64(family.value(metrics.Agents[agent])), "agent", agent)
+		}
+	}
+	const latency = "mindscript_agent_handler_duration_seconds"
+	p.family(latency, "histogram", "Run time of an agent's handlers.")
+	for _, agent := range agents {
+		histogram := metrics.Agents[agent].HandlerLatency
+		for i, bound := range vm.LatencyBuckets {
+			count := 0
+			if histogram.Buckets != nil {
+				count = histogram.Buckets[i]
+			}
+			p.sample(latency+"_bucket", float64(count), "agent", agent, "le", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64))
+		}
+		p.sample(latency+"_bucket", float64(histogram.Count), "agent", agent, "le", "+Inf")
+		p.sample(latency+"_sum", histogram.Sum.Seconds(), "agent", agent)
+		p.sample(latency+"_count", float64(histogram.Count), "agent", agent)
+	}
+	return p.w.Flush()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
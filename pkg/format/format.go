@@ -0,0 +1,439 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the format package prints MindScript programs in the canonical style of
+// msc fmt: four spaces of indentation, statements ending with semicolons,
+// expressions on one line with only the parentheses precedence needs and
+// at most one blank line between declarations and statements. Comments
+// and blank lines of the source are kept.
+package format
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+)
+
+// indentation is one level of indentation
+const indentation = "    "
+
+// ErrChanged is returned when formatting would change the tokens of a
+// program rather than only its layout, which happens when the parser skips
+// parts it cannot parse without reporting an error
+var ErrChanged = errors.New("formatting would change the program")
+
+// Source formats MindScript source. It returns an error if the source does
+// not parse.
+func Source(src []byte) (formatted []byte, err error) {
+	l := lexer.New(string(src))
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors: %s", strings.Join(p.Errors(), "; "))
+	}
+	defer func() {
+		// The parser leaves nodes it could not parse nil
+		if r := recover(); r != nil {
+			formatted, err = nil, fmt.Errorf("%w: incomplete syntax tree: %v", ErrChanged, r)
+		}
+	}()
+
+	pr := &printer{src: string(src), comments: l.Comments()}
+	pr.program(program)
+	pr.flush(len(src))
+	formatted = []byte(pr.buf.String())
+	if !equalTokens(string(src), string(formatted)) {
+		return nil, ErrChanged
+	}
+	return formatted, nil
+}
+
+// Program prints a program in the canonical style, without the comments
+// and blank lines only its source has
+func Program(program *parser.Program) string {
+	pr := &printer{}
+	pr.program(program)
+	return pr.buf.String()
+}
+
+// printer prints the nodes of a program together with the comments of its
+// source, each before the first node following it
+type printer struct {
+	buf    strings.Builder
+	src    string
+	indent int
+	// comments are the comments not printed yet
+	comments []lexer.Token
+}
+
+func (p *printer) program(program *parser.Program) {
+	for _, stmt := range program.Statements {
+		p.statement(stmt)
+	}
+}
+
+// line prints a line at the current indentation
+func (p *printer) line(format string, args ...any) {
+	p.buf.WriteString(strings.Repeat(indentation, p.indent))
+	fmt.Fprintf(&p.buf, format, args...)
+	p.buf.WriteByte('\n')
+}
+
+// open prints a line opening a block and indents what follows
+func (p *printer) open(format string, args ...any) {
+	p.line(format+" {", args...)
+	p.indent++
+}
+
+// close prints the comments left in a block and its closing brace, on the
+// opening line if the block is empty
+func (p *printer) close(rbrace int) {
+	p.flush(rbrace)
+	p.indent--
+	if text := p.buf.String(); strings.HasSuffix(text, "{\n") {
+		p.buf.Reset()
+		p.buf.WriteString(text[:len(text)-1] + "}\n")
+		return
+	}
+	p.line("}")
+}
+
+// begin starts a node at loc, printing the comments before it and keeping
+// a blank line before it if the source has one
+func (p *printer) begin(loc int) {
+	p.flush(loc)
+	p.separate(loc)
+}
+
+// flush prints the comments before loc. A comment following code on the
+// same line stays at the end of the line printed last.
+func (p *printer) flush(loc int) {
+	for len(p.comments) > 0 && p.comments[0].Loc < loc {
+		comment := p.comments[0]
+		p.comments = p.comments[1:]
+		text := p.buf.String()
+		if p.trailing(comment.Loc) && strings.HasSuffix(text, "\n") {
+			p.buf.Reset()
+			p.buf.WriteString(text[:len(text)-1])
+			p.buf.WriteString(" " + comment.Literal + "\n")
+			continue
+		}
+		p.separate(comment.Loc)
+		p.line("%s", comment.Literal)
+	}
+}
+
+// separate prints a blank line if the source has one before loc, except at
+// the start of the output or of a block
+func (p *printer) separate(loc int) {
+	text := p.buf.String()
+	if text == "" || strings.HasSuffix(text, "{\n") || strings.HasSuffix(text, "\n\n") {
+		return
+	}
+	newlines := 0
+	for i := p.start(loc) - 1; i >= 0; i-- {
+		c := p.src[i]
+		if c == '\n' {
+			newlines++
+		} else if c != ' ' && c != '\t' && c != '\r' {
+			break
+		}
+	}
+	if newlines > 1 {
+		p.buf.WriteByte('\n')
+	}
+}
+
+// start returns where the token at loc starts. The lexer places words and
+// numbers at their end and strings at their closing quote.
+func (p *printer) start(loc int) int {
+	loc = min(loc, len(p.src))
+	if loc < len(p.src) && p.src[loc] == '"' {
+		return max(strings.LastIndexByte(p.src[:loc], '"'), 0)
+	}
+	for loc > 0 && isWordChar(p.src[loc-1]) {
+		loc--
+	}
+	return loc
+}
+
+func isWordChar(c byte) bool {
+	return unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || c == '.'
+}
+
+// trailing reports whether code precedes loc on its line
+func (p *printer) trailing(loc int) bool {
+	for i := loc - 1; i >= 0; i-- {
+		switch p.src[i] {
+		case '\n':
+			return false
+		case ' ', '\t', '\r':
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (p *printer) statement(stmt parser.Statement) {
+	switch stmt := stmt.(type) {
+	case *parser.AgentStatement:
+		p.begin(stmt.Token.Loc)
+		p.agent(stmt)
+	case *parser.Function:
+		p.begin(stmt.Token.Loc)
+		p.function(stmt)
+	case *parser.VarStatement:
+		p.begin(stmt.Token.Loc)
+		p.line("%s %s: %s = %s;", stmt.Token.Literal, stmt.Name.Value, stmt.Type.Token.Literal, expr(stmt.Value))
+	case *parser.AssignStatement:
+		p.begin(stmt.Token.Loc)
+		p.line("%s = %s;", stmt.Name.Value, expr(stmt.Value))
+	case *parser.ReturnStatement:
+		p.begin(stmt.Token.Loc)
+		if stmt.Value == nil || *stmt.Value == nil {
+			p.line("return;")
+			return
+		}
+		p.line("return %s;", expr(stmt.Value))
+	case *parser.ExpressionStatement:
+		p.begin(stmt.Token.Loc)
+		p.line("%s;", expr(stmt.Expression))
+	default:
+		panic(fmt.Sprintf("unexpected statement %T", stmt))
+	}
+}
+
+// agent prints an agent's members in the order of the source
+func (p *printer) agent(agent *parser.AgentStatement) {
+	type member struct {
+		loc   int
+		print func()
+	}
+	var members []member
+	if goal := agent.Goal; goal != nil {
+		members = append(members, member{goal.Token.Loc, func() {
+			p.line("goal: %s;", quote(goal.Value))
+		}})
+	}
+	if capabilities := agent.Capabilities; capabilities != nil {
+		members = append(members, member{capabilities.Token.Loc, func() {
+			values := make([]string, len(capabilities.Values))
+			for i, value := range capabilities.Values {
+				values[i] = quote(value)
+			}
+			p.line("capabilities: [%s];", strings.Join(values, ", "))
+		}})
+	}
+	if supervision := agent.Supervision; supervision != nil {
+		members = append(members, member{supervision.Token.Loc, func() {
+			p.line("supervision: %s;", quote(supervision.Value))
+		}})
+	}
+	for _, state := range agent.State {
+		members = append(members, member{state.Token.Loc, func() { p.statement(state) }})
+	}
+	for _, behavior := range agent.Behaviors {
+		members = append(members, member{behavior.Token.Loc, func() { p.behavior(behavior) }})
+	}
+	for _, function := range agent.Functions {
+		members = append(members, member{function.Token.Loc, func() { p.function(function) }})
+	}
+	sort.SliceStable(members, func(i, j int) bool { return members[i].loc < members[j].loc })
+
+	p.open("agent %s", agent.Name.Value)
+	for _, m := range members {
+		p.begin(m.loc)
+		m.print()
+	}
+	p.close(agent.Rbrace)
+}
+
+func (p *printer) behavior(behavior *parser.Behavior) {
+	p.open("behavior")
+	for _, handler := range behavior.EventHandlers {
+		p.begin(handler.Token.Loc)
+		if len(handler.Arguments) > 0 {
+			p.open("on %s(%s)", quote(handler.Event.Name.Value), arguments(handler.Arguments))
+		} else {
+			p.open("on %s", quote(handler.Event.Name.Value))
+		}
+		p.block(handler.BlockStatement)
+	}
+	p.close(behavior.Rbrace)
+}
+
+func (p *printer) function(function *parser.Function) {
+	p.open("function %s(%s): %s", function.Name.Value, arguments(function.Arguments), function.ReturnType.Token.Literal)
+	p.block(function.Body)
+}
+
+// block prints the statements of an opened block and closes it
+func (p *printer) block(block *parser.BlockStatement) {
+	for i := 0; i < len(block.Statements); i++ {
+		p.statement(*block.Statements[i])
+	}
+	p.close(block.Rbrace)
+}
+
+func arguments(args []*parser.FunctionArgument) string {
+	params := make([]string, len(args))
+	for i, arg := range args {
+		params[i] = arg.Name.Value + ": " + arg.Type.Token.Literal
+	}
+	return strings.Join(params, ", ")
+}
+
+// operators are the canonical spellings of the infix operators, & and |
+// are accepted for && and ||
+var operators = map[lexer.TokenType]string{
+	lexer.AND: "&&",
+	lexer.OR:  "||",
+}
+
+// expr prints an expression, with parentheses around the operands that
+// bind less tightly than their operator
+func expr(e *parser.Expression) string {
+	if e == nil || *e == nil {
+		panic("missing expression")
+	}
+	switch e := (*e).(type) {
+	case *parser.IdentifierLiteral:
+		return e.Value
+	case *parser.IntegerLiteral:
+		return e.Token.Literal
+	case *parser.FloatLiteral:
+		return e.Token.Literal
+	case *parser.StringLiteral:
+		return quote(e.Value)
+	case *parser.BooleanLiteral:
+		return strconv.FormatBool(e.Value)
+	case *parser.ListLiteral:
+		return "[" + exprList(e.Elements) + "]"
+	case *parser.MapLiteral:
+		entries := make([]string, len(e.Keys))
+		for i := range e.Keys {
+			entries[i] = expr(e.Keys[i]) + ": " + expr(e.Values[i])
+		}
+		return "{" + strings.Join(entries, ", ") + "}"
+	case *parser.PrefixExpression:
+		return e.Operator.Literal + operand(e.Right, parser.PREFIX)
+	case *parser.InfixExpression:
+		precedence := precedence(*e.Operator)
+		operator, ok := operators[e.Operator.Type]
+		if !ok {
+			operator = e.Operator.Literal
+		}
+		// Operators are left associative, so an operand on the right of
+		// the same precedence needs parentheses too
+		return operand(e.Left, precedence) + " " + operator + " " + operand(e.Right, precedence+1)
+	case *parser.CallExpression:
+		return expr(e.Function) + "(" + exprList(e.Arguments) + ")"
+	case *parser.IndexExpression:
+		return operand(e.Left, parser.INDEX) + "[" + expr(e.Index) + "]"
+	}
+	panic(fmt.Sprintf("unexpected expression %T", *e))
+}
+
+// operand prints an expression in parentheses unless it binds at least as
+// tightly as precedence
+func operand(e *parser.Expression, precedence int) string {
+	s := expr(e)
+	if e != nil && bindingOf(*e) < precedence {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// bindingOf returns how tightly an expression binds
+func bindingOf(e parser.Expression) int {
+	switch e := e.(type) {
+	case *parser.InfixExpression:
+		return precedence(*e.Operator)
+	case *parser.PrefixExpression:
+		return parser.PREFIX
+	}
+	return parser.INDEX + 1
+}
+
+func precedence(operator lexer.Token) int {
+	switch operator.Type {
+	case lexer.OR:
+		return parser.LOGICAL_OR
+	case lexer.AND:
+		return parser.LOGICAL_AND
+	case lexer.EQ, lexer.NOT_EQ:
+		return parser.EQUALS
+	case lexer.LT, lexer.GT:
+		return parser.LESSGREATER
+	case lexer.PLUS, lexer.MINUS:
+		return parser.SUM
+	}
+	return parser.PRODUCT
+}
+
+func exprList(list []*parser.Expression) string {
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = expr(item)
+	}
+	return strings.Join(items, ", ")
+}
+
+// quote prints a string literal, strings have no escapes
+func quote(s string) string {
+	return `"` + s + `"`
+}
+
+// equalTokens reports whether two sources have the same tokens, apart from
+// the semicolons and parentheses formatting adds or removes and the
+// spelling of && and ||
+func equalTokens(a, b string) bool {
+	ta, tb := significantTokens(a), significantTokens(b)
+	if len(ta) != len(tb) {
+		return false
+	}
+	for i := range ta {
+		if ta[i] != tb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func significantTokens(src string) []string {
+	l := lexer.New(src)
+	var tokens []string
+	for tok := l.NextToken(); tok.Type != lexer.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case lexer.SEMICOLON, lexer.LPAREN, lexer.RPAREN:
+		case lexer.AND, lexer.OR:
+			tokens = append(tokens, string(tok.Type))
+		default:
+			tokens = append(tokens, string(tok.Type)+" "+tok.Literal)
+		}
+	}
+	for _, comment := range l.Comments() {
+		tokens = append(tokens, comment.Literal)
+	}
+	return tokens
+}
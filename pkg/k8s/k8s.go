@@ -0,0 +1,371 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the k8s package runs MindScript programs on Kubernetes. A program is
+// described by a MindScript custom resource listing its agents, and runs in
+// a Deployment of msc serve that reports the agents' status back to the
+// resource.
+package k8s
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"gopkg.in/yaml.v3"
+)
+
+// The custom resource describing a program
+const (
+	Group    = "mindscript.dev"
+	Version  = "v1alpha1"
+	Kind     = "MindScript"
+	Resource = "mindscripts"
+)
+
+// DefaultImage is the container image running msc, DefaultControlPort the
+// port of its control API
+const (
+	DefaultImage       = "msc:latest"
+	DefaultControlPort = 7420
+)
+
+// programDir is where the program's ConfigMap is mounted
+const programDir = "/etc/mindscript"
+
+// Object is a Kubernetes object
+type Object map[string]any
+
+// Options describe the manifests of a program
+type Options struct {
+	// Name names the resources, it must be a DNS label
+	Name      string
+	Namespace string
+	Image     string
+	// File is the name of the program's source file and Source its content
+	File   string
+	Source string
+	// Agents are the agents the program declares
+	Agents      []vm.AgentDeclaration
+	ControlPort int
+	// Args are added to the arguments of msc serve
+	Args []string
+	// TraceEndpoint is the OTLP/HTTP traces URL the handlers' spans are
+	// exported to, tracing is disabled when it is empty
+	TraceEndpoint string
+	// CRD includes the custom resource definition
+	CRD bool
+}
+
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// NameFor derives a resource name from the path of a program, such as
+// data-analyser for examples/DataAnalyser.ms
+func NameFor(path string) string {
+	base := []rune(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	lower := func(r rune) bool { return r >= 'a' && r <= 'z' || r >= '0' && r <= '9' }
+	upper := func(r rune) bool { return r >= 'A' && r <= 'Z' }
+	var b strings.Builder
+	dash := false
+	for i, r := range base {
+		switch {
+		case upper(r):
+			// A capital starts a word after a lowercase letter, or ends an
+			// acronym when a lowercase letter follows, as in HTTPServer
+			if i > 0 && (lower(base[i-1]) || i+1 < len(base) && upper(base[i-1]) && base[i+1] >= 'a' && base[i+1] <= 'z') {
+				dash = true
+			}
+			r += 'a' - 'A'
+		case lower(r):
+		default:
+			dash = true
+			continue
+		}
+		if dash && b.Len() > 0 {
+			b.WriteByte('-')
+		}
+		dash = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Manifests returns the objects running a program: its custom resource,
+// the ConfigMap holding its source, the Deployment and Service of msc serve
+// and the service account allowed to update the resource's status
+func Manifests(opts Options) ([]Object, error) {
+	if !dnsLabel.MatchString(opts.Name) {
+		return nil, fmt.Errorf("invalid name %q, names are lowercase letters, digits and dashes", opts.Name)
+	}
+	if opts.Image == "" {
+		opts.Image = DefaultImage
+	}
+	if opts.ControlPort == 0 {
+		opts.ControlPort = DefaultControlPort
+	}
+
+	var objects []Object
+	if opts.CRD {
+		objects = append(objects, CRD())
+	}
+	labels := map[string]any{
+		"app.kubernetes.io/name":       "msc",
+		"app.kubernetes.io/instance":   opts.Name,
+		"app.kubernetes.io/managed-by": "msc",
+	}
+	metadata := func() map[string]any {
+		m := map[string]any{"name": opts.Name, "labels": labels}
+		if opts.Namespace != "" {
+			m["namespace"] = opts.Namespace
+		}
+		return m
+	}
+
+	objects = append(objects,
+		Object{"apiVersion": "v1", "kind": "ServiceAccount", "metadata": metadata()},
+		Object{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "Role",
+			"metadata":   metadata(),
+			"rules": []any{
+				map[string]any{
+					"apiGroups":     []any{Group},
+					"resources":     []any{Resource + "/status"},
+					"resourceNames": []any{opts.Name},
+					"verbs":         []any{"get", "patch"},
+				},
+			},
+		},
+		Object{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "RoleBinding",
+			"metadata":   metadata(),
+			"roleRef":    map[string]any{"apiGroup": "rbac.authorization.k8s.io", "kind": "Role", "name": opts.Name},
+			"subjects":   []any{map[string]any{"kind": "ServiceAccount", "name": opts.Name}},
+		},
+		Object{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   metadata(),
+			"data":       map[string]any{opts.File: opts.Source},
+		},
+		Object{
+			"apiVersion": Group + "/" + Version,
+			"kind":       Kind,
+			"metadata":   metadata(),
+			"spec":       resourceSpec(opts),
+		},
+		deployment(opts, labels, metadata()),
+		Object{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   metadata(),
+			"spec": map[string]any{
+				"selector": map[string]any{"app.kubernetes.io/instance": opts.Name},
+				"ports":    []any{map[string]any{"name": "control", "port": opts.ControlPort, "targetPort": "control"}},
+			},
+		},
+	)
+	return objects, nil
+}
+
+// resourceSpec describes the program and its agents
+func resourceSpec(opts Options) map[string]any {
+	agents := []any{}
+	for _, agent := range opts.Agents {
+		spec := map[string]any{"name": agent.Name}
+		if agent.Goal != "" {
+			spec["goal"] = agent.Goal
+		}
+		if agent.Supervision != "" {
+			spec["supervision"] = agent.Supervision
+		}
+		for key, values := range map[string][]string{
+			"capabilities": agent.Capabilities,
+			"events":       agent.Events,
+			"functions":    agent.Functions,
+			"state":        agent.State,
+		} {
+			if len(values) > 0 {
+				spec[key] = values
+			}
+		}
+		agents = append(agents, spec)
+	}
+	return map[string]any{
+		"image":     opts.Image,
+		"configMap": opts.Name,
+		"program":   opts.File,
+		"agents":    agents,
+	}
+}
+
+// deployment runs msc serve with the program mounted from its ConfigMap.
+// A single replica runs at a time since agents keep their state in memory.
+func deployment(opts Options, labels, metadata map[string]any) Object {
+	args := []any{
+		"serve", programDir + "/" + opts.File,
+		"--control", fmt.Sprintf(":%d", opts.ControlPort),
+		"--k8s-status", "$(MSC_NAMESPACE)/" + opts.Name,
+	}
+	for _, arg := range opts.Args {
+		args = append(args, arg)
+	}
+	env := []any{map[string]any{
+		"name":      "MSC_NAMESPACE",
+		"valueFrom": map[string]any{"fieldRef": map[string]any{"fieldPath": "metadata.namespace"}},
+	}}
+	if opts.TraceEndpoint != "" {
+		env = append(env,
+			map[string]any{"name": tracing.EnvTracesEndpoint, "value": opts.TraceEndpoint},
+			map[string]any{"name": tracing.EnvServiceName, "value": opts.Name},
+		)
+	}
+	probe := map[string]any{"httpGet": map[string]any{"path": "/agents", "port": "control"}}
+	container := map[string]any{
+		"name":           "msc",
+		"image":          opts.Image,
+		"args":           args,
+		"env":            env,
+		"ports":          []any{map[string]any{"name": "control", "containerPort": opts.ControlPort}},
+		"readinessProbe": probe,
+		"livenessProbe":  probe,
+		"volumeMounts":   []any{map[string]any{"name": "program", "mountPath": programDir, "readOnly": true}},
+	}
+	return Object{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   metadata,
+		"spec": map[string]any{
+			"replicas": 1,
+			"strategy": map[string]any{"type": "Recreate"},
+			"selector": map[string]any{"matchLabels": map[string]any{"app.kubernetes.io/instance": opts.Name}},
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"labels": labels,
+					// Scraped by Prometheus setups honouring the usual annotations
+					"annotations": map[string]any{
+						"prometheus.io/scrape": "true",
+						"prometheus.io/port":   fmt.Sprint(opts.ControlPort),
+						"prometheus.io/path":   "/metrics",
+					},
+				},
+				"spec": map[string]any{
+					"serviceAccountName": opts.Name,
+					"containers":         []any{container},
+					"volumes": []any{map[string]any{
+						"name":      "program",
+						"configMap": map[string]any{"name": opts.Name},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// CRD returns the definition of the MindScript custom resource
+func CRD() Object {
+	stringArray := map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+	agentSpec := map[string]any{
+		"type":     "object",
+		"required": []any{"name"},
+		"properties": map[string]any{
+			"name":         map[string]any{"type": "string"},
+			"goal":         map[string]any{"type": "string"},
+			"supervision":  map[string]any{"type": "string"},
+			"capabilities": stringArray,
+			"events":       stringArray,
+			"functions":    stringArray,
+			"state":        stringArray,
+		},
+	}
+	agentStatus := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name":        map[string]any{"type": "string"},
+			"declaration": map[string]any{"type": "string"},
+			"stopped":     map[string]any{"type": "boolean"},
+			"pending":     map[string]any{"type": "integer"},
+		},
+	}
+	schema := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"spec": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"image":     map[string]any{"type": "string"},
+					"configMap": map[string]any{"type": "string"},
+					"program":   map[string]any{"type": "string"},
+					"agents":    map[string]any{"type": "array", "items": agentSpec},
+				},
+			},
+			"status": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"phase":            map[string]any{"type": "string"},
+					"running":          map[string]any{"type": "integer"},
+					"eventsDispatched": map[string]any{"type": "integer"},
+					"lastUpdateTime":   map[string]any{"type": "string", "format": "date-time"},
+					"agents":           map[string]any{"type": "array", "items": agentStatus},
+				},
+			},
+		},
+	}
+	column := func(name, typ, path string) map[string]any {
+		return map[string]any{"name": name, "type": typ, "jsonPath": path}
+	}
+	return Object{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata":   map[string]any{"name": Resource + "." + Group},
+		"spec": map[string]any{
+			"group": Group,
+			"scope": "Namespaced",
+			"names": map[string]any{
+				"kind":       Kind,
+				"listKind":   Kind + "List",
+				"plural":     Resource,
+				"singular":   strings.ToLower(Kind),
+				"shortNames": []any{"msc"},
+			},
+			"versions": []any{map[string]any{
+				"name":                     Version,
+				"served":                   true,
+				"storage":                  true,
+				"schema":                   map[string]any{"openAPIV3Schema": schema},
+				"subresources":             map[string]any{"status": map[string]any{}},
+				"additionalPrinterColumns": []any{column("Phase", "string", ".status.phase"), column("Running", "integer", ".status.running"), column("Events", "integer", ".status.eventsDispatched"), column("Age", "date", ".metadata.creationTimestamp")},
+			}},
+		},
+	}
+}
+
+// Render writes objects as a stream of YAML documents
+func Render(w io.Writer, objects []Object) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	for _, object := range objects {
+		if err := encoder.Encode(object); err != nil {
+			return err
+		}
+	}
+	return encoder.Close()
+}
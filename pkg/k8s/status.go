@@ -0,0 +1,97 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
+)
+
+// Phases of a program reported in its status
+const (
+	PhaseRunning = "Running"
+	PhaseStopped = "Stopped"
+)
+
+// DefaultStatusInterval is how often the status is reported by default
+const DefaultStatusInterval = 10 * time.Second
+
+// Status is the status of a MindScript resource
+type Status struct {
+	Phase string `json:"phase"`
+	// Running counts the agents that have not been stopped
+	Running          int           `json:"running"`
+	EventsDispatched int           `json:"eventsDispatched"`
+	LastUpdateTime   time.Time     `json:"lastUpdateTime"`
+	Agents           []AgentStatus `json:"agents"`
+}
+
+// AgentStatus is the status of an agent
+type AgentStatus struct {
+	Name        string `json:"name"`
+	Declaration string `json:"declaration"`
+	Stopped     bool   `json:"stopped"`
+	// Pending is the number of messages waiting in its mailbox
+	Pending int `json:"pending"`
+}
+
+// StatusOf returns the status of the agents of machine
+func StatusOf(machine *vm.VM, phase string) Status {
+	status := Status{
+		Phase:            phase,
+		EventsDispatched: machine.Metrics().EventsDispatched,
+		LastUpdateTime:   time.Now().UTC().Truncate(time.Second),
+		Agents:           []AgentStatus{},
+	}
+	for _, agent := range machine.Agents() {
+		if !agent.Stopped() {
+			status.Running++
+		}
+		status.Agents = append(status.Agents, AgentStatus{
+			Name:        agent.Name,
+			Declaration: agent.Declaration,
+			Stopped:     agent.Stopped(),
+			Pending:     agent.Pending(),
+		})
+	}
+	return status
+}
+
+// ReportStatus reports the status of machine's agents to a MindScript
+// resource every interval until ctx is done. Failed reports are logged and
+// retried at the next interval.
+func ReportStatus(ctx context.Context, client *Client, namespace, name string, machine *vm.VM, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultStatusInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := client.PatchStatus(ctx, namespace, name, StatusOf(machine, PhaseRunning)); err != nil && ctx.Err() == nil {
+			logger.Log.Warnw("Error reporting status to Kubernetes", zap.String("resource", namespace+"/"+name), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -43,18 +43,27 @@ const (
 	GT        TokenType = "GT"
 	LT        TokenType = "LT"
 	EQ        TokenType = "EQ"
+	NOT_EQ    TokenType = "NOT_EQ"
 	AND       TokenType = "AND"
 	OR        TokenType = "OR"
+	BANG      TokenType = "BANG"
 	AGENT     TokenType = "AGENT"
 	ON        TokenType = "ON"
 	VAR       TokenType = "VAR"
+	STATE     TokenType = "STATE"
 	RETURN    TokenType = "RETURN"
+	TRUE      TokenType = "TRUE"
+	FALSE     TokenType = "FALSE"
 
 	GOAL         TokenType = "GOAL"
 	CAPABILITIES TokenType = "CAPABILITIES"
+	SUPERVISION  TokenType = "SUPERVISION"
 	BEHAVIOR     TokenType = "BEHAVIOR"
 	FUNCTION     TokenType = "FUNCTION"
 	EOF          TokenType = "EOF"
+
+	// COMMENT is only used by the comments returned by Comments
+	COMMENT TokenType = "COMMENT"
 )
 
 // Data types
@@ -63,6 +72,7 @@ const (
 	INT    TokenType = "INT"
 	FLOAT  TokenType = "FLOAT"
 	BOOL   TokenType = "BOOL"
+	MAP    TokenType = "MAP"
 )
 
 // Store a list of keywords
@@ -70,15 +80,20 @@ var keywords = map[string]TokenType{
 	"agent":        AGENT,
 	"goal":         GOAL,
 	"capabilities": CAPABILITIES,
+	"supervision":  SUPERVISION,
 	"behavior":     BEHAVIOR,
 	"function":     FUNCTION,
 	"on":           ON,
 	"var":          VAR,
+	"state":        STATE,
 	"int":          INT,
 	"float":        FLOAT,
 	"string":       STRING,
 	"bool":         BOOL,
+	"map":          MAP,
 	"return":       RETURN,
+	"true":         TRUE,
+	"false":        FALSE,
 }
 
 type Token struct {
@@ -92,6 +107,8 @@ type Lexer struct {
 	position     int
 	readPosition int
 	ch           byte
+	// comments holds the line comments skipped so far, see Comments
+	comments []Token
 }
 
 // Line gets the line number of the provided token
@@ -151,15 +168,27 @@ func (l *Lexer) NextToken() Token {
 	case '/':
 		tok = Token{Type: SLASH, Literal: string(l.ch), Loc: l.position}
 	case '=':
-		tok = Token{Type: ASSIGN, Literal: string(l.ch), Loc: l.position}
+		if l.peekChar() == '=' {
+			tok = Token{Type: EQ, Literal: "==", Loc: l.position}
+			l.readChar()
+		} else {
+			tok = Token{Type: ASSIGN, Literal: string(l.ch), Loc: l.position}
+		}
 	case '>':
 		tok = Token{Type: GT, Literal: string(l.ch), Loc: l.position}
 	case '<':
 		tok = Token{Type: LT, Literal: string(l.ch), Loc: l.position}
 	case '&':
-		tok = Token{Type: AND, Literal: string(l.ch), Loc: l.position}
+		tok = l.readDoubleCharToken('&', AND)
 	case '|':
-		tok = Token{Type: OR, Literal: string(l.ch), Loc: l.position}
+		tok = l.readDoubleCharToken('|', OR)
+	case '!':
+		if l.peekChar() == '=' {
+			tok = Token{Type: NOT_EQ, Literal: "!=", Loc: l.position}
+			l.readChar()
+		} else {
+			tok = Token{Type: BANG, Literal: string(l.ch), Loc: l.position}
+		}
 	case '"':
 		tok.Type = STRING
 		tok.Literal = l.readString()
@@ -170,15 +199,8 @@ func (l *Lexer) NextToken() Token {
 		tok.Loc = l.position
 	default:
 		if isDigit(l.ch) {
-			if l.peekChar() == '.' {
-				tok.Literal = l.readFloat()
-				tok.Type = FLOAT
-				tok.Loc = l.position
-			} else {
-				tok.Literal = l.readInt()
-				tok.Type = INT
-				tok.Loc = l.position
-			}
+			tok.Literal, tok.Type = l.readNumber()
+			tok.Loc = l.position
 			return tok
 		} else if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
@@ -194,6 +216,17 @@ func (l *Lexer) NextToken() Token {
 	return tok
 }
 
+// readDoubleCharToken reads operators such as && and ||, where the
+// doubled form is canonical but a single character is still accepted
+func (l *Lexer) readDoubleCharToken(ch byte, tokType TokenType) Token {
+	tok := Token{Type: tokType, Literal: string(l.ch), Loc: l.position}
+	if l.peekChar() == ch {
+		l.readChar()
+		tok.Literal = string(ch) + string(ch)
+	}
+	return tok
+}
+
 func (l *Lexer) readString() string {
 	position := l.position + 1
 	for {
@@ -205,20 +238,21 @@ func (l *Lexer) readString() string {
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readInt() string {
+// readNumber reads an int, or a float when the digits are followed by a
+// decimal point and a fractional part
+func (l *Lexer) readNumber() (string, TokenType) {
 	position := l.position
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
-}
-
-func (l *Lexer) readFloat() string {
-	position := l.position
-	for isDigit(l.ch) || l.ch == '.' {
+	if l.ch != '.' || !isDigit(l.peekChar()) {
+		return l.input[position:l.position], INT
+	}
+	l.readChar()
+	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
+	return l.input[position:l.position], FLOAT
 }
 
 func (l *Lexer) readIdentifier() string {
@@ -229,10 +263,35 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
+// skipWhitespace skips whitespace and line comments, which run from // to
+// the end of the line
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	for {
+		switch {
+		case l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r':
+			l.readChar()
+		case l.ch == '/' && l.peekChar() == '/':
+			l.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+func (l *Lexer) skipComment() {
+	position := l.position
+	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
+	text := strings.TrimRight(l.input[position:l.position], " \t\r")
+	l.comments = append(l.comments, Token{Type: COMMENT, Literal: text, Loc: position})
+}
+
+// Comments returns the comments skipped so far in the order they appear.
+// They are not tokens of the program, msc fmt uses them to keep comments
+// when reprinting it.
+func (l *Lexer) Comments() []Token {
+	return l.comments
 }
 
 func isLetter(ch byte) bool {
@@ -257,5 +316,8 @@ func (l *Lexer) peekCharOffset(offset int) byte {
 
 // Helper to get prefix up to loc
 func (l *Lexer) Prefix(loc int) string {
+	if loc > len(l.input) {
+		loc = len(l.input)
+	}
 	return l.input[:loc]
 }
@@ -0,0 +1,109 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package llm
+
+import (
+	"context"
+	"fmt"
+)
+
+// Embedder turns texts into embedding vectors for similarity search
+type Embedder interface {
+	Embed(ctx context.Context, req EmbeddingRequest) (EmbeddingResponse, error)
+}
+
+// EmbeddingRequest holds the texts to embed
+type EmbeddingRequest struct {
+	Texts []string
+}
+
+// EmbeddingResponse holds a vector for every text of the request, in order
+type EmbeddingResponse struct {
+	Vectors [][]float64
+	Usage   Usage
+}
+
+// NewEmbedder returns the embedder of the provider selected by cfg. It
+// returns nil when cfg names no provider or the provider has no embeddings
+// API, which is the case for anthropic.
+func NewEmbedder(cfg Config) (Embedder, error) {
+	switch cfg.Provider {
+	case "", "anthropic":
+		return nil, nil
+	case "openai":
+		p, err := newOpenAI(cfg)
+		if err != nil {
+			return nil, err
+		}
+		p.cfg.EmbeddingModel = withDefault(cfg.EmbeddingModel, "text-embedding-3-small")
+		return p, nil
+	case "ollama":
+		p := newOllama(cfg)
+		p.cfg.EmbeddingModel = withDefault(cfg.EmbeddingModel, "nomic-embed-text")
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown llm provider %q, expected openai, anthropic or ollama", cfg.Provider)
+}
+
+func (p *openAI) Embed(ctx context.Context, req EmbeddingRequest) (EmbeddingResponse, error) {
+	body := struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}{p.cfg.EmbeddingModel, req.Texts}
+	var reply struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	headers := map[string]string{"Authorization": "Bearer " + p.cfg.APIKey}
+	if err := postJSON(ctx, p.client, p.cfg.BaseURL+"/v1/embeddings", headers, body, &reply); err != nil {
+		return EmbeddingResponse{}, err
+	}
+	if len(reply.Data) != len(req.Texts) {
+		return EmbeddingResponse{}, fmt.Errorf("openai returned %d embeddings for %d texts", len(reply.Data), len(req.Texts))
+	}
+	vectors := make([][]float64, len(req.Texts))
+	for _, item := range reply.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return EmbeddingResponse{}, fmt.Errorf("openai returned an embedding for unknown text %d", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	return EmbeddingResponse{Vectors: vectors, Usage: Usage{PromptTokens: reply.Usage.PromptTokens}}, nil
+}
+
+func (p *ollama) Embed(ctx context.Context, req EmbeddingRequest) (EmbeddingResponse, error) {
+	body := struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}{p.cfg.EmbeddingModel, req.Texts}
+	var reply struct {
+		Embeddings      [][]float64 `json:"embeddings"`
+		PromptEvalCount int         `json:"prompt_eval_count"`
+	}
+	if err := postJSON(ctx, p.client, p.cfg.BaseURL+"/api/embed", nil, body, &reply); err != nil {
+		return EmbeddingResponse{}, err
+	}
+	if len(reply.Embeddings) != len(req.Texts) {
+		return EmbeddingResponse{}, fmt.Errorf("ollama returned %d embeddings for %d texts", len(reply.Embeddings), len(req.Texts))
+	}
+	return EmbeddingResponse{Vectors: reply.Embeddings, Usage: Usage{PromptTokens: reply.PromptEvalCount}}, nil
+}
@@ -0,0 +1,177 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the llm package connects agents to language models through providers
+// such as OpenAI, Anthropic and Ollama
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+)
+
+// Provider completes prompts with a language model
+type Provider interface {
+	Complete(ctx context.Context, req Request) (Response, error)
+}
+
+// Request is a single prompt sent to a model
+type Request struct {
+	Prompt string
+	// MaxTokens limits the length of the completion, zero leaves it to the
+	// provider's configuration
+	MaxTokens int
+}
+
+// Response is a model's completion of a prompt
+type Response struct {
+	Text  string
+	Usage Usage
+}
+
+// Usage counts the tokens a request consumed
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Config selects and configures a provider
+type Config struct {
+	// Provider is openai, anthropic or ollama
+	Provider string
+	Model    string
+	// BaseURL overrides the provider's default endpoint, such as for
+	// OpenAI compatible servers
+	BaseURL string
+	APIKey  string
+	// MaxTokens is the default completion limit
+	MaxTokens int
+	// EmbeddingModel is the model used by the provider's Embedder
+	EmbeddingModel string
+}
+
+// Environment variables read by ConfigFromEnv
+const (
+	EnvProvider       = "MINDSCRIPT_LLM_PROVIDER"
+	EnvModel          = "MINDSCRIPT_LLM_MODEL"
+	EnvBaseURL        = "MINDSCRIPT_LLM_URL"
+	EnvMaxTokens      = "MINDSCRIPT_LLM_MAX_TOKENS"
+	EnvEmbeddingModel = "MINDSCRIPT_EMBEDDING_MODEL"
+)
+
+// ConfigFromEnv reads the configuration of provider from the environment.
+// When provider is empty it is read from MINDSCRIPT_LLM_PROVIDER, or picked
+// by the API key that is set, ANTHROPIC_API_KEY or OPENAI_API_KEY. Ollama's
+// endpoint can also be set with OLLAMA_HOST.
+func ConfigFromEnv(provider string) (Config, error) {
+	cfg := Config{
+		Provider:       withDefault(provider, os.Getenv(EnvProvider)),
+		Model:          os.Getenv(EnvModel),
+		BaseURL:        os.Getenv(EnvBaseURL),
+		EmbeddingModel: os.Getenv(EnvEmbeddingModel),
+	}
+	if cfg.Provider == "" {
+		switch {
+		case os.Getenv("ANTHROPIC_API_KEY") != "":
+			cfg.Provider = "anthropic"
+		case os.Getenv("OPENAI_API_KEY") != "":
+			cfg.Provider = "openai"
+		}
+	}
+	switch cfg.Provider {
+	case "anthropic":
+		cfg.APIKey = os.Getenv("ANTHROPIC_API_KEY")
+	case "openai":
+		cfg.APIKey = os.Getenv("OPENAI_API_KEY")
+	case "ollama":
+		if cfg.BaseURL == "" {
+			cfg.BaseURL = os.Getenv("OLLAMA_HOST")
+		}
+	}
+	if value := os.Getenv(EnvMaxTokens); value != "" {
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", EnvMaxTokens, err)
+		}
+		cfg.MaxTokens = maxTokens
+	}
+	return cfg, nil
+}
+
+// New returns the provider selected by cfg, or nil when cfg names none
+func New(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case "openai":
+		return newOpenAI(cfg)
+	case "anthropic":
+		return newAnthropic(cfg)
+	case "ollama":
+		return newOllama(cfg), nil
+	}
+	return nil, fmt.Errorf("unknown llm provider %q, expected openai, anthropic or ollama", cfg.Provider)
+}
+
+// postJSON sends body to url and decodes the JSON reply into out. Replies
+// with an error status are returned as errors including the reply's text.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(req.Header, tracing.SpanContextFromContext(ctx))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// maxResponseSize bounds the replies read from providers
+const maxResponseSize = 16 << 20
+
+func withDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,180 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// openAI talks to the chat completions API of OpenAI and compatible servers
+type openAI struct {
+	cfg    Config
+	client *http.Client
+}
+
+func newOpenAI(cfg Config) (*openAI, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("openai provider needs an API key, set OPENAI_API_KEY")
+	}
+	cfg.BaseURL = strings.TrimSuffix(withDefault(cfg.BaseURL, "https://api.openai.com"), "/")
+	cfg.Model = withDefault(cfg.Model, "gpt-4o-mini")
+	return &openAI{cfg: cfg, client: http.DefaultClient}, nil
+}
+
+func (p *openAI) Complete(ctx context.Context, req Request) (Response, error) {
+	body := struct {
+		Model     string    `json:"model"`
+		Messages  []message `json:"messages"`
+		MaxTokens int       `json:"max_tokens,omitempty"`
+	}{p.cfg.Model, []message{{Role: "user", Content: req.Prompt}}, maxTokens(req, p.cfg)}
+	var reply struct {
+		Choices []struct {
+			Message message `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	headers := map[string]string{"Authorization": "Bearer " + p.cfg.APIKey}
+	if err := postJSON(ctx, p.client, p.cfg.BaseURL+"/v1/chat/completions", headers, body, &reply); err != nil {
+		return Response{}, err
+	}
+	if len(reply.Choices) == 0 {
+		return Response{}, errors.New("openai returned no choices")
+	}
+	return Response{
+		Text:  reply.Choices[0].Message.Content,
+		Usage: Usage{PromptTokens: reply.Usage.PromptTokens, CompletionTokens: reply.Usage.CompletionTokens},
+	}, nil
+}
+
+// anthropic talks to Anthropic's messages API
+type anthropic struct {
+	cfg    Config
+	client *http.Client
+}
+
+func newAnthropic(cfg Config) (*anthropic, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("anthropic provider needs an API key, set ANTHROPIC_API_KEY")
+	}
+	cfg.BaseURL = strings.TrimSuffix(withDefault(cfg.BaseURL, "https://api.anthropic.com"), "/")
+	cfg.Model = withDefault(cfg.Model, "claude-3-5-haiku-latest")
+	return &anthropic{cfg: cfg, client: http.DefaultClient}, nil
+}
+
+// anthropicMaxTokens is used when no limit is configured, the messages API
+// requires one
+const anthropicMaxTokens = 1024
+
+func (p *anthropic) Complete(ctx context.Context, req Request) (Response, error) {
+	limit := maxTokens(req, p.cfg)
+	if limit == 0 {
+		limit = anthropicMaxTokens
+	}
+	body := struct {
+		Model     string    `json:"model"`
+		MaxTokens int       `json:"max_tokens"`
+		Messages  []message `json:"messages"`
+	}{p.cfg.Model, limit, []message{{Role: "user", Content: req.Prompt}}}
+	var reply struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	headers := map[string]string{
+		"x-api-key":         p.cfg.APIKey,
+		"anthropic-version": "2023-06-01",
+	}
+	if err := postJSON(ctx, p.client, p.cfg.BaseURL+"/v1/messages", headers, body, &reply); err != nil {
+		return Response{}, err
+	}
+	var text strings.Builder
+	for _, block := range reply.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return Response{
+		Text:  text.String(),
+		Usage: Usage{PromptTokens: reply.Usage.InputTokens, CompletionTokens: reply.Usage.OutputTokens},
+	}, nil
+}
+
+// ollama talks to the generate API of a local Ollama server
+type ollama struct {
+	cfg    Config
+	client *http.Client
+}
+
+func newOllama(cfg Config) *ollama {
+	baseURL := withDefault(cfg.BaseURL, "http://localhost:11434")
+	if !strings.Contains(baseURL, "://") {
+		// OLLAMA_HOST is commonly set without a scheme
+		baseURL = "http://" + baseURL
+	}
+	cfg.BaseURL = strings.TrimSuffix(baseURL, "/")
+	cfg.Model = withDefault(cfg.Model, "llama3")
+	return &ollama{cfg: cfg, client: http.DefaultClient}
+}
+
+func (p *ollama) Complete(ctx context.Context, req Request) (Response, error) {
+	type options struct {
+		NumPredict int `json:"num_predict,omitempty"`
+	}
+	body := struct {
+		Model   string  `json:"model"`
+		Prompt  string  `json:"prompt"`
+		Stream  bool    `json:"stream"`
+		Options options `json:"options"`
+	}{p.cfg.Model, req.Prompt, false, options{NumPredict: maxTokens(req, p.cfg)}}
+	var reply struct {
+		Response        string `json:"response"`
+		PromptEvalCount int    `json:"prompt_eval_count"`
+		EvalCount       int    `json:"eval_count"`
+	}
+	if err := postJSON(ctx, p.client, p.cfg.BaseURL+"/api/generate", nil, body, &reply); err != nil {
+		return Response{}, err
+	}
+	return Response{
+		Text:  reply.Response,
+		Usage: Usage{PromptTokens: reply.PromptEvalCount, CompletionTokens: reply.EvalCount},
+	}, nil
+}
+
+// maxTokens returns the request's completion limit, falling back to the
+// configured one
+func maxTokens(req Request, cfg Config) int {
+	if req.MaxTokens > 0 {
+		return req.MaxTokens
+	}
+	return cfg.MaxTokens
+}
@@ -17,18 +17,73 @@
 package logger
 
 import (
+	"fmt"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var Log *zap.SugaredLogger
+// Log discards everything until Init is called, so packages can be used as a
+// library without configuring logging first
+var Log = zap.NewNop().Sugar()
+
+// level is the level of the logger built by Init, SetLevel changes it
+var level = zap.NewAtomicLevel()
+
+// Formats of the entries written by the logger built by Init
+const (
+	// FormatJSON writes an object per line, for log collectors
+	FormatJSON = "json"
+	// FormatConsole writes tab separated fields for people to read
+	FormatConsole = "console"
+)
+
+// Option configures the logger built by Init
+type Option func(*zap.Config)
+
+// WithFormat writes entries in a format other than FormatJSON
+func WithFormat(format string) Option {
+	return func(config *zap.Config) {
+		config.Encoding = format
+		if format == FormatConsole {
+			config.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+			config.DisableStacktrace = true
+		}
+	}
+}
 
-func Init(level zapcore.Level) {
+// WithFile appends entries to a file instead of writing them to stderr,
+// where they would mix with a program's error output
+func WithFile(path string) Option {
+	return func(config *zap.Config) {
+		config.OutputPaths = []string{path}
+	}
+}
+
+// Init builds the logger, which writes JSON entries to stderr unless opts
+// say otherwise. Programs write to stdout, so their output is never mixed
+// with the logs.
+func Init(l zapcore.Level, opts ...Option) error {
 	config := zap.NewProductionConfig()
-	config.Level = zap.NewAtomicLevelAt(level)
-	logger, err := config.Build()
+	level.SetLevel(l)
+	config.Level = level
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.Encoding != FormatJSON && config.Encoding != FormatConsole {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", config.Encoding, FormatJSON, FormatConsole)
+	}
+	// Errors are mostly those of the programs and commands msc is given,
+	// stacktraces pointing into msc are kept for panics
+	logger, err := config.Build(zap.AddStacktrace(zapcore.DPanicLevel))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	Log = logger.Sugar()
+	return nil
+}
+
+// SetLevel changes the level of the logger built by Init while it is in use
+func SetLevel(l zapcore.Level) {
+	level.SetLevel(l)
 }
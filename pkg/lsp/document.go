@@ -0,0 +1,215 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/robert-cronin/mindscript-go/pkg/format"
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/semantic"
+)
+
+// semanticLine matches the line semantic errors start with
+var semanticLine = regexp.MustCompile(`^line (\d+): `)
+
+// document is the text of an open document split into lines. Positions in
+// diagnostics and symbols cover whole lines, the lexer does not record
+// where tokens start.
+type document struct {
+	text  string
+	lines []string
+}
+
+func newDocument(text string) *document {
+	return &document{text: text, lines: strings.Split(text, "\n")}
+}
+
+// lineRange returns the range from the start of line first to the end of
+// line last, both zero-based
+func (d *document) lineRange(first, last int) Range {
+	first = max(0, min(first, len(d.lines)-1))
+	last = max(first, min(last, len(d.lines)-1))
+	line := strings.TrimSuffix(d.lines[last], "\r")
+	return Range{
+		Start: Position{Line: first},
+		End:   Position{Line: last, Character: len(utf16.Encode([]rune(line)))},
+	}
+}
+
+// line returns the zero-based line of an offset in the text
+func (d *document) line(loc int) int {
+	return strings.Count(d.text[:max(0, min(loc, len(d.text)))], "\n")
+}
+
+// parse parses the document, the program is nil if the parser panicked
+func (d *document) parse() (program *parser.Program, l *lexer.Lexer, p *parser.Parser) {
+	defer func() {
+		if recover() != nil {
+			program = nil
+		}
+	}()
+	l = lexer.New(d.text)
+	p = parser.New(l)
+	return p.ParseProgram(), l, p
+}
+
+// diagnose returns the parse errors of the document or, when it parses,
+// the first semantic error
+func (d *document) diagnose() (diagnostics []Diagnostic) {
+	diagnostics = []Diagnostic{}
+	program, l, p := d.parse()
+	if len(p.Errors()) > 0 {
+		for i, msg := range p.Errors() {
+			line := l.Line(p.ErrorTokens()[i]) - 1
+			diagnostics = append(diagnostics, d.diagnostic(line, msg))
+		}
+		return diagnostics
+	}
+	if program == nil {
+		return append(diagnostics, d.diagnostic(0, "the parser failed on this document"))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			diagnostics = []Diagnostic{d.diagnostic(0, fmt.Sprintf("the analysis failed on this document: %v", r))}
+		}
+	}()
+	if err := semantic.NewSymbolTable(l).Analyse(program); err != nil {
+		msg, line := err.Error(), 0
+		if m := semanticLine.FindStringSubmatch(msg); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			msg, line = msg[len(m[0]):], n-1
+		}
+		diagnostics = append(diagnostics, d.diagnostic(line, msg))
+	}
+	return diagnostics
+}
+
+func (d *document) diagnostic(line int, msg string) Diagnostic {
+	return Diagnostic{Range: d.lineRange(line, line), Severity: severityError, Source: "msc", Message: msg}
+}
+
+// format returns the edit formatting the document, none if it already is
+func (d *document) format() ([]TextEdit, error) {
+	formatted, err := format.Source([]byte(d.text))
+	if err != nil {
+		return nil, err
+	}
+	if string(formatted) == d.text {
+		return []TextEdit{}, nil
+	}
+	return []TextEdit{{Range: d.lineRange(0, len(d.lines)-1), NewText: string(formatted)}}, nil
+}
+
+// symbols returns the agents, functions and variables declared at the top
+// level with the members of agents, as far as the document parses
+func (d *document) symbols() []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	program, _, _ := d.parse()
+	if program == nil {
+		return symbols
+	}
+	for _, stmt := range program.Statements {
+		switch stmt := stmt.(type) {
+		case *parser.AgentStatement:
+			if stmt.Name == nil {
+				continue
+			}
+			agent := d.symbol(stmt.Name.Value, symbolClass, stmt.Token.Loc, stmt.Rbrace, stmt.Name.Token.Loc)
+			if stmt.Goal != nil {
+				agent.Detail = stmt.Goal.Value
+			}
+			for _, state := range stmt.State {
+				if symbol, ok := d.variable(state, symbolField); ok {
+					agent.Children = append(agent.Children, symbol)
+				}
+			}
+			for _, behavior := range stmt.Behaviors {
+				for _, handler := range behavior.EventHandlers {
+					if handler.Event == nil || handler.Event.Name == nil || handler.BlockStatement == nil {
+						continue
+					}
+					name := strconv.Quote(handler.Event.Name.Value)
+					agent.Children = append(agent.Children, d.symbol("on "+name, symbolEvent, handler.Token.Loc, handler.BlockStatement.Rbrace, handler.Token.Loc))
+				}
+			}
+			for _, function := range stmt.Functions {
+				if symbol, ok := d.function(function, symbolMethod); ok {
+					agent.Children = append(agent.Children, symbol)
+				}
+			}
+			symbols = append(symbols, agent)
+		case *parser.Function:
+			if symbol, ok := d.function(stmt, symbolFunction); ok {
+				symbols = append(symbols, symbol)
+			}
+		case *parser.VarStatement:
+			if symbol, ok := d.variable(stmt, symbolVariable); ok {
+				symbols = append(symbols, symbol)
+			}
+		}
+	}
+	return symbols
+}
+
+// symbol returns a symbol spanning the lines from start to end, selected
+// on the line of name
+func (d *document) symbol(label string, kind, start, end, name int) DocumentSymbol {
+	first, last := d.line(start), d.line(end)
+	selected := max(first, min(d.line(name), last))
+	return DocumentSymbol{
+		Name:           label,
+		Kind:           kind,
+		Range:          d.lineRange(first, last),
+		SelectionRange: d.lineRange(selected, selected),
+	}
+}
+
+func (d *document) function(function *parser.Function, kind int) (DocumentSymbol, bool) {
+	if function.Name == nil || function.Body == nil {
+		return DocumentSymbol{}, false
+	}
+	symbol := d.symbol(function.Name.Value, kind, function.Token.Loc, function.Body.Rbrace, function.Name.Token.Loc)
+	arguments := make([]string, 0, len(function.Arguments))
+	for _, arg := range function.Arguments {
+		if arg.Name != nil && arg.Type != nil {
+			arguments = append(arguments, arg.Name.Value+": "+arg.Type.Token.Literal)
+		}
+	}
+	symbol.Detail = "(" + strings.Join(arguments, ", ") + ")"
+	if function.ReturnType != nil {
+		symbol.Detail += ": " + function.ReturnType.Token.Literal
+	}
+	return symbol, true
+}
+
+func (d *document) variable(stmt *parser.VarStatement, kind int) (DocumentSymbol, bool) {
+	if stmt.Name == nil {
+		return DocumentSymbol{}, false
+	}
+	symbol := d.symbol(stmt.Name.Value, kind, stmt.Token.Loc, stmt.Token.Loc, stmt.Token.Loc)
+	if stmt.Type != nil {
+		symbol.Detail = stmt.Type.Token.Literal
+	}
+	return symbol, true
+}
@@ -0,0 +1,194 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the lsp package is a language server for MindScript speaking the
+// Language Server Protocol. It reports the parse and semantic errors of the
+// documents open in an editor as diagnostics, formats them like msc fmt and
+// lists their agents, functions and variables as symbols.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// ErrNoShutdown is returned by Serve when the client asks the server to
+// exit without shutting it down first, which should make it exit with an
+// error
+var ErrNoShutdown = errors.New("exit without shutdown")
+
+// Server answers a single client. Documents are synchronised in full and
+// analysed again on every change.
+type Server struct {
+	w           io.Writer
+	documents   map[string]*document
+	initialized bool
+	shutdown    bool
+}
+
+// NewServer returns a server without open documents
+func NewServer() *Server {
+	return &Server{documents: make(map[string]*document)}
+}
+
+// Serve answers the messages read from r on w until the client asks the
+// server to exit or r ends
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.w = w
+	br := bufio.NewReaderSize(r, 64<<10)
+	for {
+		data, err := readMessage(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			if err := s.fail(json.RawMessage("null"), codeParseError, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return ErrNoShutdown
+			}
+			return nil
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers a message, only the errors of writing to the client are
+// returned
+func (s *Server) handle(msg message) error {
+	isRequest := len(msg.ID) > 0
+	switch {
+	case msg.Method == "":
+		if isRequest {
+			return s.fail(msg.ID, codeInvalidRequest, "request has no method")
+		}
+		return nil
+	case !s.initialized && msg.Method != "initialize":
+		if isRequest {
+			return s.fail(msg.ID, codeServerNotInitialized, "server not initialized")
+		}
+		return nil
+	case s.shutdown:
+		if isRequest {
+			return s.fail(msg.ID, codeInvalidRequest, "server is shut down")
+		}
+		return nil
+	}
+
+	logger.Log.Debugw("Language server message", zap.String("method", msg.Method))
+	switch msg.Method {
+	case "initialize":
+		s.initialized = true
+		return s.reply(msg.ID, map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":           map[string]any{"openClose": true, "change": 1},
+				"documentFormattingProvider": true,
+				"documentSymbolProvider":     true,
+			},
+			"serverInfo": map[string]any{"name": "msc", "version": "0.1.0"},
+		})
+	case "shutdown":
+		s.shutdown = true
+		return s.reply(msg.ID, nil)
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil
+		}
+		s.documents[params.TextDocument.URI] = newDocument(params.TextDocument.Text)
+		return s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params.ContentChanges) == 0 {
+			return nil
+		}
+		// Changes hold the full text since the server asks for full sync
+		text := params.ContentChanges[len(params.ContentChanges)-1].Text
+		s.documents[params.TextDocument.URI] = newDocument(text)
+		return s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didClose":
+		var params documentParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+	case "textDocument/formatting":
+		doc, err := s.document(msg.Params)
+		if err != nil {
+			return s.fail(msg.ID, codeInvalidParams, err.Error())
+		}
+		edits, err := doc.format()
+		if err != nil {
+			return s.fail(msg.ID, codeRequestFailed, err.Error())
+		}
+		return s.reply(msg.ID, edits)
+	case "textDocument/documentSymbol":
+		doc, err := s.document(msg.Params)
+		if err != nil {
+			return s.fail(msg.ID, codeInvalidParams, err.Error())
+		}
+		return s.reply(msg.ID, doc.symbols())
+	}
+	if isRequest {
+		return s.fail(msg.ID, codeMethodNotFound, "method not found: "+msg.Method)
+	}
+	return nil
+}
+
+// document returns the open document a request is about
+func (s *Server) document(params json.RawMessage) (*document, error) {
+	var p documentParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	doc, ok := s.documents[p.TextDocument.URI]
+	if !ok {
+		return nil, errors.New("document is not open: " + p.TextDocument.URI)
+	}
+	return doc, nil
+}
+
+func (s *Server) publishDiagnostics(uri string) error {
+	return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: s.documents[uri].diagnose()})
+}
+
+func (s *Server) reply(id json.RawMessage, result any) error {
+	return writeMessage(s.w, response{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *Server) fail(id json.RawMessage, code int, message string) error {
+	return writeMessage(s.w, errorResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: message}})
+}
+
+func (s *Server) notify(method string, params any) error {
+	return writeMessage(s.w, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
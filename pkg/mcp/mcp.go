@@ -0,0 +1,220 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the mcp package speaks the Model Context Protocol. Its client calls the
+// tools of MCP servers started as commands talking over stdio or reached
+// over HTTP, its server offers the functions of a program's agents as tools.
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ProtocolVersion is the MCP revision the client speaks
+const ProtocolVersion = "2025-03-26"
+
+// ErrToolFailed is returned when a tool reports that its call failed
+var ErrToolFailed = errors.New("tool failed")
+
+// Tool describes a tool offered by a server
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"inputSchema,omitempty"`
+}
+
+// transport exchanges JSON-RPC messages with a server
+type transport interface {
+	// call sends a request and returns the result of its response, or sends
+	// a notification when id is zero
+	call(ctx context.Context, id int64, method string, params any) (json.RawMessage, error)
+	close() error
+}
+
+// Client talks to a single MCP server. Calls are serialised and the
+// connection is initialised by the first of them.
+type Client struct {
+	transport   transport
+	mu          sync.Mutex
+	nextID      int64
+	initialized bool
+}
+
+// New returns a client for the server described by spec: an http or https
+// URL of a server using the streamable HTTP transport, or the command line
+// of a server talking over stdio, which is started by the first call
+func New(spec string) (*Client, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return &Client{transport: newHTTPTransport(spec)}, nil
+	}
+	args := strings.Fields(spec)
+	if len(args) == 0 {
+		return nil, errors.New("mcp server has no command")
+	}
+	return &Client{transport: newStdioTransport(args)}, nil
+}
+
+// ParseServer parses a server of the form name=spec, spec being as for New
+func ParseServer(server string) (string, *Client, error) {
+	name, spec, ok := strings.Cut(server, "=")
+	if !ok || name == "" {
+		return "", nil, fmt.Errorf("mcp server %q is not name=command or name=url", server)
+	}
+	client, err := New(spec)
+	if err != nil {
+		return "", nil, fmt.Errorf("mcp server %s: %w", name, err)
+	}
+	return name, client, nil
+}
+
+// request sends a request, initialising the connection first if needed.
+// The caller holds c.mu.
+func (c *Client) request(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	if !c.initialized {
+		if err := c.initialize(ctx); err != nil {
+			return nil, fmt.Errorf("initialize: %w", err)
+		}
+	}
+	c.nextID++
+	return c.transport.call(ctx, c.nextID, method, params)
+}
+
+func (c *Client) initialize(ctx context.Context) error {
+	params := map[string]any{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "msc", "version": "0.1.0"},
+	}
+	c.nextID++
+	if _, err := c.transport.call(ctx, c.nextID, "initialize", params); err != nil {
+		return err
+	}
+	if _, err := c.transport.call(ctx, 0, "notifications/initialized", nil); err != nil {
+		return err
+	}
+	c.initialized = true
+	return nil
+}
+
+// ListTools returns the tools offered by the server
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, err := c.request(ctx, "tools/list", map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		Tools []Tool `json:"tools"`
+	}
+	if err := json.Unmarshal(result, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Tools, nil
+}
+
+// CallTool calls a tool with args, which must encode as a JSON object, and
+// returns the tool's result. A result flagged as an error is returned as
+// an error wrapping ErrToolFailed with the text the tool returned.
+func (c *Client) CallTool(ctx context.Context, tool string, args any) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if args == nil {
+		args = map[string]any{}
+	}
+	result, err := c.request(ctx, "tools/call", map[string]any{"name": tool, "arguments": args})
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		IsError bool `json:"isError"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(result, &reply); err != nil {
+		return nil, err
+	}
+	if reply.IsError {
+		var texts []string
+		for _, content := range reply.Content {
+			if content.Type == "text" {
+				texts = append(texts, content.Text)
+			}
+		}
+		return nil, fmt.Errorf("%w: %s: %s", ErrToolFailed, tool, strings.Join(texts, "\n"))
+	}
+	return result, nil
+}
+
+// Close stops the server's command or ends the HTTP session
+func (c *Client) Close() error {
+	return c.transport.close()
+}
+
+// message is a JSON-RPC 2.0 request, notification or response
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  any             `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+func newMessage(id int64, method string, params any) message {
+	msg := message{JSONRPC: "2.0", Method: method, Params: params}
+	if id != 0 {
+		msg.ID = &id
+	}
+	return msg
+}
+
+// incoming is a message received from a server, requests from the server
+// carry both an id and a method
+type incoming struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *rpcError       `json:"error,omitempty"`
+}
+
+// response returns the result of msg if it responds to the request id
+func (msg incoming) response(id int64) (json.RawMessage, bool, error) {
+	if msg.Method != "" || string(msg.ID) != fmt.Sprint(id) {
+		return nil, false, nil
+	}
+	if msg.Error != nil {
+		return nil, true, msg.Error
+	}
+	return msg.Result, true, nil
+}
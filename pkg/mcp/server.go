@@ -0,0 +1,412 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
+)
+
+// JSON-RPC error codes returned by the server
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+)
+
+// Server exposes the functions declared in a program's agents as MCP
+// tools, over stdio with ServeStdio or the streamable HTTP transport as an
+// http.Handler. Tools are named after their function and take its
+// arguments, their schema follows the arguments' declared types. The server
+// keeps no sessions.
+type Server struct {
+	machine *vm.VM
+	origins []string
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithAllowedOrigins lets web pages on these origins make HTTP requests.
+// Requests with any other Origin header are refused, so that pages cannot
+// reach a server on the visitor's machine, by DNS rebinding or otherwise.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) {
+		s.origins = append(s.origins, origins...)
+	}
+}
+
+// NewServer returns a server calling the functions of machine's agents
+func NewServer(machine *vm.VM, opts ...Option) *Server {
+	s := &Server{machine: machine}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Tools returns the tools the server offers
+func (s *Server) Tools() []Tool {
+	var tools []Tool
+	for _, function := range s.machine.AgentFunctions() {
+		description := fmt.Sprintf("Function %s of the MindScript agent %s", function.Name, function.Agent)
+		if function.Goal != "" {
+			description += ", whose goal is: " + function.Goal
+		}
+		schema, _ := json.Marshal(inputSchema(function.Function))
+		tools = append(tools, Tool{Name: function.Name, Description: description, InputSchema: schema})
+	}
+	return tools
+}
+
+// inputSchema returns the JSON schema of a function's arguments, all of
+// which are required
+func inputSchema(function vm.Function) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	for _, argument := range function.Arguments {
+		properties[argument.Name] = typeSchema(argument.Type)
+		required = append(required, argument.Name)
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
+
+// typeSchema returns the JSON schema of a MindScript type, arguments of
+// unknown types accept any value
+func typeSchema(typ string) map[string]any {
+	switch typ {
+	case "int":
+		return map[string]any{"type": "integer"}
+	case "float":
+		return map[string]any{"type": "number"}
+	case "string":
+		return map[string]any{"type": "string"}
+	case "bool":
+		return map[string]any{"type": "boolean"}
+	case "map":
+		return map[string]any{"type": "object"}
+	case "agent":
+		return map[string]any{"type": "string", "description": "name of an agent"}
+	}
+	return map[string]any{}
+}
+
+// request is a JSON-RPC request or notification received by the server
+type request struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// response answers a request
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// handle answers a message, returning nil for notifications
+func (s *Server) handle(data []byte) *response {
+	var req request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return &response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: codeParseError, Message: err.Error()}}
+	}
+	if len(req.ID) == 0 {
+		return nil
+	}
+	resp := &response{JSONRPC: "2.0", ID: req.ID}
+	var err *rpcError
+	switch req.Method {
+	case "initialize":
+		resp.Result = map[string]any{
+			"protocolVersion": ProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "msc", "version": "0.1.0"},
+		}
+	case "ping":
+		resp.Result = struct{}{}
+	case "tools/list":
+		tools := s.Tools()
+		if tools == nil {
+			tools = []Tool{}
+		}
+		resp.Result = map[string]any{"tools": tools}
+	case "tools/call":
+		resp.Result, err = s.callTool(req.Params)
+	case "":
+		err = &rpcError{Code: codeInvalidRequest, Message: "request has no method"}
+	default:
+		err = &rpcError{Code: codeMethodNotFound, Message: "method not found: " + req.Method}
+	}
+	if err != nil {
+		resp.Result, resp.Error = nil, err
+	}
+	return resp
+}
+
+// callTool calls the function of a tool, which runs as the agent declaring
+// it and needs that agent's capabilities. Arguments that do not fit the
+// function and runtime errors are reported in the result so that the
+// client's model can see them.
+func (s *Server) callTool(params json.RawMessage) (any, *rpcError) {
+	var call struct {
+		Name      string                     `json:"name"`
+		Arguments map[string]json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &call); err != nil {
+		return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	var function *vm.AgentFunction
+	for _, f := range s.machine.AgentFunctions() {
+		if f.Name == call.Name {
+			function = &f
+			break
+		}
+	}
+	if function == nil {
+		return nil, &rpcError{Code: codeInvalidParams, Message: "unknown tool: " + call.Name}
+	}
+
+	args, err := s.arguments(function.Function, call.Arguments)
+	if err != nil {
+		return toolResult(err.Error(), true), nil
+	}
+	logger.Log.Debugw("Calling agent function for an MCP client", zap.String("agent", function.Agent), zap.String("function", function.Name))
+	result, err := s.machine.CallFunction(function.Name, args...)
+	if err != nil {
+		return toolResult(err.Error(), true), nil
+	}
+	return toolResult(resultText(result), false), nil
+}
+
+// arguments converts the arguments of a tool call to those of its function
+func (s *Server) arguments(function vm.Function, raw map[string]json.RawMessage) ([]any, error) {
+	if len(function.Arguments) != function.Arity {
+		return nil, fmt.Errorf("the arguments of %s are unknown", function.Name)
+	}
+	args := make([]any, len(function.Arguments))
+	for i, argument := range function.Arguments {
+		data, ok := raw[argument.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing argument %s", argument.Name)
+		}
+		value, err := vm.ParseJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", argument.Name, err)
+		}
+		if args[i], err = s.convert(argument.Type, value); err != nil {
+			return nil, fmt.Errorf("argument %s: %w", argument.Name, err)
+		}
+	}
+	return args, nil
+}
+
+// convert checks that a value has the declared type of an argument. Ints
+// are accepted as floats and agents are given by name.
+func (s *Server) convert(typ string, value vm.Value) (vm.Value, error) {
+	ok := true
+	switch typ {
+	case "int":
+		_, ok = value.(int)
+	case "float":
+		if i, isInt := value.(int); isInt {
+			value = float64(i)
+		}
+		_, ok = value.(float64)
+	case "string":
+		_, ok = value.(string)
+	case "bool":
+		_, ok = value.(bool)
+	case "map":
+		_, ok = value.(*vm.Map)
+	case "agent":
+		name, isString := value.(string)
+		agent, found := s.machine.Agent(name)
+		if !isString || !found {
+			return nil, fmt.Errorf("no agent named %v", value)
+		}
+		value = agent
+	}
+	if !ok {
+		return nil, fmt.Errorf("expected %s, got %s", typ, jsonType(value))
+	}
+	return value, nil
+}
+
+func jsonType(value vm.Value) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case int, float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case *vm.List:
+		return "array"
+	case *vm.Map:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// resultText returns the text content of a function's result: strings as
+// they are, agents by name and anything else as JSON
+func resultText(result vm.Value) string {
+	switch r := result.(type) {
+	case string:
+		return r
+	case *vm.Agent:
+		return r.Name
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Sprint(result)
+	}
+	return string(data)
+}
+
+func toolResult(text string, isError bool) map[string]any {
+	return map[string]any{
+		"content": []map[string]any{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
+
+// ServeStdio answers the messages read from r, one per line, on w until r
+// ends or ctx is done
+func (s *Server) ServeStdio(ctx context.Context, r io.Reader, w io.Writer) error {
+	lines := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		br := bufio.NewReaderSize(r, 64<<10)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				select {
+				case lines <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					errs <- err
+				}
+				return
+			}
+		}
+	}()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				select {
+				case err := <-errs:
+					return err
+				default:
+					return nil
+				}
+			}
+			if resp := s.handle(line); resp != nil {
+				if err := encoder.Encode(resp); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// ServeHTTP implements the streamable HTTP transport. Every POST is
+// answered with a JSON response, the server never streams nor sends
+// requests of its own so GET is not supported. Requests from origins that
+// are not allowed are forbidden, as the transport requires.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && !s.allowedOrigin(origin) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data = bytes.TrimSpace(data)
+
+	var reply any
+	if strings.HasPrefix(string(data), "[") {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			reply = s.handle(data)
+		} else {
+			var responses []*response
+			for _, msg := range batch {
+				if resp := s.handle(msg); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				reply = responses
+			}
+		}
+	} else if resp := s.handle(data); resp != nil {
+		reply = resp
+	}
+
+	if reply == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (s *Server) allowedOrigin(origin string) bool {
+	for _, allowed := range s.origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
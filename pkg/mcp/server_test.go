@@ -0,0 +1,106 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mcp
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/robert-cronin/mindscript-go/pkg/codegen"
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/semantic"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+)
+
+const toolsSource = `
+agent Reader {
+    goal: "Read the environment";
+    capabilities: ["env"];
+
+    function greeting(): string {
+        return env("MSC_MCP_TEST");
+    }
+}
+
+agent Locked {
+    goal: "Read nothing";
+    capabilities: [];
+
+    function peek(): string {
+        return env("MSC_MCP_TEST");
+    }
+}
+`
+
+// runTools compiles and runs source and returns an MCP server for it
+func runTools(t *testing.T, source string) *Server {
+	t.Helper()
+	l := lexer.New(source)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %s", strings.Join(p.Errors(), "; "))
+	}
+	st := semantic.NewSymbolTable(nil)
+	if err := st.Extend(program, l); err != nil {
+		t.Fatalf("semantic error: %v", err)
+	}
+	machine := vm.New(codegen.GenerateBytecode(program, st), vm.WithPolicy(vm.Policy{AllowEnv: true}))
+	if err := machine.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	return NewServer(machine)
+}
+
+// callTool calls a tool without arguments and returns the text and error
+// flag of its result
+func callTool(t *testing.T, s *Server, name string) (string, bool) {
+	t.Helper()
+	params, _ := json.Marshal(map[string]any{"name": name})
+	result, rpcErr := s.callTool(params)
+	if rpcErr != nil {
+		t.Fatalf("tools/call %s: %s", name, rpcErr.Message)
+	}
+	data, _ := json.Marshal(result)
+	var decoded struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil || len(decoded.Content) != 1 {
+		t.Fatalf("unexpected tool result %s", data)
+	}
+	return decoded.Content[0].Text, decoded.IsError
+}
+
+func TestCallToolChecksCapabilities(t *testing.T) {
+	t.Setenv("MSC_MCP_TEST", "hello")
+	s := runTools(t, toolsSource)
+
+	text, isError := callTool(t, s, "greeting")
+	if isError || text != "hello" {
+		t.Errorf("greeting: got %q (error %v), want hello", text, isError)
+	}
+
+	text, isError = callTool(t, s, "peek")
+	if !isError || !strings.Contains(text, `agent Locked needs the "env" capability`) {
+		t.Errorf("peek: got %q (error %v), want a capability error", text, isError)
+	}
+}
@@ -0,0 +1,276 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+)
+
+// maxMessageSize bounds the messages read from servers
+const maxMessageSize = 16 << 20
+
+// closeGracePeriod is how long a server command may take to exit once it
+// is closed
+const closeGracePeriod = 5 * time.Second
+
+// stdioTransport talks to a server command over its stdin and stdout, one
+// message per line
+type stdioTransport struct {
+	args     []string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	messages chan []byte
+	readErr  error
+}
+
+func newStdioTransport(args []string) *stdioTransport {
+	return &stdioTransport{args: args}
+}
+
+func (t *stdioTransport) start() error {
+	cmd := exec.Command(t.args[0], t.args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	t.cmd, t.stdin = cmd, stdin
+	t.messages = make(chan []byte)
+	go func() {
+		r := bufio.NewReaderSize(stdout, 64<<10)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				t.messages <- line
+			}
+			if err != nil {
+				t.readErr = err
+				close(t.messages)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *stdioTransport) call(ctx context.Context, id int64, method string, params any) (json.RawMessage, error) {
+	if t.cmd == nil {
+		if err := t.start(); err != nil {
+			return nil, fmt.Errorf("starting %s: %w", t.args[0], err)
+		}
+	}
+	if err := t.write(newMessage(id, method, params)); err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return nil, nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case line, ok := <-t.messages:
+			if !ok {
+				return nil, fmt.Errorf("server exited: %w", t.readErr)
+			}
+			var msg incoming
+			if err := json.Unmarshal(line, &msg); err != nil {
+				continue
+			}
+			if msg.Method != "" && len(msg.ID) > 0 {
+				if err := t.answer(msg); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if result, ok, err := msg.response(id); ok {
+				return result, err
+			}
+		}
+	}
+}
+
+// answer responds to a request of the server, only pings are supported
+func (t *stdioTransport) answer(req incoming) error {
+	reply := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+	if req.Method == "ping" {
+		reply["result"] = map[string]any{}
+	} else {
+		reply["error"] = rpcError{Code: -32601, Message: "method not found"}
+	}
+	return t.write(reply)
+}
+
+func (t *stdioTransport) write(msg any) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = t.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (t *stdioTransport) close() error {
+	if t.cmd == nil {
+		return nil
+	}
+	// Servers exit once their input is closed, those that do not are
+	// killed after a grace period
+	t.stdin.Close()
+	drained := make(chan struct{})
+	go func() {
+		for range t.messages {
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(closeGracePeriod):
+		t.cmd.Process.Kill()
+		<-drained
+	}
+	err := t.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil
+	}
+	return err
+}
+
+// httpTransport talks to a server with the streamable HTTP transport
+type httpTransport struct {
+	url     string
+	client  *http.Client
+	session string
+}
+
+func newHTTPTransport(url string) *httpTransport {
+	return &httpTransport{url: url, client: http.DefaultClient}
+}
+
+func (t *httpTransport) call(ctx context.Context, id int64, method string, params any) (json.RawMessage, error) {
+	data, err := json.Marshal(newMessage(id, method, params))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("MCP-Protocol-Version", ProtocolVersion)
+	tracing.Inject(req.Header, tracing.SpanContextFromContext(ctx))
+	if t.session != "" {
+		req.Header.Set("Mcp-Session-Id", t.session)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if session := resp.Header.Get("Mcp-Session-Id"); session != "" {
+		t.session = session
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if id == 0 {
+		return nil, nil
+	}
+	body := io.LimitReader(resp.Body, maxMessageSize)
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return readEventStream(body, id)
+	}
+	var msg incoming
+	if err := json.NewDecoder(body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	result, ok, err := msg.response(id)
+	if !ok {
+		return nil, errors.New("server did not respond to the request")
+	}
+	return result, err
+}
+
+// readEventStream reads server-sent events until the response to request
+// id arrives
+func readEventStream(r io.Reader, id int64) (json.RawMessage, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxMessageSize)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var msg incoming
+		err := json.Unmarshal([]byte(data.String()), &msg)
+		data.Reset()
+		if err != nil {
+			continue
+		}
+		if result, ok, err := msg.response(id); ok {
+			return result, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("event stream ended without a response")
+}
+
+func (t *httpTransport) close() error {
+	if t.session == "" {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodDelete, t.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Mcp-Session-Id", t.session)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -72,8 +72,14 @@ type AgentStatement struct {
 	Name         *Identifier   `json:"name"`
 	Goal         *Goal         `json:"goal"`
 	Capabilities *Capabilities `json:"capabilities"`
-	Behaviors    []*Behavior   `json:"behaviors"`
-	Functions    []*Function   `json:"functions"`
+	Supervision  *Supervision  `json:"supervision"`
+	// State holds the agent's state variables, which keep their values
+	// between events
+	State     []*VarStatement `json:"state"`
+	Behaviors []*Behavior     `json:"behaviors"`
+	Functions []*Function     `json:"functions"`
+	// Rbrace is the position of the closing brace
+	Rbrace int `json:"rbrace"`
 }
 
 func (a *AgentStatement) statementNode() {}
@@ -86,6 +92,15 @@ type Goal struct {
 
 func (g *Goal) expressionNode() {}
 
+// Supervision represents how the agent recovers from failing handlers, such
+// as "restart max=3"
+type Supervision struct {
+	BaseNode
+	Value string `json:"value"`
+}
+
+func (s *Supervision) expressionNode() {}
+
 // Capabilities represents the agent's capabilities
 type Capabilities struct {
 	BaseNode
@@ -104,6 +119,8 @@ func (e *Event) expressionNode() {}
 type Behavior struct {
 	BaseNode
 	EventHandlers []*EventHandler `json:"event_handlers"`
+	// Rbrace is the position of the closing brace
+	Rbrace int `json:"rbrace"`
 }
 
 func (b *Behavior) expressionNode() {}
@@ -111,8 +128,10 @@ func (b *Behavior) expressionNode() {}
 // EventHandler represents an event handler in a behavior block
 type EventHandler struct {
 	BaseNode
-	Event          *Event          `json:"event"`
-	BlockStatement *BlockStatement `json:"block_statement"`
+	Event *Event `json:"event"`
+	// Arguments optionally declares a parameter receiving the event payload
+	Arguments      []*FunctionArgument `json:"arguments,omitempty"`
+	BlockStatement *BlockStatement     `json:"block_statement"`
 }
 
 // FunctionArgument represents a function argument
@@ -145,6 +164,8 @@ func (rs *ReturnStatement) statementNode() {}
 type BlockStatement struct {
 	BaseNode
 	Statements map[int]*Statement `json:"statements"`
+	// Rbrace is the position of the closing brace
+	Rbrace int `json:"rbrace"`
 }
 
 func (bs *BlockStatement) statementNode() {}
@@ -160,12 +181,27 @@ type VarStatement struct {
 
 func (vs *VarStatement) statementNode() {}
 
+// AssignStatement represents an assignment to a declared variable
+type AssignStatement struct {
+	BaseNode
+	Name  *Identifier `json:"name"`
+	Value *Expression `json:"value"`
+}
+
+func (as *AssignStatement) statementNode() {}
+
 // DataType represents a data type
 type DataType struct {
 	BaseNode
 	Token lexer.Token `json:"token"`
 }
 
+// TokenLiteral returns the type name, DataType keeps its own token rather
+// than the one embedded through BaseNode
+func (dt *DataType) TokenLiteral() string {
+	return dt.Token.Literal
+}
+
 // IdentifierLiteral represents an identifier literal
 type IdentifierLiteral struct {
 	BaseNode
@@ -206,6 +242,24 @@ type BooleanLiteral struct {
 
 func (b *BooleanLiteral) expressionNode() {}
 
+// ListLiteral represents a list like ["-l", path]
+type ListLiteral struct {
+	BaseNode
+	Elements []*Expression `json:"elements"`
+}
+
+func (ll *ListLiteral) expressionNode() {}
+
+// MapLiteral represents a map like {"timeoutMs": 500}, Keys and Values hold
+// its entries in order
+type MapLiteral struct {
+	BaseNode
+	Keys   []*Expression `json:"keys"`
+	Values []*Expression `json:"values"`
+}
+
+func (ml *MapLiteral) expressionNode() {}
+
 // InfixExpression represents binary operations like 42 * 7
 type InfixExpression struct {
 	BaseNode
@@ -216,6 +270,24 @@ type InfixExpression struct {
 
 func (ie *InfixExpression) expressionNode() {}
 
+// PrefixExpression represents unary operations like !ready
+type PrefixExpression struct {
+	BaseNode
+	Operator *lexer.Token `json:"operator"`
+	Right    *Expression  `json:"right"`
+}
+
+func (pe *PrefixExpression) expressionNode() {}
+
+// IndexExpression represents an index operation like name[0]
+type IndexExpression struct {
+	BaseNode
+	Left  *Expression `json:"left"`
+	Index *Expression `json:"index"`
+}
+
+func (ie *IndexExpression) expressionNode() {}
+
 // CallExpression represents a function call
 type CallExpression struct {
 	BaseNode
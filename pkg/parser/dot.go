@@ -0,0 +1,143 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+)
+
+var (
+	tokenType      = reflect.TypeOf(lexer.Token{})
+	identifierType = reflect.TypeOf(&Identifier{})
+)
+
+// WriteDot renders the syntax tree of program in the DOT language of
+// Graphviz. Nodes are labelled with their type followed by their name,
+// value or operator, edges with the field holding the child.
+func WriteDot(w io.Writer, program *Program) error {
+	d := &dotWriter{w: bufio.NewWriter(w)}
+	fmt.Fprintln(d.w, "digraph ast {")
+	fmt.Fprintln(d.w, "\tnode [shape=box];")
+	d.node(reflect.ValueOf(program))
+	fmt.Fprintln(d.w, "}")
+	return d.w.Flush()
+}
+
+type dotWriter struct {
+	w     *bufio.Writer
+	nodes int
+}
+
+// node writes a node and its subtree and returns its id, or -1 for nil
+func (d *dotWriter) node(v reflect.Value) int {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return -1
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return -1
+	}
+
+	id := d.nodes
+	d.nodes++
+	label := v.Type().Name()
+	if detail := dotDetail(v); detail != "" {
+		label += " " + detail
+	}
+	fmt.Fprintf(d.w, "\tn%d [label=%s];\n", id, strconv.Quote(label))
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		// Embedded fields are BaseNode and unset interfaces, names are
+		// part of the label
+		if field.Anonymous || field.Type == tokenType || field.Type == identifierType {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		d.children(id, name, v.Field(i))
+	}
+	return id
+}
+
+// children writes the nodes held by a field with edges from the node id
+func (d *dotWriter) children(id int, name string, v reflect.Value) {
+	edge := func(label string, child reflect.Value) {
+		if childID := d.node(child); childID >= 0 {
+			fmt.Fprintf(d.w, "\tn%d -> n%d [label=%s];\n", id, childID, strconv.Quote(label))
+		}
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			edge(fmt.Sprintf("%s[%d]", name, i), v.Index(i))
+		}
+	case reflect.Map:
+		// Block statements are keyed by their position
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Int() < keys[j].Int() })
+		for _, key := range keys {
+			edge(fmt.Sprintf("%s[%d]", name, key.Int()), v.MapIndex(key))
+		}
+	case reflect.Pointer, reflect.Interface:
+		if v.Type().Elem() != tokenType {
+			edge(name, v)
+		}
+	}
+}
+
+// dotDetail returns what distinguishes a node from others of its type
+func dotDetail(v reflect.Value) string {
+	var details []string
+	switch node := v.Interface().(type) {
+	case DataType:
+		return node.Token.Literal
+	case IdentifierLiteral:
+		return node.Value
+	case Capabilities:
+		for _, value := range node.Values {
+			details = append(details, strconv.Quote(value))
+		}
+		return strings.Join(details, " ")
+	}
+	if f := v.FieldByName("Name"); f.IsValid() && f.Type() == identifierType && !f.IsNil() {
+		details = append(details, f.Elem().FieldByName("Value").String())
+	}
+	if f := v.FieldByName("Operator"); f.IsValid() && f.Type() == reflect.PointerTo(tokenType) && !f.IsNil() {
+		details = append(details, f.Elem().FieldByName("Literal").String())
+	}
+	switch f := v.FieldByName("Value"); {
+	case !f.IsValid():
+	case f.Kind() == reflect.String:
+		details = append(details, strconv.Quote(f.String()))
+	case f.Kind() == reflect.Int64, f.Kind() == reflect.Float64, f.Kind() == reflect.Bool:
+		details = append(details, fmt.Sprint(f.Interface()))
+	}
+	return strings.Join(details, " ")
+}
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/robert-cronin/mindscript-go/pkg/lexer"
 	"github.com/robert-cronin/mindscript-go/pkg/logger"
@@ -33,6 +34,8 @@ type Parser struct {
 	peekToken lexer.Token
 
 	errors []string
+	// errorTokens holds the token each error was found at
+	errorTokens []lexer.Token
 }
 
 func New(l *lexer.Lexer) *Parser {
@@ -53,14 +56,25 @@ func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// ErrorTokens returns the tokens at which the errors returned by Errors
+// were found, in the same order
+func (p *Parser) ErrorTokens() []lexer.Token {
+	return p.errorTokens
+}
+
 func (p *Parser) addError(msg string) {
+	p.addErrorAt(p.curToken, msg)
+}
+
+func (p *Parser) addErrorAt(tok lexer.Token, msg string) {
 	p.errors = append(p.errors, msg)
+	p.errorTokens = append(p.errorTokens, tok)
 }
 
 func (p *Parser) peekError(expectedType lexer.TokenType) {
 	msg := fmt.Sprintf("Expected next token to be %s, got %s instead",
 		expectedType, p.peekToken.Type)
-	p.addError(msg)
+	p.addErrorAt(p.peekToken, msg)
 }
 
 func (p *Parser) nextToken() {
@@ -89,13 +103,18 @@ func (p *Parser) parseStatement() Statement {
 		// TODO: make err handling like this everywhere else
 		agent, err := p.parseAgentStatement()
 		if err != nil {
-			logger.Log.Error("Error parsing agent statement", zap.Error(err))
+			logger.Log.Errorw("Error parsing agent statement", zap.Error(err))
 			return nil
 		}
 		return agent
 	case lexer.VAR:
 		return p.parseVarStatement()
 	case lexer.IDENT:
+		if p.peekTokenIs(lexer.ASSIGN) {
+			return p.parseAssignStatement()
+		}
+		return p.parseExpressionStatement()
+	case lexer.INT, lexer.FLOAT, lexer.STRING, lexer.BOOL, lexer.MAP, lexer.TRUE, lexer.FALSE, lexer.BANG, lexer.LPAREN, lexer.LBRACKET, lexer.LBRACE:
 		return p.parseExpressionStatement()
 	case lexer.RETURN:
 		return p.parseReturnStatement()
@@ -135,11 +154,18 @@ Loop:
 			stmt.Goal = p.parseGoal()
 		case lexer.CAPABILITIES:
 			stmt.Capabilities = p.parseCapabilities()
+		case lexer.SUPERVISION:
+			stmt.Supervision = p.parseSupervision()
+		case lexer.STATE:
+			if state := p.parseVarStatement(); state != nil {
+				stmt.State = append(stmt.State, state)
+			}
 		case lexer.BEHAVIOR:
 			stmt.Behaviors = append(stmt.Behaviors, p.parseBehavior())
 		case lexer.FUNCTION:
 			stmt.Functions = append(stmt.Functions, p.parseFunction())
 		case lexer.RBRACE:
+			stmt.Rbrace = p.curToken.Loc
 			break Loop
 		}
 	}
@@ -164,6 +190,23 @@ func (p *Parser) parseGoal() *Goal {
 	return goal
 }
 
+func (p *Parser) parseSupervision() *Supervision {
+	supervision := &Supervision{}
+	supervision.Token = p.curToken
+
+	if !p.expectPeek(lexer.COLON) {
+		return nil
+	}
+
+	if !p.expectPeek(lexer.STRING) {
+		return nil
+	}
+
+	supervision.Value = p.curToken.Literal
+
+	return supervision
+}
+
 func (p *Parser) parseCapabilities() *Capabilities {
 	capabilities := &Capabilities{}
 	capabilities.Token = p.curToken
@@ -210,6 +253,7 @@ Loop:
 		case lexer.ON:
 			behavior.EventHandlers = append(behavior.EventHandlers, p.parseEventHandler())
 		case lexer.RBRACE:
+			behavior.Rbrace = p.curToken.Loc
 			break Loop
 		default:
 			logger.Log.Error("Error parsing behavior")
@@ -233,6 +277,15 @@ func (p *Parser) parseEventHandler() *EventHandler {
 	eventHandler.Event.Name.Token = p.curToken
 	eventHandler.Event.Name.Value = p.curToken.Literal
 
+	if p.peekTokenIs(lexer.LPAREN) {
+		p.nextToken()
+		eventHandler.Arguments = p.parseFunctionArguments()
+		if len(eventHandler.Arguments) > 1 {
+			p.addError(fmt.Sprintf("event handler for %q takes at most 1 argument, the payload", eventHandler.Event.Name.Value))
+			return nil
+		}
+	}
+
 	if !p.expectPeek(lexer.LBRACE) {
 		logger.Log.Error("Error parsing event handler")
 		return nil
@@ -265,7 +318,7 @@ func (p *Parser) parseFunction() *Function {
 		return nil
 	}
 
-	function.ReturnType = p.parseReturnDataType()
+	function.ReturnType = p.parseDataType()
 
 	if !p.expectPeek(lexer.LBRACE) {
 		return nil
@@ -304,20 +357,45 @@ func (p *Parser) parseVarStatement() *VarStatement {
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
 
+	if p.peekTokenIs(lexer.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseAssignStatement() *AssignStatement {
+	stmt := &AssignStatement{}
+	stmt.Token = p.curToken
+	stmt.Name = &Identifier{}
+	stmt.Name.Token = p.curToken
+	stmt.Name.Value = p.curToken.Literal
+
+	p.nextToken()
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(lexer.SEMICOLON) {
+		p.nextToken()
+	}
+
 	return stmt
 }
 
+// parseDataType parses the type of a variable, argument or function. list
+// and any are not keywords so that they can still name variables.
 func (p *Parser) parseDataType() *DataType {
 	dataType := &DataType{}
 
-	switch p.peekToken.Type {
-	case lexer.INT, lexer.FLOAT, lexer.STRING, lexer.BOOL:
-		p.nextToken()
-		dataType.Token = p.curToken
+	switch {
+	case p.peekTokenIs(lexer.INT), p.peekTokenIs(lexer.FLOAT), p.peekTokenIs(lexer.STRING), p.peekTokenIs(lexer.BOOL), p.peekTokenIs(lexer.MAP), p.peekTokenIs(lexer.AGENT):
+	case p.peekTokenIs(lexer.IDENT) && (p.peekToken.Literal == "list" || p.peekToken.Literal == "any"):
 	default:
-		logger.Log.Error("Error parsing data type")
+		p.addErrorAt(p.peekToken, fmt.Sprintf("Expected a data type, got %s instead", p.peekToken.Literal))
 		return nil
 	}
+	p.nextToken()
+	dataType.Token = p.curToken
 
 	return dataType
 }
@@ -387,6 +465,7 @@ func (p *Parser) parseBlockStatement() *BlockStatement {
 		}
 		p.nextToken()
 	}
+	block.Rbrace = p.curToken.Loc
 
 	return block
 }
@@ -394,23 +473,38 @@ func (p *Parser) parseBlockStatement() *BlockStatement {
 const (
 	_ int = iota
 	LOWEST
-	SUM     // + or -
-	PRODUCT // * or /
-	PREFIX  // -X or !X
-	CALL    // myFunction(X)
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
+	EQUALS      // == or !=
+	LESSGREATER // > or <
+	SUM         // + or -
+	PRODUCT     // * or /
+	PREFIX      // -X or !X
+	CALL        // myFunction(X)
+	INDEX       // array[index]
 )
 
 var precedences = map[lexer.TokenType]int{
+	lexer.OR:       LOGICAL_OR,
+	lexer.AND:      LOGICAL_AND,
+	lexer.EQ:       EQUALS,
+	lexer.NOT_EQ:   EQUALS,
+	lexer.LT:       LESSGREATER,
+	lexer.GT:       LESSGREATER,
 	lexer.PLUS:     SUM,
 	lexer.MINUS:    SUM,
 	lexer.ASTERISK: PRODUCT,
 	lexer.SLASH:    PRODUCT,
 	lexer.LPAREN:   CALL,
+	lexer.LBRACKET: INDEX,
 }
 
 func (p *Parser) parseExpression(precedence int) *Expression {
 	var leftExp Expression
 
+	if p.isConversionCall() {
+		p.curToken.Type = lexer.IDENT
+	}
 	switch p.curToken.Type {
 	case lexer.IDENT:
 		leftExp = p.parseIdentifier()
@@ -420,8 +514,21 @@ func (p *Parser) parseExpression(precedence int) *Expression {
 		leftExp = p.parseFloatLiteral()
 	case lexer.STRING:
 		leftExp = p.parseStringLiteral()
-	case lexer.BOOL:
+	case lexer.TRUE, lexer.FALSE:
 		leftExp = p.parseBooleanLiteral()
+	case lexer.BANG:
+		leftExp = p.parsePrefixExpression()
+	case lexer.LBRACKET:
+		leftExp = p.parseListLiteral()
+	case lexer.LBRACE:
+		leftExp = p.parseMapLiteral()
+	case lexer.LPAREN:
+		// A group is the left operand of whatever follows it, as in (a + b) * c
+		group := p.parseGroupedExpression()
+		if group == nil {
+			return nil
+		}
+		leftExp = *group
 	default:
 		// Check first if its a function call
 		if p.peekToken.Type != lexer.LPAREN {
@@ -431,12 +538,15 @@ func (p *Parser) parseExpression(precedence int) *Expression {
 
 	for !p.peekTokenIs(lexer.SEMICOLON) && precedence < p.peekPrecedence() {
 		switch p.peekToken.Type {
-		case lexer.PLUS, lexer.MINUS, lexer.ASTERISK, lexer.SLASH:
+		case lexer.PLUS, lexer.MINUS, lexer.ASTERISK, lexer.SLASH, lexer.AND, lexer.OR, lexer.EQ, lexer.NOT_EQ, lexer.LT, lexer.GT:
 			p.nextToken()
 			leftExp = p.parseInfixExpression(leftExp)
 		case lexer.LPAREN:
 			p.nextToken()
 			leftExp = p.parseCallExpression(leftExp)
+		case lexer.LBRACKET:
+			p.nextToken()
+			leftExp = p.parseIndexExpression(leftExp)
 		default:
 			return &leftExp
 		}
@@ -445,26 +555,115 @@ func (p *Parser) parseExpression(precedence int) *Expression {
 	return &leftExp
 }
 
+// isConversionCall reports whether the current token is a type keyword
+// called like a function, such as int(x). The conversion builtins are named
+// after the types they convert to, and map(list, fn) after what it does.
+func (p *Parser) isConversionCall() bool {
+	switch p.curToken.Type {
+	case lexer.INT, lexer.FLOAT, lexer.STRING, lexer.BOOL, lexer.MAP:
+	default:
+		return false
+	}
+	return p.curToken.Literal == strings.ToLower(string(p.curToken.Type)) && p.peekTokenIs(lexer.LPAREN)
+}
+
 func (p *Parser) parseInfixExpression(left Expression) Expression {
+	operator := p.curToken
 	expression := &InfixExpression{
 		BaseNode: BaseNode{Token: p.curToken},
 		Left:     &left,
-		Operator: &p.curToken,
+		Operator: &operator,
 	}
 
 	precedence := p.curPrecedence()
 	p.nextToken()
 	expression.Right = p.parseExpression(precedence)
+	if expression.Right == nil {
+		p.addErrorAt(operator, fmt.Sprintf("Expected an expression after %s", operator.Literal))
+	}
+
+	return expression
+}
+
+func (p *Parser) parsePrefixExpression() Expression {
+	operator := p.curToken
+	expression := &PrefixExpression{
+		BaseNode: BaseNode{Token: p.curToken},
+		Operator: &operator,
+	}
+
+	p.nextToken()
+	expression.Right = p.parseExpression(PREFIX)
+	if expression.Right == nil {
+		p.addErrorAt(operator, fmt.Sprintf("Expected an expression after %s", operator.Literal))
+	}
 
 	return expression
 }
 
+func (p *Parser) parseGroupedExpression() *Expression {
+	p.nextToken()
+
+	exp := p.parseExpression(LOWEST)
+
+	if !p.expectPeek(lexer.RPAREN) {
+		return nil
+	}
+
+	return exp
+}
+
 func (p *Parser) parseCallExpression(function Expression) Expression {
 	exp := &CallExpression{BaseNode: BaseNode{Token: p.curToken}, Function: &function}
 	exp.Arguments = p.parseExpressionList(lexer.RPAREN)
 	return exp
 }
 
+func (p *Parser) parseIndexExpression(left Expression) Expression {
+	exp := &IndexExpression{BaseNode: BaseNode{Token: p.curToken}, Left: &left}
+
+	p.nextToken()
+	exp.Index = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(lexer.RBRACKET) {
+		return nil
+	}
+
+	return exp
+}
+
+func (p *Parser) parseListLiteral() Expression {
+	list := &ListLiteral{BaseNode: BaseNode{Token: p.curToken}}
+	list.Elements = p.parseExpressionList(lexer.RBRACKET)
+	return list
+}
+
+func (p *Parser) parseMapLiteral() Expression {
+	m := &MapLiteral{BaseNode: BaseNode{Token: p.curToken}}
+
+	for !p.peekTokenIs(lexer.RBRACE) {
+		p.nextToken()
+		key := p.parseExpression(LOWEST)
+		if !p.expectPeek(lexer.COLON) {
+			return nil
+		}
+		p.nextToken()
+		value := p.parseExpression(LOWEST)
+		m.Keys = append(m.Keys, key)
+		m.Values = append(m.Values, value)
+
+		if !p.peekTokenIs(lexer.RBRACE) && !p.expectPeek(lexer.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(lexer.RBRACE) {
+		return nil
+	}
+
+	return m
+}
+
 func (p *Parser) parseExpressionList(end lexer.TokenType) []*Expression {
 	list := []*Expression{}
 
@@ -502,7 +701,7 @@ func (p *Parser) parseIntegerLiteral() *IntegerLiteral {
 
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
-		logger.Log.Error("Error parsing integer literal", zap.Error(err))
+		logger.Log.Errorw("Error parsing integer literal", zap.Error(err))
 		return nil
 	}
 
@@ -516,7 +715,7 @@ func (p *Parser) parseFloatLiteral() *FloatLiteral {
 
 	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
 	if err != nil {
-		logger.Log.Error("Error parsing float literal", zap.Error(err))
+		logger.Log.Errorw("Error parsing float literal", zap.Error(err))
 		return nil
 	}
 
@@ -540,7 +739,7 @@ func (p *Parser) parseBooleanLiteral() *BooleanLiteral {
 
 	value, err := strconv.ParseBool(p.curToken.Literal)
 	if err != nil {
-		logger.Log.Error("Error parsing boolean literal", zap.Error(err))
+		logger.Log.Errorw("Error parsing boolean literal", zap.Error(err))
 		return nil
 	}
 
@@ -562,21 +761,6 @@ func (p *Parser) parseExpressionStatement() *ExpressionStatement {
 	return stmt
 }
 
-func (p *Parser) parseReturnDataType() *DataType {
-	dataType := &DataType{}
-
-	switch p.peekToken.Type {
-	case lexer.INT, lexer.FLOAT, lexer.STRING, lexer.BOOL:
-		p.nextToken()
-		dataType.Token = p.curToken
-	default:
-		logger.Log.Error("Error parsing return data type")
-		return nil
-	}
-
-	return dataType
-}
-
 func (p *Parser) parseReturnStatement() *ReturnStatement {
 	stmt := &ReturnStatement{}
 	stmt.Token = p.curToken
@@ -0,0 +1,95 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+)
+
+// render writes an expression with every operation in parentheses
+func render(expr Expression) string {
+	switch e := expr.(type) {
+	case *IntegerLiteral:
+		return fmt.Sprint(e.Value)
+	case *BooleanLiteral:
+		return fmt.Sprint(e.Value)
+	case *IdentifierLiteral:
+		return e.Value
+	case *PrefixExpression:
+		return "(" + e.Operator.Literal + render(*e.Right) + ")"
+	case *InfixExpression:
+		return "(" + render(*e.Left) + " " + e.Operator.Literal + " " + render(*e.Right) + ")"
+	}
+	return fmt.Sprintf("<%T>", expr)
+}
+
+func TestGroupedExpressions(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"(true || false) && false", "((true || false) && false)"},
+		{"((1 + 2)) - (3 - 4)", "((1 + 2) - (3 - 4))"},
+		{"!(a && b) || c", "((!(a && b)) || c)"},
+		{"(a)", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			p := New(lexer.New("var x: bool = " + tt.source + ";"))
+			program := p.ParseProgram()
+			if len(p.Errors()) != 0 {
+				t.Fatalf("parser errors: %s", strings.Join(p.Errors(), "; "))
+			}
+			if len(program.Statements) != 1 {
+				t.Fatalf("got %d statements, want 1", len(program.Statements))
+			}
+			stmt, ok := program.Statements[0].(*VarStatement)
+			if !ok || stmt.Value == nil {
+				t.Fatalf("got %T, want a var statement with a value", program.Statements[0])
+			}
+			if got := render(*stmt.Value); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataTypes(t *testing.T) {
+	for _, typ := range []string{"int", "float", "string", "bool", "map", "agent", "list", "any"} {
+		p := New(lexer.New("var x: " + typ + " = y;"))
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Fatalf("%s: parser errors: %s", typ, strings.Join(p.Errors(), "; "))
+		}
+		stmt, ok := program.Statements[0].(*VarStatement)
+		if !ok || stmt.Type.TokenLiteral() != typ {
+			t.Errorf("%s: got %#v", typ, program.Statements[0])
+		}
+	}
+
+	p := New(lexer.New("var x: lst = [1];"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 {
+		t.Errorf("unknown type lst was accepted")
+	}
+}
@@ -0,0 +1,218 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the pprof package writes profiles in the gzipped protocol buffer format
+// of pprof, so that go tool pprof and other viewers read the profiles of
+// MindScript programs
+package pprof
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"time"
+)
+
+// ValueType names a value of the samples and its unit, such as
+// instructions/count or cpu/nanoseconds
+type ValueType struct {
+	Type string
+	Unit string
+}
+
+// Profile accumulates samples, each a stack of function names and values.
+// Samples of the same stack are added together.
+type Profile struct {
+	sampleTypes []ValueType
+	start       time.Time
+	duration    time.Duration
+	// filename is reported as the file of every function
+	filename string
+
+	strings   []string
+	stringIDs map[string]int64
+	functions map[string]uint64
+	samples   map[string]*sample
+	// order keeps the samples in the order they were first added
+	order []string
+}
+
+type sample struct {
+	locations []uint64
+	values    []int64
+}
+
+// New returns an empty profile of samples holding a value of each type,
+// started now
+func New(filename string, sampleTypes ...ValueType) *Profile {
+	p := &Profile{
+		sampleTypes: sampleTypes,
+		start:       time.Now(),
+		filename:    filename,
+		stringIDs:   make(map[string]int64),
+		functions:   make(map[string]uint64),
+		samples:     make(map[string]*sample),
+	}
+	// The string table starts with the empty string
+	p.str("")
+	return p
+}
+
+// Add adds values to the sample of a stack, listed from the outermost
+// function to the one executing
+func (p *Profile) Add(stack []string, values ...int64) {
+	key := strings.Join(stack, "\x00")
+	s, ok := p.samples[key]
+	if !ok {
+		s = &sample{values: make([]int64, len(p.sampleTypes))}
+		// pprof lists the executing function first
+		for i := len(stack) - 1; i >= 0; i-- {
+			s.locations = append(s.locations, p.function(stack[i]))
+		}
+		p.samples[key] = s
+		p.order = append(p.order, key)
+	}
+	for i, value := range values {
+		s.values[i] += value
+	}
+}
+
+// SetDuration records how long the profiled program ran
+func (p *Profile) SetDuration(d time.Duration) {
+	p.duration = d
+}
+
+func (p *Profile) str(s string) int64 {
+	id, ok := p.stringIDs[s]
+	if !ok {
+		id = int64(len(p.strings))
+		p.strings = append(p.strings, s)
+		p.stringIDs[s] = id
+	}
+	return id
+}
+
+// function returns the id of a function, which is also the id of its only
+// location
+func (p *Profile) function(name string) uint64 {
+	id, ok := p.functions[name]
+	if !ok {
+		id = uint64(len(p.functions) + 1)
+		p.functions[name] = id
+	}
+	return id
+}
+
+// WriteTo writes the profile gzipped
+func (p *Profile) WriteTo(w io.Writer) (int64, error) {
+	var b buffer
+	for _, t := range p.sampleTypes {
+		b.message(1, valueType(p, t))
+	}
+	for _, key := range p.order {
+		s := p.samples[key]
+		var m buffer
+		m.packed(1, s.locations)
+		values := make([]uint64, len(s.values))
+		for i, v := range s.values {
+			values[i] = uint64(v)
+		}
+		m.packed(2, values)
+		b.message(2, m)
+	}
+	names := make([]string, len(p.functions))
+	for name, id := range p.functions {
+		names[id-1] = name
+	}
+	for i := range names {
+		id := uint64(i + 1)
+		var line buffer
+		line.uint(1, id)
+		var location buffer
+		location.uint(1, id)
+		location.message(4, line)
+		b.message(4, location)
+	}
+	filename := p.str(p.filename)
+	for i, name := range names {
+		var function buffer
+		function.uint(1, uint64(i+1))
+		function.uint(2, uint64(p.str(name)))
+		function.uint(3, uint64(p.str(name)))
+		function.uint(4, uint64(filename))
+		b.message(5, function)
+	}
+	// Strings are interned while encoding the rest, so they come last
+	for _, s := range p.strings {
+		b.bytes(6, []byte(s))
+	}
+	b.uint(9, uint64(p.start.UnixNano()))
+	b.uint(10, uint64(p.duration.Nanoseconds()))
+
+	gz := gzip.NewWriter(w)
+	n, err := gz.Write(b)
+	if err != nil {
+		return int64(n), err
+	}
+	return int64(n), gz.Close()
+}
+
+func valueType(p *Profile, t ValueType) buffer {
+	var b buffer
+	b.uint(1, uint64(p.str(t.Type)))
+	b.uint(2, uint64(p.str(t.Unit)))
+	return b
+}
+
+// buffer encodes protocol buffer fields, only those profile.proto uses
+type buffer []byte
+
+func (b *buffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+// uint writes a varint field, left out when zero like proto3 does
+func (b *buffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+// bytes writes a length delimited field
+func (b *buffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *buffer) message(field int, m buffer) {
+	b.bytes(field, m)
+}
+
+// packed writes a packed repeated varint field
+func (b *buffer) packed(field int, values []uint64) {
+	var m buffer
+	for _, v := range values {
+		m.varint(v)
+	}
+	b.bytes(field, m)
+}
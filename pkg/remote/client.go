@@ -0,0 +1,253 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultTimeout limits the calls made to peers
+const DefaultTimeout = 10 * time.Second
+
+// Client calls the agents of a single process
+type Client struct {
+	addr string
+	conn *grpc.ClientConn
+}
+
+// Dial returns a client for the process listening on addr. The connection
+// is made lazily by the first call.
+func Dial(addr string) (*Client, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{addr: addr, conn: conn}, nil
+}
+
+// Emit delivers an event to the named agent of the process, or to all of
+// its agents when agent is empty
+func (c *Client) Emit(ctx context.Context, agent, event string, payload vm.Value) error {
+	req, err := newEmitRequest(ctx, agent, event, payload)
+	if err != nil {
+		return err
+	}
+	return c.emit(ctx, req)
+}
+
+func newEmitRequest(ctx context.Context, agent, event string, payload vm.Value) (*EmitRequest, error) {
+	req := &EmitRequest{
+		Agent:       agent,
+		Event:       event,
+		Traceparent: tracing.SpanContextFromContext(ctx).Traceparent(),
+		Session:     vm.SessionFromContext(ctx),
+	}
+	if payload != nil {
+		data, err := vm.MarshalValue(payload)
+		if err != nil {
+			return nil, fmt.Errorf("payload: %w", err)
+		}
+		req.Payload = data
+	}
+	return req, nil
+}
+
+func (c *Client) emit(ctx context.Context, req *EmitRequest) error {
+	err := c.conn.Invoke(ctx, "/"+serviceName+"/Emit", req, &EmitReply{})
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%w: %s on %s", vm.ErrUnknownAgent, req.Agent, c.addr)
+	}
+	return err
+}
+
+// List returns the agents of the process
+func (c *Client) List(ctx context.Context) ([]AgentInfo, error) {
+	var reply ListReply
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/List", &ListRequest{}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Agents, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// peerQueueSize bounds the events waiting to be sent to a peer
+const peerQueueSize = 1024
+
+// discoveryInterval limits how often peers are asked for their agents when
+// a program emits to an agent none of them was known to run
+const discoveryInterval = time.Second
+
+// Peers is a vm.Remote delivering events to the agents of other processes.
+// It discovers which peer runs an agent by listing their agents and sends
+// the events to each peer in order from a goroutine of its own, so the VM
+// does not wait for the peer's handlers.
+type Peers struct {
+	peers []*peer
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mu         sync.Mutex
+	agents     map[string]*peer
+	discovered time.Time
+}
+
+type peer struct {
+	client *Client
+	queue  chan *EmitRequest
+}
+
+// NewPeers connects to the processes listening on addrs
+func NewPeers(addrs []string) (*Peers, error) {
+	p := &Peers{done: make(chan struct{}), agents: make(map[string]*peer)}
+	for _, addr := range addrs {
+		client, err := Dial(addr)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("peer %s: %w", addr, err)
+		}
+		pr := &peer{client: client, queue: make(chan *EmitRequest, peerQueueSize)}
+		p.peers = append(p.peers, pr)
+		p.wg.Add(1)
+		go p.send(pr)
+	}
+	return p, nil
+}
+
+// Emit queues the event for the peer running the agent, with the trace
+// context ctx carries
+func (p *Peers) Emit(ctx context.Context, agent, event string, payload vm.Value) error {
+	target, err := p.lookup(agent)
+	if err != nil {
+		return err
+	}
+	req, err := newEmitRequest(ctx, agent, event, payload)
+	if err != nil {
+		return err
+	}
+	select {
+	case target.queue <- req:
+		return nil
+	default:
+		return fmt.Errorf("too many events waiting to be sent to %s", target.client.addr)
+	}
+}
+
+// Agents returns the agents of every peer that could be reached
+func (p *Peers) Agents(ctx context.Context) map[string][]AgentInfo {
+	agents := make(map[string][]AgentInfo, len(p.peers))
+	for _, pr := range p.peers {
+		list, err := pr.client.List(ctx)
+		if err != nil {
+			logger.Log.Warnw("Error listing the agents of peer", zap.String("peer", pr.client.addr), zap.Error(err))
+			continue
+		}
+		agents[pr.client.addr] = list
+	}
+	return agents
+}
+
+// lookup returns the peer running agent, asking the peers for their agents
+// when it is not known yet
+func (p *Peers) lookup(agent string) (*peer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if target, ok := p.agents[agent]; ok {
+		return target, nil
+	}
+	if time.Since(p.discovered) >= discoveryInterval {
+		p.discovered = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		for _, pr := range p.peers {
+			list, err := pr.client.List(ctx)
+			if err != nil {
+				logger.Log.Warnw("Error listing the agents of peer", zap.String("peer", pr.client.addr), zap.Error(err))
+				continue
+			}
+			for _, info := range list {
+				if !info.Stopped {
+					p.agents[info.Name] = pr
+				}
+			}
+		}
+		if target, ok := p.agents[agent]; ok {
+			return target, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no peer runs %s", vm.ErrUnknownAgent, agent)
+}
+
+// forget drops a stale discovery of an agent, it is looked up again by the
+// next event emitted to it
+func (p *Peers) forget(agent string, pr *peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.agents[agent] == pr {
+		delete(p.agents, agent)
+	}
+}
+
+func (p *Peers) send(pr *peer) {
+	defer p.wg.Done()
+	for {
+		select {
+		case req := <-pr.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+			err := pr.client.emit(ctx, req)
+			cancel()
+			if err != nil {
+				if errors.Is(err, vm.ErrUnknownAgent) {
+					p.forget(req.Agent, pr)
+				}
+				logger.Log.Warnw("Error emitting event to remote agent", zap.String("peer", pr.client.addr), zap.String("agent", req.Agent), zap.String("event", req.Event), zap.Error(err))
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Close stops sending events and closes the connections. Events that were
+// not sent yet are dropped.
+func (p *Peers) Close() error {
+	close(p.done)
+	p.wg.Wait()
+	var errs []error
+	for _, pr := range p.peers {
+		errs = append(errs, pr.client.Close())
+	}
+	return errors.Join(errs...)
+}
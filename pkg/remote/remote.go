@@ -0,0 +1,163 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the remote package connects the agents of msc processes over gRPC. A
+// Server exposes the agents of a VM, and Peers delivers the events a VM
+// emits to agents running in other processes. Messages are JSON encoded,
+// with payloads in the format of vm.MarshalValue. Connections are not
+// encrypted, peers should only be reachable on a trusted network.
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const serviceName = "mindscript.remote.Agents"
+
+// EmitRequest delivers an event to an agent
+type EmitRequest struct {
+	Agent   string          `json:"agent"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Traceparent is the W3C trace context of the emitting handler
+	Traceparent string `json:"traceparent,omitempty"`
+	// Session is the session the event belongs to
+	Session string `json:"session,omitempty"`
+}
+
+// EmitReply acknowledges an event
+type EmitReply struct{}
+
+// ListRequest asks a process for its agents
+type ListRequest struct{}
+
+// ListReply holds the agents of a process
+type ListReply struct {
+	Agents []AgentInfo `json:"agents"`
+}
+
+// AgentInfo describes an agent for discovery
+type AgentInfo struct {
+	Name        string `json:"name"`
+	Declaration string `json:"declaration"`
+	Stopped     bool   `json:"stopped,omitempty"`
+}
+
+// codec encodes messages as JSON rather than protocol buffers, so the
+// service needs no generated code
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (codec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (codec) Name() string                       { return "json" }
+
+// agentsService is implemented by Server, grpc checks registered services
+// against it
+type agentsService interface {
+	emit(ctx context.Context, req *EmitRequest) (*EmitReply, error)
+	list(ctx context.Context, req *ListRequest) (*ListReply, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*agentsService)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Emit", Handler: unaryHandler("Emit", agentsService.emit)},
+		{MethodName: "List", Handler: unaryHandler("List", agentsService.list)},
+	},
+	Metadata: "mindscript/remote",
+}
+
+func unaryHandler[Req, Reply any](method string, call func(agentsService, context.Context, *Req) (*Reply, error)) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req any) (any, error) {
+			return call(srv.(agentsService), ctx, req.(*Req))
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + method}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// Server exposes the agents of a VM to other processes
+type Server struct {
+	machine *vm.VM
+	grpc    *grpc.Server
+}
+
+// NewServer returns a server delivering the events it receives to the
+// agents of machine
+func NewServer(machine *vm.VM) *Server {
+	s := &Server{machine: machine, grpc: grpc.NewServer(grpc.ForceServerCodec(codec{}))}
+	s.grpc.RegisterService(&serviceDesc, s)
+	return s
+}
+
+// Serve accepts connections on lis until Stop is called
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// Stop stops accepting connections and waits for the pending calls
+func (s *Server) Stop() {
+	s.grpc.GracefulStop()
+}
+
+func (s *Server) emit(ctx context.Context, req *EmitRequest) (*EmitReply, error) {
+	var payload vm.Value
+	if len(req.Payload) > 0 {
+		var err error
+		payload, err = vm.UnmarshalValue(req.Payload)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "payload: %v", err)
+		}
+	}
+	if sc, err := tracing.ParseTraceparent(req.Traceparent); err == nil {
+		ctx = tracing.ContextWithSpanContext(ctx, sc)
+	}
+	ctx = vm.ContextWithSession(ctx, req.Session)
+	if err := s.machine.EmitContext(ctx, req.Agent, req.Event, payload); err != nil {
+		if errors.Is(err, vm.ErrUnknownAgent) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	return &EmitReply{}, nil
+}
+
+func (s *Server) list(ctx context.Context, req *ListRequest) (*ListReply, error) {
+	agents := s.machine.Agents()
+	reply := &ListReply{Agents: make([]AgentInfo, len(agents))}
+	for i, agent := range agents {
+		reply.Agents[i] = AgentInfo{Name: agent.Name, Declaration: agent.Declaration, Stopped: agent.Stopped()}
+	}
+	return reply, nil
+}
@@ -0,0 +1,189 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package repl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterh/liner"
+	"github.com/robert-cronin/mindscript-go/pkg/codegen"
+	"github.com/robert-cronin/mindscript-go/pkg/control"
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/semantic"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
+)
+
+// Evaluator evaluates the inputs of attached REPLs in the context of the
+// program a VM is serving. Inputs are compiled after the program, so they
+// can read its globals, call its functions and emit events to its agents.
+// It implements control.Evaluator.
+type Evaluator struct {
+	mu          sync.Mutex
+	machine     *vm.VM
+	symbolTable *semantic.SymbolTable
+	generator   *codegen.CodeGenerator
+}
+
+// NewEvaluator returns an evaluator for machine, which runs the program
+// symbolTable analysed and generator generated with Generate
+func NewEvaluator(machine *vm.VM, symbolTable *semantic.SymbolTable, generator *codegen.CodeGenerator) *Evaluator {
+	return &Evaluator{machine: machine, symbolTable: symbolTable, generator: generator}
+}
+
+// Reset makes inputs compile after another program, once the VM has been
+// reloaded with it
+func (e *Evaluator) Reset(symbolTable *semantic.SymbolTable, generator *codegen.CodeGenerator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.symbolTable, e.generator = symbolTable, generator
+}
+
+// CompileError is returned by Eval for inputs that do not compile, Parse
+// tells parse errors from semantic ones
+type CompileError struct {
+	Parse bool
+	Err   error
+}
+
+func (e *CompileError) Error() string { return e.Err.Error() }
+
+func (e *CompileError) Unwrap() error { return e.Err }
+
+// Eval compiles and runs an input, returning its result as the REPL prints
+// it or "" if it has none. Output written with print goes to the server's
+// standard output. Inputs that do not compile fail with a *CompileError.
+func (e *Evaluator) Eval(input string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return "", &CompileError{Parse: true, Err: fmt.Errorf("parser errors: %s", strings.Join(p.Errors(), "; "))}
+	}
+	if err := e.symbolTable.Extend(program, l); err != nil {
+		return "", &CompileError{Err: err}
+	}
+	bytecode, entry := e.generator.Append(program)
+	result, err := e.machine.Eval(bytecode, entry)
+	if err != nil {
+		return "", err
+	}
+	if !hasResult(e.symbolTable, program, l) {
+		return "", nil
+	}
+	return formatValue(result), nil
+}
+
+// errNotAttachable is returned by servers that do not evaluate inputs
+var errNotAttachable = errors.New("the server does not accept REPL inputs, serve the program with --allow-attach")
+
+// remote is the control API of a msc serve instance evaluating the inputs
+// of an attached REPL
+type remote struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+// eval sends an input to the server and returns its formatted result
+func (r *remote) eval(input string) (string, error) {
+	data, err := json.Marshal(control.EvalRequest{Source: input})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+r.addr+"/eval", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return "", errNotAttachable
+	}
+	var body struct {
+		Result string `json:"result"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("reading the response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(body.Error)
+	}
+	return body.Result, nil
+}
+
+// Attach runs a REPL whose inputs are evaluated by the msc serve instance
+// with its control API on addr, for debugging the agents it runs, sending
+// them with the API's bearer token. The
+// startup script is not run and commands working on the local session,
+// such as :symbols, are not available.
+func Attach(addr, token string) error {
+	r := &remote{addr: addr, token: token, client: &http.Client{}}
+	// An empty input checks that the server evaluates inputs at all
+	if _, err := r.eval(""); err != nil {
+		return err
+	}
+	fmt.Printf("Attached to the MindScript server at %s\n", addr)
+	fmt.Println("Type :help for commands, :quit or exit to detach.")
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	historyPath := loadHistory(line)
+	defer saveHistory(line, historyPath)
+
+	s := &session{line: line, prompt: addr + defaultPrompt, remote: r}
+	s.loop()
+	fmt.Println("Detached.")
+	return nil
+}
+
+// evalRemote evaluates an input on the server, printing its result
+func (s *session) evalRemote(input string) {
+	start := time.Now()
+	result, err := s.remote.eval(input)
+	if s.timing {
+		// Reported after the result
+		elapsed := time.Since(start)
+		defer fmt.Printf("evaluated in %s\n", elapsed)
+	}
+	if err != nil {
+		logger.Log.Errorw("Remote error", zap.Error(err))
+		return
+	}
+	s.inputs = append(s.inputs, input)
+	if result != "" {
+		fmt.Println(result)
+	}
+}
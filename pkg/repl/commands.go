@@ -0,0 +1,285 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peterh/liner"
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap/zapcore"
+)
+
+// command is a meta command of the REPL, entered as :name followed by its
+// argument
+type command struct {
+	name string
+	// usage describes the argument, empty for commands taking none
+	usage string
+	help  string
+	// local commands work on the session's own symbol table, code or VM and
+	// are not available when attached to a server
+	local bool
+	// run handles the command and reports whether the REPL should go on
+	run func(s *session, arg string) bool
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "help", help: "list the commands", run: (*session).help},
+		{name: "symbols", local: true, help: "list the variables and functions declared so far", run: (*session).symbols},
+		{name: "type", local: true, usage: "expr", help: "show the type of an expression without running it", run: (*session).typeOf},
+		{name: "bytecode", local: true, help: "show the instructions compiled for the last input", run: (*session).bytecode},
+		{name: "time", usage: "on|off", help: "report compile time, run time and instructions after each input", run: (*session).time},
+		{name: "paste", help: "read lines until a lone . or Ctrl-D and run them as one input", run: (*session).paste},
+		{name: "set", usage: "option value", help: "set prompt, time (on|off) or log (debug|info|warn|error)", run: (*session).set},
+		{name: "load", usage: "path.ms", help: "compile and run a file in the session", run: (*session).load},
+		{name: "save", usage: "path", help: "write every input compiled so far to a file", run: (*session).save},
+		{name: "reset", local: true, help: "discard every declaration and start a new session", run: (*session).reset},
+		{name: "clear", help: "clear the screen", run: (*session).clear},
+		{name: "quit", help: "leave the REPL", run: func(*session, string) bool { return false }},
+	}
+}
+
+// command runs a meta command and reports whether the REPL should go on
+func (s *session) command(input string) bool {
+	name, arg, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(input), ":"), " ")
+	arg = strings.TrimSpace(arg)
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if c.local && s.remote != nil {
+			fmt.Printf(":%s is not available when attached to %s\n", c.name, s.remote.addr)
+			return true
+		}
+		if c.usage != "" && arg == "" {
+			fmt.Printf("usage: :%s %s\n", c.name, c.usage)
+			return true
+		}
+		return c.run(s, arg)
+	}
+	fmt.Printf("unknown command :%s, :help lists the commands\n", name)
+	return true
+}
+
+func (s *session) help(string) bool {
+	for _, c := range commands {
+		usage := ":" + c.name
+		if c.usage != "" {
+			usage += " " + c.usage
+		}
+		fmt.Printf("  %-14s %s\n", usage, c.help)
+	}
+	return true
+}
+
+func (s *session) symbols(string) bool {
+	variables := s.symbolTable.Variables()
+	functions := s.symbolTable.Functions()
+	if len(variables) == 0 && len(functions) == 0 {
+		fmt.Println("nothing declared yet")
+		return true
+	}
+	for _, name := range sortedKeys(variables) {
+		fmt.Printf("  %s: %s\n", name, variables[name])
+	}
+	for _, name := range sortedKeys(functions) {
+		fmt.Printf("  function %s%s\n", name, functions[name])
+	}
+	return true
+}
+
+// typeOf parses the argument as an expression and prints the type the
+// analysis infers for it
+func (s *session) typeOf(arg string) bool {
+	l := lexer.New(arg)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, msg := range p.Errors() {
+			fmt.Println(msg)
+		}
+		return true
+	}
+	var stmt *parser.ExpressionStatement
+	if len(program.Statements) == 1 {
+		stmt, _ = program.Statements[0].(*parser.ExpressionStatement)
+	}
+	if stmt == nil || stmt.Expression == nil {
+		fmt.Println(":type expects a single expression")
+		return true
+	}
+	typ, err := s.symbolTable.TypeOf(*stmt.Expression, l)
+	if err != nil {
+		fmt.Println(err)
+		return true
+	}
+	fmt.Println(typ)
+	return true
+}
+
+// bytecode disassembles the code of the last input, including the bodies
+// of the functions and handlers it declared
+func (s *session) bytecode(string) bool {
+	if s.program == nil {
+		fmt.Println("nothing compiled yet")
+		return true
+	}
+	fmt.Print(vm.DisassembleCode(s.program, s.entry, len(s.program.Instructions)))
+	return true
+}
+
+func (s *session) time(arg string) bool {
+	switch arg {
+	case "on":
+		s.timing = true
+	case "off":
+		s.timing = false
+	default:
+		fmt.Println("usage: :time on|off")
+		return true
+	}
+	fmt.Printf("timing %s\n", arg)
+	return true
+}
+
+// set changes a setting of the session. The prompt may be quoted to keep
+// surrounding spaces: :set prompt "ms> ".
+func (s *session) set(arg string) bool {
+	option, value, _ := strings.Cut(arg, " ")
+	value = strings.TrimSpace(value)
+	switch option {
+	case "prompt":
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		s.prompt = value
+	case "time":
+		return s.time(value)
+	case "log":
+		level, err := zapcore.ParseLevel(value)
+		if err != nil {
+			fmt.Println(err)
+			return true
+		}
+		logger.SetLevel(level)
+	default:
+		fmt.Printf("unknown option %q, expected prompt, time or log\n", option)
+	}
+	return true
+}
+
+// paste collects lines into a single input, so that declarations spanning
+// several lines, such as agents, can be pasted whole. Ctrl-C discards them.
+func (s *session) paste(string) bool {
+	fmt.Println("paste mode, end with a lone . or Ctrl-D")
+	var lines []string
+	for {
+		line, err := s.line.Prompt("")
+		if errors.Is(err, liner.ErrPromptAborted) {
+			fmt.Println("paste discarded")
+			return true
+		}
+		if err != nil || line == "." {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > 0 {
+		s.eval(strings.Join(lines, "\n"))
+	}
+	return true
+}
+
+// load runs a file as a single input, so its declarations join the session
+// and :save writes it out with the rest
+func (s *session) load(path string) bool {
+	s.loadFile(path)
+	return true
+}
+
+// loadFile runs a file like :load and reports whether it ran without errors
+func (s *session) loadFile(path string) bool {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return s.eval(string(source))
+}
+
+func (s *session) save(path string) bool {
+	var b strings.Builder
+	for _, input := range s.inputs {
+		b.WriteString(input)
+		if !strings.HasSuffix(input, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		fmt.Println(err)
+		return true
+	}
+	fmt.Printf("saved %d inputs to %s\n", len(s.inputs), path)
+	return true
+}
+
+// reset replaces the session's symbol table, code and VM with new ones and
+// runs the startup script and preloaded files again, keeping the settings
+func (s *session) reset(string) bool {
+	if s.startup {
+		fmt.Println(":reset is ignored in the startup script")
+		return true
+	}
+	variables, functions := len(s.symbolTable.Variables()), len(s.symbolTable.Functions())
+	// Cancels the timers of the session's agents
+	s.vm.Reset(&vm.Program{})
+	fresh := newSession(s.line)
+	fresh.prompt, fresh.timing = s.prompt, s.timing
+	fresh.preload = s.preload
+	*s = *fresh
+	fmt.Printf("session reset, dropped %d variables and %d functions\n", variables, functions)
+	s.runStartup()
+	s.runPreload()
+	return true
+}
+
+// clear clears the terminal with ANSI escapes, moving the cursor home
+func (s *session) clear(string) bool {
+	fmt.Print("\x1b[H\x1b[2J")
+	return true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,129 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package repl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+)
+
+// maxLineWidth is how wide a list or map may be before it is printed with
+// an item per line
+const maxLineWidth = 80
+
+// formatValue formats a result for the REPL by its runtime type: strings
+// are quoted, floats always show a decimal point so they can be told apart
+// from ints, lists and maps print their items the same way and agents are
+// summarised. Lists and maps that do not fit on a line are indented.
+func formatValue(value vm.Value) string {
+	return formatIndented(value, "", map[vm.Value]bool{})
+}
+
+// formatIndented formats value at the indentation of the line it starts on.
+// seen holds the lists and maps being formatted, which print as [...] or
+// {...} if they contain themselves.
+func formatIndented(value vm.Value, indent string, seen map[vm.Value]bool) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEnI") {
+			s += ".0"
+		}
+		return s
+	case *vm.List:
+		if seen[v] {
+			return "[...]"
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		items := make([]string, v.Len())
+		for i, item := range v.Items() {
+			items[i] = formatIndented(item, indent+"  ", seen)
+		}
+		return joinItems("[", items, "]", indent)
+	case *vm.Map:
+		if seen[v] {
+			return "{...}"
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		items := make([]string, 0, v.Len())
+		for _, key := range v.Keys() {
+			item, _ := v.Get(key)
+			items = append(items, formatIndented(key, indent+"  ", seen)+": "+formatIndented(item, indent+"  ", seen))
+		}
+		return joinItems("{", items, "}", indent)
+	case *vm.Agent:
+		return formatAgent(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// joinItems joins the formatted items of a list or map between its
+// brackets, on one line if they fit and one per line otherwise
+func joinItems(open string, items []string, close string, indent string) string {
+	line := open + strings.Join(items, ", ") + close
+	if len(indent)+len(line) <= maxLineWidth && !strings.Contains(line, "\n") {
+		return line
+	}
+	var b strings.Builder
+	b.WriteString(open + "\n")
+	for i, item := range items {
+		b.WriteString(indent + "  " + item)
+		if i < len(items)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(indent + close)
+	return b.String()
+}
+
+// formatAgent summarises an agent by its goal, capabilities, the events it
+// handles and its mailbox
+func formatAgent(agent *vm.Agent) string {
+	events := make([]string, len(agent.Handlers))
+	for i, handler := range agent.Handlers {
+		events[i] = handler.Event
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "agent %s", agent.Name)
+	if agent.Declaration != "" && agent.Declaration != agent.Name {
+		fmt.Fprintf(&b, " (%s)", agent.Declaration)
+	}
+	if agent.Goal != "" {
+		fmt.Fprintf(&b, "\n  goal: %s", strconv.Quote(agent.Goal))
+	}
+	if len(agent.Capabilities) > 0 {
+		fmt.Fprintf(&b, "\n  capabilities: %s", strings.Join(agent.Capabilities, ", "))
+	}
+	if len(events) > 0 {
+		fmt.Fprintf(&b, "\n  handles: %s", strings.Join(events, ", "))
+	}
+	fmt.Fprintf(&b, "\n  pending: %d", agent.Pending())
+	if agent.Stopped() {
+		b.WriteString("\n  stopped")
+	}
+	return b.String()
+}
@@ -17,10 +17,15 @@
 package repl
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/peterh/liner"
 	"github.com/robert-cronin/mindscript-go/pkg/codegen"
 	"github.com/robert-cronin/mindscript-go/pkg/lexer"
 	"github.com/robert-cronin/mindscript-go/pkg/logger"
@@ -30,48 +35,302 @@ import (
 	"go.uber.org/zap"
 )
 
-func Start() {
+// historyFile is where inputs are kept between sessions and startupFile
+// the script every session starts by running, both in the user's home
+// directory
+const (
+	historyFile = ".msc_history"
+	startupFile = ".mscrc"
+)
+
+// defaultPrompt is the prompt until the startup script sets another and
+// continuationPrompt the one of the lines completing an input
+const (
+	defaultPrompt      = ">> "
+	continuationPrompt = ".. "
+)
+
+// Start runs an interactive session on the terminal until the user quits.
+// The files of preload are compiled and run into the session, in order,
+// before the first prompt.
+func Start(preload ...string) {
 	fmt.Println("Welcome to the MindScript REPL!")
-	fmt.Println("Type 'exit' to quit.")
+	fmt.Println("Type :help for commands, :quit or exit to quit.")
 
-	scanner := bufio.NewScanner(os.Stdin)
-	symbolTable := semantic.NewSymbolTable(lexer.New(""))
+	// The line editor provides cursor movement, history navigation with the
+	// arrow keys and reverse search with Ctrl-R
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	historyPath := loadHistory(line)
+	defer saveHistory(line, historyPath)
 
+	s := newSession(line)
+	s.preload = preload
+	s.runStartup()
+	s.runPreload()
+	s.loop()
+	fmt.Println("Goodbye!")
+}
+
+// loop reads and runs inputs until the user quits
+func (s *session) loop() {
+	line := s.line
 	for {
-		fmt.Print(">> ")
-		if !scanner.Scan() {
+		input, err := line.Prompt(s.prompt)
+		if errors.Is(err, liner.ErrPromptAborted) {
+			// Ctrl-C discards the line being edited
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Log.Errorw("Could not read input", zap.Error(err))
+			}
 			break
 		}
-
-		input := scanner.Text()
 		if input == "exit" {
 			break
 		}
+		if input != "" {
+			line.AppendHistory(input)
+		}
 
-		l := lexer.New(input)
-		p := parser.New(l)
-		program := p.ParseProgram()
-
-		if len(p.Errors()) != 0 {
-			for _, msg := range p.Errors() {
-				logger.Log.Error("Parser error", zap.String("error", msg))
+		// Meta commands are handled before compilation
+		if strings.HasPrefix(strings.TrimSpace(input), ":") {
+			if !s.command(input) {
+				break
 			}
 			continue
 		}
+		input, ok := s.continueInput(input)
+		if !ok {
+			continue
+		}
+		s.eval(input)
+	}
+}
 
-		err := symbolTable.Analyse(program)
+// continueInput reads more lines while input leaves brackets open, such as
+// the body of a function declared over several lines, and returns the
+// whole input. Ctrl-C discards it, reported by ok being false.
+func (s *session) continueInput(input string) (string, bool) {
+	for openBrackets(input) > 0 {
+		more, err := s.line.Prompt(continuationPrompt)
+		if errors.Is(err, liner.ErrPromptAborted) {
+			return "", false
+		}
 		if err != nil {
-			logger.Log.Error("Semantic error", zap.Error(err))
+			// Ctrl-D runs the input as it is, the parser reporting what is
+			// missing
+			break
+		}
+		if more != "" {
+			s.line.AppendHistory(more)
+		}
+		input += "\n" + more
+	}
+	return input, true
+}
+
+// openBrackets returns how many braces, parentheses and square brackets of
+// source are left open. The lexer skips those in strings and comments.
+func openBrackets(source string) int {
+	l := lexer.New(source)
+	open := 0
+	for tok := l.NextToken(); tok.Type != lexer.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case lexer.LBRACE, lexer.LPAREN, lexer.LBRACKET:
+			open++
+		case lexer.RBRACE, lexer.RPAREN, lexer.RBRACKET:
+			open--
+		}
+	}
+	return open
+}
+
+// session is the state of a REPL session. Every input is compiled after the
+// ones before it and run on the same VM, so variables, functions and agents
+// persist across inputs.
+type session struct {
+	line        *liner.State
+	symbolTable *semantic.SymbolTable
+	generator   *codegen.CodeGenerator
+	vm          *vm.VM
+	// inputs holds the source of every input compiled so far, for :save
+	inputs []string
+	// program is everything compiled so far and entry the address the code
+	// of the last input starts at, for :bytecode
+	program *vm.Program
+	entry   int
+	// prompt and timing are settings of :set, timing reports how long each
+	// input took to compile and run
+	prompt string
+	timing bool
+	// remote is the server inputs are sent to when attached, see Attach
+	remote *remote
+	// preload holds the files run after the startup script, again on :reset
+	preload []string
+	// startup is set while the startup script runs, whose :reset would run
+	// it again
+	startup bool
+}
+
+func newSession(line *liner.State) *session {
+	symbolTable := semantic.NewSymbolTable(lexer.New(""))
+	return &session{
+		line:        line,
+		prompt:      defaultPrompt,
+		symbolTable: symbolTable,
+		generator:   codegen.NewCodeGenerator(symbolTable),
+		// The REPL is often used to try out untrusted snippets, so external
+		// commands are denied
+		vm: vm.New(&vm.Program{}, vm.WithPolicy(vm.DenyPolicy())),
+	}
+}
+
+// eval compiles and runs an input, printing its result. It reports whether
+// the input ran without errors.
+func (s *session) eval(input string) bool {
+	if s.remote != nil {
+		s.evalRemote(input)
+		return true
+	}
+	start := time.Now()
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		for _, msg := range p.Errors() {
+			logger.Log.Errorw("Parser error", zap.String("error", msg))
+		}
+		return false
+	}
+
+	if err := s.symbolTable.Extend(program, l); err != nil {
+		logger.Log.Errorw("Semantic error", zap.Error(err))
+		return false
+	}
+
+	bytecode, entry := s.generator.Append(program)
+	s.inputs = append(s.inputs, input)
+	s.program, s.entry = bytecode, entry
+	compiled := time.Now()
+	instructions := s.vm.Metrics().Instructions
+	err := s.vm.Extend(bytecode, entry)
+	if s.timing {
+		// Reported after the result
+		ran := time.Since(compiled)
+		executed := s.vm.Metrics().Instructions - instructions
+		defer fmt.Printf("compile %s, run %s, %d instructions\n", compiled.Sub(start), ran, executed)
+	}
+	if err != nil {
+		// The input's declarations are dropped, like those failing analysis,
+		// rather than left holding nil
+		s.symbolTable.Rollback()
+		s.inputs = s.inputs[:len(s.inputs)-1]
+		logger.Log.Errorw("Runtime error", zap.Error(err))
+		return false
+	}
+
+	if hasResult(s.symbolTable, program, l) {
+		fmt.Println(formatValue(s.vm.GetLastResult()))
+	}
+	return true
+}
+
+// hasResult reports whether running program leaves a value to print. Only
+// expressions have one, void calls such as print leave nothing behind.
+func hasResult(symbolTable *semantic.SymbolTable, program *parser.Program, l *lexer.Lexer) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	stmt, ok := program.Statements[len(program.Statements)-1].(*parser.ExpressionStatement)
+	if !ok || stmt.Expression == nil {
+		return false
+	}
+	typ, err := symbolTable.TypeOf(*stmt.Expression, l)
+	return err == nil && typ != "void"
+}
+
+// runStartup runs the startup script, if the user has one. Its lines are
+// meta commands, typically :set, and MindScript: each run of consecutive
+// MindScript lines is compiled as one input, so functions may span lines.
+func (s *session) runStartup() {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	source, err := os.ReadFile(filepath.Join(home, startupFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Warnw("Could not read the REPL startup script", zap.Error(err))
+		}
+		return
+	}
+	s.startup = true
+	defer func() { s.startup = false }()
+	var code []string
+	flush := func() {
+		if len(code) > 0 {
+			s.eval(strings.Join(code, "\n"))
+			code = nil
+		}
+	}
+	for _, line := range strings.Split(string(source), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), ":") {
+			flush()
+			s.command(line)
 			continue
 		}
+		code = append(code, line)
+	}
+	flush()
+}
 
-		instructions := codegen.GenerateBytecode(program, symbolTable)
-		virtualMachine := vm.New(instructions)
-		virtualMachine.Run()
+// runPreload runs every preloaded file like :load
+func (s *session) runPreload() {
+	for _, path := range s.preload {
+		if s.loadFile(path) {
+			fmt.Printf("preloaded %s\n", path)
+		}
+	}
+}
 
-		result := virtualMachine.GetLastResult()
-		fmt.Printf("%v\n", result)
+// loadHistory reads the history of past sessions into the line editor and
+// returns the path of the history file, or "" if there is no home directory
+func loadHistory(line *liner.State) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
 	}
+	path := filepath.Join(home, historyFile)
+	f, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Warnw("Could not read REPL history", zap.Error(err))
+		}
+		return path
+	}
+	defer f.Close()
+	if _, err := line.ReadHistory(f); err != nil {
+		logger.Log.Warnw("Could not read REPL history", zap.Error(err))
+	}
+	return path
+}
 
-	fmt.Println("Goodbye!")
+// saveHistory writes the history, including this session's inputs, to path
+func saveHistory(line *liner.State, path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		logger.Log.Warnw("Could not save REPL history", zap.Error(err))
+		return
+	}
+	defer f.Close()
+	if _, err := line.WriteHistory(f); err != nil {
+		logger.Log.Warnw("Could not save REPL history", zap.Error(err))
+	}
 }
@@ -18,12 +18,20 @@ package semantic
 
 import (
 	"fmt"
+	"maps"
 
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
 	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
 )
 
 func (st *SymbolTable) Analyse(program *parser.Program) error {
-	st.initSystemFunctions()
+	if !st.initialised {
+		st.initSystemFunctions()
+		st.initialised = true
+	}
 	for _, stmt := range program.Statements {
 		if err := st.analyseStatement(stmt); err != nil {
 			return err
@@ -32,29 +40,443 @@ func (st *SymbolTable) Analyse(program *parser.Program) error {
 	return nil
 }
 
+// Extend analyses a program continuing those analysed before, whose
+// variables and functions it may use, as the REPL does with every input. l
+// is the program's lexer, used to report lines. The declarations of a
+// program that fails analysis are discarded, so it can be corrected and
+// entered again.
+func (st *SymbolTable) Extend(program *parser.Program, l *lexer.Lexer) error {
+	if !st.initialised {
+		st.initSystemFunctions()
+		st.initialised = true
+	}
+	global := st.currentScope
+	st.previous = &declarations{
+		variables:     maps.Clone(global.variables),
+		functions:     maps.Clone(global.functions),
+		userFunctions: maps.Clone(st.userFunctions),
+	}
+	st.l = l
+	if err := st.Analyse(program); err != nil {
+		st.currentScope = global
+		st.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Rollback discards the declarations of the program last given to Extend,
+// for the REPL to drop those of an input that fails at runtime
+func (st *SymbolTable) Rollback() {
+	if st.previous == nil {
+		return
+	}
+	global := st.currentScope
+	global.variables, global.functions = st.previous.variables, st.previous.functions
+	st.userFunctions = st.previous.userFunctions
+	st.previous = nil
+}
+
 // Initialise the system functions like log, syscall, and exec
 func (st *SymbolTable) initSystemFunctions() {
 	var err error
+	// log takes the message, or a level, the message and optionally a map
+	// of fields
 	err = st.DeclareFunction("log", FunctionSignature{
-		Arguments:  []string{"string"},
 		ReturnType: "void",
+		Variadic:   true,
 	})
 	if err != nil {
-		fmt.Printf("Could not declare 'log' function: %s\n", err)
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "log"), zap.Error(err))
 	}
-	err = st.DeclareFunction("syscall", FunctionSignature{
-		Arguments:  []string{"string", "string"},
+	// print writes any number of values of any type to the program's output
+	err = st.DeclareFunction("print", FunctionSignature{
 		ReturnType: "void",
+		Variadic:   true,
 	})
 	if err != nil {
-		fmt.Printf("Could not declare 'syscall' function: %s\n", err)
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "print"), zap.Error(err))
 	}
+	// syscall takes the command name followed by any number of arguments
+	// and returns a map holding its exitCode, the output is streamed
+	err = st.DeclareFunction("syscall", FunctionSignature{
+		Arguments:  []string{"string"},
+		Rest:       "string",
+		ReturnType: "map",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "syscall"), zap.Error(err))
+	}
+	// exec takes the command name, optionally a list of its arguments and a
+	// map of options, and returns a map holding stdout, stderr and exitCode,
+	// and truncated when the output was cut
 	err = st.DeclareFunction("exec", FunctionSignature{
+		Arguments:  []string{"string", anyType, "map"},
+		Optional:   2,
+		ReturnType: "map",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "exec"), zap.Error(err))
+	}
+	err = st.DeclareFunction("len", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: "int",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "len"), zap.Error(err))
+	}
+	err = st.DeclareFunction("send", FunctionSignature{
+		Arguments:  []string{"agent", anyType},
+		ReturnType: "bool",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "send"), zap.Error(err))
+	}
+	// receive takes the agent and optionally whether to block
+	err = st.DeclareFunction("receive", FunctionSignature{
+		ReturnType: anyType,
+		Variadic:   true,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "receive"), zap.Error(err))
+	}
+	// emit takes the event name and optionally a payload, or the agent to
+	// deliver them to followed by the event name and payload like ask
+	err = st.DeclareFunction("emit", FunctionSignature{
+		ReturnType: "void",
+		Variadic:   true,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "emit"), zap.Error(err))
+	}
+	// ask takes the agent, the event name and optionally a payload and
+	// returns the agent's reply
+	err = st.DeclareFunction("ask", FunctionSignature{
+		ReturnType: anyType,
+		Variadic:   true,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "ask"), zap.Error(err))
+	}
+	err = st.DeclareFunction("reply", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "bool",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "reply"), zap.Error(err))
+	}
+	err = st.DeclareFunction("spawn", FunctionSignature{
+		Arguments:  []string{"agent"},
+		ReturnType: "agent",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "spawn"), zap.Error(err))
+	}
+	// self returns the agent whose event handler is running
+	err = st.DeclareFunction("self", FunctionSignature{
+		ReturnType: "agent",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "self"), zap.Error(err))
+	}
+	err = st.DeclareFunction("llm", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "llm"), zap.Error(err))
+	}
+	// prompt renders a template with the agent and the event it handles
+	err = st.DeclareFunction("prompt", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "prompt"), zap.Error(err))
+	}
+	// remember, recall and forget use the agent's long-term memory, observe
+	// and recent its conversation buffer
+	err = st.DeclareFunction("remember", FunctionSignature{
+		Arguments:  []string{"string", anyType},
+		ReturnType: "void",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "remember"), zap.Error(err))
+	}
+	err = st.DeclareFunction("recall", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "recall"), zap.Error(err))
+	}
+	err = st.DeclareFunction("forget", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: "void",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "forget"), zap.Error(err))
+	}
+	err = st.DeclareFunction("observe", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "void",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "observe"), zap.Error(err))
+	}
+	err = st.DeclareFunction("recent", FunctionSignature{
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "recent"), zap.Error(err))
+	}
+	// session returns the ID of the handled event's session, whose memory
+	// sessionRemember and sessionRecall use and whose events sessionHistory
+	// returns
+	err = st.DeclareFunction("session", FunctionSignature{
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "session"), zap.Error(err))
+	}
+	err = st.DeclareFunction("sessionRemember", FunctionSignature{
+		Arguments:  []string{"string", anyType},
+		ReturnType: "void",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "sessionRemember"), zap.Error(err))
+	}
+	err = st.DeclareFunction("sessionRecall", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "sessionRecall"), zap.Error(err))
+	}
+	err = st.DeclareFunction("sessionHistory", FunctionSignature{
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "sessionHistory"), zap.Error(err))
+	}
+	// embed returns a text's embedding, index stores a text under an id in
+	// the vector store and search returns the texts most similar to a query
+	err = st.DeclareFunction("embed", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "embed"), zap.Error(err))
+	}
+	err = st.DeclareFunction("index", FunctionSignature{
 		Arguments:  []string{"string", "string"},
+		ReturnType: "void",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "index"), zap.Error(err))
+	}
+	err = st.DeclareFunction("search", FunctionSignature{
+		Arguments:  []string{"string", "int"},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "search"), zap.Error(err))
+	}
+	// mcp calls a tool of an MCP server with a map of arguments
+	err = st.DeclareFunction("mcp", FunctionSignature{
+		Arguments:  []string{"string", "string", anyType},
+		ReturnType: "map",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "mcp"), zap.Error(err))
+	}
+	// env returns an environment variable, args the program's arguments
+	err = st.DeclareFunction("env", FunctionSignature{
+		Arguments:  []string{"string"},
 		ReturnType: "string",
 	})
 	if err != nil {
-		fmt.Printf("Could not declare 'exec' function: %s\n", err)
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "env"), zap.Error(err))
+	}
+	err = st.DeclareFunction("args", FunctionSignature{
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "args"), zap.Error(err))
+	}
+	// random returns a float in [0, 1), randomInt an int between its bounds
+	// inclusive and choice an item of a list, all from the VM's seedable source
+	err = st.DeclareFunction("random", FunctionSignature{
+		ReturnType: "float",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "random"), zap.Error(err))
+	}
+	err = st.DeclareFunction("randomInt", FunctionSignature{
+		Arguments:  []string{"int", "int"},
+		ReturnType: "int",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "randomInt"), zap.Error(err))
+	}
+	err = st.DeclareFunction("choice", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "choice"), zap.Error(err))
+	}
+	// int, float, string and bool convert a value to their type, see
+	// checkConversion for the values they accept
+	err = st.DeclareFunction("int", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "int",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "int"), zap.Error(err))
+	}
+	err = st.DeclareFunction("float", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "float",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "float"), zap.Error(err))
+	}
+	err = st.DeclareFunction("string", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "string"), zap.Error(err))
+	}
+	err = st.DeclareFunction("bool", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "bool",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "bool"), zap.Error(err))
+	}
+	// typeof names the runtime type of a value
+	err = st.DeclareFunction("typeof", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "typeof"), zap.Error(err))
+	}
+	// assert fails the handler with ErrAssertionFailed unless the condition holds
+	err = st.DeclareFunction("assert", FunctionSignature{
+		Arguments:  []string{"bool", "string"},
+		ReturnType: "void",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "assert"), zap.Error(err))
+	}
+	// uuid returns a random version 4 UUID, drawn from the same seedable
+	// source as random
+	err = st.DeclareFunction("uuid", FunctionSignature{
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "uuid"), zap.Error(err))
+	}
+	// sqlQuery takes the name of a connection, the query and optionally a
+	// list of its parameters, and returns the rows as a list of maps
+	err = st.DeclareFunction("sqlQuery", FunctionSignature{
+		Arguments:  []string{"string", "string", anyType},
+		Optional:   1,
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "sqlQuery"), zap.Error(err))
+	}
+	// format fills the {name} placeholders of a template from a map
+	err = st.DeclareFunction("format", FunctionSignature{
+		Arguments:  []string{"string", "map"},
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "format"), zap.Error(err))
+	}
+	// urlParse splits a URL into a map of its parts, urlEncode escapes a
+	// string or encodes a map as a query string and queryParam returns the
+	// first value of a URL's query parameter
+	err = st.DeclareFunction("urlParse", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: "map",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "urlParse"), zap.Error(err))
+	}
+	err = st.DeclareFunction("urlEncode", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: "string",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "urlEncode"), zap.Error(err))
+	}
+	err = st.DeclareFunction("queryParam", FunctionSignature{
+		Arguments:  []string{"string", "string"},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "queryParam"), zap.Error(err))
+	}
+	// yamlParse and tomlParse decode a document into maps, lists and
+	// scalars
+	err = st.DeclareFunction("yamlParse", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "yamlParse"), zap.Error(err))
+	}
+	err = st.DeclareFunction("tomlParse", FunctionSignature{
+		Arguments:  []string{"string"},
+		ReturnType: "map",
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "tomlParse"), zap.Error(err))
+	}
+	// map, filter and reduce call a function of the program on each item of
+	// a list, the function is passed by name: map(items, double). sort
+	// returns a sorted copy of a list.
+	err = st.DeclareFunction("map", FunctionSignature{
+		Arguments:  []string{anyType, functionType},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "map"), zap.Error(err))
+	}
+	err = st.DeclareFunction("filter", FunctionSignature{
+		Arguments:  []string{anyType, functionType},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "filter"), zap.Error(err))
+	}
+	err = st.DeclareFunction("reduce", FunctionSignature{
+		Arguments:  []string{anyType, functionType, anyType},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "reduce"), zap.Error(err))
+	}
+	err = st.DeclareFunction("sort", FunctionSignature{
+		Arguments:  []string{anyType},
+		ReturnType: anyType,
+	})
+	if err != nil {
+		logger.Log.Errorw("Could not declare system function", zap.String("function", "sort"), zap.Error(err))
+	}
+	for _, name := range vm.Builtins() {
+		err = st.DeclareFunction(name, FunctionSignature{
+			ReturnType: anyType,
+			Variadic:   true,
+		})
+		if err != nil {
+			logger.Log.Errorw("Could not declare system function", zap.String("function", name), zap.Error(err))
+		}
 	}
 }
 
@@ -68,10 +490,11 @@ func (st *SymbolTable) analyseStatement(stmt parser.Statement) error {
 			return err
 		}
 	case *parser.VarStatement:
-		if err := st.DeclareVariable(s.Name.Value, s.Type.TokenLiteral()); err != nil {
+		// The initial value cannot refer to the variable it initialises
+		if err := st.analyseInitialiser(s); err != nil {
 			return err
 		}
-		return st.analyseExpression(*s.Value)
+		return st.DeclareVariable(s.Name.Value, s.Type.TokenLiteral())
 	case *parser.Function:
 		signature := FunctionSignature{
 			Arguments:  st.getArgumentsTypes(s.Arguments),
@@ -80,18 +503,19 @@ func (st *SymbolTable) analyseStatement(stmt parser.Statement) error {
 		if err := st.DeclareFunction(s.Name.Value, signature); err != nil {
 			return err
 		}
+		st.userFunctions[s.Name.Value] = true
 		st.pushScope()
 		for _, arg := range s.Arguments {
 			if err := st.DeclareVariable(arg.Name.Value, arg.Type.TokenLiteral()); err != nil {
 				return err
 			}
 		}
-		for _, stmt := range s.Body.Statements {
-			if err := st.analyseStatement(*stmt); err != nil {
-				return err
-			}
+		if err := st.analyseBlockStatement(s.Body); err != nil {
+			return err
 		}
 		st.popScope()
+	case *parser.AssignStatement:
+		return st.analyseAssignStatement(s)
 	case *parser.ExpressionStatement:
 		return st.analyseExpression(*s.Expression)
 	case *parser.ReturnStatement:
@@ -101,26 +525,123 @@ func (st *SymbolTable) analyseStatement(stmt parser.Statement) error {
 }
 
 func (st *SymbolTable) analyseAgentStatement(agent *parser.AgentStatement) error {
+	if agent.Supervision != nil {
+		if _, err := vm.ParseSupervision(agent.Supervision.Value); err != nil {
+			return fmt.Errorf("line %d: %s", st.l.Line(agent.Supervision.Token), err)
+		}
+	}
+	// State variables are initialised as the agent is created, so their
+	// initial values cannot refer to each other
+	for _, state := range agent.State {
+		if err := st.analyseInitialiser(state); err != nil {
+			return err
+		}
+	}
+	st.pushScope()
+	for _, state := range agent.State {
+		if err := st.DeclareVariable(state.Name.Value, state.Type.TokenLiteral()); err != nil {
+			return fmt.Errorf("line %d: state variable %s: %s", st.l.Line(state.Name.Token), state.Name.Value, err)
+		}
+	}
+
+	// Functions are analysed first so that event handlers can call them
+	for _, function := range agent.Functions {
+		if err := st.analyseStatement(function); err != nil {
+			return err
+		}
+	}
 	for _, behavior := range agent.Behaviors {
 		for _, eventHandler := range behavior.EventHandlers {
+			if err := vm.CheckTopicEvent(eventHandler.Event.Name.Value, true); err != nil {
+				return fmt.Errorf("line %d: %s", st.l.Line(eventHandler.Event.Name.Token), err)
+			}
+			spec, _, err := vm.ParseTimerEvent(eventHandler.Event.Name.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", st.l.Line(eventHandler.Event.Name.Token), err)
+			}
+			if spec.Cron != nil && !hasCapability(agent, vm.ScheduleCapability) {
+				return fmt.Errorf("line %d: agent %s needs the %q capability for event %q", st.l.Line(eventHandler.Event.Name.Token), agent.Name.Value, vm.ScheduleCapability, eventHandler.Event.Name.Value)
+			}
 			st.pushScope()
+			for _, arg := range eventHandler.Arguments {
+				if err := st.DeclareVariable(arg.Name.Value, arg.Type.TokenLiteral()); err != nil {
+					return err
+				}
+			}
 			if err := st.analyseBlockStatement(eventHandler.BlockStatement); err != nil {
 				return err
 			}
 			st.popScope()
 		}
 	}
-	for _, function := range agent.Functions {
-		if err := st.analyseStatement(function); err != nil {
+
+	// The agent's functions stay visible to the rest of the program, only its
+	// state variables go out of scope
+	scope := st.currentScope
+	st.popScope()
+	for name, signature := range scope.functions {
+		if err := st.DeclareFunction(name, signature); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// analyseAssignStatement checks that the variable is declared and that the
+// value has its type
+func (st *SymbolTable) analyseAssignStatement(stmt *parser.AssignStatement) error {
+	varType, err := st.GetVariableType(stmt.Name.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: cannot assign to %s: %s", st.l.Line(stmt.Name.Token), stmt.Name.Value, err)
+	}
+	if err := st.analyseExpression(*stmt.Value); err != nil {
+		return err
+	}
+	valueType, err := st.getExpressionType(*stmt.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", st.l.Line(stmt.Name.Token), err)
+	}
+	if valueType != varType && valueType != anyType && varType != anyType {
+		return fmt.Errorf("line %d: cannot assign %s to %s of type %s", st.l.Line(stmt.Name.Token), valueType, stmt.Name.Value, varType)
+	}
+	return nil
+}
+
+// analyseInitialiser checks the initial value of a variable and that it
+// has the variable's type
+func (st *SymbolTable) analyseInitialiser(stmt *parser.VarStatement) error {
+	if err := st.analyseExpression(*stmt.Value); err != nil {
+		return err
+	}
+	valueType, err := st.getExpressionType(*stmt.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", st.l.Line(stmt.Name.Token), err)
+	}
+	varType := stmt.Type.TokenLiteral()
+	if valueType != varType && valueType != anyType && varType != anyType {
+		return fmt.Errorf("line %d: cannot initialise %s of type %s with %s", st.l.Line(stmt.Name.Token), stmt.Name.Value, varType, valueType)
+	}
+	return nil
+}
+
+// hasCapability reports whether an agent declares a capability
+func hasCapability(agent *parser.AgentStatement, capability string) bool {
+	if agent.Capabilities == nil {
+		return false
+	}
+	for _, value := range agent.Capabilities.Values {
+		if value == capability {
+			return true
+		}
+	}
+	return false
+}
+
 func (st *SymbolTable) analyseBlockStatement(block *parser.BlockStatement) error {
-	for _, stmt := range block.Statements {
-		if err := st.analyseStatement(*stmt); err != nil {
+	// Statements is a map keyed by position, walked in order so that
+	// variables are declared before they are used
+	for i := 0; i < len(block.Statements); i++ {
+		if err := st.analyseStatement(*block.Statements[i]); err != nil {
 			return err
 		}
 	}
@@ -140,16 +661,65 @@ func (st *SymbolTable) analyseExpression(expr parser.Expression) error {
 		if err := st.analyseExpression(*e.Right); err != nil {
 			return err
 		}
+		if isLogicalOperator(e.Operator.Type) {
+			if err := st.expectBool(*e.Left, e.Operator.Literal); err != nil {
+				return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+			}
+			if err := st.expectBool(*e.Right, e.Operator.Literal); err != nil {
+				return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+			}
+		}
+		if _, err := st.getExpressionType(e); err != nil {
+			return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+		}
+	case *parser.IndexExpression:
+		if err := st.analyseExpression(*e.Left); err != nil {
+			return err
+		}
+		if err := st.analyseExpression(*e.Index); err != nil {
+			return err
+		}
+		if _, err := st.getExpressionType(e); err != nil {
+			return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+		}
+	case *parser.PrefixExpression:
+		if err := st.analyseExpression(*e.Right); err != nil {
+			return err
+		}
+		if err := st.expectBool(*e.Right, e.Operator.Literal); err != nil {
+			return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+		}
 	case *parser.CallExpression:
 		funcName := (*e.Function).(*parser.IdentifierLiteral).Value
 		funcSig, err := st.GetFunctionSignature(funcName)
 		if err != nil {
 			return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
 		}
-		if len(funcSig.Arguments) != len(e.Arguments) {
+		switch {
+		case funcSig.Variadic:
+		case funcSig.Rest != "":
+			if len(e.Arguments) < len(funcSig.Arguments) {
+				return fmt.Errorf("line %d: expected at least %d arguments but got %d", st.l.Line(e.Token), len(funcSig.Arguments), len(e.Arguments))
+			}
+		case funcSig.Optional > 0:
+			required := len(funcSig.Arguments) - funcSig.Optional
+			if len(e.Arguments) < required || len(e.Arguments) > len(funcSig.Arguments) {
+				return fmt.Errorf("line %d: expected %d to %d arguments but got %d", st.l.Line(e.Token), required, len(funcSig.Arguments), len(e.Arguments))
+			}
+		case len(funcSig.Arguments) != len(e.Arguments):
 			return fmt.Errorf("line %d: expected %d arguments but got %d", st.l.Line(e.Token), len(funcSig.Arguments), len(e.Arguments))
 		}
 		for i, arg := range e.Arguments {
+			expected := funcSig.Rest
+			if i < len(funcSig.Arguments) {
+				expected = funcSig.Arguments[i]
+			}
+			if expected == functionType {
+				if err := st.checkCallback(funcName, *arg); err != nil {
+					return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+				}
+				continue
+			}
 			if err := st.analyseExpression(*arg); err != nil {
 				return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
 			}
@@ -157,8 +727,36 @@ func (st *SymbolTable) analyseExpression(expr parser.Expression) error {
 			if err != nil {
 				return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
 			}
-			if funcSig.Arguments[i] != argType {
-				return fmt.Errorf("line %d: type mismatch for argument %d: expected %s but got %s", st.l.Line(e.Token), i+1, funcSig.Arguments[i], argType)
+			if err := checkConversion(funcName, argType); err != nil {
+				return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+			}
+			if funcSig.Variadic || argType == anyType || expected == anyType {
+				continue
+			}
+			if expected != argType {
+				return fmt.Errorf("line %d: type mismatch for argument %d: expected %s but got %s", st.l.Line(e.Token), i+1, expected, argType)
+			}
+		}
+	case *parser.ListLiteral:
+		for _, element := range e.Elements {
+			if err := st.analyseExpression(*element); err != nil {
+				return err
+			}
+		}
+	case *parser.MapLiteral:
+		for i, key := range e.Keys {
+			if err := st.analyseExpression(*key); err != nil {
+				return err
+			}
+			if err := st.analyseExpression(*e.Values[i]); err != nil {
+				return err
+			}
+			keyType, err := st.getExpressionType(*key)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", st.l.Line(e.Token), err)
+			}
+			if keyType != "string" && keyType != anyType {
+				return fmt.Errorf("line %d: map key must be string but got %s", st.l.Line(e.Token), keyType)
 			}
 		}
 	case *parser.IntegerLiteral, *parser.FloatLiteral, *parser.StringLiteral, *parser.BooleanLiteral:
@@ -178,7 +776,17 @@ func (st *SymbolTable) getArgumentsTypes(args []*parser.FunctionArgument) []stri
 	return types
 }
 
+// getExpressionType infers the type of an expression and records it
 func (st *SymbolTable) getExpressionType(expr parser.Expression) (string, error) {
+	exprType, err := st.inferExpressionType(expr)
+	if err != nil {
+		return "", err
+	}
+	st.types[expr] = exprType
+	return exprType, nil
+}
+
+func (st *SymbolTable) inferExpressionType(expr parser.Expression) (string, error) {
 	switch e := expr.(type) {
 	case *parser.IdentifierLiteral:
 		return st.GetVariableType(e.Value)
@@ -190,7 +798,16 @@ func (st *SymbolTable) getExpressionType(expr parser.Expression) (string, error)
 		return "string", nil
 	case *parser.BooleanLiteral:
 		return "bool", nil
+	case *parser.ListLiteral:
+		return "list", nil
+	case *parser.MapLiteral:
+		return "map", nil
+	case *parser.PrefixExpression:
+		return "bool", nil
 	case *parser.InfixExpression:
+		if isLogicalOperator(e.Operator.Type) {
+			return "bool", nil
+		}
 		leftType, err := st.getExpressionType(*e.Left)
 		if err != nil {
 			return "", err
@@ -199,10 +816,44 @@ func (st *SymbolTable) getExpressionType(expr parser.Expression) (string, error)
 		if err != nil {
 			return "", err
 		}
-		if leftType != rightType {
-			return "", fmt.Errorf("type mismatch in infix expression: %s != %s", leftType, rightType)
+		return infixResultType(e.Operator, leftType, rightType)
+	case *parser.IndexExpression:
+		leftType, err := st.getExpressionType(*e.Left)
+		if err != nil {
+			return "", err
 		}
-		return leftType, nil
+		indexType, err := st.getExpressionType(*e.Index)
+		if err != nil {
+			return "", err
+		}
+		if leftType == "map" {
+			// Map values are only known at runtime
+			if indexType != "string" && indexType != anyType {
+				return "", fmt.Errorf("map key must be string but got %s", indexType)
+			}
+			return anyType, nil
+		}
+		if leftType == "list" {
+			// So are the items of lists
+			if indexType != "int" && indexType != anyType {
+				return "", fmt.Errorf("list index must be int but got %s", indexType)
+			}
+			return anyType, nil
+		}
+		if leftType == anyType {
+			// A map, list or string, indexed by what it is at runtime
+			if indexType != "string" && indexType != "int" && indexType != anyType {
+				return "", fmt.Errorf("index must be int or string but got %s", indexType)
+			}
+			return anyType, nil
+		}
+		if leftType != "string" {
+			return "", fmt.Errorf("cannot index value of type %s", leftType)
+		}
+		if indexType != "int" && indexType != anyType {
+			return "", fmt.Errorf("string index must be int but got %s", indexType)
+		}
+		return "string", nil
 	case *parser.CallExpression:
 		funcName := (*e.Function).(*parser.IdentifierLiteral).Value
 		funcSig, err := st.GetFunctionSignature(funcName)
@@ -214,3 +865,116 @@ func (st *SymbolTable) getExpressionType(expr parser.Expression) (string, error)
 		return "", fmt.Errorf("unknown expression type: %T", e)
 	}
 }
+
+// callbackArity is how many arguments the builtins taking a function pass
+// to it
+var callbackArity = map[string]int{
+	"map":    1,
+	"filter": 1,
+	"reduce": 2,
+}
+
+// checkCallback checks an argument of type function: it must name one of the
+// program's functions taking as many arguments as the builtin passes to it.
+// The argument is recorded as a function so that its name is compiled as a
+// string rather than a variable.
+func (st *SymbolTable) checkCallback(builtin string, arg parser.Expression) error {
+	ident, ok := arg.(*parser.IdentifierLiteral)
+	if !ok {
+		return fmt.Errorf("%s expects the name of a function", builtin)
+	}
+	if !st.userFunctions[ident.Value] {
+		return fmt.Errorf("%s expects the name of a function, %s is not a function of this program", builtin, ident.Value)
+	}
+	signature, err := st.GetFunctionSignature(ident.Value)
+	if err != nil {
+		return err
+	}
+	if arity := callbackArity[builtin]; len(signature.Arguments) != arity {
+		return fmt.Errorf("%s calls %s with %d arguments but it takes %d", builtin, ident.Value, arity, len(signature.Arguments))
+	}
+	if builtin == "filter" && signature.ReturnType != "bool" && signature.ReturnType != anyType {
+		return fmt.Errorf("filter expects %s to return bool but it returns %s", ident.Value, signature.ReturnType)
+	}
+	st.types[arg] = functionType
+	return nil
+}
+
+// expectBool checks that an operand of a logical operator is a bool
+func (st *SymbolTable) expectBool(expr parser.Expression, operator string) error {
+	exprType, err := st.getExpressionType(expr)
+	if err != nil {
+		return err
+	}
+	if exprType != "bool" && exprType != anyType {
+		return fmt.Errorf("operator %s expects bool operands but got %s", operator, exprType)
+	}
+	return nil
+}
+
+func isLogicalOperator(t lexer.TokenType) bool {
+	return t == lexer.AND || t == lexer.OR
+}
+
+func isOrderingOperator(t lexer.TokenType) bool {
+	return t == lexer.LT || t == lexer.GT
+}
+
+// infixResultType returns the type produced by applying an arithmetic,
+// equality or ordering operator to operands of the given types
+func infixResultType(operator *lexer.Token, leftType, rightType string) (string, error) {
+	numeric := isNumericType(leftType) && isNumericType(rightType)
+	if leftType == anyType || rightType == anyType {
+		// Checked at runtime instead
+		if operator.Type == lexer.EQ || operator.Type == lexer.NOT_EQ || isOrderingOperator(operator.Type) {
+			return "bool", nil
+		}
+		return anyType, nil
+	}
+	switch operator.Type {
+	case lexer.EQ, lexer.NOT_EQ:
+		if leftType != rightType && !numeric {
+			return "", fmt.Errorf("cannot compare %s with %s", leftType, rightType)
+		}
+		return "bool", nil
+	case lexer.LT, lexer.GT:
+		if !numeric && (leftType != "string" || rightType != "string") {
+			return "", fmt.Errorf("operator %s expects numbers or strings but got %s and %s", operator.Literal, leftType, rightType)
+		}
+		return "bool", nil
+	case lexer.PLUS:
+		if leftType == "string" && rightType == "string" {
+			return "string", nil
+		}
+	}
+	if !numeric {
+		if leftType != rightType {
+			return "", fmt.Errorf("type mismatch in infix expression: %s != %s", leftType, rightType)
+		}
+		return "", fmt.Errorf("operator %s not supported for %s", operator.Literal, leftType)
+	}
+	if leftType == "float" || rightType == "float" {
+		return "float", nil
+	}
+	return "int", nil
+}
+
+// checkConversion rejects the conversions by int, float and bool that
+// always fail at runtime, such as int of an agent. Every value converts to a
+// string and values of unknown type are checked at runtime.
+func checkConversion(funcName, argType string) error {
+	switch funcName {
+	case "int", "float", "bool":
+	default:
+		return nil
+	}
+	switch argType {
+	case "int", "float", "string", "bool", anyType:
+		return nil
+	}
+	return fmt.Errorf("cannot convert %s to %s", argType, funcName)
+}
+
+func isNumericType(t string) bool {
+	return t == "int" || t == "float"
+}
@@ -19,8 +19,11 @@ package semantic
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"strings"
 
 	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
 )
 
 type Scope struct {
@@ -29,14 +32,53 @@ type Scope struct {
 	parent    *Scope
 }
 
+// declarations are the global variables and functions of a symbol table
+type declarations struct {
+	variables     map[string]string
+	functions     map[string]FunctionSignature
+	userFunctions map[string]bool
+}
+
 type FunctionSignature struct {
 	Arguments  []string
 	ReturnType string
+	// Variadic signatures accept any number of arguments of any type, as
+	// used for native builtins registered with the VM
+	Variadic bool
+	// Rest is the type of any further arguments after Arguments, empty when
+	// the function takes exactly Arguments
+	Rest string
+	// Optional is how many of the last Arguments may be left out
+	Optional int
 }
 
+// anyType is the type of values only known at runtime, such as the results
+// of native builtins. It is accepted wherever a specific type is expected.
+const anyType = "any"
+
+// functionType is the type of arguments naming one of the program's
+// functions, such as the fn of map(list, fn). It is not a type of values:
+// the name is passed to the builtin, which calls the function.
+const functionType = "function"
+
 type SymbolTable struct {
 	currentScope *Scope
 
+	// types records the inferred type of each expression checked during
+	// analysis, so later stages can pick type-specific instructions
+	types map[parser.Expression]string
+
+	// userFunctions are the functions declared by the program, which unlike
+	// builtins can be passed as arguments of type function
+	userFunctions map[string]bool
+
+	// initialised is set once the system functions have been declared
+	initialised bool
+
+	// previous holds the global declarations before the last Extend, see
+	// Rollback
+	previous *declarations
+
 	l *lexer.Lexer
 }
 
@@ -45,7 +87,12 @@ func NewSymbolTable(l *lexer.Lexer) *SymbolTable {
 		variables: make(map[string]string),
 		functions: make(map[string]FunctionSignature),
 	}
-	return &SymbolTable{currentScope: globalScope, l: l}
+	return &SymbolTable{
+		currentScope:  globalScope,
+		types:         make(map[parser.Expression]string),
+		userFunctions: make(map[string]bool),
+		l:             l,
+	}
 }
 
 func (st *SymbolTable) pushScope() {
@@ -113,3 +160,63 @@ func (st *SymbolTable) CheckVariableType(name string, expectedType string) error
 	}
 	return nil
 }
+
+// ExpressionType returns the type inferred for an expression during analysis,
+// or an empty string if the expression was never type checked
+func (st *SymbolTable) ExpressionType(expr parser.Expression) string {
+	return st.types[expr]
+}
+
+// Variables returns the names and types of the variables declared in the
+// current scope, which is the top level between analyses
+func (st *SymbolTable) Variables() map[string]string {
+	return maps.Clone(st.currentScope.variables)
+}
+
+// Functions returns the signatures of the functions the programs analysed so
+// far declare, leaving out builtins
+func (st *SymbolTable) Functions() map[string]FunctionSignature {
+	functions := make(map[string]FunctionSignature)
+	for name := range st.userFunctions {
+		if signature, err := st.GetFunctionSignature(name); err == nil {
+			functions[name] = signature
+		}
+	}
+	return functions
+}
+
+// TypeOf checks an expression against the declarations analysed so far and
+// returns its type, without declaring anything
+func (st *SymbolTable) TypeOf(expr parser.Expression, l *lexer.Lexer) (string, error) {
+	st.l = l
+	if err := st.analyseExpression(expr); err != nil {
+		return "", err
+	}
+	return st.getExpressionType(expr)
+}
+
+// String formats a signature the way functions are declared, as in
+// (int, string): bool
+func (sig FunctionSignature) String() string {
+	var b strings.Builder
+	b.WriteString("(")
+	for i, arg := range sig.Arguments {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(arg)
+	}
+	if sig.Rest != "" || sig.Variadic {
+		if len(sig.Arguments) > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("...")
+		b.WriteString(sig.Rest)
+	}
+	b.WriteString(")")
+	if sig.ReturnType != "" {
+		b.WriteString(": ")
+		b.WriteString(sig.ReturnType)
+	}
+	return b.String()
+}
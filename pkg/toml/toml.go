@@ -0,0 +1,767 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the toml package decodes TOML v1.0 documents into Go maps
+package toml
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Parse decodes a TOML document. Tables become map[string]any and arrays
+// []any. Integers are int64, floats float64, offset date-times time.Time
+// and local dates, times and date-times strings in their TOML form.
+func Parse(data []byte) (map[string]any, error) {
+	p := &parser{text: string(data), line: 1}
+	p.root = &table{values: map[string]any{}}
+	p.current = p.root
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.root.toMap(), nil
+}
+
+// table is a table being decoded, the flags enforce TOML's rules on
+// defining tables only once
+type table struct {
+	values map[string]any
+	// explicit tables were defined by a [header]
+	explicit bool
+	// dotted tables were created by dotted keys
+	dotted bool
+	// inline tables are complete once their closing brace is read
+	inline bool
+}
+
+// tableArray is an array of tables defined by [[headers]]
+type tableArray struct {
+	tables []*table
+}
+
+func (t *table) toMap() map[string]any {
+	m := make(map[string]any, len(t.values))
+	for key, value := range t.values {
+		m[key] = plain(value)
+	}
+	return m
+}
+
+// plain converts the tables of a decoded value to maps
+func plain(value any) any {
+	switch v := value.(type) {
+	case *table:
+		return v.toMap()
+	case *tableArray:
+		items := make([]any, len(v.tables))
+		for i, t := range v.tables {
+			items[i] = t.toMap()
+		}
+		return items
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = plain(item)
+		}
+		return items
+	}
+	return value
+}
+
+type parser struct {
+	text    string
+	pos     int
+	line    int
+	root    *table
+	current *table
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("toml: line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.text)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func (p *parser) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(p.text[p.pos:], prefix)
+}
+
+// skipSpace skips spaces and tabs
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipComment skips a comment up to the end of the line
+func (p *parser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+// skipNewline consumes a line ending and reports whether there was one
+func (p *parser) skipNewline() bool {
+	switch {
+	case p.hasPrefix("\n"):
+		p.pos++
+	case p.hasPrefix("\r\n"):
+		p.pos += 2
+	default:
+		return false
+	}
+	p.line++
+	return true
+}
+
+// skipBlank skips whitespace, comments and line endings, as allowed
+// between the values of an array
+func (p *parser) skipBlank() {
+	for {
+		p.skipSpace()
+		p.skipComment()
+		if !p.skipNewline() {
+			return
+		}
+	}
+}
+
+// endLine expects the rest of the line to be blank or a comment
+func (p *parser) endLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.eof() || p.skipNewline() {
+		return nil
+	}
+	return p.errorf("unexpected %q after value", p.peek())
+}
+
+func (p *parser) parse() error {
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+		var err error
+		switch {
+		case p.hasPrefix("[["):
+			err = p.parseArrayTableHeader()
+		case p.peek() == '[':
+			err = p.parseTableHeader()
+		default:
+			err = p.parseKeyValue(p.current)
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.endLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTableHeader reads [a.b] and makes it the current table
+func (p *parser) parseTableHeader() error {
+	p.pos++
+	p.skipSpace()
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if p.peek() != ']' {
+		return p.errorf("expected ] to close table header")
+	}
+	p.pos++
+
+	parent, err := p.walkHeader(keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	switch existing := parent.values[last].(type) {
+	case nil:
+		t := &table{values: map[string]any{}, explicit: true}
+		parent.values[last] = t
+		p.current = t
+	case *table:
+		if existing.explicit || existing.dotted || existing.inline {
+			return p.errorf("table %s is already defined", strings.Join(keys, "."))
+		}
+		existing.explicit = true
+		p.current = existing
+	default:
+		return p.errorf("key %s is already defined", strings.Join(keys, "."))
+	}
+	return nil
+}
+
+// parseArrayTableHeader reads [[a.b]] and makes a new table appended to the
+// array the current table
+func (p *parser) parseArrayTableHeader() error {
+	p.pos += 2
+	p.skipSpace()
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if !p.hasPrefix("]]") {
+		return p.errorf("expected ]] to close array of tables header")
+	}
+	p.pos += 2
+
+	parent, err := p.walkHeader(keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	t := &table{values: map[string]any{}, explicit: true}
+	switch existing := parent.values[last].(type) {
+	case nil:
+		parent.values[last] = &tableArray{tables: []*table{t}}
+	case *tableArray:
+		existing.tables = append(existing.tables, t)
+	default:
+		return p.errorf("key %s is already defined", strings.Join(keys, "."))
+	}
+	p.current = t
+	return nil
+}
+
+// walkHeader returns the table a header's keys lead to from the root,
+// creating missing tables. Keys naming an array of tables continue in its
+// last table.
+func (p *parser) walkHeader(keys []string) (*table, error) {
+	t := p.root
+	for i, key := range keys {
+		switch next := t.values[key].(type) {
+		case nil:
+			created := &table{values: map[string]any{}}
+			t.values[key] = created
+			t = created
+		case *table:
+			if next.inline {
+				return nil, p.errorf("inline table %s cannot be extended", strings.Join(keys[:i+1], "."))
+			}
+			t = next
+		case *tableArray:
+			t = next.tables[len(next.tables)-1]
+		default:
+			return nil, p.errorf("key %s is not a table", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return t, nil
+}
+
+// parseKeyValue reads key = value into t
+func (p *parser) parseKeyValue(t *table) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if p.peek() != '=' {
+		return p.errorf("expected = after key %s", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpace()
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys[:len(keys)-1] {
+		switch next := t.values[key].(type) {
+		case nil:
+			created := &table{values: map[string]any{}, dotted: true}
+			t.values[key] = created
+			t = created
+		case *table:
+			if next.explicit || next.inline {
+				return p.errorf("table %s cannot be extended with dotted keys", strings.Join(keys[:i+1], "."))
+			}
+			t = next
+		default:
+			return p.errorf("key %s is not a table", strings.Join(keys[:i+1], "."))
+		}
+	}
+	last := keys[len(keys)-1]
+	if _, exists := t.values[last]; exists {
+		return p.errorf("key %s is already defined", strings.Join(keys, "."))
+	}
+	t.values[last] = value
+	return nil
+}
+
+// parseKey reads a possibly dotted key
+func (p *parser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		key, err := p.parseSimpleKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		p.skipSpace()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+		p.skipSpace()
+	}
+}
+
+func (p *parser) parseSimpleKey() (string, error) {
+	switch p.peek() {
+	case '"':
+		if p.hasPrefix(`"""`) {
+			return "", p.errorf("keys cannot be multi-line strings")
+		}
+		return p.parseBasicString()
+	case '\'':
+		if p.hasPrefix("'''") {
+			return "", p.errorf("keys cannot be multi-line strings")
+		}
+		return p.parseLiteralString()
+	}
+	start := p.pos
+	for !p.eof() && isBareKeyChar(p.peek()) {
+		p.pos++
+	}
+	if p.pos == start {
+		if p.eof() {
+			return "", p.errorf("expected a key")
+		}
+		return "", p.errorf("unexpected %q, expected a key", p.peek())
+	}
+	return p.text[start:p.pos], nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *parser) parseValue() (any, error) {
+	switch {
+	case p.eof():
+		return nil, p.errorf("expected a value")
+	case p.hasPrefix(`"""`):
+		return p.parseMultilineBasicString()
+	case p.peek() == '"':
+		return p.parseBasicString()
+	case p.hasPrefix("'''"):
+		return p.parseMultilineLiteralString()
+	case p.peek() == '\'':
+		return p.parseLiteralString()
+	case p.peek() == '[':
+		return p.parseArray()
+	case p.peek() == '{':
+		return p.parseInlineTable()
+	}
+	return p.parseScalar()
+}
+
+func (p *parser) parseBasicString() (string, error) {
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		switch {
+		case c == '"':
+			p.pos++
+			return sb.String(), nil
+		case c == '\\':
+			if err := p.parseEscape(&sb); err != nil {
+				return "", err
+			}
+		default:
+			if err := p.copyChar(&sb); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+func (p *parser) parseMultilineBasicString() (string, error) {
+	p.pos += 3
+	p.skipNewline()
+	var sb strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated multi-line string")
+		}
+		switch {
+		case p.hasPrefix(`"""`):
+			// Up to two quotes may directly precede the closing delimiter
+			extra := 0
+			for extra < 2 && strings.HasPrefix(p.text[p.pos+3+extra:], `"`) {
+				extra++
+			}
+			sb.WriteString(strings.Repeat(`"`, extra))
+			p.pos += 3 + extra
+			return sb.String(), nil
+		case p.peek() == '\\' && p.lineEndingBackslash():
+			// A backslash ending a line trims the whitespace up to the
+			// next non-blank character
+			p.pos++
+			for !p.eof() {
+				if p.peek() == ' ' || p.peek() == '\t' {
+					p.pos++
+				} else if !p.skipNewline() {
+					break
+				}
+			}
+		case p.peek() == '\\':
+			if err := p.parseEscape(&sb); err != nil {
+				return "", err
+			}
+		case p.skipNewline():
+			sb.WriteByte('\n')
+		default:
+			if err := p.copyChar(&sb); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// lineEndingBackslash reports whether the backslash at the current position
+// is only followed by whitespace up to the end of the line
+func (p *parser) lineEndingBackslash() bool {
+	rest := p.text[p.pos+1:]
+	trimmed := strings.TrimLeft(rest, " \t")
+	return strings.HasPrefix(trimmed, "\n") || strings.HasPrefix(trimmed, "\r\n")
+}
+
+func (p *parser) parseLiteralString() (string, error) {
+	p.pos++
+	start := p.pos
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		if p.peek() == '\'' {
+			s := p.text[start:p.pos]
+			p.pos++
+			return s, nil
+		}
+		if isControl(p.peek()) {
+			return "", p.errorf("control character %q in string", p.peek())
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) parseMultilineLiteralString() (string, error) {
+	p.pos += 3
+	p.skipNewline()
+	var sb strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated multi-line string")
+		}
+		switch {
+		case p.hasPrefix("'''"):
+			extra := 0
+			for extra < 2 && strings.HasPrefix(p.text[p.pos+3+extra:], "'") {
+				extra++
+			}
+			sb.WriteString(strings.Repeat("'", extra))
+			p.pos += 3 + extra
+			return sb.String(), nil
+		case p.skipNewline():
+			sb.WriteByte('\n')
+		case isControl(p.peek()):
+			return "", p.errorf("control character %q in string", p.peek())
+		default:
+			sb.WriteByte(p.peek())
+			p.pos++
+		}
+	}
+}
+
+// copyChar copies the character at the current position into a string
+func (p *parser) copyChar(sb *strings.Builder) error {
+	if isControl(p.peek()) {
+		return p.errorf("control character %q in string", p.peek())
+	}
+	sb.WriteByte(p.peek())
+	p.pos++
+	return nil
+}
+
+func isControl(c byte) bool {
+	return c < 0x20 && c != '\t' || c == 0x7f
+}
+
+// parseEscape decodes the escape sequence at the current position
+func (p *parser) parseEscape(sb *strings.Builder) error {
+	p.pos++
+	if p.eof() {
+		return p.errorf("unterminated escape sequence")
+	}
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		sb.WriteByte('\b')
+	case 't':
+		sb.WriteByte('\t')
+	case 'n':
+		sb.WriteByte('\n')
+	case 'f':
+		sb.WriteByte('\f')
+	case 'r':
+		sb.WriteByte('\r')
+	case '"':
+		sb.WriteByte('"')
+	case '\\':
+		sb.WriteByte('\\')
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.text) {
+			return p.errorf("short unicode escape")
+		}
+		code, err := strconv.ParseUint(p.text[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return p.errorf("invalid unicode escape \\%c%s", c, p.text[p.pos:p.pos+n])
+		}
+		sb.WriteRune(rune(code))
+		p.pos += n
+	default:
+		return p.errorf("invalid escape sequence \\%c", c)
+	}
+	return nil
+}
+
+func (p *parser) parseArray() ([]any, error) {
+	p.pos++
+	items := []any{}
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos++
+			return items, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return items, nil
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *parser) parseInlineTable() (*table, error) {
+	p.pos++
+	t := &table{values: map[string]any{}}
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.pos++
+		t.inline = true
+		return t, nil
+	}
+	for {
+		p.skipSpace()
+		if err := p.parseKeyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			// Tables created by dotted keys inside are sealed as well
+			seal(t)
+			return t, nil
+		default:
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// seal marks an inline table and the tables within it as complete
+func seal(t *table) {
+	t.inline = true
+	for _, value := range t.values {
+		if nested, ok := value.(*table); ok {
+			seal(nested)
+		}
+	}
+}
+
+// parseScalar reads a boolean, number or date-time
+func (p *parser) parseScalar() (any, error) {
+	start := p.pos
+	for !p.eof() && isScalarChar(p.peek()) {
+		p.pos++
+	}
+	// A date and a time may be separated by a space
+	if isDate(p.text[start:p.pos]) && p.pos+3 < len(p.text) && p.text[p.pos] == ' ' && isDigit(p.text[p.pos+1]) && isDigit(p.text[p.pos+2]) && p.text[p.pos+3] == ':' {
+		p.pos++
+		for !p.eof() && isScalarChar(p.peek()) {
+			p.pos++
+		}
+	}
+	token := p.text[start:p.pos]
+	if token == "" {
+		return nil, p.errorf("unexpected %q, expected a value", p.peek())
+	}
+
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan", "+nan", "-nan":
+		return math.NaN(), nil
+	}
+	if value, ok := parseDateTime(token); ok {
+		return value, nil
+	}
+	if value, ok := parseInteger(token); ok {
+		return value, nil
+	}
+	if value, ok := parseFloat(token); ok {
+		return value, nil
+	}
+	return nil, p.errorf("invalid value %q", token)
+}
+
+func isScalarChar(c byte) bool {
+	return isBareKeyChar(c) || c == '+' || c == '.' || c == ':'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isDate(s string) bool {
+	_, err := time.Parse("2006-01-02", s)
+	return err == nil
+}
+
+// parseDateTime parses the four kinds of TOML date-times
+func parseDateTime(token string) (any, bool) {
+	normalised := strings.ToUpper(strings.Replace(token, " ", "T", 1))
+	if t, err := time.Parse(time.RFC3339Nano, normalised); err == nil {
+		return t, true
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02", "15:04:05.999999999"} {
+		if _, err := time.Parse(layout, normalised); err == nil {
+			return normalised, true
+		}
+	}
+	return nil, false
+}
+
+// parseInteger parses decimal integers and hexadecimal, octal and binary
+// ones with their 0x, 0o and 0b prefixes
+func parseInteger(token string) (int64, bool) {
+	base := 10
+	digits := token
+	switch {
+	case strings.HasPrefix(token, "0x"):
+		base, digits = 16, token[2:]
+	case strings.HasPrefix(token, "0o"):
+		base, digits = 8, token[2:]
+	case strings.HasPrefix(token, "0b"):
+		base, digits = 2, token[2:]
+	}
+	unsigned := strings.TrimLeft(digits, "+-")
+	if base == 10 {
+		if len(digits)-len(unsigned) > 1 || len(unsigned) > 1 && unsigned[0] == '0' {
+			return 0, false
+		}
+	} else if unsigned != digits {
+		return 0, false
+	}
+	if !validUnderscores(unsigned) {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(digits, "_", ""), base, 64)
+	return n, err == nil
+}
+
+func parseFloat(token string) (float64, bool) {
+	unsigned := strings.TrimLeft(token, "+-")
+	if len(token)-len(unsigned) > 1 || unsigned == "" || !isDigit(unsigned[0]) {
+		return 0, false
+	}
+	mantissa, _, _ := strings.Cut(strings.ToLower(unsigned), "e")
+	integer, fraction, hasFraction := strings.Cut(mantissa, ".")
+	if len(integer) > 1 && integer[0] == '0' || hasFraction && (fraction == "" || !isDigit(fraction[0])) {
+		return 0, false
+	}
+	for _, part := range strings.FieldsFunc(unsigned, func(r rune) bool { return r == '.' || r == 'e' || r == 'E' || r == '+' || r == '-' }) {
+		if !validUnderscores(part) {
+			return 0, false
+		}
+	}
+	f, err := strconv.ParseFloat(strings.ReplaceAll(token, "_", ""), 64)
+	return f, err == nil
+}
+
+// validUnderscores reports whether every underscore in digits sits between
+// two digits
+func validUnderscores(digits string) bool {
+	if digits == "" {
+		return false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] == '_' && (i == 0 || i == len(digits)-1 || digits[i-1] == '_' || digits[i+1] == '_') {
+			return false
+		}
+	}
+	return true
+}
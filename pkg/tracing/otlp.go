@@ -0,0 +1,217 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config configures the export of spans
+type Config struct {
+	// Endpoint is the URL spans are posted to, such as
+	// http://localhost:4318/v1/traces. Tracing is disabled when it is empty.
+	Endpoint string
+	// Service names the process in the exported spans
+	Service string
+	// Headers are sent with every export, such as an API key
+	Headers map[string]string
+}
+
+// Environment variables read by ConfigFromEnv, as defined by OpenTelemetry
+const (
+	EnvEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	EnvTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	EnvHeaders        = "OTEL_EXPORTER_OTLP_HEADERS"
+	EnvServiceName    = "OTEL_SERVICE_NAME"
+)
+
+// DefaultService is the service name of spans when none is configured
+const DefaultService = "msc"
+
+// ConfigFromEnv reads the configuration from the standard OpenTelemetry
+// environment variables. OTEL_EXPORTER_OTLP_ENDPOINT is the collector's
+// base URL, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT the full URL of its traces
+// endpoint, and OTEL_EXPORTER_OTLP_HEADERS a list of key=value pairs
+// separated by commas.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Endpoint: os.Getenv(EnvTracesEndpoint),
+		Service:  os.Getenv(EnvServiceName),
+	}
+	if cfg.Endpoint == "" {
+		if base := os.Getenv(EnvEndpoint); base != "" {
+			cfg.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if value := os.Getenv(EnvHeaders); value != "" {
+		cfg.Headers = make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return cfg, fmt.Errorf("%s: %q is not key=value", EnvHeaders, pair)
+			}
+			cfg.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return cfg, nil
+}
+
+// New returns a tracer exporting to the configured endpoint, or nil when
+// none is configured
+func New(cfg Config) (*Tracer, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(cfg.Endpoint, "http://") && !strings.HasPrefix(cfg.Endpoint, "https://") {
+		return nil, fmt.Errorf("trace endpoint %q is not an http or https URL", cfg.Endpoint)
+	}
+	if cfg.Service == "" {
+		cfg.Service = DefaultService
+	}
+	return NewTracer(&otlpExporter{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}}), nil
+}
+
+// otlpExporter posts spans in the JSON encoding of OTLP over HTTP
+type otlpExporter struct {
+	cfg    Config
+	client *http.Client
+}
+
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              SpanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// otlpStatusError is the status code of failed operations
+const otlpStatusError = 2
+
+func (e *otlpExporter) Export(ctx context.Context, spans []*Span) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/robert-cronin/mindscript-go"}}
+	for _, span := range spans {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        attributes(span.Attributes),
+		}
+		if span.Parent != (SpanID{}) {
+			out.ParentSpanID = hex.EncodeToString(span.Parent[:])
+		}
+		if span.Error != "" {
+			out.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		scope.Spans = append(scope.Spans, out)
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attributes(map[string]any{"service.name": e.cfg.Service})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("exporting spans: %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// attributes encodes attributes as OTLP key values, sorted by key
+func attributes(values map[string]any) []otlpAttribute {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value map[string]any
+		switch v := values[key].(type) {
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpAttribute{Key: key, Value: value})
+	}
+	return out
+}
@@ -0,0 +1,315 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the tracing package records OpenTelemetry spans of the work agents do and
+// exports them to a collector with OTLP over HTTP. Trace context travels
+// between processes in the W3C traceparent format, so the handlers of
+// events emitted to other msc processes join the trace of the emitting
+// handler.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// TraceID identifies a trace and SpanID a span within it
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+// SpanContext identifies a span across processes
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether sc identifies a span
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceparentHeader is the header carrying the trace context of requests
+const TraceparentHeader = "traceparent"
+
+// Traceparent formats sc as a W3C traceparent, empty when it is invalid
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+// ParseTraceparent parses a W3C traceparent such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %w", value, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %w", value, err)
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", value)
+	}
+	return sc, nil
+}
+
+// Extract returns the span context of a request's traceparent header, an
+// invalid one when it has none
+func Extract(header http.Header) SpanContext {
+	sc, _ := ParseTraceparent(header.Get(TraceparentHeader))
+	return sc
+}
+
+// Inject sets the traceparent header of a request to sc
+func Inject(header http.Header, sc SpanContext) {
+	if sc.IsValid() {
+		header.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+type contextKey struct{}
+
+// ContextWithSpanContext returns a context carrying sc, the parent of the
+// spans started for work done on the context's behalf
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context ctx carries
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(contextKey{}).(SpanContext)
+	return sc
+}
+
+// SpanKind is the role of a span in a trace, as defined by OpenTelemetry
+type SpanKind int
+
+const (
+	KindInternal SpanKind = iota + 1
+	KindServer
+	KindClient
+	KindProducer
+	KindConsumer
+)
+
+// Span is a timed operation of a trace. Its methods may be called on a nil
+// Span, which is what a nil Tracer starts, so callers need not check
+// whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	ended  bool
+
+	Name    string
+	Kind    SpanKind
+	Context SpanContext
+	// Parent is the parent's span ID, zero for the root of a trace
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	// Error is the failure of the operation, empty when it succeeded
+	Error string
+}
+
+// SpanContext returns the span's context, the zero SpanContext of a nil span
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// SetAttribute records a string, bool, int or float64 value describing the
+// operation
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the operation as failed with err
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// Finish ends the span and queues it for export. Later calls do nothing.
+func (s *Span) Finish() {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.tracer.queue(s)
+}
+
+// Tracer starts spans and exports them in batches
+type Tracer struct {
+	exporter Exporter
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []*Span
+	dropped int
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+// Batching of exported spans: spans are exported every exportInterval, or
+// as soon as batchSize are waiting. Spans beyond maxPending are dropped
+// when the backend cannot keep up.
+const (
+	exportInterval = 5 * time.Second
+	batchSize      = 512
+	maxPending     = 4096
+)
+
+// NewTracer returns a tracer exporting its spans with exporter. It must be
+// shut down to export the last spans.
+func NewTracer(exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		interval: exportInterval,
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+// Start starts a span, a child of parent when it is valid and the root of a
+// new trace otherwise. A nil tracer returns a nil span.
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]any),
+	}
+	span.Context.TraceID = parent.TraceID
+	if parent.IsValid() {
+		span.Parent = parent.SpanID
+	} else {
+		randomID(span.Context.TraceID[:])
+	}
+	randomID(span.Context.SpanID[:])
+	return span
+}
+
+func randomID(id []byte) {
+	for i := range id {
+		id[i] = byte(rand.Uint32())
+	}
+}
+
+func (t *Tracer) queue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPending {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, span)
+	if len(t.pending) == batchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		case <-t.flush:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), t.interval)
+		t.export(ctx)
+		cancel()
+	}
+}
+
+// export sends the pending spans in batches
+func (t *Tracer) export(ctx context.Context) error {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		logger.Log.Warnw("Dropped spans the tracing backend could not keep up with", zap.Int("spans", dropped))
+	}
+	for len(spans) > 0 {
+		n := min(len(spans), batchSize)
+		if err := t.exporter.Export(ctx, spans[:n]); err != nil {
+			logger.Log.Warnw("Error exporting spans", zap.Int("spans", len(spans)), zap.Error(err))
+			return err
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+// Shutdown exports the remaining spans. Spans finished later are not
+// exported.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	close(t.done)
+	t.wg.Wait()
+	return t.export(ctx)
+}
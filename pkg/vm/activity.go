@@ -0,0 +1,196 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kinds of activity recorded for an agent
+const (
+	// ActivityEvent records an event delivered to the agent's handlers
+	ActivityEvent = "event"
+	// ActivityHandler records a handler that ran, with how long it took
+	ActivityHandler = "handler"
+	// ActivityBuiltin records a builtin a handler called
+	ActivityBuiltin = "builtin"
+	// ActivityError records a failed handler, including handlers stopped
+	// for exceeding the agent's quota
+	ActivityError = "error"
+)
+
+// DefaultActivityLogSize is how many entries msc serve keeps for each agent
+const DefaultActivityLogSize = 256
+
+// Activity is an entry of an agent's activity log
+type Activity struct {
+	// Seq numbers the entries of all agents in the order they were recorded
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Event is the event that was delivered or being handled
+	Event    string        `json:"event,omitempty"`
+	Builtin  string        `json:"builtin,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	// Message is the error of a failed handler
+	Message string `json:"message,omitempty"`
+}
+
+// ActivityQuery selects entries of an activity log, its zero value selects
+// all of them
+type ActivityQuery struct {
+	// Kind selects the entries of a kind
+	Kind string
+	// Since selects the entries recorded at or after a time, and After the
+	// entries following the one with that Seq
+	Since time.Time
+	After int
+	// Limit keeps the most recent entries
+	Limit int
+}
+
+// WithActivityLog keeps the last size events, handler runs, builtin calls
+// and failures of each agent, see VM.Activity. Zero, the default, records
+// nothing.
+func WithActivityLog(size int) Option {
+	return func(vm *VM) {
+		vm.activitySize = size
+	}
+}
+
+// activityLog is a ring buffer of an agent's most recent activity
+type activityLog struct {
+	entries []Activity
+	// oldest is the index of the oldest entry once the buffer is full
+	oldest int
+}
+
+func (l *activityLog) add(size int, entry Activity) {
+	if len(l.entries) < size {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.oldest] = entry
+	l.oldest = (l.oldest + 1) % len(l.entries)
+}
+
+// list returns the entries from the oldest to the most recent
+func (l *activityLog) list() []Activity {
+	return append(append([]Activity(nil), l.entries[l.oldest:]...), l.entries[:l.oldest]...)
+}
+
+// record adds an entry to an agent's activity log
+func (vm *VM) record(agent *Agent, entry Activity) {
+	if vm.activitySize <= 0 {
+		return
+	}
+	vm.activitySeq++
+	entry.Seq = vm.activitySeq
+	entry.Time = time.Now()
+	agent.activity.add(vm.activitySize, entry)
+}
+
+// builtinOpcodes names the opcodes of the language's builtins
+var builtinOpcodes = map[Opcode]string{
+	OpLog:             "log",
+	OpPrint:           "print",
+	OpSyscall:         "syscall",
+	OpExec:            "exec",
+	OpStringLength:    "len",
+	OpSend:            "send",
+	OpReceive:         "receive",
+	OpEmit:            "emit",
+	OpAsk:             "ask",
+	OpReply:           "reply",
+	OpSpawn:           "spawn",
+	OpSelf:            "self",
+	OpLLM:             "llm",
+	OpPrompt:          "prompt",
+	OpRemember:        "remember",
+	OpRecall:          "recall",
+	OpForget:          "forget",
+	OpObserve:         "observe",
+	OpRecent:          "recent",
+	OpSession:         "session",
+	OpSessionRemember: "sessionRemember",
+	OpSessionRecall:   "sessionRecall",
+	OpSessionHistory:  "sessionHistory",
+	OpEmbed:           "embed",
+	OpIndex:           "index",
+	OpSearch:          "search",
+	OpMCP:             "mcp",
+	OpSort:            "sort",
+	OpReduce:          "reduce",
+	OpFilter:          "filter",
+	OpMapList:         "map",
+	OpTOMLParse:       "tomlParse",
+	OpYAMLParse:       "yamlParse",
+	OpQueryParam:      "queryParam",
+	OpURLEncode:       "urlEncode",
+	OpURLParse:        "urlParse",
+	OpFormat:          "format",
+	OpSQLQuery:        "sqlQuery",
+	OpUUID:            "uuid",
+	OpAssert:          "assert",
+	OpTypeOf:          "typeof",
+	OpToBool:          "bool",
+	OpToString:        "string",
+	OpToFloat:         "float",
+	OpToInt:           "int",
+	OpChoice:          "choice",
+	OpRandomInt:       "randomInt",
+	OpRandom:          "random",
+	OpArgs:            "args",
+	OpEnv:             "env",
+}
+
+// recordBuiltin records the builtin called by an instruction of the running
+// handler, if it calls one
+func (vm *VM) recordBuiltin(instr Instruction) {
+	name, ok := builtinOpcodes[instr.Opcode]
+	if instr.Opcode == OpCallBuiltin && len(vm.stack) > 0 {
+		name, ok = vm.stack[len(vm.stack)-1].(string)
+	}
+	if ok {
+		vm.record(vm.self, Activity{Kind: ActivityBuiltin, Event: vm.event.Name, Builtin: name})
+	}
+}
+
+// Activity returns the entries of an agent's activity log selected by
+// query, from the oldest to the most recent. The log is empty unless the VM
+// was created WithActivityLog.
+func (vm *VM) Activity(name string, query ActivityQuery) ([]Activity, error) {
+	agent, ok := vm.Agent(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAgent, name)
+	}
+	entries := []Activity{}
+	vm.do(func() {
+		for _, entry := range agent.activity.list() {
+			if query.Kind != "" && entry.Kind != query.Kind ||
+				entry.Time.Before(query.Since) || entry.Seq <= query.After {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	})
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	return entries, nil
+}
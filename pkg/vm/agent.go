@@ -0,0 +1,458 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// DefaultMailboxCapacity is the number of messages an agent's mailbox holds
+// before backpressure applies
+const DefaultMailboxCapacity = 64
+
+// Backpressure decides what happens to a message sent to a full mailbox
+type Backpressure int
+
+const (
+	// BackpressureFail rejects the message with ErrMailboxFull
+	BackpressureFail Backpressure = iota
+	// BackpressureDropNewest discards the message being sent
+	BackpressureDropNewest
+	// BackpressureDropOldest discards the oldest queued message to make room
+	BackpressureDropOldest
+)
+
+// Agent is the runtime instance of an agent declaration. Agents communicate
+// by sending messages to each other's mailboxes rather than sharing
+// variables.
+type Agent struct {
+	// Name identifies the agent. The agent created by a declaration has the
+	// declaration's name, instances spawned from it are numbered, such as
+	// Worker#2.
+	Name string
+	// Declaration is the name of the agent declaration the agent was
+	// created from
+	Declaration  string
+	Goal         string
+	Capabilities []string
+	Handlers     []EventHandler
+	// Functions names the functions declared in the agent's declaration
+	Functions []string
+
+	mailbox *mailbox
+	// state holds the agent's state variables and initial the values they
+	// were declared with, saved is the state restored from the VM's store.
+	// dirty is set when a handler changes the state and cleared once saved.
+	state   map[string]Value
+	initial map[string]Value
+	saved   map[string]Value
+	dirty   bool
+	// memory is the agent's long-term memory and memoryDirty is set when a
+	// handler changes it. recent is its conversation buffer.
+	memory      map[string]Value
+	memoryDirty bool
+	recent      []Value
+	// supervision is how the agent recovers from failing handlers, nil when
+	// failures are left to error handlers. failures holds when its handlers
+	// failed since it last started, backoffs counts its consecutive backoffs
+	// and resumed is when it last came back from one.
+	supervision *Supervision
+	failures    []time.Time
+	backoffs    int
+	resumed     time.Time
+	// parent is the agent that spawned it, escalated failures go to it
+	parent *Agent
+	// suspended is set while the agent waits out a backoff, it receives no
+	// events meanwhile
+	suspended atomic.Bool
+	// stopped is set once the agent has handled its stop event
+	stopped atomic.Bool
+	// quota limits the agent's resources, execs and tokens record its
+	// recent exec calls and token usage
+	quota  Quota
+	execs  []time.Time
+	tokens []tokenUse
+	// activity is its activity log, written by the VM's goroutine
+	activity activityLog
+}
+
+// String returns the agent's name
+func (a *Agent) String() string {
+	return a.Name
+}
+
+// References returns the queued messages, the state and the memory for the
+// garbage collector
+func (a *Agent) References() []Value {
+	a.mailbox.mu.Lock()
+	references := append([]Value(nil), a.mailbox.messages...)
+	a.mailbox.mu.Unlock()
+	for _, value := range a.state {
+		references = append(references, value)
+	}
+	for _, value := range a.initial {
+		references = append(references, value)
+	}
+	for _, value := range a.memory {
+		references = append(references, value)
+	}
+	references = append(references, a.recent...)
+	return references
+}
+
+// Send delivers a message to the agent's mailbox. It is safe to call from
+// other goroutines while the VM runs, so hosts can feed agents that are
+// blocked receiving. It reports whether the message was queued, which is
+// false when the backpressure policy dropped it.
+func (a *Agent) Send(message Value) (bool, error) {
+	return a.mailbox.send(normaliseValue(message))
+}
+
+// Stopped reports whether the agent has been stopped and no longer receives
+// events
+func (a *Agent) Stopped() bool {
+	return a.stopped.Load()
+}
+
+// HasCapability reports whether the agent declares a capability
+func (a *Agent) HasCapability(capability string) bool {
+	for _, declared := range a.Capabilities {
+		if declared == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// receives reports whether an event is delivered to the agent. Stopped
+// agents receive no events and suspended ones only the stop event.
+func (a *Agent) receives(event Event) bool {
+	if a.stopped.Load() {
+		return false
+	}
+	return event.stop || !a.suspended.Load()
+}
+
+// handles reports whether the agent has a handler for the event
+func (a *Agent) handles(event string) bool {
+	for _, handler := range a.Handlers {
+		if handler.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the number of messages waiting in the agent's mailbox
+func (a *Agent) Pending() int {
+	a.mailbox.mu.Lock()
+	defer a.mailbox.mu.Unlock()
+	return len(a.mailbox.messages)
+}
+
+// mailbox is a bounded queue of messages guarded by a mutex
+type mailbox struct {
+	mu           sync.Mutex
+	messages     []Value
+	capacity     int
+	backpressure Backpressure
+	// arrived is signalled whenever a message is queued, waking a blocked
+	// receiver
+	arrived chan struct{}
+}
+
+func newMailbox(capacity int, backpressure Backpressure) *mailbox {
+	return &mailbox{
+		capacity:     capacity,
+		backpressure: backpressure,
+		arrived:      make(chan struct{}, 1),
+	}
+}
+
+func (m *mailbox) send(message Value) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.capacity > 0 && len(m.messages) >= m.capacity {
+		switch m.backpressure {
+		case BackpressureDropNewest:
+			return false, nil
+		case BackpressureDropOldest:
+			m.messages[0] = nil
+			m.messages = m.messages[1:]
+		default:
+			return false, fmt.Errorf("%w: %d messages queued", ErrMailboxFull, len(m.messages))
+		}
+	}
+	m.messages = append(m.messages, message)
+	select {
+	case m.arrived <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// receive takes the oldest message. When block is set it waits for one to
+// arrive, giving up with ErrTimeout at the deadline unless it is zero. While
+// waiting, serve is called whenever interrupt fires.
+func (m *mailbox) receive(block bool, deadline time.Time, interrupt <-chan struct{}, serve func()) (Value, error) {
+	var expired <-chan time.Time
+	for {
+		m.mu.Lock()
+		if len(m.messages) > 0 {
+			message := m.messages[0]
+			m.messages[0] = nil
+			m.messages = m.messages[1:]
+			m.mu.Unlock()
+			return message, nil
+		}
+		m.mu.Unlock()
+		if !block {
+			return nil, nil
+		}
+
+		if expired == nil && !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-m.arrived:
+		case <-interrupt:
+			serve()
+		case <-expired:
+			return nil, fmt.Errorf("%w while waiting for a message", ErrTimeout)
+		}
+	}
+}
+
+// WithMailboxCapacity sets how many messages each agent's mailbox holds
+// before backpressure applies. Zero makes mailboxes unbounded.
+func WithMailboxCapacity(n int) Option {
+	return func(vm *VM) {
+		vm.mailboxCapacity = n
+	}
+}
+
+// WithBackpressure sets what happens to messages sent to a full mailbox,
+// BackpressureFail by default
+func WithBackpressure(backpressure Backpressure) Option {
+	return func(vm *VM) {
+		vm.backpressure = backpressure
+	}
+}
+
+// Agent returns the agent with the given name once the program has created
+// it
+func (vm *VM) Agent(name string) (*Agent, bool) {
+	vm.agentsMu.RLock()
+	defer vm.agentsMu.RUnlock()
+	agent, ok := vm.agents[name]
+	return agent, ok
+}
+
+// Agents returns the agents the program has created, in order of creation
+func (vm *VM) Agents() []*Agent {
+	vm.agentsMu.RLock()
+	defer vm.agentsMu.RUnlock()
+	return append([]*Agent(nil), vm.agentList...)
+}
+
+// createAgent runs OpCreateAgent: the agent's name is on the stack and the
+// new agent is stored in the global slot of the declaration
+func (vm *VM) createAgent(index int) {
+	name, ok := vm.popStack().(string)
+	if !ok {
+		vm.fail(fmt.Errorf("agent %d has no name", index))
+		return
+	}
+	agent := &Agent{Name: name, Declaration: name, mailbox: newMailbox(vm.mailboxCapacity, vm.backpressure)}
+	vm.alloc(agent)
+	if !vm.setGlobal(index, agent) || !vm.loadState(agent) {
+		return
+	}
+	vm.addAgent(agent)
+	// The agent's handlers are registered by the instructions that follow,
+	// they run once the event is dispatched
+	vm.postEvent(Event{Agent: name, Name: StartEvent})
+}
+
+// addAgentFunction runs OpAddAgentFunction: the index of a function
+// declared in the agent is on the stack
+func (vm *VM) addAgentFunction(index int) {
+	value := vm.popStack()
+	functionIndex, ok := value.(int)
+	if !ok || functionIndex < 0 || functionIndex >= len(vm.functions) {
+		vm.fail(fmt.Errorf("cannot add %v as a function of an agent", value))
+		return
+	}
+	agent, ok := vm.globalAgent(index)
+	if !ok {
+		return
+	}
+	agent.Functions = append(agent.Functions, vm.functions[functionIndex].Name)
+}
+
+// AgentFunction is a function declared in an agent
+type AgentFunction struct {
+	Function
+	// Agent is the name of the agent declaring the function and Goal its
+	// goal
+	Agent string
+	Goal  string
+}
+
+// AgentFunctions returns the functions declared in the agents the program
+// created, in order of declaration. Spawned instances share the functions
+// of their declaration and are left out.
+func (vm *VM) AgentFunctions() []AgentFunction {
+	var functions []AgentFunction
+	vm.do(func() {
+		for _, agent := range vm.Agents() {
+			if agent.Name != agent.Declaration {
+				continue
+			}
+			for _, name := range agent.Functions {
+				if index := vm.functionIndex(name); index >= 0 {
+					functions = append(functions, AgentFunction{Function: vm.functions[index], Agent: agent.Name, Goal: agent.Goal})
+				}
+			}
+		}
+	})
+	return functions
+}
+
+// addAgent makes an agent known to the VM by its name
+func (vm *VM) addAgent(agent *Agent) {
+	vm.agentsMu.Lock()
+	defer vm.agentsMu.Unlock()
+	agent.quota = vm.quotaFor(agent.Declaration)
+	vm.agents[agent.Name] = agent
+	vm.agentList = append(vm.agentList, agent)
+	vm.instances[agent.Declaration]++
+}
+
+// spawn runs OpSpawn: the agent on the stack is replaced by a new instance
+// of its declaration. The instance has the declaration's goal, capabilities
+// and handlers but a mailbox, timers and state of its own, and receives the
+// start event like any other agent. The agent running the handler becomes
+// its parent.
+func (vm *VM) spawn() {
+	value := vm.popStack()
+	template, ok := value.(*Agent)
+	if !ok {
+		vm.fail(fmt.Errorf("cannot spawn an instance of %T", value))
+		return
+	}
+	vm.agentsMu.RLock()
+	name := fmt.Sprintf("%s#%d", template.Declaration, vm.instances[template.Declaration]+1)
+	vm.agentsMu.RUnlock()
+	agent := &Agent{
+		Name:         name,
+		Declaration:  template.Declaration,
+		Goal:         template.Goal,
+		Capabilities: append([]string(nil), template.Capabilities...),
+		Handlers:     append([]EventHandler(nil), template.Handlers...),
+		Functions:    template.Functions,
+		mailbox:      newMailbox(vm.mailboxCapacity, vm.backpressure),
+		supervision:  template.supervision,
+		parent:       vm.self,
+	}
+	vm.alloc(agent)
+	if !vm.spawnState(agent, template.initial) {
+		return
+	}
+	vm.addAgent(agent)
+	for _, handler := range agent.Handlers {
+		if spec, isTimer, _ := ParseTimerEvent(handler.Event); isTimer {
+			vm.schedule(agent.Name, handler.Event, spec)
+		}
+	}
+	logger.Log.Debugw("Spawned agent", zap.String("agent", name))
+	vm.postEvent(Event{Agent: name, Name: StartEvent})
+	vm.stack = append(vm.stack, agent)
+}
+
+// globalAgent returns the agent stored in a global slot
+func (vm *VM) globalAgent(index int) (*Agent, bool) {
+	value, ok := vm.getGlobal(index)
+	if !ok {
+		return nil, false
+	}
+	agent, ok := value.(*Agent)
+	if !ok {
+		vm.fail(fmt.Errorf("global %d holds %T, not an agent", index, value))
+		return nil, false
+	}
+	return agent, true
+}
+
+// sendMessage runs OpSend: the agent and the message are on the stack and
+// whether the message was queued replaces them
+func (vm *VM) sendMessage() {
+	message := vm.popStack()
+	target := vm.popStack()
+	agent, ok := target.(*Agent)
+	if !ok {
+		vm.fail(fmt.Errorf("cannot send a message to %T", target))
+		return
+	}
+	queued, err := agent.mailbox.send(message)
+	if err != nil {
+		vm.fail(fmt.Errorf("sending to agent %s: %w", agent.Name, err))
+		return
+	}
+	vm.stack = append(vm.stack, queued)
+}
+
+// receiveMessage runs OpReceive with argc arguments: the agent, optionally
+// followed by a bool choosing whether to block. The oldest message, or nil
+// when a non-blocking receive finds the mailbox empty, replaces them. A
+// blocking receive without a timeout configured waits until another
+// goroutine sends a message.
+func (vm *VM) receiveMessage(argc int) {
+	block := true
+	switch argc {
+	case 1:
+	case 2:
+		block = isTruthy(vm.popStack())
+	default:
+		vm.fail(fmt.Errorf("receive expects 1 or 2 arguments but got %d", argc))
+		return
+	}
+	source := vm.popStack()
+	agent, ok := source.(*Agent)
+	if !ok {
+		vm.fail(fmt.Errorf("cannot receive messages from %T", source))
+		return
+	}
+	var deadline time.Time
+	if vm.timeout > 0 {
+		deadline = vm.deadline
+	}
+	message, err := agent.mailbox.receive(block, deadline, vm.host.wake, vm.runCommands)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	vm.stack = append(vm.stack, message)
+}
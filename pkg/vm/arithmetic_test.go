@@ -0,0 +1,158 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// runBinary runs a binary operation on two operands loaded from the
+// constant pool and returns the result it stored in global 0
+func runBinary(t *testing.T, opcode Opcode, left, right Value) (Value, error) {
+	t.Helper()
+	program := &Program{
+		Constants: []Value{left, right},
+		Instructions: []Instruction{
+			{Opcode: OpConstant, Operand: 0},
+			{Opcode: OpConstant, Operand: 1},
+			{Opcode: opcode},
+			{Opcode: OpSetGlobal, Operand: 0},
+			{Opcode: OpHalt},
+		},
+	}
+	if err := program.Validate(); err != nil {
+		t.Fatalf("invalid program: %v", err)
+	}
+	machine := New(program)
+	if err := machine.Run(); err != nil {
+		return nil, err
+	}
+	return machine.Globals()[0], nil
+}
+
+func TestMixedArithmetic(t *testing.T) {
+	tests := []struct {
+		name        string
+		opcode      Opcode
+		left, right Value
+		want        Value
+	}{
+		{"int + int", OpAdd, 2, 3, 5},
+		{"int + float", OpAdd, 2, 0.5, 2.5},
+		{"float + int", OpAdd, 0.5, 2, 2.5},
+		{"float + float", OpAdd, 0.25, 0.5, 0.75},
+		{"int - float", OpSub, 3, 0.5, 2.5},
+		{"float - int", OpSub, 0.5, 3, -2.5},
+		{"int * float", OpMul, 3, 1.5, 4.5},
+		{"float * int", OpMul, 1.5, -2, -3.0},
+		{"int * int", OpMul, -4, 5, -20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runBinary(t, tt.opcode, tt.left, tt.right)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v (%T), want %v (%T)", got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestDivision(t *testing.T) {
+	tests := []struct {
+		name        string
+		left, right Value
+		want        Value
+		wantErr     error
+	}{
+		{"ints truncate", 7, 2, 3, nil},
+		{"negative ints truncate towards zero", -7, 2, -3, nil},
+		{"int by float", 7, 2.0, 3.5, nil},
+		{"float by int", 7.0, 2, 3.5, nil},
+		{"floats", 1.0, 4.0, 0.25, nil},
+		{"float by zero", 1.0, 0, math.Inf(1), nil},
+		{"negative int by float zero", -1, 0.0, math.Inf(-1), nil},
+		{"int by zero", 1, 0, nil, ErrDivisionByZero},
+		{"overflow", math.MinInt, -1, nil, ErrIntegerOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runBinary(t, OpDiv, tt.left, tt.right)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v (%T), want %v (%T)", got, got, tt.want, tt.want)
+			}
+		})
+	}
+
+	t.Run("zero by zero is NaN", func(t *testing.T) {
+		got, err := runBinary(t, OpDiv, 0.0, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if f, ok := got.(float64); !ok || !math.IsNaN(f) {
+			t.Errorf("got %v (%T), want NaN", got, got)
+		}
+	})
+}
+
+func TestMixedComparisons(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name        string
+		opcode      Opcode
+		left, right Value
+		want        bool
+	}{
+		{"int == float", OpEqual, 2, 2.0, true},
+		{"float == int", OpEqual, 2.5, 2, false},
+		{"int != float", OpNotEqual, 2, 2.5, true},
+		{"float != int", OpNotEqual, 3.0, 3, false},
+		{"int < float", OpLessThan, 2, 2.5, true},
+		{"float < int", OpLessThan, 2.5, 2, false},
+		{"int > float", OpGreaterThan, 3, 2.5, true},
+		{"float > int", OpGreaterThan, -0.5, 0, false},
+		{"int <= float", OpLessThanOrEqual, 2, 2.0, true},
+		{"float >= int", OpGreaterThanOrEqual, 1.999, 2, false},
+		{"NaN == NaN", OpEqual, nan, nan, false},
+		{"NaN < int", OpLessThan, nan, 1, false},
+		{"NaN >= int", OpGreaterThanOrEqual, nan, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runBinary(t, tt.opcode, tt.left, tt.right)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
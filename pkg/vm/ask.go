@@ -0,0 +1,235 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A handler calling ask(agent, event, payload) sends the event to the agent
+// and is suspended until the agent replies: its frames are saved as a
+// continuation and the VM goes on dispatching events, the asked agent's
+// handlers among them. A handler answers with reply(value), which becomes
+// the result of ask. When the agent's handlers finish without replying the
+// result is nil, when one of them fails ask fails too. Replies arriving
+// after the ask timeout fail the ask with ErrAskTimeout. Only agents of the
+// same VM can be asked, asking one reached through the VM's Remote fails
+// with ErrRemoteAsk.
+
+// DefaultAskTimeout is how long an agent waits for a reply by default
+const DefaultAskTimeout = 30 * time.Second
+
+// ErrAskTimeout is returned when an asked agent did not reply in time,
+// ErrRemoteAsk when the agent runs in another process
+var (
+	ErrAskTimeout = errors.New("ask timed out")
+	ErrRemoteAsk  = errors.New("agents of other processes cannot be asked")
+)
+
+// WithAskTimeout limits how long a handler waits for the reply to an ask,
+// zero removes the limit. DefaultAskTimeout applies otherwise.
+func WithAskTimeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.askTimeout = d
+	}
+}
+
+// continuation is a suspended handler: its frames, with bases relative to
+// the first one, their locals, the values it had on the stack and the pc of
+// the instruction following its ask
+type continuation struct {
+	agent  *Agent
+	event  Event
+	pc     int
+	frames []Frame
+	locals []Value
+	stack  []Value
+}
+
+// request is an event sent with ask
+type request struct {
+	// asker is the handler waiting for the reply
+	asker    *continuation
+	deadline time.Time
+	// pending counts the handlers of the asked agent that have not finished
+	pending  int
+	answered bool
+	reply    Value
+	err      error
+}
+
+// ask runs OpAsk with argc arguments: the agent, the event name and
+// optionally the payload. The handler is suspended once the event is posted
+// and continues with the reply on the stack.
+func (vm *VM) ask(argc int) {
+	var payload Value
+	switch argc {
+	case 2:
+	case 3:
+		payload = vm.popStack()
+	default:
+		vm.fail(fmt.Errorf("ask expects 2 or 3 arguments but got %d", argc))
+		return
+	}
+	name, ok := vm.popStack().(string)
+	if !ok {
+		vm.fail(fmt.Errorf("event name must be a string"))
+		return
+	}
+	target := vm.popStack()
+	// Only the frames of the handler itself can be saved, not those of host
+	// calls running inside it
+	if vm.self == nil || vm.calls != vm.handlerCall {
+		vm.fail(fmt.Errorf("ask used outside of an agent's event handler"))
+		return
+	}
+	if err := CheckTopicEvent(name, false); err != nil {
+		vm.fail(err)
+		return
+	}
+	if strings.HasPrefix(name, TopicEventPrefix) {
+		vm.fail(fmt.Errorf("topic event %s goes to every subscriber and cannot be asked", name))
+		return
+	}
+	var agentName string
+	switch t := target.(type) {
+	case *Agent:
+		agentName = t.Name
+	case string:
+		agentName = t
+	default:
+		vm.fail(fmt.Errorf("cannot ask %T", target))
+		return
+	}
+	if _, ok := vm.Agent(agentName); !ok {
+		if vm.remote != nil {
+			vm.fail(fmt.Errorf("%w: %s does not run in this VM, emit to it and have it emit back instead", ErrRemoteAsk, agentName))
+			return
+		}
+		vm.fail(fmt.Errorf("%w: %s, only agents of this VM can be asked", ErrUnknownAgent, agentName))
+		return
+	}
+
+	req := &request{}
+	if vm.askTimeout > 0 {
+		req.deadline = time.Now().Add(vm.askTimeout)
+	}
+	if vm.asks == nil {
+		vm.asks = make(map[*request]bool)
+	}
+	vm.asks[req] = true
+	vm.postEvent(Event{Agent: agentName, Name: name, Payload: payload, request: req})
+	vm.suspended = req
+}
+
+// replyTo runs OpReply: the value on the stack answers the ask the running
+// handler's event was sent with and is replaced by whether it did. Events
+// that were emitted or already answered are not.
+func (vm *VM) replyTo() {
+	value := vm.popStack()
+	if vm.self == nil {
+		vm.fail(fmt.Errorf("reply used outside of an agent's event handler"))
+		return
+	}
+	answered := vm.event.request != nil && vm.answer(vm.event.request, value, nil)
+	vm.stack = append(vm.stack, answered)
+}
+
+// answer completes a request, posting the event that resumes the asker. It
+// reports false when the request was already answered.
+func (vm *VM) answer(req *request, reply Value, err error) bool {
+	if req.answered {
+		return false
+	}
+	req.answered = true
+	if !req.deadline.IsZero() && time.Now().After(req.deadline) {
+		reply, err = nil, fmt.Errorf("%w after %s", ErrAskTimeout, vm.askTimeout)
+	}
+	req.reply, req.err = reply, err
+	vm.postEvent(Event{Agent: req.asker.agent.Name, reply: req})
+	return true
+}
+
+// finishRequest is called when a handler of an asked event finishes, the
+// request is answered with nil once all of them have without replying
+func (vm *VM) finishRequest(req *request) {
+	req.pending--
+	if req.pending == 0 {
+		vm.answer(req, nil, nil)
+	}
+}
+
+// saveContinuation saves the frames above callDepth and the values above
+// stackDepth of the handler being suspended
+func (vm *VM) saveContinuation(stackDepth, callDepth int) *continuation {
+	frames := append([]Frame(nil), vm.callStack[callDepth:]...)
+	base := frames[0].Base
+	for i := range frames {
+		frames[i].Base -= base
+	}
+	return &continuation{
+		agent:  vm.self,
+		event:  vm.event,
+		pc:     vm.pc,
+		frames: frames,
+		locals: append([]Value(nil), vm.locals[base:]...),
+		stack:  append([]Value(nil), vm.stack[stackDepth:]...),
+	}
+}
+
+// resume restores a suspended handler and runs it to completion, or until
+// it is suspended again. The result of its ask is the reply, or it fails
+// with the error answering the request.
+func (vm *VM) resume(c *continuation, reply Value, err error) (Value, error) {
+	pc, running := vm.pc, vm.running
+	stackDepth, callDepth := len(vm.stack), len(vm.callStack)
+	defer func() {
+		vm.pc, vm.running = pc, running
+	}()
+
+	base := len(vm.locals)
+	vm.locals = append(vm.locals, c.locals...)
+	for _, frame := range c.frames {
+		frame.Base += base
+		vm.callStack = append(vm.callStack, frame)
+	}
+	vm.localBase = vm.callStack[len(vm.callStack)-1].Base
+	vm.stack = append(vm.stack, c.stack...)
+	vm.running = true
+	if err != nil {
+		// The error is raised by the ask
+		vm.pc = c.pc - 1
+		vm.fail(err)
+	} else {
+		vm.pc = c.pc
+		vm.stack = append(vm.stack, reply)
+	}
+	return vm.runFrames(stackDepth, callDepth)
+}
+
+// resumeHandler continues the handler waiting on an answered request
+func (vm *VM) resumeHandler(req *request) bool {
+	delete(vm.asks, req)
+	c := req.asker
+	return vm.runAgent(c.agent, c.event, func() error {
+		_, err := vm.resume(c, req.reply, req.err)
+		return err
+	})
+}
@@ -0,0 +1,69 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import "fmt"
+
+// Backend selects how a VM executes its program
+type Backend int
+
+const (
+	// StackBackend interprets the bytecode directly on the value stack
+	StackBackend Backend = iota
+	// RegisterBackend translates the bytecode into register instructions
+	// before running it, which removes most of the push and pop traffic of
+	// arithmetic and local variable access
+	RegisterBackend
+)
+
+var backendNames = map[Backend]string{
+	StackBackend:    "stack",
+	RegisterBackend: "register",
+}
+
+func (b Backend) String() string {
+	if name, ok := backendNames[b]; ok {
+		return name
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// ParseBackend returns the backend with the given name
+func ParseBackend(name string) (Backend, error) {
+	for backend, backendName := range backendNames {
+		if backendName == name {
+			return backend, nil
+		}
+	}
+	return StackBackend, fmt.Errorf("unknown backend %q, expected stack or register", name)
+}
+
+// WithBackend selects the execution backend, the stack backend is the
+// default. Breakpoints, stepping, tracing and profiling work on stack
+// instructions, so a VM using any of them always runs on the stack backend.
+func WithBackend(backend Backend) Option {
+	return func(vm *VM) {
+		vm.backend = backend
+	}
+}
+
+// useRegisters reports whether Run should use the register backend. Once
+// the VM has been stepped it has to carry on with the stack backend.
+func (vm *VM) useRegisters() bool {
+	return vm.backend == RegisterBackend && vm.traceFunc == nil && vm.profiler == nil &&
+		len(vm.breakpoints) == 0 && vm.executed == 0 && vm.pc == 0
+}
@@ -0,0 +1,250 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// BuiltinFunc is a Go function callable from MindScript. It receives the
+// call's arguments in order and returns a single value, which may be nil.
+type BuiltinFunc func(args []Value) (Value, error)
+
+// builtin is a registered builtin and the capability agents need to call it
+type builtin struct {
+	fn         BuiltinFunc
+	capability string
+}
+
+var (
+	builtinsMu sync.RWMutex
+	builtins   = make(map[string]builtin)
+)
+
+// reservedBuiltins are compiled to dedicated opcodes and cannot be replaced
+var reservedBuiltins = map[string]bool{
+	"log":             true,
+	"print":           true,
+	"syscall":         true,
+	"exec":            true,
+	"len":             true,
+	"send":            true,
+	"receive":         true,
+	"emit":            true,
+	"ask":             true,
+	"reply":           true,
+	"spawn":           true,
+	"self":            true,
+	"llm":             true,
+	"prompt":          true,
+	"remember":        true,
+	"recall":          true,
+	"forget":          true,
+	"observe":         true,
+	"recent":          true,
+	"session":         true,
+	"sessionRemember": true,
+	"sessionRecall":   true,
+	"sessionHistory":  true,
+	"embed":           true,
+	"index":           true,
+	"search":          true,
+	"mcp":             true,
+	"sort":            true,
+	"reduce":          true,
+	"filter":          true,
+	"map":             true,
+	"tomlParse":       true,
+	"yamlParse":       true,
+	"queryParam":      true,
+	"urlEncode":       true,
+	"urlParse":        true,
+	"format":          true,
+	"sqlQuery":        true,
+	"uuid":            true,
+	"assert":          true,
+	"typeof":          true,
+	"bool":            true,
+	"string":          true,
+	"float":           true,
+	"int":             true,
+	"choice":          true,
+	"randomInt":       true,
+	"random":          true,
+	"args":            true,
+	"env":             true,
+}
+
+// RegisterBuiltin makes fn callable from MindScript as name. Builtins must be
+// registered before programs using them are analysed and compiled. It panics
+// if fn is nil, the name is already registered or it names one of the
+// language's own builtins.
+func RegisterBuiltin(name string, fn func(args []Value) (Value, error)) {
+	registerBuiltin(name, "", fn)
+}
+
+// RegisterPrivilegedBuiltin registers a builtin like RegisterBuiltin that
+// agents may only call if they declare capability, such as FileCapability
+// for a builtin reading files
+func RegisterPrivilegedBuiltin(name, capability string, fn func(args []Value) (Value, error)) {
+	if capability == "" {
+		panic("vm: RegisterPrivilegedBuiltin capability is empty")
+	}
+	registerBuiltin(name, capability, fn)
+}
+
+func registerBuiltin(name, capability string, fn BuiltinFunc) {
+	builtinsMu.Lock()
+	defer builtinsMu.Unlock()
+	if fn == nil {
+		panic("vm: RegisterBuiltin function is nil")
+	}
+	if reservedBuiltins[name] {
+		panic("vm: RegisterBuiltin cannot replace the builtin " + name)
+	}
+	if _, exists := builtins[name]; exists {
+		panic("vm: RegisterBuiltin called twice for " + name)
+	}
+	builtins[name] = builtin{fn: fn, capability: capability}
+}
+
+// IsBuiltin reports whether name was registered with RegisterBuiltin
+func IsBuiltin(name string) bool {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+	_, ok := builtins[name]
+	return ok
+}
+
+// Builtins returns the names of all registered builtins in sorted order
+func Builtins() []string {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupBuiltin(name string) (builtin, bool) {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+	b, ok := builtins[name]
+	return b, ok
+}
+
+// callBuiltin runs OpCallBuiltin: the builtin's name is on top of the stack
+// with its argc arguments below it. The result replaces them, so the call
+// always leaves exactly one value behind.
+func (vm *VM) callBuiltin(argc int) {
+	value := vm.popStack()
+	name, ok := value.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("builtin call expects a name, got %T", value))
+		return
+	}
+	if argc < 0 || argc > len(vm.stack) {
+		vm.fail(fmt.Errorf("not enough values on the stack to call builtin %s with %d arguments", name, argc))
+		return
+	}
+	b, ok := lookupBuiltin(name)
+	if !ok {
+		vm.fail(fmt.Errorf("unknown builtin %s", name))
+		return
+	}
+
+	args := make([]Value, argc)
+	copy(args, vm.stack[len(vm.stack)-argc:])
+	vm.stack = vm.stack[:len(vm.stack)-argc]
+
+	if b.capability != "" && !vm.requireCapability(b.capability, "call "+name) {
+		return
+	}
+	result, err := b.fn(args)
+	if err != nil {
+		vm.fail(fmt.Errorf("builtin %s: %w", name, err))
+		return
+	}
+	vm.stack = append(vm.stack, normaliseValue(result))
+}
+
+// print runs OpPrint, writing the argc values on the stack to the
+// program's output separated by spaces and followed by a newline. nil is
+// written as nil.
+func (vm *VM) print(argc int) {
+	if argc < 0 || argc > len(vm.stack) {
+		vm.fail(fmt.Errorf("not enough values on the stack to print %d values", argc))
+		return
+	}
+	args := vm.stack[len(vm.stack)-argc:]
+	values := make([]any, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			arg = "nil"
+		}
+		values[i] = arg
+	}
+	vm.stack = vm.stack[:len(vm.stack)-argc]
+	if _, err := fmt.Fprintln(vm.stdout, values...); err != nil {
+		vm.fail(fmt.Errorf("print: %w", err))
+	}
+}
+
+// assert runs OpAssert: the condition and the message on the stack are
+// popped and the program fails with the message unless the condition is
+// true
+func (vm *VM) assert() {
+	message, cond := vm.popStack(), vm.popStack()
+	ok, isBool := cond.(bool)
+	if !isBool {
+		vm.fail(fmt.Errorf("assert expects a bool condition, got %s", typeName(cond)))
+		return
+	}
+	if !ok {
+		vm.fail(fmt.Errorf("%w: %s", ErrAssertionFailed, toString(message)))
+	}
+}
+
+// normaliseValue converts the Go types builtins commonly return to the
+// types the VM works with
+func normaliseValue(value Value) Value {
+	switch v := value.(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case float32:
+		return float64(v)
+	case []byte:
+		return string(v)
+	}
+	return value
+}
@@ -0,0 +1,222 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// hostReturnAddress is the return address of calls made by CallFunction,
+// execution stops once the call returns to it
+const hostReturnAddress = -1
+
+// CallFunction runs a single compiled function, declared at the top level or
+// inside an agent, and returns its result, or nil if it returns nothing. It
+// can be used before or after Run, for example to invoke functions of a
+// program whose top level only sets up state. A function declared in an
+// agent runs as that agent, with its capabilities, and can only be called
+// once the agent has been created. Execution limits apply to each call
+// separately. A runtime error is returned as a *RuntimeError and leaves the
+// VM usable for further calls.
+//
+// CallFunction may be called from other goroutines while the VM runs, the
+// call then runs between two instructions of the program without affecting
+// its state or limits.
+func (vm *VM) CallFunction(name string, args ...interface{}) (result interface{}, err error) {
+	vm.do(func() {
+		result, err = vm.callFunction(name, args)
+	})
+	return result, err
+}
+
+func (vm *VM) callFunction(name string, args []interface{}) (interface{}, error) {
+	if vm.err != nil {
+		return nil, vm.err
+	}
+	index := vm.functionIndex(name)
+	if index < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFunction, name)
+	}
+	function := vm.functions[index]
+	if len(args) != function.Arity {
+		return nil, fmt.Errorf("function %s expects %d arguments but got %d", name, function.Arity, len(args))
+	}
+	if function.Address < 0 || function.Address >= len(vm.instructions) {
+		return nil, fmt.Errorf("function %s has address %d out of range", name, function.Address)
+	}
+	owner, err := vm.functionOwner(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer vm.beginHostCall()()
+	self := vm.self
+	vm.self = owner
+	defer func() {
+		vm.self = self
+	}()
+
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		values[i] = normaliseValue(arg)
+	}
+	result, err := vm.invoke(index, values)
+	if err != nil {
+		vm.err = nil
+		return nil, err
+	}
+	return result, nil
+}
+
+// Eval runs code added to the VM's program like a call made with
+// CallFunction and returns the value it leaves on the stack, if any. It is
+// how REPLs attached to a served program evaluate their inputs: program must
+// begin with the VM's program and the code from entry on, which ends with
+// OpHalt, may use its globals and functions and talk to its agents. The
+// events it emits are dispatched like those emitted with Emit. A runtime
+// error is returned and leaves the VM usable.
+func (vm *VM) Eval(program *Program, entry int) (result Value, err error) {
+	vm.do(func() {
+		result, err = vm.eval(program, entry)
+	})
+	return result, err
+}
+
+func (vm *VM) eval(program *Program, entry int) (Value, error) {
+	if vm.err != nil {
+		return nil, vm.err
+	}
+	if err := vm.extendProgram(program, entry); err != nil {
+		return nil, err
+	}
+
+	restore := vm.beginHostCall()
+	pc, running := vm.pc, vm.running
+	stackDepth, callDepth := len(vm.stack), len(vm.callStack)
+	vm.pc, vm.running = entry, true
+	for vm.running {
+		vm.execute()
+	}
+	var result Value
+	if len(vm.stack) > stackDepth && vm.err == nil {
+		result = vm.stack[len(vm.stack)-1]
+	}
+	// Code that fails in a function leaves its frames behind
+	for len(vm.callStack) > callDepth {
+		vm.popFrame()
+	}
+	vm.stack = vm.stack[:min(stackDepth, len(vm.stack))]
+	vm.pc, vm.running = pc, running
+	restore()
+
+	if err := vm.err; err != nil {
+		vm.err = nil
+		return nil, err
+	}
+	return result, vm.hostDispatch()
+}
+
+// beginHostCall gives a call made by the host an instruction budget and a
+// deadline of its own. The returned function restores those of the program.
+func (vm *VM) beginHostCall() func() {
+	executed, deadline := vm.executed, vm.deadline
+	vm.executed = 0
+	if vm.timeout > 0 {
+		vm.deadline = time.Now().Add(vm.timeout)
+	}
+	return func() {
+		vm.metrics.Instructions += vm.executed
+		vm.executed, vm.deadline = executed, deadline
+	}
+}
+
+// invoke runs a function to completion and returns its result, restoring
+// the pc and the stacks of whatever was executing before. A runtime error is
+// left in vm.err for the caller to handle.
+func (vm *VM) invoke(index int, args []Value) (Value, error) {
+	function := vm.functions[index]
+	pc, running := vm.pc, vm.running
+	stackDepth, callDepth := len(vm.stack), len(vm.callStack)
+	defer func() {
+		vm.pc, vm.running = pc, running
+	}()
+
+	vm.stack = append(vm.stack, args...)
+	vm.running = true
+	if vm.pushFrame(hostReturnAddress, index) {
+		vm.pc = function.Address
+	}
+	return vm.runFrames(stackDepth, callDepth)
+}
+
+// runFrames executes until the frames above callDepth have returned and
+// returns the result left above stackDepth. A handler suspended by ask has
+// its frames saved as the continuation of its request instead.
+func (vm *VM) runFrames(stackDepth, callDepth int) (Value, error) {
+	vm.calls++
+	defer func() {
+		vm.calls--
+	}()
+	for vm.running && vm.suspended == nil && len(vm.callStack) > callDepth {
+		vm.execute()
+	}
+	var result Value
+	if vm.suspended != nil {
+		vm.suspended.asker = vm.saveContinuation(stackDepth, callDepth)
+	} else if len(vm.stack) > stackDepth && vm.err == nil {
+		result = vm.stack[len(vm.stack)-1]
+	}
+	// A function that halts, fails or is suspended leaves its frames behind
+	for len(vm.callStack) > callDepth {
+		vm.popFrame()
+	}
+	vm.stack = vm.stack[:min(stackDepth, len(vm.stack))]
+	return result, vm.err
+}
+
+// functionOwner returns the agent declaring the named function, or nil for
+// a function declared at the top level. Functions of agents that have not
+// been created yet have no agent to run as and cannot be called.
+func (vm *VM) functionOwner(name string) (*Agent, error) {
+	for _, agent := range vm.Agents() {
+		if agent.Name == agent.Declaration && slices.Contains(agent.Functions, name) {
+			return agent, nil
+		}
+	}
+	decls, err := declarations(vm.instructions, vm.constants, vm.functions)
+	if err != nil {
+		return nil, err
+	}
+	for _, decl := range decls {
+		if slices.Contains(decl.functions, name) {
+			return nil, fmt.Errorf("function %s belongs to agent %s, which has not been created", name, decl.name)
+		}
+	}
+	return nil, nil
+}
+
+// functionIndex returns the index of the named function, or -1
+func (vm *VM) functionIndex(name string) int {
+	for i, function := range vm.functions {
+		if function.Name == name {
+			return i
+		}
+	}
+	return -1
+}
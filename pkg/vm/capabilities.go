@@ -0,0 +1,48 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import "fmt"
+
+// Capabilities guarding privileged builtins. Agents must list them among
+// their capabilities to use the builtins: exec and syscall require
+// ExecCapability, llm, embed, index and search require LLMCapability, mcp
+// requires MCPCapability, env requires EnvCapability and sqlQuery requires
+// SQLCapability. Hosts registering
+// builtins that reach the network or the file system should require
+// HTTPCapability or FileCapability with RegisterPrivilegedBuiltin.
+const (
+	ExecCapability = "exec"
+	LLMCapability  = "llm"
+	HTTPCapability = "http"
+	FileCapability = "file"
+	MCPCapability  = "mcp"
+	EnvCapability  = "env"
+	SQLCapability  = "sql"
+)
+
+// requireCapability fails with ErrCapabilityDenied unless the agent whose
+// handler or function is running declares capability. Only the program's top
+// level and the functions declared there run without an agent, they are
+// restricted by the Policy alone.
+func (vm *VM) requireCapability(capability, operation string) bool {
+	if vm.self == nil || vm.self.HasCapability(capability) {
+		return true
+	}
+	vm.fail(fmt.Errorf("%w: agent %s needs the %q capability to %s", ErrCapabilityDenied, vm.self.Name, capability, operation))
+	return false
+}
@@ -0,0 +1,167 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// mapList runs OpMapList: the list and the name of a function on the stack
+// are replaced by a new list holding the function's result for each item
+func (vm *VM) mapList() {
+	list, index, ok := vm.callbackArgs("map", 2, 1)
+	if !ok {
+		return
+	}
+	// The result stays on the stack while the function runs, so a collection
+	// triggered by it sees the items collected so far
+	result := NewList()
+	vm.alloc(result)
+	vm.stack = append(vm.stack, result)
+	for _, item := range list.Items() {
+		value, ok := vm.callBack(index, item)
+		if !ok {
+			return
+		}
+		result.Append(value)
+	}
+	vm.replaceArgs(3, result)
+}
+
+// filterList runs OpFilter: the list and the name of a function on the
+// stack are replaced by a new list of the items the function returned true
+// for
+func (vm *VM) filterList() {
+	list, index, ok := vm.callbackArgs("filter", 2, 1)
+	if !ok {
+		return
+	}
+	result := NewList()
+	vm.alloc(result)
+	vm.stack = append(vm.stack, result)
+	for _, item := range list.Items() {
+		value, ok := vm.callBack(index, item)
+		if !ok {
+			return
+		}
+		keep, isBool := value.(bool)
+		if !isBool {
+			vm.fail(fmt.Errorf("filter: %s returned %s, expected bool", vm.functions[index].Name, typeName(value)))
+			return
+		}
+		if keep {
+			result.Append(item)
+		}
+	}
+	vm.replaceArgs(3, result)
+}
+
+// reduceList runs OpReduce: the list, the name of a function and an initial
+// value on the stack are replaced by the result of calling the function with
+// the value so far and each item in turn, or the initial value for an empty
+// list
+func (vm *VM) reduceList() {
+	list, index, ok := vm.callbackArgs("reduce", 3, 2)
+	if !ok {
+		return
+	}
+	acc := vm.stack[len(vm.stack)-1]
+	for _, item := range list.Items() {
+		value, ok := vm.callBack(index, acc, item)
+		if !ok {
+			return
+		}
+		acc = value
+	}
+	vm.replaceArgs(3, acc)
+}
+
+// callbackArgs checks the arguments of map, filter and reduce, the first
+// two of argc on the stack: a list and the name of a function of the program
+// taking arity arguments. It returns the list and the function's index.
+func (vm *VM) callbackArgs(builtin string, argc, arity int) (*List, int, bool) {
+	if len(vm.stack) < argc {
+		vm.fail(fmt.Errorf("not enough values on the stack to call %s", builtin))
+		return nil, 0, false
+	}
+	args := vm.stack[len(vm.stack)-argc:]
+	list, ok := args[0].(*List)
+	if !ok {
+		vm.fail(fmt.Errorf("%s expects a list, got %s", builtin, typeName(args[0])))
+		return nil, 0, false
+	}
+	name, ok := args[1].(string)
+	if !ok {
+		vm.fail(fmt.Errorf("%s expects the name of a function, got %s", builtin, typeName(args[1])))
+		return nil, 0, false
+	}
+	index := vm.functionIndex(name)
+	if index < 0 {
+		vm.fail(fmt.Errorf("%s: %w: %s", builtin, ErrUnknownFunction, name))
+		return nil, 0, false
+	}
+	if function := vm.functions[index]; function.Arity != arity {
+		vm.fail(fmt.Errorf("%s calls %s with %d arguments but it takes %d", builtin, name, arity, function.Arity))
+		return nil, 0, false
+	}
+	return list, index, true
+}
+
+// callBack calls a function of the program on behalf of a builtin,
+// reporting false if it failed
+func (vm *VM) callBack(index int, args ...Value) (Value, bool) {
+	result, err := vm.invoke(index, args)
+	if err != nil {
+		// invoke restores running, the error still stops the handler
+		vm.running = false
+		return nil, false
+	}
+	return result, true
+}
+
+// replaceArgs replaces the top n values on the stack with result
+func (vm *VM) replaceArgs(n int, result Value) {
+	clear(vm.stack[len(vm.stack)-n:])
+	vm.stack = append(vm.stack[:len(vm.stack)-n], result)
+}
+
+// sortList runs OpSort: the list on the stack is replaced by a sorted copy.
+// Its items must all be numbers or all be strings, which are sorted by byte
+// value.
+func (vm *VM) sortList() {
+	value := vm.popStack()
+	list, ok := value.(*List)
+	if !ok {
+		vm.fail(fmt.Errorf("sort expects a list, got %s", typeName(value)))
+		return
+	}
+	items := append([]Value(nil), list.Items()...)
+	for _, item := range items {
+		if _, comparable := compareValues(OpLessThan, items[0], item); !comparable {
+			vm.fail(fmt.Errorf("sort expects all numbers or all strings, got %s and %s", typeName(items[0]), typeName(item)))
+			return
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		less, _ := compareValues(OpLessThan, items[i], items[j])
+		return less
+	})
+	sorted := NewList(items...)
+	vm.alloc(sorted)
+	vm.stack = append(vm.stack, sorted)
+}
@@ -0,0 +1,170 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// convert runs the conversion builtins OpToInt, OpToFloat, OpToString and
+// OpToBool: the value on the stack is replaced by its conversion to typ.
+// Conversions that lose information or cannot be made fail the program
+// rather than producing a default:
+//
+//   - int truncates floats towards zero and parses decimal strings, true is 1
+//   - float parses strings, true is 1.0
+//   - string formats any value the way print does, nil is "nil"
+//   - bool parses "true" and "false", numbers are true unless zero
+//
+// Surrounding whitespace is ignored when parsing strings.
+func (vm *VM) convert(typ string) {
+	value := vm.popStack()
+	converted, err := convertTo(value, typ)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	if s, ok := converted.(string); ok {
+		converted = vm.strings.intern(s)
+	}
+	vm.stack = append(vm.stack, converted)
+}
+
+// convertTo converts a value to the MindScript type typ, which is one of int,
+// float, string or bool, following the rules of the conversion builtins
+func convertTo(value Value, typ string) (Value, error) {
+	switch typ {
+	case "int":
+		return toInt(value)
+	case "float":
+		return toFloat(value)
+	case "string":
+		return toString(value), nil
+	case "bool":
+		return toBool(value)
+	}
+	return nil, fmt.Errorf("cannot convert to unknown type %s", typ)
+}
+
+func toInt(value Value) (Value, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case float64:
+		if math.IsNaN(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return nil, fmt.Errorf("int: %v is out of range", v)
+		}
+		return int(v), nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("int: cannot parse %q", v)
+		}
+		return int(n), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return nil, fmt.Errorf("int: cannot convert %s", typeName(value))
+}
+
+func toFloat(value Value) (Value, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("float: cannot parse %q", v)
+		}
+		return f, nil
+	case bool:
+		if v {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	}
+	return nil, fmt.Errorf("float: cannot convert %s", typeName(value))
+}
+
+func toString(value Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+func toBool(value Value) (Value, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		switch strings.TrimSpace(v) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("bool: cannot parse %q", v)
+	}
+	return nil, fmt.Errorf("bool: cannot convert %s", typeName(value))
+}
+
+// typeOf runs OpTypeOf: the value on the stack is replaced by the name of
+// its type
+func (vm *VM) typeOf() {
+	vm.stack = append(vm.stack, typeName(vm.popStack()))
+}
+
+// typeName returns the MindScript name of a value's type: int, float,
+// string, bool, list, map, agent or nil. Values of other Go types,
+// which only builtins registered by the host return, are named by Go.
+func typeName(value Value) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case *List:
+		return "list"
+	case *Map:
+		return "map"
+	case *Agent:
+		return "agent"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,128 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import "sort"
+
+// This file exposes the hooks a debugger front-end needs: breakpoints,
+// single stepping and read-only inspection of the VM state. Run ignores
+// breakpoints, a debugger drives execution with Step and Continue instead.
+
+// SetBreakpoint makes Continue stop before executing the instruction at pc
+func (vm *VM) SetBreakpoint(pc int) {
+	if vm.breakpoints == nil {
+		vm.breakpoints = make(map[int]bool)
+	}
+	vm.breakpoints[pc] = true
+}
+
+// ClearBreakpoint removes a breakpoint set with SetBreakpoint
+func (vm *VM) ClearBreakpoint(pc int) {
+	delete(vm.breakpoints, pc)
+}
+
+// Breakpoints returns the addresses of all breakpoints in ascending order
+func (vm *VM) Breakpoints() []int {
+	pcs := make([]int, 0, len(vm.breakpoints))
+	for pc := range vm.breakpoints {
+		pcs = append(pcs, pc)
+	}
+	sort.Ints(pcs)
+	return pcs
+}
+
+// Step executes a single instruction. It returns the runtime error that
+// stopped the program, if any.
+func (vm *VM) Step() error {
+	vm.acquire()
+	defer vm.release()
+	vm.start()
+	if vm.running {
+		vm.execute()
+	}
+	return vm.err
+}
+
+// Continue executes until the next breakpoint or until the program stops.
+// The instruction at the current pc always runs, so calling Continue while
+// stopped at a breakpoint moves past it. Use Halted to tell whether the
+// program finished or hit a breakpoint.
+func (vm *VM) Continue() error {
+	vm.acquire()
+	defer vm.release()
+	vm.start()
+	if vm.running {
+		vm.execute()
+	}
+	for vm.running && !vm.breakpoints[vm.pc] {
+		vm.execute()
+	}
+	return vm.err
+}
+
+// Halted reports whether the program has stopped, either normally or with an
+// error
+func (vm *VM) Halted() bool {
+	return !vm.running
+}
+
+// PC returns the address of the next instruction to execute
+func (vm *VM) PC() int {
+	return vm.pc
+}
+
+// CurrentInstruction returns the next instruction to execute and false if
+// the pc is past the end of the program
+func (vm *VM) CurrentInstruction() (Instruction, bool) {
+	if vm.pc < 0 || vm.pc >= len(vm.instructions) {
+		return Instruction{}, false
+	}
+	return vm.instructions[vm.pc], true
+}
+
+// Stack returns a copy of the value stack, bottom first
+func (vm *VM) Stack() []Value {
+	return append([]Value(nil), vm.stack...)
+}
+
+// Locals returns a copy of the local variables of the current frame, or nil
+// outside of a function
+func (vm *VM) Locals() []Value {
+	if len(vm.callStack) == 0 {
+		return nil
+	}
+	return append([]Value(nil), vm.locals[vm.localBase:]...)
+}
+
+// Globals returns a copy of the global variables
+func (vm *VM) Globals() []Value {
+	return append([]Value(nil), vm.globals...)
+}
+
+// Frames returns a copy of the call stack, outermost call first
+func (vm *VM) Frames() []Frame {
+	return append([]Frame(nil), vm.callStack...)
+}
+
+// FunctionName returns the name of the function with the given index in the
+// function table, as referenced by Frame.Function
+func (vm *VM) FunctionName(index int) string {
+	if index < 0 || index >= len(vm.functions) {
+		return ""
+	}
+	return vm.functions[index].Name
+}
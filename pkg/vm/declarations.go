@@ -0,0 +1,195 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// declaration is an agent declaration as compiled into the main program
+type declaration struct {
+	name         string
+	slot         int
+	goal         string
+	capabilities []string
+	supervision  string
+	handlers     []EventHandler
+	functions    []string
+	// state holds the initial values of the state variables, unknown for
+	// those computed by an expression
+	state map[string]Value
+}
+
+// unknown stands for a value computed by the program, declarations only
+// hold literals
+type unknown struct{}
+
+// declarations reads the agent declarations of a program by following the
+// literals the declaration instructions take from the stack
+func declarations(instructions []Instruction, constants []Value, functions []Function) ([]*declaration, error) {
+	var decls []*declaration
+	bySlot := map[int]*declaration{}
+	var stack []Value
+	pop := func() Value {
+		if len(stack) == 0 {
+			return unknown{}
+		}
+		value := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return value
+	}
+	for pc, instr := range instructions {
+		if instr.Opcode == OpHalt {
+			break
+		}
+		decl := bySlot[instr.Operand]
+		switch instr.Opcode {
+		case OpConstant:
+			if instr.Operand < 0 || instr.Operand >= len(constants) {
+				return nil, fmt.Errorf("constant %d out of range at %d", instr.Operand, pc)
+			}
+			stack = append(stack, constants[instr.Operand])
+			continue
+		case OpPush:
+			stack = append(stack, instr.Operand)
+			continue
+		case OpCreateEventHandler:
+			stack = append(stack, &EventHandler{Function: instr.Operand})
+			continue
+		case OpSetEventHandlerEvent:
+			event := pop()
+			if handler, ok := pop().(*EventHandler); ok {
+				handler.Event = fmt.Sprint(event)
+				stack = append(stack, handler)
+			}
+			continue
+		case OpAddFunctionArgument:
+			pop()
+			continue
+		case OpCreateFunction:
+			continue
+		case OpCreateAgent:
+			name, ok := pop().(string)
+			if !ok {
+				return nil, fmt.Errorf("agent %d has no name", instr.Operand)
+			}
+			decl = &declaration{name: name, slot: instr.Operand, state: map[string]Value{}}
+			bySlot[instr.Operand] = decl
+			decls = append(decls, decl)
+			continue
+		}
+		if !declares(instr.Opcode) {
+			// Other instructions compute values the declarations cannot
+			// rely on
+			stack = stack[:0]
+			continue
+		}
+		if decl == nil {
+			return nil, fmt.Errorf("agent %d used at %d before it is declared", instr.Operand, pc)
+		}
+		switch instr.Opcode {
+		case OpSetAgentGoal:
+			decl.goal = fmt.Sprint(pop())
+		case OpAddAgentCapability:
+			decl.capabilities = append(decl.capabilities, fmt.Sprint(pop()))
+		case OpSetAgentSupervision:
+			decl.supervision = fmt.Sprint(pop())
+		case OpAddAgentEventHandler:
+			handler, ok := pop().(*EventHandler)
+			if !ok {
+				return nil, fmt.Errorf("handler of agent %s at %d is not a literal", decl.name, pc)
+			}
+			decl.handlers = append(decl.handlers, *handler)
+		case OpAddAgentFunction:
+			index, ok := pop().(int)
+			if !ok || index < 0 || index >= len(functions) {
+				return nil, fmt.Errorf("function of agent %s at %d is not a literal", decl.name, pc)
+			}
+			decl.functions = append(decl.functions, functions[index].Name)
+		case OpDefineState:
+			name, ok := pop().(string)
+			if !ok {
+				return nil, fmt.Errorf("state variable of agent %s has no name", decl.name)
+			}
+			decl.state[name] = pop()
+		}
+	}
+	return decls, nil
+}
+
+// declares reports whether an instruction declares part of an agent in the
+// global slot it takes
+func declares(op Opcode) bool {
+	switch op {
+	case OpSetAgentGoal, OpAddAgentCapability, OpSetAgentSupervision, OpAddAgentEventHandler, OpAddAgentFunction, OpDefineState:
+		return true
+	}
+	return false
+}
+
+func findDeclaration(decls []*declaration, name string) *declaration {
+	for _, decl := range decls {
+		if decl.name == name {
+			return decl
+		}
+	}
+	return nil
+}
+
+// AgentDeclaration describes an agent a program declares
+type AgentDeclaration struct {
+	Name         string
+	Goal         string
+	Capabilities []string
+	// Supervision is the declared supervision strategy, empty when failures
+	// are left to error handlers
+	Supervision string
+	// Events are the events the agent has handlers for
+	Events    []string
+	Functions []string
+	// State names the agent's state variables in alphabetical order
+	State []string
+}
+
+// Agents returns the agents declared by the program's main code without
+// running it, in order of declaration
+func (p *Program) Agents() ([]AgentDeclaration, error) {
+	decls, err := declarations(p.Instructions, p.Constants, p.Functions)
+	if err != nil {
+		return nil, err
+	}
+	agents := make([]AgentDeclaration, len(decls))
+	for i, decl := range decls {
+		agent := AgentDeclaration{
+			Name:         decl.name,
+			Goal:         decl.goal,
+			Capabilities: decl.capabilities,
+			Supervision:  decl.supervision,
+			Functions:    decl.functions,
+		}
+		for _, handler := range decl.handlers {
+			agent.Events = append(agent.Events, handler.Event)
+		}
+		for name := range decl.state {
+			agent.State = append(agent.State, name)
+		}
+		sort.Strings(agent.State)
+		agents[i] = agent
+	}
+	return agents, nil
+}
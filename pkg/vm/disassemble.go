@@ -0,0 +1,252 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var opcodeNames = [opcodeCount]string{
+	OpAdd:                  "OpAdd",
+	OpSub:                  "OpSub",
+	OpMul:                  "OpMul",
+	OpDiv:                  "OpDiv",
+	OpPush:                 "OpPush",
+	OpPop:                  "OpPop",
+	OpTrue:                 "OpTrue",
+	OpFalse:                "OpFalse",
+	OpPrint:                "OpPrint",
+	OpHalt:                 "OpHalt",
+	OpJump:                 "OpJump",
+	OpJumpIfFalse:          "OpJumpIfFalse",
+	OpSetLocal:             "OpSetLocal",
+	OpGetLocal:             "OpGetLocal",
+	OpSetGlobal:            "OpSetGlobal",
+	OpGetGlobal:            "OpGetGlobal",
+	OpCall:                 "OpCall",
+	OpReturn:               "OpReturn",
+	OpCreateAgent:          "OpCreateAgent",
+	OpSetAgentGoal:         "OpSetAgentGoal",
+	OpAddAgentCapability:   "OpAddAgentCapability",
+	OpCreateEventHandler:   "OpCreateEventHandler",
+	OpSetEventHandlerEvent: "OpSetEventHandlerEvent",
+	OpAddAgentEventHandler: "OpAddAgentEventHandler",
+	OpCreateFunction:       "OpCreateFunction",
+	OpAddFunctionArgument:  "OpAddFunctionArgument",
+	OpAddAgentFunction:     "OpAddAgentFunction",
+	OpSetAgentSupervision:  "OpSetAgentSupervision",
+	OpSend:                 "OpSend",
+	OpReceive:              "OpReceive",
+	OpEmit:                 "OpEmit",
+	OpAsk:                  "OpAsk",
+	OpReply:                "OpReply",
+	OpSpawn:                "OpSpawn",
+	OpSelf:                 "OpSelf",
+	OpDefineState:          "OpDefineState",
+	OpGetState:             "OpGetState",
+	OpSetState:             "OpSetState",
+	OpEqual:                "OpEqual",
+	OpNotEqual:             "OpNotEqual",
+	OpGreaterThan:          "OpGreaterThan",
+	OpLessThan:             "OpLessThan",
+	OpGreaterThanOrEqual:   "OpGreaterThanOrEqual",
+	OpLessThanOrEqual:      "OpLessThanOrEqual",
+	OpAnd:                  "OpAnd",
+	OpOr:                   "OpOr",
+	OpNot:                  "OpNot",
+	OpConcatString:         "OpConcatString",
+	OpConstant:             "OpConstant",
+	OpStringLength:         "OpStringLength",
+	OpGetStringItem:        "OpGetStringItem",
+	OpSyscall:              "OpSyscall",
+	OpExec:                 "OpExec",
+	OpLog:                  "OpLog",
+	OpLLM:                  "OpLLM",
+	OpPrompt:               "OpPrompt",
+	OpEnv:                  "OpEnv",
+	OpArgs:                 "OpArgs",
+	OpRandom:               "OpRandom",
+	OpRandomInt:            "OpRandomInt",
+	OpChoice:               "OpChoice",
+	OpUUID:                 "OpUUID",
+	OpToInt:                "OpToInt",
+	OpToFloat:              "OpToFloat",
+	OpToString:             "OpToString",
+	OpToBool:               "OpToBool",
+	OpTypeOf:               "OpTypeOf",
+	OpFormat:               "OpFormat",
+	OpURLParse:             "OpURLParse",
+	OpURLEncode:            "OpURLEncode",
+	OpQueryParam:           "OpQueryParam",
+	OpYAMLParse:            "OpYAMLParse",
+	OpTOMLParse:            "OpTOMLParse",
+	OpMapList:              "OpMapList",
+	OpFilter:               "OpFilter",
+	OpReduce:               "OpReduce",
+	OpSort:                 "OpSort",
+	OpAssert:               "OpAssert",
+	OpRemember:             "OpRemember",
+	OpRecall:               "OpRecall",
+	OpForget:               "OpForget",
+	OpObserve:              "OpObserve",
+	OpRecent:               "OpRecent",
+	OpSession:              "OpSession",
+	OpSessionRemember:      "OpSessionRemember",
+	OpSessionRecall:        "OpSessionRecall",
+	OpSessionHistory:       "OpSessionHistory",
+	OpEmbed:                "OpEmbed",
+	OpIndex:                "OpIndex",
+	OpSearch:               "OpSearch",
+	OpMCP:                  "OpMCP",
+	OpSQLQuery:             "OpSQLQuery",
+	OpCreateList:           "OpCreateList",
+	OpAppendList:           "OpAppendList",
+	OpGetListItem:          "OpGetListItem",
+	OpSetListItem:          "OpSetListItem",
+	OpCreateMap:            "OpCreateMap",
+	OpSetMapItem:           "OpSetMapItem",
+	OpGetMapItem:           "OpGetMapItem",
+	OpGetItem:              "OpGetItem",
+	OpGetLocalAdd:          "OpGetLocalAdd",
+	OpPushAdd:              "OpPushAdd",
+	OpSetLocalGetLocal:     "OpSetLocalGetLocal",
+	OpJumpIfEqual:          "OpJumpIfEqual",
+	OpJumpIfNotEqual:       "OpJumpIfNotEqual",
+	OpCallBuiltin:          "OpCallBuiltin",
+}
+
+// operandless lists the opcodes that ignore their operand, it is left out
+// when they are printed
+var operandless = map[Opcode]bool{
+	OpAdd: true, OpSub: true, OpMul: true, OpDiv: true,
+	OpPop: true, OpTrue: true, OpFalse: true, OpHalt: true,
+	OpReturn: true, OpSetEventHandlerEvent: true, OpSend: true,
+	OpSpawn: true, OpSelf: true, OpReply: true,
+	OpEqual: true, OpNotEqual: true, OpGreaterThan: true, OpLessThan: true,
+	OpGreaterThanOrEqual: true, OpLessThanOrEqual: true,
+	OpAnd: true, OpOr: true, OpNot: true,
+	OpConcatString: true, OpStringLength: true, OpGetStringItem: true,
+	OpSyscall: true, OpLLM: true, OpPrompt: true,
+	OpRemember: true, OpRecall: true, OpForget: true, OpObserve: true, OpRecent: true,
+	OpSession: true, OpSessionRemember: true, OpSessionRecall: true, OpSessionHistory: true,
+	OpEmbed: true, OpIndex: true, OpSearch: true, OpMCP: true,
+	OpAppendList: true, OpGetListItem: true, OpSetListItem: true,
+	OpSetMapItem: true, OpGetMapItem: true, OpGetItem: true,
+	OpMapList: true, OpFilter: true, OpReduce: true, OpSort: true,
+	OpYAMLParse: true, OpTOMLParse: true,
+	OpURLParse: true, OpURLEncode: true, OpQueryParam: true,
+	OpFormat: true,
+	OpUUID:   true,
+	OpAssert: true,
+	OpTypeOf: true,
+	OpToInt:  true, OpToFloat: true, OpToString: true, OpToBool: true,
+	OpRandom: true, OpRandomInt: true, OpChoice: true,
+	OpEnv: true, OpArgs: true,
+}
+
+func (op Opcode) String() string {
+	if op >= 0 && op < opcodeCount && opcodeNames[op] != "" {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("Opcode(%d)", int(op))
+}
+
+func (instr Instruction) String() string {
+	if operandless[instr.Opcode] {
+		return instr.Opcode.String()
+	}
+	return instr.Opcode.String() + " " + strconv.Itoa(instr.Operand)
+}
+
+// Disassemble returns a readable listing of a program: its constant pool,
+// its function table and its instructions, with function entry points
+// labelled and constant and function operands resolved
+func Disassemble(program *Program) string {
+	var sb strings.Builder
+
+	sb.WriteString("constants:\n")
+	for i, constant := range program.Constants {
+		fmt.Fprintf(&sb, "%6d  %s\n", i, formatConstant(constant))
+	}
+
+	sb.WriteString("functions:\n")
+	for i, function := range program.Functions {
+		fmt.Fprintf(&sb, "%6d  %s address=%d arity=%d locals=%d\n", i, function.Name, function.Address, function.Arity, function.Locals)
+	}
+
+	sb.WriteString("code:\n")
+	writeCode(&sb, program, 0, len(program.Instructions))
+	return sb.String()
+}
+
+// DisassembleCode returns the listing of the instructions from start up to
+// end alone, such as the code the REPL generated for an input, labelled and
+// resolved like those of Disassemble
+func DisassembleCode(program *Program, start, end int) string {
+	var sb strings.Builder
+	writeCode(&sb, program, max(start, 0), min(end, len(program.Instructions)))
+	return sb.String()
+}
+
+// writeCode lists the instructions from start up to end, labelling function
+// entry points
+func writeCode(sb *strings.Builder, program *Program, start, end int) {
+	entries := make(map[int][]string)
+	for _, function := range program.Functions {
+		entries[function.Address] = append(entries[function.Address], function.Name)
+	}
+	for pc := start; pc < end; pc++ {
+		instr := program.Instructions[pc]
+		for _, name := range entries[pc] {
+			fmt.Fprintf(sb, "%s:\n", name)
+		}
+		line := fmt.Sprintf("%6d  %s", pc, instr)
+		if comment := operandComment(program, instr); comment != "" {
+			line = fmt.Sprintf("%-40s; %s", line, comment)
+		}
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+}
+
+// operandComment resolves an operand that refers into the constant pool or
+// the function table
+func operandComment(program *Program, instr Instruction) string {
+	switch instr.Opcode {
+	case OpConstant, OpGetState, OpSetState:
+		if instr.Operand >= 0 && instr.Operand < len(program.Constants) {
+			return formatConstant(program.Constants[instr.Operand])
+		}
+		return "out of range"
+	case OpCall, OpCreateEventHandler, OpCreateFunction:
+		if instr.Operand >= 0 && instr.Operand < len(program.Functions) {
+			return program.Functions[instr.Operand].Name
+		}
+		return "out of range"
+	}
+	return ""
+}
+
+// formatConstant prints strings quoted so they stand apart from numbers
+func formatConstant(constant Value) string {
+	if s, ok := constant.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(constant)
+}
@@ -0,0 +1,116 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ParseYAML decodes a single YAML document into maps, lists and scalars.
+// Timestamps become strings in RFC 3339 form and an empty document nil.
+func ParseYAML(data []byte) (Value, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var extra any
+	if err := decoder.Decode(&extra); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected data after the first YAML document")
+	}
+	return documentValue(value), nil
+}
+
+// ParseTOML decodes a TOML document into a map. Date-times become strings
+// in RFC 3339 form.
+func ParseTOML(data []byte) (Value, error) {
+	document, err := toml.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return documentValue(document), nil
+}
+
+// parseDocument runs OpYAMLParse and OpTOMLParse: the text on the stack is
+// replaced by the document parse decodes from it
+func (vm *VM) parseDocument(builtin string, parse func([]byte) (Value, error)) {
+	text, ok := vm.popText(builtin, "document")
+	if !ok {
+		return
+	}
+	value, err := parse([]byte(text))
+	if err != nil {
+		vm.fail(fmt.Errorf("%s: %w", builtin, err))
+		return
+	}
+	vm.adopt(value)
+	vm.stack = append(vm.stack, value)
+}
+
+// documentValue converts a decoded YAML or TOML value to the types the VM
+// works with. Keys are sorted like those of ParseJSON, as the decoders do
+// not keep their order.
+func documentValue(value any) Value {
+	switch v := value.(type) {
+	case int64:
+		return int(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return float64(v)
+		}
+		return int(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []any:
+		l := NewList()
+		for _, item := range v {
+			l.Append(documentValue(item))
+		}
+		return l
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		m := NewMap()
+		for _, key := range keys {
+			m.Set(key, documentValue(v[key]))
+		}
+		return m
+	case map[any]any:
+		// YAML allows keys other than strings, they are formatted
+		values := make(map[string]any, len(v))
+		for key, item := range v {
+			values[fmt.Sprint(key)] = item
+		}
+		return documentValue(values)
+	}
+	return value
+}
@@ -0,0 +1,67 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+// WithArgs sets the arguments the program was started with, which args()
+// returns
+func WithArgs(args []string) Option {
+	return func(vm *VM) {
+		vm.args = args
+	}
+}
+
+// readEnv runs OpEnv: the variable name on the stack is replaced by its
+// value in the host environment, empty when it is not set. The Policy must
+// allow reading it and agents need EnvCapability.
+func (vm *VM) readEnv() {
+	value := vm.popStack()
+	name, ok := value.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("env expects a variable name, got %T", value))
+		return
+	}
+	if !vm.requireCapability(EnvCapability, fmt.Sprintf("read %s", name)) {
+		return
+	}
+	if !vm.policy.AllowEnv {
+		vm.fail(fmt.Errorf("%w: reading %s is not allowed", ErrEnvDenied, name))
+		return
+	}
+	if len(vm.policy.ReadableEnv) > 0 && !slices.Contains(vm.policy.ReadableEnv, name) {
+		vm.fail(fmt.Errorf("%w: %s is not in the readable list", ErrEnvDenied, name))
+		return
+	}
+	vm.stack = append(vm.stack, os.Getenv(name))
+}
+
+// programArgs runs OpArgs, pushing the program's arguments as a list of
+// strings
+func (vm *VM) programArgs() {
+	args := make([]Value, len(vm.args))
+	for i, arg := range vm.args {
+		args[i] = arg
+	}
+	l := NewList(args...)
+	vm.alloc(l)
+	vm.stack = append(vm.stack, l)
+}
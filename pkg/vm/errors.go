@@ -0,0 +1,107 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInstructionBudgetExceeded is returned when a program executes more
+	// instructions than allowed by WithMaxInstructions
+	ErrInstructionBudgetExceeded = errors.New("instruction budget exceeded")
+	// ErrTimeout is returned when a program runs for longer than allowed by
+	// WithTimeout
+	ErrTimeout = errors.New("execution timed out")
+	// ErrStackOverflow is returned when the value stack or the call stack
+	// grows beyond its configured limit
+	ErrStackOverflow = errors.New("stack overflow")
+	// ErrUnknownFunction is returned by CallFunction when the program has no
+	// function with the requested name
+	ErrUnknownFunction = errors.New("unknown function")
+	// ErrDivisionByZero is returned when an int is divided by the int zero,
+	// float division follows IEEE 754 instead
+	ErrDivisionByZero = errors.New("division by zero")
+	// ErrIntegerOverflow is returned when the result of int arithmetic does
+	// not fit in an int
+	ErrIntegerOverflow = errors.New("integer overflow")
+	// ErrOutOfMemory is returned when a program holds more memory than
+	// allowed by WithMaxMemory
+	ErrOutOfMemory = errors.New("out of memory")
+	// ErrUnknownAgent is returned by Emit when the program has not created
+	// an agent with the requested name
+	ErrUnknownAgent = errors.New("unknown agent")
+	// ErrMailboxFull is returned when a message is sent to a full mailbox
+	// and the backpressure policy is BackpressureFail
+	ErrMailboxFull = errors.New("mailbox full")
+	// ErrCapabilityDenied is returned when an agent uses a privileged
+	// builtin without declaring the capability it requires. Like other
+	// handler failures it can be caught with an error handler.
+	ErrCapabilityDenied = errors.New("capability denied")
+	// ErrQuotaExceeded is returned when an agent exceeds its quota, set with
+	// WithQuota or WithAgentQuota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrUnknownSession is returned by EndSession when no session has the
+	// requested ID
+	ErrUnknownSession = errors.New("unknown session")
+	// ErrAssertionFailed is returned when the condition of an assert is
+	// false. Like other handler failures it can be caught with an error
+	// handler.
+	ErrAssertionFailed = errors.New("assertion failed")
+)
+
+// RuntimeError is an error raised while executing a program
+type RuntimeError struct {
+	PC  int
+	Err error
+	// CallChain holds the functions that were active when the error was
+	// raised, outermost first
+	CallChain []string
+}
+
+func (e *RuntimeError) Error() string {
+	msg := fmt.Sprintf("runtime error at pc %d: %s", e.PC, e.Err)
+	if len(e.CallChain) > 1 {
+		msg += " (call chain: " + formatCallChain(e.CallChain) + ")"
+	}
+	return msg
+}
+
+// formatCallChain joins a call chain, collapsing runs of the same function
+// so deep recursion stays readable
+func formatCallChain(chain []string) string {
+	parts := []string{}
+	for i := 0; i < len(chain); {
+		j := i
+		for j < len(chain) && chain[j] == chain[i] {
+			j++
+		}
+		if j-i > 1 {
+			parts = append(parts, fmt.Sprintf("%s x%d", chain[i], j-i))
+		} else {
+			parts = append(parts, chain[i])
+		}
+		i = j
+	}
+	return strings.Join(parts, " -> ")
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
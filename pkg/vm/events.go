@@ -0,0 +1,507 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+	"go.uber.org/zap"
+)
+
+// Lifecycle events the runtime delivers to agents
+const (
+	// StartEvent is posted to every agent once it has been created
+	StartEvent = "start"
+	// StopEvent is delivered when an agent is stopped with StopAgent or
+	// Shutdown. Its handlers are the last ones the agent runs.
+	StopEvent = "stop"
+	// ErrorEvent is delivered to an agent when one of its handlers fails,
+	// with a map holding the failed "event" and the error "message" as the
+	// payload. A failure in an agent without error handlers or supervision
+	// stops the VM.
+	ErrorEvent = "error"
+	// ThrottleEvent is delivered to an agent when one of its handlers
+	// exceeded the agent's quota and was stopped, see Quota
+	ThrottleEvent = "throttle"
+)
+
+// Event is something that happened which agents react to with their on
+// handlers
+type Event struct {
+	// Agent is the name of the agent the event is for, events without one
+	// go to every agent
+	Agent   string
+	Name    string
+	Payload Value
+	// Session is the ID of the session the event belongs to, if any. Events
+	// posted by a handler belong to the session of the handled event.
+	Session string
+
+	// stop marks the event posted by StopAgent, the agent stops receiving
+	// events once it has been dispatched
+	stop bool
+	// resume marks the event ending an agent's backoff, which restarts it
+	resume bool
+	// request is set on events sent with ask, their handlers answer it.
+	// reply marks the event resuming the handler that sent it.
+	request *request
+	reply   *request
+	// trace is the span context of the handler that posted the event, or
+	// of the host that emitted it
+	trace tracing.SpanContext
+}
+
+// EventHandler is a compiled on handler of an agent
+type EventHandler struct {
+	Event string
+	// Function is the index of the handler's body in the function table
+	Function int
+}
+
+// postEvent queues an event, it is dispatched once the code running now
+// has finished
+func (vm *VM) postEvent(event Event) {
+	if !event.trace.IsValid() {
+		event.trace = vm.span.SpanContext()
+	}
+	if event.Session == "" && vm.self != nil {
+		event.Session = vm.event.Session
+	}
+	if metrics := vm.topicMetrics(event.Name); metrics != nil {
+		metrics.Published++
+	}
+	vm.events = append(vm.events, event)
+}
+
+// dispatchEvents runs the handlers of queued events in the order the events
+// were posted until the queue is empty or a handler fails without the agent
+// handling the error. Handlers may post further events.
+func (vm *VM) dispatchEvents() {
+	for len(vm.events) > 0 && vm.err == nil {
+		event := vm.events[0]
+		vm.events[0] = Event{}
+		vm.events = vm.events[1:]
+		if event.resume {
+			vm.resumeAgent(event.Agent)
+			continue
+		}
+		if event.reply != nil {
+			if !vm.resumeHandler(event.reply) {
+				return
+			}
+			continue
+		}
+		vm.metrics.EventsDispatched++
+		vm.touchSession(event)
+		delivered := 0
+		// The request stays open while its handlers are being run
+		if event.request != nil {
+			event.request.pending++
+		}
+		for _, agent := range vm.eventTargets(event) {
+			received := false
+			for _, handler := range agent.Handlers {
+				if !handlerMatches(handler.Event, event.Name) {
+					continue
+				}
+				if !received {
+					vm.record(agent, Activity{Kind: ActivityEvent, Event: event.Name})
+					vm.metricsOf(agent).Events++
+					received = true
+				}
+				delivered++
+				logger.Log.Debugw("Dispatching event", zap.String("agent", agent.Name), zap.String("event", event.Name))
+				if !vm.runHandler(agent, handler, event) {
+					return
+				}
+			}
+			if event.stop {
+				agent.stopped.Store(true)
+				vm.scheduler.cancel(agent.Name)
+				logger.Log.Infow("Agent stopped", zap.String("agent", agent.Name))
+			}
+		}
+		if event.request != nil {
+			if delivered == 0 {
+				vm.answer(event.request, nil, fmt.Errorf("agent %s has no handler for event %s", event.Agent, event.Name))
+			}
+			vm.finishRequest(event.request)
+		}
+		if metrics := vm.topicMetrics(event.Name); metrics != nil {
+			metrics.Delivered += delivered
+			if delivered == 0 {
+				metrics.Undelivered++
+			}
+		}
+	}
+}
+
+// runHandler runs an agent's handler for an event. It reports false when
+// the handler failed and the agent did not handle the error.
+func (vm *VM) runHandler(agent *Agent, handler EventHandler, event Event) bool {
+	if event.request != nil {
+		event.request.pending++
+	}
+	return vm.runAgent(agent, event, func() error {
+		_, err := vm.invoke(handler.Function, vm.handlerArgs(handler, event))
+		return err
+	})
+}
+
+// runAgent runs a handler, or the rest of a suspended one, as agent
+// handling event. The agent's state is saved once the handler finishes and
+// a request the event was sent with is answered with its failure.
+func (vm *VM) runAgent(agent *Agent, event Event, run func() error) bool {
+	self, current, handlerCall, handlerLimit, span := vm.self, vm.event, vm.handlerCall, vm.handlerLimit, vm.span
+	vm.self, vm.event, vm.handlerCall = agent, event, vm.calls+1
+	if agent.quota.InstructionsPerEvent > 0 {
+		vm.handlerLimit = vm.executed + agent.quota.InstructionsPerEvent
+	}
+	vm.span = vm.startHandlerSpan(agent, event)
+	defer func() {
+		vm.span.Finish()
+		vm.self, vm.event, vm.handlerCall, vm.handlerLimit, vm.span = self, current, handlerCall, handlerLimit, span
+	}()
+	start, executed := time.Now(), vm.executed
+	err := run()
+	elapsed := time.Since(start)
+	vm.record(agent, Activity{Kind: ActivityHandler, Event: event.Name, Duration: elapsed})
+	metrics := vm.metricsOf(agent)
+	metrics.Handlers++
+	metrics.Instructions += vm.executed - executed
+	metrics.HandlerLatency.observe(elapsed)
+	if vm.suspended != nil {
+		vm.span.SetAttribute("mindscript.suspended", true)
+		vm.suspended = nil
+		return true
+	}
+	if err == nil {
+		if err = vm.checkpoint(agent); err == nil {
+			err = vm.checkAgentMemory(agent)
+		}
+		if err != nil {
+			vm.fail(err)
+			err = vm.err
+		}
+	}
+	if event.request != nil {
+		if err != nil {
+			vm.answer(event.request, nil, fmt.Errorf("agent %s failed handling %s: %w", agent.Name, event.Name, unwrapRuntimeError(err)))
+		}
+		vm.finishRequest(event.request)
+	}
+	if err != nil {
+		metrics.HandlerFailures++
+		vm.span.SetError(unwrapRuntimeError(err))
+		vm.record(agent, Activity{Kind: ActivityError, Event: event.Name, Message: unwrapRuntimeError(err).Error()})
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		vm.throttle(agent, event, err)
+		return true
+	}
+	if err != nil {
+		return vm.handleError(agent, event, err)
+	}
+	return true
+}
+
+// handleError turns the failure of a handler into an error event for the
+// agent and hands it to the agent's supervision, clearing the runtime error.
+// It reports false when neither handled the failure: the agent has no error
+// handler, or an error handler failed itself, and its supervision did not
+// recover it.
+func (vm *VM) handleError(agent *Agent, event Event, err error) bool {
+	err = unwrapRuntimeError(err)
+	handled := false
+	if event.Name != ErrorEvent && agent.handles(ErrorEvent) {
+		payload := NewMap()
+		payload.Set("event", event.Name)
+		payload.Set("message", err.Error())
+		vm.alloc(payload)
+		vm.postEvent(Event{Agent: agent.Name, Name: ErrorEvent, Payload: payload})
+		handled = true
+	}
+	if agent.supervision != nil && vm.supervise(agent, event, err) {
+		handled = true
+	}
+	if handled {
+		logger.Log.Warnw("Event handler failed", zap.String("agent", agent.Name), zap.String("event", event.Name), zap.Error(err))
+		vm.err = nil
+	}
+	return handled
+}
+
+// unwrapRuntimeError returns the error a runtime error was raised with
+func unwrapRuntimeError(err error) error {
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return runtimeErr.Err
+	}
+	return err
+}
+
+// hostDispatch dispatches the queued events on behalf of the host, unless
+// Run is executing the program and dispatches them itself
+func (vm *VM) hostDispatch() error {
+	if vm.dispatching {
+		return nil
+	}
+
+	defer vm.beginHostCall()()
+	vm.dispatchEvents()
+	if err := vm.err; err != nil {
+		vm.err = nil
+		return err
+	}
+	return nil
+}
+
+// eventTargets returns the agents an event is delivered to
+func (vm *VM) eventTargets(event Event) []*Agent {
+	vm.agentsMu.RLock()
+	defer vm.agentsMu.RUnlock()
+	if event.Agent == "" {
+		targets := make([]*Agent, 0, len(vm.agentList))
+		for _, agent := range vm.agentList {
+			if agent.receives(event) {
+				targets = append(targets, agent)
+			}
+		}
+		return targets
+	}
+	if agent, ok := vm.agents[event.Agent]; ok && agent.receives(event) {
+		return []*Agent{agent}
+	}
+	return nil
+}
+
+// handlerArgs returns the arguments a handler is called with, handlers
+// that declare a parameter receive the event's payload
+func (vm *VM) handlerArgs(handler EventHandler, event Event) []Value {
+	if vm.functions[handler.Function].Arity == 0 {
+		return nil
+	}
+	return []Value{event.Payload}
+}
+
+// createEventHandler runs OpCreateEventHandler, pushing a handler for the
+// function at index whose event is set by OpSetEventHandlerEvent
+func (vm *VM) createEventHandler(index int) {
+	if index < 0 || index >= len(vm.functions) {
+		vm.fail(fmt.Errorf("event handler function %d out of range", index))
+		return
+	}
+	if vm.functions[index].Arity > 1 {
+		vm.fail(fmt.Errorf("event handler %s takes %d arguments, at most 1 is allowed", vm.functions[index].Name, vm.functions[index].Arity))
+		return
+	}
+	vm.stack = append(vm.stack, &EventHandler{Function: index})
+}
+
+// setEventHandlerEvent runs OpSetEventHandlerEvent: the event name is on
+// top of the stack with the handler below it, which stays on the stack
+func (vm *VM) setEventHandlerEvent() {
+	event := vm.popStack()
+	if len(vm.stack) == 0 {
+		vm.fail(fmt.Errorf("no event handler to set event %v on", event))
+		return
+	}
+	handler, ok := vm.stack[len(vm.stack)-1].(*EventHandler)
+	if !ok {
+		vm.fail(fmt.Errorf("cannot set the event of %T", vm.stack[len(vm.stack)-1]))
+		return
+	}
+	handler.Event = fmt.Sprint(event)
+}
+
+// addAgentEventHandler runs OpAddAgentEventHandler, registering the handler
+// on top of the stack with the agent in the global slot index
+func (vm *VM) addAgentEventHandler(index int) {
+	value := vm.popStack()
+	handler, ok := value.(*EventHandler)
+	if !ok {
+		vm.fail(fmt.Errorf("cannot add %T as an event handler", value))
+		return
+	}
+	agent, ok := vm.globalAgent(index)
+	if !ok {
+		return
+	}
+	spec, isTimer, err := ParseTimerEvent(handler.Event)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	agent.Handlers = append(agent.Handlers, *handler)
+	if isTimer {
+		vm.schedule(agent.Name, handler.Event, spec)
+	}
+}
+
+// Emit fires an event at the named agent, or at every agent when agentName
+// is empty, and runs the matching on handlers. It may be called from other
+// goroutines. While Run is executing the program the event is queued behind
+// the events the program posted and Emit returns once it is queued.
+// Otherwise the handlers run before Emit returns, limits apply to them as to
+// a CallFunction call and a handler failure is returned as a *RuntimeError
+// that leaves the VM usable.
+func (vm *VM) Emit(agentName, eventName string, payload Value) error {
+	return vm.EmitContext(context.Background(), agentName, eventName, payload)
+}
+
+// EmitContext emits an event like Emit, as part of the trace of the span
+// context ctx carries and of its session, if any
+func (vm *VM) EmitContext(ctx context.Context, agentName, eventName string, payload Value) (err error) {
+	event := Event{
+		Agent:   agentName,
+		Name:    eventName,
+		Payload: normaliseValue(payload),
+		Session: SessionFromContext(ctx),
+		trace:   tracing.SpanContextFromContext(ctx),
+	}
+	vm.do(func() {
+		err = vm.emitEvent(event)
+	})
+	return err
+}
+
+func (vm *VM) emitEvent(event Event) error {
+	if vm.err != nil {
+		return vm.err
+	}
+	if event.Agent != "" {
+		if _, ok := vm.Agent(event.Agent); !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownAgent, event.Agent)
+		}
+	}
+	if err := CheckTopicEvent(event.Name, false); err != nil {
+		return err
+	}
+	vm.postEvent(event)
+	return vm.hostDispatch()
+}
+
+// StopAgent delivers the stop event to the named agent, after which it no
+// longer receives events. Stopping an agent twice does nothing. Like Emit it
+// may be called from other goroutines and only queues the event while Run
+// is executing the program.
+func (vm *VM) StopAgent(name string) (err error) {
+	vm.do(func() {
+		if vm.err != nil {
+			err = vm.err
+			return
+		}
+		agent, ok := vm.Agent(name)
+		if !ok {
+			err = fmt.Errorf("%w: %s", ErrUnknownAgent, name)
+			return
+		}
+		if !agent.Stopped() {
+			vm.postEvent(Event{Agent: name, Name: StopEvent, stop: true})
+			err = vm.hostDispatch()
+		}
+	})
+	return err
+}
+
+// Shutdown stops every agent that is still running, the most recently
+// created first, so agents can run their teardown logic before the host
+// exits
+func (vm *VM) Shutdown() (err error) {
+	vm.do(func() {
+		if vm.err != nil {
+			err = vm.err
+			return
+		}
+		vm.agentsMu.RLock()
+		agents := append([]*Agent(nil), vm.agentList...)
+		vm.agentsMu.RUnlock()
+		for i := len(agents) - 1; i >= 0; i-- {
+			if !agents[i].Stopped() {
+				vm.postEvent(Event{Agent: agents[i].Name, Name: StopEvent, stop: true})
+			}
+		}
+		err = vm.hostDispatch()
+	})
+	return err
+}
+
+// emit runs OpEmit with argc arguments: the event name, optionally followed
+// by its payload, which go to every local agent, or the agent to deliver
+// them to followed by the event name and payload, in the order of ask and
+// VM.Emit. The agent may be given by name, names of agents that do not run
+// in this VM are delivered through its Remote.
+func (vm *VM) emit(argc int) {
+	var payload, target Value
+	switch argc {
+	case 1:
+	case 2:
+		payload = vm.popStack()
+	case 3:
+		payload = vm.popStack()
+	default:
+		vm.fail(fmt.Errorf("emit expects 1 to 3 arguments but got %d", argc))
+		return
+	}
+	name, ok := vm.popStack().(string)
+	if !ok {
+		vm.fail(fmt.Errorf("event name must be a string"))
+		return
+	}
+	if argc == 3 {
+		target = vm.popStack()
+	}
+	if err := CheckTopicEvent(name, false); err != nil {
+		vm.fail(err)
+		return
+	}
+	if argc < 3 {
+		vm.postEvent(Event{Name: name, Payload: payload})
+		return
+	}
+	if strings.HasPrefix(name, TopicEventPrefix) {
+		vm.fail(fmt.Errorf("topic event %s goes to every subscriber and cannot be emitted to an agent", name))
+		return
+	}
+	var agentName string
+	switch t := target.(type) {
+	case *Agent:
+		agentName = t.Name
+	case string:
+		agentName = t
+	default:
+		vm.fail(fmt.Errorf("cannot emit an event to %T", target))
+		return
+	}
+	if _, ok := vm.Agent(agentName); ok {
+		vm.postEvent(Event{Agent: agentName, Name: name, Payload: payload})
+		return
+	}
+	if vm.remote == nil {
+		vm.fail(fmt.Errorf("%w: %s", ErrUnknownAgent, agentName))
+		return
+	}
+	if err := vm.remote.Emit(traceContext(ContextWithSession(context.Background(), vm.event.Session), vm.span), agentName, name, payload); err != nil {
+		vm.fail(fmt.Errorf("emitting %s to agent %s: %w", name, agentName, err))
+	}
+}
@@ -0,0 +1,259 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// commandOptions are the options exec takes as its third argument
+type commandOptions struct {
+	// timeout kills the command earlier than the policy's timeout
+	timeout time.Duration
+	// env holds environment variables for the command, as NAME=value
+	env []string
+	// dir is the directory the command runs in
+	dir string
+}
+
+// syscall runs OpSyscall: the command name and a list of its arguments on
+// the stack are replaced by the command's result, its output is streamed to
+// the VM's stdout and stderr
+func (vm *VM) syscall() {
+	argsValue := vm.popStack()
+	name, ok := vm.popStack().(string)
+	if !ok {
+		vm.fail(errors.New("command name must be a string"))
+		return
+	}
+	vm.runCommand(name, argsValue, commandOptions{}, false)
+}
+
+// exec runs OpExec: the command name, optionally followed by a list of its
+// arguments and a map of options, is replaced by the command's result with
+// the output it captured. The options are timeoutMs, which kills the
+// command sooner than the policy's timeout, env, a map of environment
+// variables to set for the command as the policy allows, and cwd, the
+// directory to run it in, which must be inside the policy's WorkDir.
+func (vm *VM) exec(argc int) {
+	var argsValue, optionsValue Value
+	switch argc {
+	case 1:
+	case 2:
+		argsValue = vm.popStack()
+	case 3:
+		optionsValue = vm.popStack()
+		argsValue = vm.popStack()
+	default:
+		vm.fail(fmt.Errorf("exec expects 1 to 3 arguments but got %d", argc))
+		return
+	}
+	name, ok := vm.popStack().(string)
+	if !ok {
+		vm.fail(errors.New("command name must be a string"))
+		return
+	}
+	opts, err := parseCommandOptions(optionsValue)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	vm.runCommand(name, argsValue, opts, true)
+}
+
+// parseCommandOptions reads the options map of exec, nil means no options
+func parseCommandOptions(value Value) (commandOptions, error) {
+	var opts commandOptions
+	if value == nil {
+		return opts, nil
+	}
+	m, ok := value.(*Map)
+	if !ok {
+		return opts, fmt.Errorf("exec options must be a map, got %s", typeName(value))
+	}
+	for _, key := range m.Keys() {
+		option, _ := m.Get(key)
+		switch key {
+		case "timeoutMs":
+			ms, ok := option.(int)
+			if !ok || ms <= 0 {
+				return opts, fmt.Errorf("exec option timeoutMs must be a positive int, got %v", option)
+			}
+			opts.timeout = time.Duration(ms) * time.Millisecond
+		case "env":
+			env, ok := option.(*Map)
+			if !ok {
+				return opts, fmt.Errorf("exec option env must be a map, got %s", typeName(option))
+			}
+			for _, key := range env.Keys() {
+				name := toString(key)
+				if name == "" || strings.ContainsAny(name, "=\x00") {
+					return opts, fmt.Errorf("exec option env has an invalid variable name %q", name)
+				}
+				value, _ := env.Get(key)
+				opts.env = append(opts.env, name+"="+toString(value))
+			}
+		case "cwd":
+			dir, ok := option.(string)
+			if !ok || dir == "" {
+				return opts, fmt.Errorf("exec option cwd must be a directory, got %v", option)
+			}
+			opts.dir = dir
+		default:
+			return opts, fmt.Errorf("unknown exec option %v", key)
+		}
+	}
+	return opts, nil
+}
+
+// runCommand runs a command for OpExec and OpSyscall with the arguments in
+// argsValue, a list or nil. Each argument reaches the process as is, without
+// being split or passed through a shell. The command's result, a map holding
+// its stdout, stderr and exitCode, is pushed. Captured output is cut at the
+// policy's MaxOutput, truncated is then set in the result. When capture is
+// not set the output is streamed to the VM's stdout and stderr instead and
+// left out of the result. Agents need ExecCapability to run commands.
+func (vm *VM) runCommand(name string, argsValue Value, opts commandOptions, capture bool) {
+	var items []Value
+	switch list := argsValue.(type) {
+	case nil:
+	case *List:
+		items = list.Items()
+	default:
+		vm.fail(fmt.Errorf("command arguments must be a list, got %s", typeName(argsValue)))
+		return
+	}
+	if !vm.requireCapability(ExecCapability, fmt.Sprintf("run %q", name)) {
+		return
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		args[i] = toString(item)
+	}
+	logger.Log.Debugw("Running external command", zap.String("command", name), zap.Strings("args", args))
+
+	// Programs may shorten the policy's timeout but not extend it
+	timeout := vm.policy.Timeout
+	if opts.timeout > 0 && (timeout <= 0 || opts.timeout < timeout) {
+		timeout = opts.timeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd, err := vm.policy.command(ctx, name, args, opts.dir)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	if err := vm.policy.checkCommandEnv(opts.env); err != nil {
+		vm.fail(err)
+		return
+	}
+	if len(opts.env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, opts.env...)
+	}
+	if !vm.chargeExec() {
+		return
+	}
+	vm.metrics.Execs++
+	agentMetrics := vm.metricsOf(vm.self)
+	if agentMetrics != nil {
+		agentMetrics.Execs++
+	}
+	span := vm.startSpan("exec " + name)
+	span.SetAttribute("mindscript.command", name)
+	defer span.Finish()
+	stdout := &limitedBuffer{limit: vm.policy.maxOutput()}
+	stderr := &limitedBuffer{limit: vm.policy.maxOutput()}
+	if capture {
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+	} else {
+		cmd.Stdout = vm.stdout
+		cmd.Stderr = vm.stderr
+	}
+
+	exitCode := 0
+	if err := cmd.Run(); err != nil {
+		logger.Log.Errorw("External command failed", zap.String("command", name), zap.Error(err))
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		} else {
+			exitCode = -1
+			fmt.Fprint(stderr, err)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			exitCode = -1
+			fmt.Fprintf(stderr, "command timed out after %s", timeout)
+		}
+		span.SetError(err)
+		vm.metrics.ExecFailures++
+		if agentMetrics != nil {
+			agentMetrics.ExecFailures++
+		}
+	}
+	span.SetAttribute("mindscript.exit_code", exitCode)
+
+	result := NewMap()
+	vm.alloc(result)
+	result.Set("stdout", stdout.String())
+	result.Set("stderr", stderr.String())
+	result.Set("exitCode", exitCode)
+	if stdout.truncated || stderr.truncated {
+		result.Set("truncated", true)
+	}
+	vm.stack = append(vm.stack, result)
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so that commands writing more are not stopped by a failed write. It
+// does not embed its buffer, whose ReadFrom would bypass the limit.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		b.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,79 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// format runs OpFormat: the template and the map on the stack are replaced
+// by the template with each {name} placeholder replaced by the value under
+// name in the map, formatted like string does, such as
+//
+//	format("Hello {name}, count={n}", {"name": user, "n": n})
+//
+// {{ and }} stand for literal braces. A placeholder without a value in the
+// map fails the handler.
+func (vm *VM) format() {
+	valuesValue, templateValue := vm.popStack(), vm.popStack()
+	text, ok := templateValue.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("format template must be a string, got %s", typeName(templateValue)))
+		return
+	}
+	values, ok := valuesValue.(*Map)
+	if !ok {
+		vm.fail(fmt.Errorf("format values must be a map, got %s", typeName(valuesValue)))
+		return
+	}
+	formatted, err := formatTemplate(text, values)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	vm.stack = append(vm.stack, formatted)
+}
+
+func formatTemplate(text string, values *Map) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '{' && strings.HasPrefix(text[i:], "{{"), c == '}' && strings.HasPrefix(text[i:], "}}"):
+			sb.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("format: unclosed placeholder at offset %d", i)
+			}
+			name := text[i+1 : i+end]
+			value, ok := values.Get(name)
+			if !ok {
+				return "", fmt.Errorf("format: no value for placeholder {%s}", name)
+			}
+			sb.WriteString(toString(value))
+			i += end
+		case c == '}':
+			return "", fmt.Errorf("format: unexpected } at offset %d, use }} for a literal brace", i)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+// fusedOperand says which half of a pair a superinstruction takes its
+// operand from
+type fusedOperand int
+
+const (
+	operandFromFirst fusedOperand = iota
+	operandFromSecond
+	// operandFromBoth only fuses pairs whose operands are equal
+	operandFromBoth
+)
+
+// superinstruction describes an instruction that does the work of two
+// adjacent instructions in a single dispatch
+type superinstruction struct {
+	fused         Opcode
+	first, second Opcode
+	operand       fusedOperand
+}
+
+// superinstructions lists the pairs that are fused, chosen from the pairs
+// that dominate the OpcodePairs of typical profiles
+var superinstructions = []superinstruction{
+	{fused: OpGetLocalAdd, first: OpGetLocal, second: OpAdd, operand: operandFromFirst},
+	{fused: OpPushAdd, first: OpPush, second: OpAdd, operand: operandFromFirst},
+	{fused: OpSetLocalGetLocal, first: OpSetLocal, second: OpGetLocal, operand: operandFromBoth},
+	{fused: OpJumpIfEqual, first: OpNotEqual, second: OpJumpIfFalse, operand: operandFromSecond},
+	{fused: OpJumpIfNotEqual, first: OpEqual, second: OpJumpIfFalse, operand: operandFromSecond},
+}
+
+// isJump reports whether the operand of an opcode is a jump target
+func isJump(opcode Opcode) bool {
+	switch opcode {
+	case OpJump, OpJumpIfFalse, OpJumpIfEqual, OpJumpIfNotEqual:
+		return true
+	}
+	return false
+}
+
+// fusePair returns the superinstruction replacing first and second, if any
+func fusePair(first, second Instruction) (Instruction, bool) {
+	for _, super := range superinstructions {
+		if first.Opcode != super.first || second.Opcode != super.second {
+			continue
+		}
+		switch super.operand {
+		case operandFromFirst:
+			return Instruction{Opcode: super.fused, Operand: first.Operand}, true
+		case operandFromSecond:
+			return Instruction{Opcode: super.fused, Operand: second.Operand}, true
+		case operandFromBoth:
+			if first.Operand == second.Operand {
+				return Instruction{Opcode: super.fused, Operand: first.Operand}, true
+			}
+		}
+	}
+	return Instruction{}, false
+}
+
+// unfuse splits a superinstruction back into the pair it replaced
+func unfuse(instr Instruction) ([2]Instruction, bool) {
+	for _, super := range superinstructions {
+		if instr.Opcode == super.fused {
+			pair := [2]Instruction{{Opcode: super.first}, {Opcode: super.second}}
+			if super.operand != operandFromSecond {
+				pair[0].Operand = instr.Operand
+			}
+			if super.operand != operandFromFirst {
+				pair[1].Operand = instr.Operand
+			}
+			return pair, true
+		}
+	}
+	return [2]Instruction{}, false
+}
+
+// Fuse replaces common pairs of adjacent instructions with superinstructions
+// to cut dispatch overhead. Pairs whose second instruction is a jump target
+// or a function entry are left alone, and jump targets and function
+// addresses are updated for the shorter code.
+func (p *Program) Fuse() {
+	count := len(p.Instructions)
+	targets := make([]bool, count+1)
+	for _, instr := range p.Instructions {
+		if isJump(instr.Opcode) && instr.Operand >= 0 && instr.Operand <= count {
+			targets[instr.Operand] = true
+		}
+	}
+	for _, function := range p.Functions {
+		if function.Address >= 0 && function.Address <= count {
+			targets[function.Address] = true
+		}
+	}
+
+	addresses := make([]int, count+1)
+	fused := make([]Instruction, 0, count)
+	for pc := 0; pc < count; pc++ {
+		addresses[pc] = len(fused)
+		if pc+1 < count && !targets[pc+1] {
+			if instr, ok := fusePair(p.Instructions[pc], p.Instructions[pc+1]); ok {
+				fused = append(fused, instr)
+				pc++
+				addresses[pc] = len(fused) - 1
+				continue
+			}
+		}
+		fused = append(fused, p.Instructions[pc])
+	}
+	addresses[count] = len(fused)
+
+	for i, instr := range fused {
+		if isJump(instr.Opcode) && instr.Operand >= 0 && instr.Operand <= count {
+			fused[i].Operand = addresses[instr.Operand]
+		}
+	}
+	for i, function := range p.Functions {
+		if function.Address >= 0 && function.Address <= count {
+			p.Functions[i].Address = addresses[function.Address]
+		}
+	}
+	p.Instructions = fused
+}
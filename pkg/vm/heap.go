@@ -0,0 +1,191 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Object is a value allocated on the VM heap. References returns the values
+// the object holds so the collector can trace through it.
+type Object interface {
+	References() []Value
+}
+
+// DefaultGCThreshold is the number of live objects that triggers the first
+// collection, later thresholds grow with the live heap
+const DefaultGCThreshold = 1024
+
+// HeapStats describes the state of the VM heap
+type HeapStats struct {
+	// Live is the number of objects currently on the heap
+	Live int
+	// Allocated and Freed count objects over the lifetime of the VM
+	Allocated int
+	Freed     int
+	// Collections is the number of garbage collections that have run
+	Collections int
+	// TotalPause is the time spent collecting garbage
+	TotalPause time.Duration
+}
+
+// heap is the object table of a VM. Memory itself is managed by the Go
+// runtime, the table tracks which objects a program can still reach and
+// drops the rest so they can be reclaimed.
+type heap struct {
+	objects map[Object]bool
+	// nextCollection is the live object count that triggers a collection
+	nextCollection int
+	threshold      int
+	stats          HeapStats
+}
+
+func newHeap(threshold int) *heap {
+	return &heap{
+		objects:        make(map[Object]bool),
+		nextCollection: threshold,
+		threshold:      threshold,
+	}
+}
+
+// reset drops every object and the statistics
+func (h *heap) reset() {
+	clear(h.objects)
+	h.nextCollection = h.threshold
+	h.stats = HeapStats{}
+}
+
+// WithGCThreshold sets the number of live objects that triggers the first
+// garbage collection
+func WithGCThreshold(n int) Option {
+	return func(vm *VM) {
+		vm.heap = newHeap(n)
+	}
+}
+
+// alloc registers a new object on the heap, collecting garbage first when
+// the heap has grown past its threshold
+func (vm *VM) alloc(obj Object) {
+	if len(vm.heap.objects) >= vm.heap.nextCollection {
+		vm.CollectGarbage()
+	}
+	vm.heap.objects[obj] = false
+	vm.heap.stats.Allocated++
+	vm.heap.stats.Live = len(vm.heap.objects)
+}
+
+// CollectGarbage runs a mark and sweep collection, removing every object
+// that is not reachable from the stack, the registers or the variables
+func (vm *VM) CollectGarbage() {
+	start := time.Now()
+	h := vm.heap
+
+	for _, value := range vm.stack {
+		h.mark(value)
+	}
+	for _, value := range vm.registers {
+		h.mark(value)
+	}
+	for _, value := range vm.locals {
+		h.mark(value)
+	}
+	for _, value := range vm.globals {
+		h.mark(value)
+	}
+	vm.agentsMu.RLock()
+	for _, agent := range vm.agentList {
+		h.mark(agent)
+	}
+	vm.agentsMu.RUnlock()
+	for _, event := range vm.events {
+		h.mark(event.Payload)
+	}
+	for _, session := range vm.sessions {
+		for _, value := range session.references() {
+			h.mark(value)
+		}
+	}
+	// Suspended handlers hold values in their saved frames
+	for req := range vm.asks {
+		h.mark(req.reply)
+		if c := req.asker; c != nil {
+			h.mark(c.event.Payload)
+			for _, value := range c.locals {
+				h.mark(value)
+			}
+			for _, value := range c.stack {
+				h.mark(value)
+			}
+		}
+	}
+
+	freed := 0
+	for obj, marked := range h.objects {
+		if marked {
+			h.objects[obj] = false
+		} else {
+			delete(h.objects, obj)
+			freed++
+		}
+	}
+
+	h.nextCollection = len(h.objects) * 2
+	if h.nextCollection < h.threshold {
+		h.nextCollection = h.threshold
+	}
+	h.stats.Live = len(h.objects)
+	h.stats.Freed += freed
+	h.stats.Collections++
+	h.stats.TotalPause += time.Since(start)
+	logger.Log.Debugw("Garbage collection finished", zap.Int("freed", freed), zap.Int("live", h.stats.Live))
+}
+
+// mark flags value and everything reachable from it as live. Objects the
+// heap does not know about, such as constants, are traced but not tracked.
+func (h *heap) mark(value Value) {
+	pending := []Value{value}
+	untracked := map[Object]bool{}
+	for len(pending) > 0 {
+		value = pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		obj, ok := value.(Object)
+		if !ok {
+			continue
+		}
+		if marked, tracked := h.objects[obj]; tracked {
+			if marked {
+				continue
+			}
+			h.objects[obj] = true
+		} else {
+			if untracked[obj] {
+				continue
+			}
+			untracked[obj] = true
+		}
+		pending = append(pending, obj.References()...)
+	}
+}
+
+// HeapStats returns statistics about the objects allocated by the program
+func (vm *VM) HeapStats() HeapStats {
+	return vm.heap.stats
+}
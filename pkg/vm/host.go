@@ -0,0 +1,143 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Concurrency model
+//
+// A VM is owned by one goroutine at a time: the one inside Run, Step,
+// Continue or a host call. CallFunction and Metrics may be called from any
+// goroutine. While another goroutine owns the VM they are queued as commands
+// which the owner runs between instructions, while paused or while blocked
+// receiving a message, and the caller waits for the result. An external
+// command started with exec or syscall delays them until it finishes. When
+// no goroutine owns the VM the caller takes ownership and runs the call
+// itself.
+//
+// Host calls are not stopped by Pause, a call made while the VM is paused
+// runs to completion. Queued calls run on the goroutine executing the
+// program, so builtins and trace functions must not make them or they wait
+// on themselves. Pause, Resume, Paused and Agent.Send are safe to call at any
+// time. All other methods, including Reset and the debugger hooks other than
+// Step and Continue, must not be used while the VM runs.
+
+// hostQueue holds the commands waiting for the goroutine that owns the VM
+type hostQueue struct {
+	mu sync.Mutex
+	// idle is signalled when ownership is released
+	idle *sync.Cond
+	// owned is set while a goroutine executes the program
+	owned    bool
+	commands []func()
+	// pending is checked before every instruction, so it is atomic to keep
+	// the check cheap
+	pending atomic.Bool
+	// wake interrupts a blocking receive so it can serve commands
+	wake chan struct{}
+	// serving is the nesting depth of commands being run, it is only used
+	// by the goroutine owning the VM
+	serving int
+}
+
+func newHostQueue() *hostQueue {
+	q := &hostQueue{wake: make(chan struct{}, 1)}
+	q.idle = sync.NewCond(&q.mu)
+	return q
+}
+
+// acquire waits until no other goroutine owns the VM and takes ownership
+func (vm *VM) acquire() {
+	q := vm.host
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.owned {
+		q.idle.Wait()
+	}
+	q.owned = true
+}
+
+// release runs the commands queued while the VM was owned and gives up
+// ownership
+func (vm *VM) release() {
+	q := vm.host
+	q.mu.Lock()
+	for len(q.commands) > 0 {
+		q.mu.Unlock()
+		vm.runCommands()
+		q.mu.Lock()
+	}
+	q.owned = false
+	q.idle.Signal()
+	q.mu.Unlock()
+}
+
+// do runs fn with ownership of the VM, either directly or by queuing it for
+// the goroutine that owns the VM, and returns once fn has run
+func (vm *VM) do(fn func()) {
+	q := vm.host
+	q.mu.Lock()
+	if !q.owned {
+		q.owned = true
+		q.mu.Unlock()
+		defer vm.release()
+		fn()
+		return
+	}
+
+	done := make(chan struct{})
+	q.commands = append(q.commands, func() {
+		defer close(done)
+		fn()
+	})
+	q.pending.Store(true)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	// Wake the owner if it is parked by Pause
+	vm.pause.mu.Lock()
+	vm.pause.changed.Broadcast()
+	vm.pause.mu.Unlock()
+	<-done
+}
+
+// runCommands runs the queued commands on the goroutine owning the VM. The
+// commands get a stack of their own, the register backend's stack aliases
+// its registers and must not be appended to.
+func (vm *VM) runCommands() {
+	q := vm.host
+	q.mu.Lock()
+	commands := q.commands
+	q.commands = nil
+	q.pending.Store(false)
+	q.mu.Unlock()
+
+	stack := vm.stack
+	vm.stack = nil
+	q.serving++
+	for _, command := range commands {
+		command()
+	}
+	q.serving--
+	vm.stack = stack
+}
@@ -0,0 +1,72 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+const (
+	// maxInternedLength keeps long strings such as command output out of the
+	// intern table, only short identifiers like event names repeat often
+	maxInternedLength = 128
+	// maxInternedStrings bounds the table so programs that build many
+	// distinct strings cannot grow it without limit
+	maxInternedStrings = 1 << 16
+)
+
+// internTable maps strings to a single shared copy. Equal interned strings
+// share their backing memory, so comparing them only compares pointers and
+// repeated event and capability names are stored once.
+type internTable struct {
+	strings map[string]string
+	// bytes is the total length of the interned strings
+	bytes int
+}
+
+func newInternTable() *internTable {
+	return &internTable{strings: make(map[string]string)}
+}
+
+// reset empties the table
+func (t *internTable) reset() {
+	clear(t.strings)
+	t.bytes = 0
+}
+
+// intern returns the shared copy of s, adding s to the table if it is short
+// enough and the table has room
+func (t *internTable) intern(s string) string {
+	if interned, ok := t.strings[s]; ok {
+		return interned
+	}
+	if len(s) <= maxInternedLength && len(t.strings) < maxInternedStrings {
+		t.strings[s] = s
+		t.bytes += len(s)
+	}
+	return s
+}
+
+// internConstants returns a copy of the constant pool with its strings
+// replaced by their interned copies, the program itself is left untouched
+// so it can be shared between VMs
+func (t *internTable) internConstants(constants []Value) []Value {
+	interned := make([]Value, len(constants))
+	for i, constant := range constants {
+		if s, ok := constant.(string); ok {
+			constant = t.intern(s)
+		}
+		interned[i] = constant
+	}
+	return interned
+}
@@ -0,0 +1,126 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/llm"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// DefaultLLMTimeout is how long an llm call may take by default
+const DefaultLLMTimeout = time.Minute
+
+// ErrNoLLMProvider is returned when a program calls llm but the VM was
+// created without a provider
+var ErrNoLLMProvider = errors.New("no llm provider configured")
+
+// LLMMetrics counts the calls agents made to the language model
+type LLMMetrics struct {
+	Calls int
+	// Embeddings counts the requests to the embedder, they are not included
+	// in Calls
+	Embeddings int
+	Failures   int
+	// PromptTokens and CompletionTokens are the tokens reported by the
+	// provider
+	PromptTokens     int
+	CompletionTokens int
+	// Latency is the total time spent waiting for the provider
+	Latency time.Duration
+}
+
+// WithLLM sets the provider the llm builtin sends prompts to
+func WithLLM(provider llm.Provider) Option {
+	return func(vm *VM) {
+		vm.llm = provider
+	}
+}
+
+// WithLLMTimeout limits how long a single llm call may take, zero removes
+// the limit. DefaultLLMTimeout applies otherwise.
+func WithLLMTimeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.llmTimeout = d
+	}
+}
+
+// callLLM runs OpLLM: the prompt on the stack is replaced by the model's
+// completion. Agents need LLMCapability to call the model.
+func (vm *VM) callLLM() {
+	value := vm.popStack()
+	prompt, ok := value.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("llm prompt must be a string, got %T", value))
+		return
+	}
+	if !vm.requireCapability(LLMCapability, "call llm") {
+		return
+	}
+	if vm.llm == nil {
+		vm.fail(ErrNoLLMProvider)
+		return
+	}
+	if !vm.checkTokens() {
+		return
+	}
+
+	span := vm.startSpan("llm")
+	defer span.Finish()
+	ctx, cancel := vm.llmContext()
+	defer cancel()
+	start := time.Now()
+	resp, err := vm.llm.Complete(traceContext(ctx, span), llm.Request{Prompt: prompt})
+	metrics := &vm.metrics.LLM
+	metrics.Calls++
+	metrics.Latency += time.Since(start)
+	if err != nil {
+		metrics.Failures++
+		span.SetError(err)
+		vm.fail(vm.llmError("llm", err))
+		return
+	}
+	span.SetAttribute("gen_ai.usage.input_tokens", resp.Usage.PromptTokens)
+	span.SetAttribute("gen_ai.usage.output_tokens", resp.Usage.CompletionTokens)
+	metrics.PromptTokens += resp.Usage.PromptTokens
+	metrics.CompletionTokens += resp.Usage.CompletionTokens
+	vm.chargeTokens(resp.Usage.PromptTokens + resp.Usage.CompletionTokens)
+	logger.Log.Debugw("LLM call completed", zap.Int("promptTokens", resp.Usage.PromptTokens), zap.Int("completionTokens", resp.Usage.CompletionTokens), zap.Duration("latency", time.Since(start)))
+	vm.stack = append(vm.stack, resp.Text)
+}
+
+// llmContext limits a call to the model to the VM's llm timeout
+func (vm *VM) llmContext() (context.Context, context.CancelFunc) {
+	if vm.llmTimeout > 0 {
+		return context.WithTimeout(context.Background(), vm.llmTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// llmError describes a failed call to the model, reporting deadlines as
+// timeouts
+func (vm *VM) llmError(builtin string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %s call took longer than %s", ErrTimeout, builtin, vm.llmTimeout)
+	}
+	return fmt.Errorf("%s: %w", builtin, err)
+}
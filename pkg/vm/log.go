@@ -0,0 +1,84 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logLevels are the levels programs log at
+var logLevels = map[string]zapcore.Level{
+	"debug": zapcore.DebugLevel,
+	"info":  zapcore.InfoLevel,
+	"warn":  zapcore.WarnLevel,
+	"error": zapcore.ErrorLevel,
+}
+
+// log runs OpLog, writing a message to the runtime's logger. It takes the
+// message alone, logged at info, or a level, the message and optionally a
+// map of fields: log("warn", "disk low", fields). The agent and event being
+// handled are added to the fields.
+func (vm *VM) log(argc int) {
+	var level, fields Value = "info", nil
+	switch argc {
+	case 1:
+	case 2:
+	case 3:
+		fields = vm.popStack()
+	default:
+		vm.fail(fmt.Errorf("log expects 1 to 3 arguments but got %d", argc))
+		return
+	}
+	message := vm.popStack()
+	if argc > 1 {
+		level = vm.popStack()
+	}
+
+	name, ok := level.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("log level must be a string, got %s", typeName(level)))
+		return
+	}
+	lvl, ok := logLevels[name]
+	if !ok {
+		vm.fail(fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name))
+		return
+	}
+	var zapFields []zap.Field
+	if vm.self != nil {
+		zapFields = append(zapFields, zap.String("agent", vm.self.Name), zap.String("event", vm.event.Name))
+	}
+	switch f := fields.(type) {
+	case nil:
+	case *Map:
+		for _, key := range f.Keys() {
+			value, _ := f.Get(key)
+			zapFields = append(zapFields, zap.Any(toString(key), value))
+		}
+	default:
+		vm.fail(fmt.Errorf("log fields must be a map, got %s", typeName(fields)))
+		return
+	}
+
+	if entry := logger.Log.Desugar().Check(lvl, toString(message)); entry != nil {
+		entry.Write(zapFields...)
+	}
+}
@@ -0,0 +1,109 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultMCPTimeout is how long an mcp tool call may take by default
+const DefaultMCPTimeout = time.Minute
+
+// MCPClient calls the tools of a Model Context Protocol server, such as
+// mcp.Client
+type MCPClient interface {
+	// CallTool calls the tool with args, a JSON object, and returns the
+	// tool's result
+	CallTool(ctx context.Context, tool string, args any) (json.RawMessage, error)
+}
+
+// WithMCPServer makes the tools of client callable as
+// mcp("name", "tool", args)
+func WithMCPServer(name string, client MCPClient) Option {
+	return func(vm *VM) {
+		if vm.mcpServers == nil {
+			vm.mcpServers = make(map[string]MCPClient)
+		}
+		vm.mcpServers[name] = client
+	}
+}
+
+// WithMCPTimeout limits how long a single mcp tool call may take, zero
+// removes the limit. DefaultMCPTimeout applies otherwise.
+func WithMCPTimeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.mcpTimeout = d
+	}
+}
+
+// callTool runs OpMCP: the server, tool and arguments on the stack are
+// replaced by the tool's result as a map, holding the tool's "content" and
+// any "structuredContent". Agents need MCPCapability to call tools.
+func (vm *VM) callTool() {
+	args := vm.popStack()
+	tool, ok := vm.popText("mcp", "tool")
+	if !ok {
+		return
+	}
+	server, ok := vm.popText("mcp", "server")
+	if !ok {
+		return
+	}
+	if args != nil {
+		if _, ok := args.(*Map); !ok {
+			vm.fail(fmt.Errorf("mcp arguments must be a map, got %T", args))
+			return
+		}
+	}
+	if !vm.requireCapability(MCPCapability, fmt.Sprintf("call %s.%s", server, tool)) {
+		return
+	}
+	client, ok := vm.mcpServers[server]
+	if !ok {
+		vm.fail(fmt.Errorf("no mcp server named %s", server))
+		return
+	}
+
+	span := vm.startSpan("mcp " + server + "." + tool)
+	defer span.Finish()
+	ctx := traceContext(context.Background(), span)
+	if vm.mcpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vm.mcpTimeout)
+		defer cancel()
+	}
+	data, err := client.CallTool(ctx, tool, args)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: tool call took longer than %s", ErrTimeout, vm.mcpTimeout)
+		}
+		span.SetError(err)
+		vm.fail(fmt.Errorf("mcp %s.%s: %w", server, tool, err))
+		return
+	}
+	result, err := ParseJSON(data)
+	if err != nil {
+		vm.fail(fmt.Errorf("mcp %s.%s: %w", server, tool, err))
+		return
+	}
+	vm.adopt(result)
+	vm.stack = append(vm.stack, result)
+}
@@ -0,0 +1,140 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import "fmt"
+
+// Estimated sizes in bytes used for memory accounting
+const (
+	// valueSize is the size of a stack slot, variable or map entry value
+	valueSize = 16
+	// frameSize is the size of a call stack entry
+	frameSize = 24
+	// mapSize is the fixed size of an empty map and mapEntrySize what each
+	// entry adds on top of its key and value
+	mapSize      = 64
+	mapEntrySize = 32
+)
+
+// memoryCheckInterval is how many instructions run between memory checks,
+// adding up the usage on every step would dominate execution time
+const memoryCheckInterval = 256
+
+// MemoryUsage is an estimate of the memory held by a VM, in bytes
+type MemoryUsage struct {
+	// Stacks covers the value stack, the variables, the registers and the
+	// call stack, including the strings they hold
+	Stacks int
+	// Heap covers the objects on the heap
+	Heap int
+	// Strings covers the constant pool and the interned strings
+	Strings int
+}
+
+// Total returns the combined usage
+func (u MemoryUsage) Total() int {
+	return u.Stacks + u.Heap + u.Strings
+}
+
+// WithMaxMemory limits the estimated memory a program may hold to n bytes,
+// exceeding it fails with ErrOutOfMemory. Usage is checked periodically, so
+// a program can briefly go over the limit before it is stopped. Zero removes
+// the limit.
+func WithMaxMemory(n int) Option {
+	return func(vm *VM) {
+		vm.maxMemory = n
+	}
+}
+
+// MemoryUsage returns an estimate of the memory currently held by the VM
+func (vm *VM) MemoryUsage() MemoryUsage {
+	usage := MemoryUsage{
+		Strings: vm.constantBytes + vm.strings.bytes,
+		Stacks:  len(vm.callStack) * frameSize,
+	}
+	for _, values := range [][]Value{vm.stack, vm.locals, vm.globals, vm.registers} {
+		for _, value := range values {
+			usage.Stacks += sizeOfValue(value)
+		}
+	}
+	for obj := range vm.heap.objects {
+		usage.Heap += sizeOfObject(obj)
+	}
+	return usage
+}
+
+// checkMemory returns ErrOutOfMemory when the memory limit is exceeded even
+// after collecting garbage
+func (vm *VM) checkMemory() error {
+	if vm.MemoryUsage().Total() <= vm.maxMemory {
+		return nil
+	}
+	vm.CollectGarbage()
+	if used := vm.MemoryUsage().Total(); used > vm.maxMemory {
+		return fmt.Errorf("%w: using %d bytes, limit is %d", ErrOutOfMemory, used, vm.maxMemory)
+	}
+	return nil
+}
+
+// concat joins two values as strings. Strings grow quickly when built in a
+// loop, so a result that alone exceeds the memory limit fails right away
+// instead of waiting for the next periodic check.
+func (vm *VM) concat(left, right Value) Value {
+	concatenated := fmt.Sprint(left) + fmt.Sprint(right)
+	if vm.maxMemory > 0 && len(concatenated) > vm.maxMemory {
+		vm.fail(fmt.Errorf("%w: string of %d bytes exceeds limit of %d", ErrOutOfMemory, len(concatenated), vm.maxMemory))
+		return nil
+	}
+	return vm.strings.intern(concatenated)
+}
+
+// sizeOfValue estimates the size of a value held in a slot. Objects are
+// accounted for by the heap, so only the reference is counted here.
+func sizeOfValue(value Value) int {
+	if s, ok := value.(string); ok {
+		return valueSize + len(s)
+	}
+	return valueSize
+}
+
+// sizeOfObject estimates the size of a heap object
+func sizeOfObject(obj Object) int {
+	switch o := obj.(type) {
+	case *Map:
+		size := mapSize
+		for _, key := range o.keys {
+			size += mapEntrySize + sizeOfValue(key) + sizeOfValue(o.items[key])
+		}
+		return size
+	case *List:
+		size := valueSize
+		for _, item := range o.items {
+			size += sizeOfValue(item)
+		}
+		return size
+	}
+	return valueSize
+}
+
+// sizeOfConstants estimates the size of a constant pool
+func sizeOfConstants(constants []Value) int {
+	size := 0
+	for _, constant := range constants {
+		size += sizeOfValue(constant)
+	}
+	return size
+}
@@ -0,0 +1,147 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"slices"
+	"time"
+)
+
+// Metrics holds counters describing the work a VM has done since it was
+// created or last reset. Unlike profiling they are always collected.
+type Metrics struct {
+	// Instructions is the number of instructions executed
+	Instructions int
+	// Calls counts function calls, including calls made by CallFunction and
+	// event handler invocations
+	Calls int
+	// Execs counts external commands started by exec and syscall, and
+	// ExecFailures those that could not run, exited with a non-zero status
+	// or timed out
+	Execs        int
+	ExecFailures int
+	// PeakStackDepth is the largest number of values the stack has held
+	PeakStackDepth int
+	// EventsDispatched counts events taken from the queue and delivered to
+	// the agents' handlers
+	EventsDispatched int
+	// Throttles counts the handlers stopped for exceeding their agent's
+	// quota
+	Throttles int
+	// Topics holds the traffic of each topic messages were published to
+	Topics map[string]TopicMetrics
+	// LLM counts the calls made to the language model and their tokens
+	LLM LLMMetrics
+	// Agents holds the work of each agent that received an event, by name
+	Agents map[string]AgentMetrics
+}
+
+// AgentMetrics counts the work of a single agent
+type AgentMetrics struct {
+	// Events counts the events delivered to the agent's handlers
+	Events int
+	// Handlers counts the handler runs, a handler suspended by ask counts
+	// again when it resumes, and HandlerFailures those that failed
+	Handlers        int
+	HandlerFailures int
+	// Instructions is the number of instructions its handlers executed
+	Instructions int
+	Execs        int
+	ExecFailures int
+	// HandlerLatency is the distribution of the handlers' run times
+	HandlerLatency Histogram
+}
+
+// LatencyBuckets are the upper bounds of the buckets handler run times are
+// counted in
+var LatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second, 30 * time.Second,
+}
+
+// Histogram counts durations in the LatencyBuckets
+type Histogram struct {
+	// Buckets holds the number of durations at most each of the
+	// LatencyBuckets, durations above the last one are only counted in
+	// Count
+	Buckets []int
+	Count   int
+	Sum     time.Duration
+}
+
+// observe counts a duration
+func (h *Histogram) observe(d time.Duration) {
+	if h.Buckets == nil {
+		h.Buckets = make([]int, len(LatencyBuckets))
+	}
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			h.Buckets[i]++
+		}
+	}
+	h.Count++
+	h.Sum += d
+}
+
+// Metrics returns a snapshot of the VM's counters. It may be called from
+// other goroutines while the VM runs.
+func (vm *VM) Metrics() Metrics {
+	var metrics Metrics
+	vm.do(func() {
+		metrics = vm.metrics
+		metrics.Instructions += vm.executed
+		if len(vm.topics) > 0 {
+			metrics.Topics = make(map[string]TopicMetrics, len(vm.topics))
+			for topic, topicMetrics := range vm.topics {
+				metrics.Topics[topic] = *topicMetrics
+			}
+		}
+		if len(vm.agentMetrics) > 0 {
+			metrics.Agents = make(map[string]AgentMetrics, len(vm.agentMetrics))
+			for name, agentMetrics := range vm.agentMetrics {
+				snapshot := *agentMetrics
+				snapshot.HandlerLatency.Buckets = slices.Clone(agentMetrics.HandlerLatency.Buckets)
+				metrics.Agents[name] = snapshot
+			}
+		}
+	})
+	return metrics
+}
+
+// recordStackDepth updates the peak stack depth
+func (vm *VM) recordStackDepth(depth int) {
+	if depth > vm.metrics.PeakStackDepth {
+		vm.metrics.PeakStackDepth = depth
+	}
+}
+
+// metricsOf returns the counters of an agent, or nil when no agent is
+// running
+func (vm *VM) metricsOf(agent *Agent) *AgentMetrics {
+	if agent == nil {
+		return nil
+	}
+	if vm.agentMetrics == nil {
+		vm.agentMetrics = make(map[string]*AgentMetrics)
+	}
+	metrics, ok := vm.agentMetrics[agent.Name]
+	if !ok {
+		metrics = &AgentMetrics{}
+		vm.agentMetrics[agent.Name] = metrics
+	}
+	return metrics
+}
@@ -0,0 +1,234 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Value is any value that can live on the VM stack
+type Value = interface{}
+
+// Map is the runtime representation of a MindScript map. Keys are kept in
+// insertion order so maps print and serialise deterministically.
+type Map struct {
+	keys  []Value
+	items map[Value]Value
+}
+
+func NewMap() *Map {
+	return &Map{
+		keys:  make([]Value, 0),
+		items: make(map[Value]Value),
+	}
+}
+
+// isValidMapKey reports whether a value can be used as a map key
+func isValidMapKey(key Value) bool {
+	switch key.(type) {
+	case string, int, float64, bool:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get returns the value stored under key
+func (m *Map) Get(key Value) (Value, bool) {
+	value, ok := m.items[key]
+	return value, ok
+}
+
+// Set stores value under key, keeping the original position of existing keys
+func (m *Map) Set(key Value, value Value) {
+	if _, exists := m.items[key]; !exists {
+		m.keys = append(m.keys, key)
+	}
+	m.items[key] = value
+}
+
+// References returns the values stored in the map for the garbage collector
+func (m *Map) References() []Value {
+	values := make([]Value, 0, len(m.items))
+	for _, key := range m.keys {
+		values = append(values, m.items[key])
+	}
+	return values
+}
+
+// Len returns the number of entries in the map
+func (m *Map) Len() int {
+	return len(m.keys)
+}
+
+// Keys returns the keys of the map in insertion order
+func (m *Map) Keys() []Value {
+	return m.keys
+}
+
+func (m *Map) String() string {
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, key := range m.keys {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%q: %v", fmt.Sprint(key), m.items[key])
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// MarshalJSON encodes the map as a JSON object, preserving key order
+func (m *Map) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyJson, err := json.Marshal(fmt.Sprint(key))
+		if err != nil {
+			return nil, err
+		}
+		valueJson, err := json.Marshal(m.items[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(keyJson)
+		buf.WriteByte(':')
+		buf.Write(valueJson)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// List is the runtime representation of a MindScript list
+type List struct {
+	items []Value
+}
+
+// NewList returns a list holding items
+func NewList(items ...Value) *List {
+	return &List{items: append([]Value{}, items...)}
+}
+
+// Get returns the item at index
+func (l *List) Get(index int) (Value, bool) {
+	if index < 0 || index >= len(l.items) {
+		return nil, false
+	}
+	return l.items[index], true
+}
+
+// Set replaces the item at index, reporting false if it is out of range
+func (l *List) Set(index int, value Value) bool {
+	if index < 0 || index >= len(l.items) {
+		return false
+	}
+	l.items[index] = value
+	return true
+}
+
+// Append adds a value to the end of the list
+func (l *List) Append(value Value) {
+	l.items = append(l.items, value)
+}
+
+// References returns the items of the list for the garbage collector
+func (l *List) References() []Value {
+	return l.items
+}
+
+// Len returns the number of items in the list
+func (l *List) Len() int {
+	return len(l.items)
+}
+
+// Items returns the items of the list in order
+func (l *List) Items() []Value {
+	return l.items
+}
+
+func (l *List) String() string {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i, item := range l.items {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%v", item)
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// MarshalJSON encodes the list as a JSON array
+func (l *List) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.items)
+}
+
+// ParseJSON decodes JSON into maps, lists and scalars. Integral numbers
+// become ints and other numbers floats.
+func ParseJSON(data []byte) (Value, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return jsonValue(value), nil
+}
+
+func jsonValue(value any) Value {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		l := NewList()
+		for _, item := range v {
+			l.Append(jsonValue(item))
+		}
+		return l
+	case map[string]any:
+		// Objects are unordered, their keys are sorted so maps print the
+		// same every time
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		m := NewMap()
+		for _, key := range keys {
+			m.Set(key, jsonValue(v[key]))
+		}
+		return m
+	}
+	return value
+}
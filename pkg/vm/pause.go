@@ -0,0 +1,102 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+)
+
+// pauseState coordinates Pause and Resume, which are called from other
+// goroutines, with the goroutine executing the program
+type pauseState struct {
+	// requested is checked before every instruction, so it is atomic to
+	// keep the check cheap
+	requested atomic.Bool
+	mu        sync.Mutex
+	changed   *sync.Cond
+	// parked is set while the executing goroutine waits to be resumed
+	parked bool
+}
+
+func newPauseState() *pauseState {
+	p := &pauseState{}
+	p.changed = sync.NewCond(&p.mu)
+	return p
+}
+
+// Pause asks the VM to stop before its next instruction and returns without
+// waiting, Paused reports once it has stopped. The executing goroutine
+// blocks until Resume is called, time spent paused does not count towards
+// the timeout. Pause and Resume may be called from any goroutine.
+func (vm *VM) Pause() {
+	vm.pause.requested.Store(true)
+}
+
+// Resume continues a VM stopped with Pause
+func (vm *VM) Resume() {
+	vm.pause.mu.Lock()
+	defer vm.pause.mu.Unlock()
+	vm.pause.requested.Store(false)
+	vm.pause.changed.Broadcast()
+}
+
+// Paused reports whether the VM is stopped at a safe point waiting for
+// Resume
+func (vm *VM) Paused() bool {
+	vm.pause.mu.Lock()
+	defer vm.pause.mu.Unlock()
+	return vm.pause.parked
+}
+
+// safePoint is called between instructions. It runs queued host calls and
+// parks the executing goroutine while a pause is requested.
+func (vm *VM) safePoint() {
+	if vm.host.pending.Load() {
+		vm.runCommands()
+	}
+	if !vm.pause.requested.Load() || vm.host.serving > 0 {
+		return
+	}
+	p := vm.pause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.requested.Load() {
+		return
+	}
+	logger.Log.Info("VM paused")
+	start := time.Now()
+	p.parked = true
+	for p.requested.Load() {
+		// Host calls are still served while paused
+		if vm.host.pending.Load() {
+			p.mu.Unlock()
+			vm.runCommands()
+			p.mu.Lock()
+			continue
+		}
+		p.changed.Wait()
+	}
+	p.parked = false
+	if vm.timeout > 0 {
+		vm.deadline = vm.deadline.Add(time.Since(start))
+	}
+	logger.Log.Info("VM resumed")
+}
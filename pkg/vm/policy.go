@@ -0,0 +1,248 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrExecDenied is returned when a program tries to run an external command
+// that its Policy does not allow, ErrEnvDenied when it reads an environment
+// variable it does not allow
+var (
+	ErrExecDenied = errors.New("exec denied by policy")
+	ErrEnvDenied  = errors.New("env denied by policy")
+)
+
+// Policy controls which external commands a program may run through OpExec
+// and OpSyscall and which environment variables it may read with OpEnv. It
+// is checked before any process is started.
+type Policy struct {
+	// AllowExec permits running external commands at all
+	AllowExec bool
+	// AllowedBinaries restricts commands to these names or paths. An empty
+	// list allows any binary.
+	AllowedBinaries []string
+	// ScrubEnv runs commands with an environment containing only the
+	// variables named in AllowedEnv instead of the full host environment.
+	// With ScrubEnv or AllowedBinaries, programs may only set the variables
+	// of AllowedEnv for commands, as others such as GIT_SSH_COMMAND or
+	// BASH_ENV make an allowed binary run any other.
+	ScrubEnv   bool
+	AllowedEnv []string
+	// WorkDir confines commands to this directory: they run inside it, or
+	// in a directory below it given with exec's cwd option, and path
+	// arguments may not point outside of it. Empty means no confinement.
+	WorkDir string
+	// Env holds extra environment variables for commands, as NAME=value.
+	// They are added after scrubbing.
+	Env []string
+	// Timeout kills commands that run for longer, zero means no limit
+	Timeout time.Duration
+	// MaxOutput bounds the bytes exec captures from each of a command's
+	// stdout and stderr, the rest is discarded. Zero means
+	// DefaultMaxOutput.
+	MaxOutput int
+	// AllowEnv permits reading environment variables with env, and
+	// ReadableEnv restricts them to these names. An empty list allows any
+	// variable.
+	AllowEnv    bool
+	ReadableEnv []string
+}
+
+// DefaultMaxOutput is the output exec captures from each stream of a
+// command when the Policy does not set MaxOutput
+const DefaultMaxOutput = 1 << 20
+
+// PermissivePolicy allows any command with the host environment and any
+// environment variable to be read, matching the behaviour of trusted local
+// builds
+func PermissivePolicy() Policy {
+	return Policy{AllowExec: true, AllowEnv: true}
+}
+
+// DenyPolicy refuses every external command and environment variable
+func DenyPolicy() Policy {
+	return Policy{AllowExec: false, AllowEnv: false}
+}
+
+// WithPolicy sets the sandbox policy used for external commands
+func WithPolicy(policy Policy) Option {
+	return func(vm *VM) {
+		vm.policy = policy
+	}
+}
+
+// command checks name, args and the directory to run in against the policy
+// and returns the command to run, which is killed once ctx is done. An empty
+// dir runs it in WorkDir, or the current directory, a relative one is
+// relative to them.
+func (p Policy) command(ctx context.Context, name string, args []string, dir string) (*exec.Cmd, error) {
+	if !p.AllowExec {
+		return nil, fmt.Errorf("%w: running %q is not allowed", ErrExecDenied, name)
+	}
+	if !p.binaryAllowed(name) {
+		return nil, fmt.Errorf("%w: binary %q is not in the allowed list", ErrExecDenied, name)
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+
+	if p.WorkDir != "" {
+		workDir, err := filepath.Abs(p.WorkDir)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(workDir, dir)
+		}
+		if !pathWithin(workDir, workDir, dir) {
+			return nil, fmt.Errorf("%w: directory %q is outside the working directory", ErrExecDenied, cmd.Dir)
+		}
+		for _, arg := range args {
+			if !argWithin(workDir, dir, arg) {
+				return nil, fmt.Errorf("%w: argument %q escapes the working directory", ErrExecDenied, arg)
+			}
+		}
+		cmd.Dir = dir
+	}
+
+	if p.ScrubEnv {
+		cmd.Env = scrubEnv(os.Environ(), p.AllowedEnv)
+	}
+	if len(p.Env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, p.Env...)
+	}
+
+	return cmd, nil
+}
+
+// checkCommandEnv checks the variables a program sets for a command, as
+// NAME=value. Those of the dynamic loader, which would let it run any code
+// in an allowed binary, are always refused. When the policy restricts the
+// binaries or scrubs the environment only the variables of AllowedEnv may
+// be set.
+func (p Policy) checkCommandEnv(env []string) error {
+	restricted := p.ScrubEnv || len(p.AllowedBinaries) > 0
+	for _, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, "LD_") || strings.HasPrefix(name, "DYLD_") {
+			return fmt.Errorf("%w: setting %s for commands is not allowed", ErrExecDenied, name)
+		}
+		if restricted && !slices.Contains(p.AllowedEnv, name) {
+			return fmt.Errorf("%w: setting %s for commands is not allowed", ErrExecDenied, name)
+		}
+	}
+	return nil
+}
+
+// maxOutput returns the bytes exec captures from each stream of a command
+func (p Policy) maxOutput() int {
+	if p.MaxOutput > 0 {
+		return p.MaxOutput
+	}
+	return DefaultMaxOutput
+}
+
+func (p Policy) binaryAllowed(name string) bool {
+	if len(p.AllowedBinaries) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedBinaries {
+		// Bare names only match bare names, so an allowed "ls" does not
+		// permit an arbitrary "./ls" from the working directory
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// argWithin reports whether an argument of a command running in dir stays
+// inside root. Besides paths, the values of flags and assignments, as in
+// --out=path, -opath and name=path, must be inside it. Where a value cannot
+// be told apart from the flag's name it is refused: long flags looking like
+// a path without an =, and short flags unless their value stays inside root
+// wherever it starts.
+func argWithin(root, dir, arg string) bool {
+	name, value, assigned := strings.Cut(arg, "=")
+	if assigned && !pathWithin(root, dir, value) {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(name, "--"):
+		return !strings.ContainsRune(name, filepath.Separator) && !strings.Contains(name, "..")
+	case strings.HasPrefix(name, "-"):
+		// The value of a short flag follows its letter, which may come
+		// after others as in -xvf../archive, so it may start after any of
+		// the leading letters
+		for i := 2; i <= len(name) && isFlagLetter(name[i-1]); i++ {
+			if !pathWithin(root, dir, name[i:]) {
+				return false
+			}
+		}
+		return true
+	}
+	return pathWithin(root, dir, arg)
+}
+
+func isFlagLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// pathWithin reports whether an argument, if it is a path, stays inside
+// root when resolved against dir. Arguments that are not paths are always
+// allowed.
+func pathWithin(root, dir, arg string) bool {
+	if !strings.ContainsRune(arg, filepath.Separator) && arg != ".." {
+		return true
+	}
+	path := arg
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func scrubEnv(environ []string, allowed []string) []string {
+	env := []string{}
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		for _, allowedName := range allowed {
+			if name == allowedName {
+				env = append(env, entry)
+				break
+			}
+		}
+	}
+	return env
+}
@@ -0,0 +1,194 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"sort"
+	"time"
+)
+
+// mainFunctionName is used for code that runs outside of any function
+const mainFunctionName = "<main>"
+
+// Profile holds the execution statistics collected by a VM created with
+// WithProfiling
+type Profile struct {
+	// OpcodeCounts is the number of times each opcode was executed
+	OpcodeCounts map[Opcode]int
+	// OpcodePairs counts how often each opcode ran directly after another,
+	// the most frequent pairs are candidates for superinstructions
+	OpcodePairs map[[2]Opcode]int
+	// Functions holds per function statistics keyed by function name, code
+	// outside of functions is reported as "<main>"
+	Functions map[string]*FunctionProfile
+	// Instructions is the total number of instructions executed
+	Instructions int
+	// Duration is the wall time spent executing instructions
+	Duration time.Duration
+}
+
+// FunctionProfile holds the statistics of a single function
+type FunctionProfile struct {
+	Name  string
+	Calls int
+	// Instructions counts the instructions executed in the function itself,
+	// excluding the functions it calls
+	Instructions int
+	// Flat is the time spent in the function itself and Cumulative includes
+	// the time spent in the functions it calls
+	Flat       time.Duration
+	Cumulative time.Duration
+}
+
+// profiler collects a Profile while the VM runs
+type profiler struct {
+	profile Profile
+	// callStarts holds the start time of every active call, in step with
+	// the VM call stack
+	callStarts []time.Time
+	previous   Opcode
+}
+
+// WithProfiling enables collection of execution statistics, which can be
+// read with Profile. It reads the clock on every instruction, so it slows
+// execution down noticeably.
+func WithProfiling() Option {
+	return func(vm *VM) {
+		vm.profiler = &profiler{
+			profile: Profile{
+				OpcodeCounts: make(map[Opcode]int),
+				OpcodePairs:  make(map[[2]Opcode]int),
+				Functions:    make(map[string]*FunctionProfile),
+			},
+		}
+	}
+}
+
+// Profile returns a snapshot of the statistics collected so far, or nil if
+// profiling is not enabled
+func (vm *VM) Profile() *Profile {
+	if vm.profiler == nil {
+		return nil
+	}
+	snapshot := vm.profiler.profile
+	snapshot.OpcodeCounts = make(map[Opcode]int, len(vm.profiler.profile.OpcodeCounts))
+	for opcode, count := range vm.profiler.profile.OpcodeCounts {
+		snapshot.OpcodeCounts[opcode] = count
+	}
+	snapshot.OpcodePairs = make(map[[2]Opcode]int, len(vm.profiler.profile.OpcodePairs))
+	for pair, count := range vm.profiler.profile.OpcodePairs {
+		snapshot.OpcodePairs[pair] = count
+	}
+	snapshot.Functions = make(map[string]*FunctionProfile, len(vm.profiler.profile.Functions))
+	for name, function := range vm.profiler.profile.Functions {
+		copied := *function
+		snapshot.Functions[name] = &copied
+	}
+	return &snapshot
+}
+
+// TopFunctions returns the function profiles sorted by flat time, hottest
+// first
+func (p *Profile) TopFunctions() []*FunctionProfile {
+	functions := make([]*FunctionProfile, 0, len(p.Functions))
+	for _, function := range p.Functions {
+		functions = append(functions, function)
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		if functions[i].Flat != functions[j].Flat {
+			return functions[i].Flat > functions[j].Flat
+		}
+		return functions[i].Name < functions[j].Name
+	})
+	return functions
+}
+
+// currentFunctionName returns the name of the function that is executing
+func (vm *VM) currentFunctionName() string {
+	if len(vm.callStack) == 0 {
+		return mainFunctionName
+	}
+	return vm.FunctionName(vm.callStack[len(vm.callStack)-1].Function)
+}
+
+// function returns the profile for name, creating it on first use
+func (p *profiler) function(name string) *FunctionProfile {
+	function, ok := p.profile.Functions[name]
+	if !ok {
+		function = &FunctionProfile{Name: name}
+		p.profile.Functions[name] = function
+	}
+	return function
+}
+
+// profileSample is the state captured before an instruction runs
+type profileSample struct {
+	opcode   Opcode
+	function string
+	depth    int
+	start    time.Time
+}
+
+// beginProfile captures the state needed to attribute the next instruction,
+// it reports false when profiling is disabled or there is nothing to run
+func (vm *VM) beginProfile() (profileSample, bool) {
+	if vm.profiler == nil || vm.pc < 0 || vm.pc >= len(vm.instructions) {
+		return profileSample{}, false
+	}
+	return profileSample{
+		opcode:   vm.instructions[vm.pc].Opcode,
+		function: vm.currentFunctionName(),
+		depth:    len(vm.callStack),
+		start:    time.Now(),
+	}, true
+}
+
+// recordProfile attributes an executed instruction to its function. Calls
+// and returns are detected from the change in call depth.
+func (vm *VM) recordProfile(sample profileSample) {
+	p := vm.profiler
+	now := time.Now()
+	elapsed := now.Sub(sample.start)
+
+	p.profile.OpcodeCounts[sample.opcode]++
+	if p.profile.Instructions > 0 {
+		p.profile.OpcodePairs[[2]Opcode{p.previous, sample.opcode}]++
+	}
+	p.previous = sample.opcode
+	p.profile.Instructions++
+	p.profile.Duration += elapsed
+
+	current := p.function(sample.function)
+	current.Instructions++
+	current.Flat += elapsed
+
+	switch {
+	case len(vm.callStack) > sample.depth:
+		p.function(vm.currentFunctionName()).Calls++
+		p.callStarts = append(p.callStarts, now)
+	case len(vm.callStack) < sample.depth && len(p.callStarts) > 0:
+		callStart := p.callStarts[len(p.callStarts)-1]
+		p.callStarts = p.callStarts[:len(p.callStarts)-1]
+		current.Cumulative += now.Sub(callStart)
+	}
+
+	// Everything runs beneath the top level, so its cumulative time is the
+	// total time
+	main := p.function(mainFunctionName)
+	main.Calls = 1
+	main.Cumulative = p.profile.Duration
+}
@@ -0,0 +1,359 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Program is a compiled MindScript program: the bytecode together with the
+// constant pool its OpConstant instructions refer to
+type Program struct {
+	Instructions []Instruction
+	// Constants holds the int, float64 and string literals of the program
+	Constants []Value
+	// Functions is the function table OpCall operands index into
+	Functions []Function
+}
+
+// Function describes a compiled function
+type Function struct {
+	Name    string
+	Address int
+	Arity   int
+	// Locals is the number of local variable slots the function needs,
+	// including its arguments
+	Locals int
+	// Arguments holds the declared names and types of the arguments, it is
+	// empty for functions built without them
+	Arguments []Argument
+}
+
+// Argument is a declared argument of a function
+type Argument struct {
+	Name string
+	// Type is the declared type, such as int or map
+	Type string
+}
+
+// The serialised .mindc format is, in little endian order:
+//
+//	magic      [4]byte "MNDC"
+//	version    uint16
+//	constants  uint32 count, then per constant a tag byte and its payload
+//	           (int64 for ints, IEEE 754 bits for floats, uint32 length
+//	           followed by the bytes for strings)
+//	functions  uint32 count, then per function a uint32 length and the
+//	           bytes of its name, an int64 address, a uint32 arity, a
+//	           uint32 local count and a uint32 argument count followed by
+//	           the length and bytes of each argument's name and type
+//	code       uint32 count, then per instruction a uint16 opcode and an
+//	           int64 operand
+const (
+	bytecodeVersion uint16 = 31
+
+	constantInt    byte = 1
+	constantFloat  byte = 2
+	constantString byte = 3
+
+	// maxSectionLength bounds counts and string lengths read from a file so
+	// a corrupt header cannot trigger a huge allocation
+	maxSectionLength = 1 << 24
+
+	// maxGlobals bounds the index of globals, whose table grows to hold
+	// the highest one set
+	maxGlobals = 1 << 20
+)
+
+// BytecodeVersion is the version of the .mindc format WriteTo writes,
+// ReadProgram rejects programs of other versions
+const BytecodeVersion = bytecodeVersion
+
+var bytecodeMagic = [4]byte{'M', 'N', 'D', 'C'}
+
+// ErrInvalidBytecode is returned when a serialised program cannot be loaded
+var ErrInvalidBytecode = errors.New("invalid bytecode")
+
+// WriteTo serialises the program in the .mindc format
+func (p *Program) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	write := func(data interface{}) {
+		if cw.err == nil {
+			cw.err = binary.Write(cw, binary.LittleEndian, data)
+		}
+	}
+
+	write(bytecodeMagic)
+	write(bytecodeVersion)
+
+	write(uint32(len(p.Constants)))
+	for i, constant := range p.Constants {
+		switch c := constant.(type) {
+		case int:
+			write(constantInt)
+			write(int64(c))
+		case float64:
+			write(constantFloat)
+			write(math.Float64bits(c))
+		case string:
+			write(constantString)
+			write(uint32(len(c)))
+			write([]byte(c))
+		default:
+			return cw.n, fmt.Errorf("constant %d has unsupported type %T", i, constant)
+		}
+	}
+
+	write(uint32(len(p.Functions)))
+	for _, function := range p.Functions {
+		write(uint32(len(function.Name)))
+		write([]byte(function.Name))
+		write(int64(function.Address))
+		write(uint32(function.Arity))
+		write(uint32(function.Locals))
+		write(uint32(len(function.Arguments)))
+		for _, argument := range function.Arguments {
+			write(uint32(len(argument.Name)))
+			write([]byte(argument.Name))
+			write(uint32(len(argument.Type)))
+			write([]byte(argument.Type))
+		}
+	}
+
+	write(uint32(len(p.Instructions)))
+	for _, instr := range p.Instructions {
+		write(uint16(instr.Opcode))
+		write(int64(instr.Operand))
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// ReadProgram reads a program in the .mindc format and validates it
+func ReadProgram(r io.Reader) (*Program, error) {
+	br := bufio.NewReader(r)
+	var err error
+
+	read := func(data interface{}) {
+		if err == nil {
+			err = binary.Read(br, binary.LittleEndian, data)
+		}
+	}
+	readString := func() string {
+		var length uint32
+		read(&length)
+		if err != nil {
+			return ""
+		}
+		if length > maxSectionLength {
+			err = fmt.Errorf("string is too long (%d bytes)", length)
+			return ""
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(br, data)
+		return string(data)
+	}
+
+	var magic [4]byte
+	var version uint16
+	read(&magic)
+	read(&version)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading header: %s", ErrInvalidBytecode, err)
+	}
+	if magic != bytecodeMagic {
+		return nil, fmt.Errorf("%w: not a MindScript program", ErrInvalidBytecode)
+	}
+	if version != bytecodeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d, expected %d", ErrInvalidBytecode, version, bytecodeVersion)
+	}
+
+	var constantCount uint32
+	read(&constantCount)
+	if err == nil && constantCount > maxSectionLength {
+		return nil, fmt.Errorf("%w: too many constants (%d)", ErrInvalidBytecode, constantCount)
+	}
+
+	program := &Program{Constants: make([]Value, 0, constantCount)}
+	for i := 0; err == nil && i < int(constantCount); i++ {
+		var tag byte
+		read(&tag)
+		switch tag {
+		case constantInt:
+			var value int64
+			read(&value)
+			program.Constants = append(program.Constants, int(value))
+		case constantFloat:
+			var bits uint64
+			read(&bits)
+			program.Constants = append(program.Constants, math.Float64frombits(bits))
+		case constantString:
+			var length uint32
+			read(&length)
+			if err == nil && length > maxSectionLength {
+				return nil, fmt.Errorf("%w: constant %d is too long (%d bytes)", ErrInvalidBytecode, i, length)
+			}
+			data := make([]byte, length)
+			if err == nil {
+				_, err = io.ReadFull(br, data)
+			}
+			program.Constants = append(program.Constants, string(data))
+		default:
+			if err == nil {
+				return nil, fmt.Errorf("%w: constant %d has unknown tag %d", ErrInvalidBytecode, i, tag)
+			}
+		}
+	}
+
+	var functionCount uint32
+	read(&functionCount)
+	if err == nil && functionCount > maxSectionLength {
+		return nil, fmt.Errorf("%w: too many functions (%d)", ErrInvalidBytecode, functionCount)
+	}
+
+	program.Functions = make([]Function, 0, functionCount)
+	for i := 0; err == nil && i < int(functionCount); i++ {
+		var nameLength uint32
+		var address int64
+		var arity, locals uint32
+		read(&nameLength)
+		if err == nil && nameLength > maxSectionLength {
+			return nil, fmt.Errorf("%w: function %d name is too long (%d bytes)", ErrInvalidBytecode, i, nameLength)
+		}
+		name := make([]byte, nameLength)
+		if err == nil {
+			_, err = io.ReadFull(br, name)
+		}
+		read(&address)
+		read(&arity)
+		read(&locals)
+		function := Function{Name: string(name), Address: int(address), Arity: int(arity), Locals: int(locals)}
+		var argumentCount uint32
+		read(&argumentCount)
+		if err == nil && argumentCount > arity {
+			return nil, fmt.Errorf("%w: function %d declares %d arguments for an arity of %d", ErrInvalidBytecode, i, argumentCount, arity)
+		}
+		for j := 0; err == nil && j < int(argumentCount); j++ {
+			function.Arguments = append(function.Arguments, Argument{Name: readString(), Type: readString()})
+		}
+		program.Functions = append(program.Functions, function)
+	}
+
+	var instructionCount uint32
+	read(&instructionCount)
+	if err == nil && instructionCount > maxSectionLength {
+		return nil, fmt.Errorf("%w: too many instructions (%d)", ErrInvalidBytecode, instructionCount)
+	}
+
+	program.Instructions = make([]Instruction, 0, instructionCount)
+	for i := 0; err == nil && i < int(instructionCount); i++ {
+		var opcode uint16
+		var operand int64
+		read(&opcode)
+		read(&operand)
+		program.Instructions = append(program.Instructions, Instruction{Opcode: Opcode(opcode), Operand: int(operand)})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBytecode, err)
+	}
+
+	if err := program.Validate(); err != nil {
+		return nil, err
+	}
+	return program, nil
+}
+
+// LoadProgram reads a serialised program and returns a VM ready to run it
+func LoadProgram(r io.Reader, opts ...Option) (*VM, error) {
+	program, err := ReadProgram(r)
+	if err != nil {
+		return nil, err
+	}
+	return New(program, opts...), nil
+}
+
+// Validate checks that every instruction is well formed: opcodes must be
+// known, constant and function indices must be inside their tables, global
+// indices below maxGlobals, counts of values not negative, and jumps and
+// function addresses must land inside the program
+func (p *Program) Validate() error {
+	for i, function := range p.Functions {
+		if function.Address < 0 || function.Address >= len(p.Instructions) {
+			return fmt.Errorf("%w: function %d (%s) has address %d out of range", ErrInvalidBytecode, i, function.Name, function.Address)
+		}
+		if function.Locals < function.Arity {
+			return fmt.Errorf("%w: function %d (%s) has %d locals for %d arguments", ErrInvalidBytecode, i, function.Name, function.Locals, function.Arity)
+		}
+		if len(function.Arguments) > 0 && len(function.Arguments) != function.Arity {
+			return fmt.Errorf("%w: function %d (%s) declares %d arguments for an arity of %d", ErrInvalidBytecode, i, function.Name, len(function.Arguments), function.Arity)
+		}
+	}
+	for pc, instr := range p.Instructions {
+		if instr.Opcode < 0 || instr.Opcode >= opcodeCount {
+			return fmt.Errorf("%w: unknown opcode %v at %d", ErrInvalidBytecode, instr.Opcode, pc)
+		}
+		switch instr.Opcode {
+		case OpConstant:
+			if instr.Operand < 0 || instr.Operand >= len(p.Constants) {
+				return fmt.Errorf("%w: constant index %d out of range at %d", ErrInvalidBytecode, instr.Operand, pc)
+			}
+		case OpGetLocal, OpSetLocal, OpGetGlobal, OpSetGlobal, OpGetLocalAdd, OpSetLocalGetLocal:
+			if instr.Operand < 0 {
+				return fmt.Errorf("%w: negative variable index %d at %d", ErrInvalidBytecode, instr.Operand, pc)
+			}
+			if (instr.Opcode == OpGetGlobal || instr.Opcode == OpSetGlobal) && instr.Operand >= maxGlobals {
+				return fmt.Errorf("%w: global index %d out of range at %d", ErrInvalidBytecode, instr.Operand, pc)
+			}
+		case OpCreateList, OpCreateMap, OpPrint, OpLog, OpExec, OpSQLQuery, OpEmit, OpAsk, OpReceive, OpCallBuiltin:
+			if instr.Operand < 0 {
+				return fmt.Errorf("%w: negative count %d at %d", ErrInvalidBytecode, instr.Operand, pc)
+			}
+		case OpCall, OpCreateEventHandler:
+			if instr.Operand < 0 || instr.Operand >= len(p.Functions) {
+				return fmt.Errorf("%w: function index %d out of range at %d", ErrInvalidBytecode, instr.Operand, pc)
+			}
+		}
+		if isJump(instr.Opcode) && (instr.Operand < 0 || instr.Operand > len(p.Instructions)) {
+			return fmt.Errorf("%w: jump target %d out of range at %d", ErrInvalidBytecode, instr.Operand, pc)
+		}
+	}
+	return nil
+}
+
+// countingWriter tracks how many bytes have been written for WriteTo
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// maxCachedTemplates bounds the parsed templates a VM keeps, programs
+// normally render a handful of constant templates
+const maxCachedTemplates = 256
+
+// templateFuncs are available to prompt templates in addition to Go's
+// template builtins
+var templateFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// renderPrompt runs OpPrompt: the template on the stack is replaced by its
+// rendering. Templates use Go's text/template syntax and see the running
+// agent as .agent, .goal, .capabilities and .state, its long-term memory
+// as .memory and conversation buffer as .recent, and the event being
+// handled as .event and .payload, such as
+//
+//	"You are {{.agent}}, your goal is {{.goal}}. Summarise {{.payload.text}}"
+//
+// Maps and lists can be walked with range and printed with json.
+// Referring to a missing field fails the handler.
+func (vm *VM) renderPrompt() {
+	value := vm.popStack()
+	text, ok := value.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("prompt template must be a string, got %T", value))
+		return
+	}
+	if vm.self == nil {
+		vm.fail(errors.New("prompt used outside of an agent's event handler"))
+		return
+	}
+	tmpl, err := vm.parseTemplate(text)
+	if err != nil {
+		vm.fail(fmt.Errorf("prompt template: %w", err))
+		return
+	}
+
+	state := make(map[string]any, len(vm.self.state))
+	for name, value := range vm.self.state {
+		state[name] = templateValue(value)
+	}
+	memory := make(map[string]any, len(vm.self.memory))
+	for key, value := range vm.self.memory {
+		memory[key] = templateValue(value)
+	}
+	recent := make([]any, len(vm.self.recent))
+	for i, value := range vm.self.recent {
+		recent[i] = templateValue(value)
+	}
+	capabilities := make([]any, len(vm.self.Capabilities))
+	for i, capability := range vm.self.Capabilities {
+		capabilities[i] = capability
+	}
+	data := map[string]any{
+		"agent":        vm.self.Name,
+		"goal":         vm.self.Goal,
+		"capabilities": capabilities,
+		"state":        state,
+		"event":        vm.event.Name,
+		"payload":      templateValue(vm.event.Payload),
+		"memory":       memory,
+		"recent":       recent,
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		vm.fail(fmt.Errorf("prompt template: %w", err))
+		return
+	}
+	vm.stack = append(vm.stack, sb.String())
+}
+
+// parseTemplate returns the parsed template, parsing each distinct template
+// once
+func (vm *VM) parseTemplate(text string) (*template.Template, error) {
+	if tmpl, ok := vm.templates[text]; ok {
+		return tmpl, nil
+	}
+	tmpl, err := template.New("prompt").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if vm.templates == nil || len(vm.templates) >= maxCachedTemplates {
+		vm.templates = make(map[string]*template.Template)
+	}
+	vm.templates[text] = tmpl
+	return tmpl, nil
+}
+
+// templateValue converts maps and lists to Go maps and slices, which
+// templates can index and range over
+func templateValue(value Value) any {
+	switch v := value.(type) {
+	case *Map:
+		m := make(map[string]any, v.Len())
+		for _, key := range v.Keys() {
+			item, _ := v.Get(key)
+			m[fmt.Sprint(key)] = templateValue(item)
+		}
+		return m
+	case *List:
+		items := make([]any, v.Len())
+		for i, item := range v.Items() {
+			items[i] = templateValue(item)
+		}
+		return items
+	case *Agent:
+		return v.Name
+	}
+	return value
+}
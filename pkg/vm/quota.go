@@ -0,0 +1,250 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Quota limits the resources each agent may use so that one misbehaving
+// agent cannot starve the others. A handler exceeding a quota is stopped
+// and the agent receives a ThrottleEvent instead of an error event, the VM
+// goes on dispatching. Zero fields are unlimited.
+type Quota struct {
+	// InstructionsPerEvent limits the instructions a single handler runs
+	InstructionsPerEvent int
+	// Memory limits the estimated bytes held by the agent's state, memory
+	// and mailbox. It is checked periodically and when a handler finishes.
+	Memory int
+	// ExecsPerMinute limits the external commands the agent starts with
+	// exec and syscall in any minute
+	ExecsPerMinute int
+	// TokensPerMinute limits the language model tokens the agent's llm and
+	// embedding calls use in any minute. Usage is only known once a call
+	// returns, so calls are refused once the limit has been reached.
+	TokensPerMinute int
+}
+
+// quotaWindow is the window of the per-minute quotas
+const quotaWindow = time.Minute
+
+// ParseQuota parses a quota such as "instructions=10000 memory=65536
+// execs=5 tokens=2000". The settings are instructions per event, memory in
+// bytes and execs and tokens per minute.
+func ParseQuota(spec string) (Quota, error) {
+	var q Quota
+	for _, field := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return q, fmt.Errorf("quota %q: setting %q is not key=value", spec, field)
+		}
+		n, err := strconv.Atoi(value)
+		if err == nil && n < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		if err != nil {
+			return q, fmt.Errorf("quota %q: %s: %w", spec, key, err)
+		}
+		switch key {
+		case "instructions":
+			q.InstructionsPerEvent = n
+		case "memory":
+			q.Memory = n
+		case "execs":
+			q.ExecsPerMinute = n
+		case "tokens":
+			q.TokensPerMinute = n
+		default:
+			return q, fmt.Errorf("quota %q: unknown setting %q", spec, key)
+		}
+	}
+	return q, nil
+}
+
+// WithQuota sets the quota of every agent that has none of its own
+func WithQuota(q Quota) Option {
+	return func(vm *VM) {
+		vm.quota = q
+	}
+}
+
+// WithAgentQuota sets the quota of the agents created from a declaration,
+// instead of the one set with WithQuota
+func WithAgentQuota(declaration string, q Quota) Option {
+	return func(vm *VM) {
+		if vm.agentQuotas == nil {
+			vm.agentQuotas = make(map[string]Quota)
+		}
+		vm.agentQuotas[declaration] = q
+	}
+}
+
+// quotaFor returns the quota of the agents of a declaration
+func (vm *VM) quotaFor(declaration string) Quota {
+	if q, ok := vm.agentQuotas[declaration]; ok {
+		return q
+	}
+	return vm.quota
+}
+
+// QuotaError is the failure of a handler that exceeded a quota
+type QuotaError struct {
+	// Quota is the exceeded quota: instructions, memory, execs or tokens
+	Quota string
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Quota {
+	case "instructions":
+		return fmt.Sprintf("%s: more than %d instructions for an event", ErrQuotaExceeded, e.Limit)
+	case "memory":
+		return fmt.Sprintf("%s: holding more than %d bytes", ErrQuotaExceeded, e.Limit)
+	}
+	return fmt.Sprintf("%s: more than %d %s per minute", ErrQuotaExceeded, e.Limit, e.Quota)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// tokenUse records the tokens used by a call to the model
+type tokenUse struct {
+	at     time.Time
+	tokens int
+}
+
+// chargeExec counts an external command started by the running agent. It
+// fails and reports false when the agent's exec quota is used up.
+func (vm *VM) chargeExec() bool {
+	agent := vm.self
+	if agent == nil || agent.quota.ExecsPerMinute == 0 {
+		return true
+	}
+	now := time.Now()
+	recent := agent.execs[:0]
+	for _, at := range agent.execs {
+		if now.Sub(at) < quotaWindow {
+			recent = append(recent, at)
+		}
+	}
+	agent.execs = recent
+	if len(agent.execs) >= agent.quota.ExecsPerMinute {
+		vm.fail(&QuotaError{Quota: "execs", Limit: agent.quota.ExecsPerMinute})
+		return false
+	}
+	agent.execs = append(agent.execs, now)
+	return true
+}
+
+// checkTokens fails and reports false when the running agent has used up
+// its token quota
+func (vm *VM) checkTokens() bool {
+	agent := vm.self
+	if agent == nil || agent.quota.TokensPerMinute == 0 {
+		return true
+	}
+	now := time.Now()
+	used := 0
+	recent := agent.tokens[:0]
+	for _, use := range agent.tokens {
+		if now.Sub(use.at) < quotaWindow {
+			recent = append(recent, use)
+			used += use.tokens
+		}
+	}
+	agent.tokens = recent
+	if used >= agent.quota.TokensPerMinute {
+		vm.fail(&QuotaError{Quota: "tokens", Limit: agent.quota.TokensPerMinute})
+		return false
+	}
+	return true
+}
+
+// chargeTokens records the tokens used by a call the running agent made
+func (vm *VM) chargeTokens(tokens int) {
+	if agent := vm.self; agent != nil && agent.quota.TokensPerMinute > 0 && tokens > 0 {
+		agent.tokens = append(agent.tokens, tokenUse{at: time.Now(), tokens: tokens})
+	}
+}
+
+// checkAgentMemory returns a QuotaError when an agent holds more memory than
+// its quota allows
+func (vm *VM) checkAgentMemory(agent *Agent) error {
+	if agent.quota.Memory == 0 || agentMemory(agent) <= agent.quota.Memory {
+		return nil
+	}
+	return &QuotaError{Quota: "memory", Limit: agent.quota.Memory}
+}
+
+// agentMemory estimates the memory held by an agent's state, memory and
+// mailbox, including the objects they refer to. Other agents are only
+// counted as references.
+func agentMemory(agent *Agent) int {
+	size := 0
+	seen := make(map[Object]bool)
+	var add func(value Value)
+	add = func(value Value) {
+		size += sizeOfValue(value)
+		obj, ok := value.(Object)
+		if !ok || seen[obj] {
+			return
+		}
+		if _, isAgent := obj.(*Agent); isAgent {
+			return
+		}
+		seen[obj] = true
+		size += sizeOfObject(obj)
+		for _, ref := range obj.References() {
+			if _, isObject := ref.(Object); isObject {
+				add(ref)
+			}
+		}
+	}
+	for _, value := range agent.References() {
+		add(value)
+	}
+	return size
+}
+
+// throttle stops an agent's handler that exceeded a quota and tells the
+// agent with a ThrottleEvent, whose payload holds the "quota", its "limit",
+// the "event" that was being handled and the error "message"
+func (vm *VM) throttle(agent *Agent, event Event, err error) {
+	err = unwrapRuntimeError(err)
+	vm.err = nil
+	vm.metrics.Throttles++
+	logger.Log.Warnw("Agent throttled", zap.String("agent", agent.Name), zap.String("event", event.Name), zap.Error(err))
+	if event.Name == ThrottleEvent || !agent.handles(ThrottleEvent) {
+		return
+	}
+	payload := NewMap()
+	if quotaErr, ok := err.(*QuotaError); ok {
+		payload.Set("quota", quotaErr.Quota)
+		payload.Set("limit", quotaErr.Limit)
+	}
+	payload.Set("event", event.Name)
+	payload.Set("message", err.Error())
+	vm.alloc(payload)
+	vm.postEvent(Event{Agent: agent.Name, Name: ThrottleEvent, Payload: payload})
+}
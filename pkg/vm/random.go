@@ -0,0 +1,98 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+)
+
+// WithSeed seeds the source of random, randomInt, choice and uuid, so that
+// runs of a program make the same choices and generate the same IDs. Without it the source is seeded
+// randomly. Reset reseeds a seeded source.
+func WithSeed(seed uint64) Option {
+	return func(vm *VM) {
+		vm.seed, vm.seeded = seed, true
+	}
+}
+
+// seedRandom creates the VM's source of random numbers
+func (vm *VM) seedRandom() {
+	seed := vm.seed
+	if !vm.seeded {
+		seed = rand.Uint64()
+	}
+	vm.rand = rand.New(rand.NewPCG(seed, seed))
+}
+
+// random runs OpRandom, pushing a float in [0, 1)
+func (vm *VM) random() {
+	vm.stack = append(vm.stack, vm.rand.Float64())
+}
+
+// randomInt runs OpRandomInt: the bounds on the stack are replaced by an
+// int between them, both included
+func (vm *VM) randomInt() {
+	maxValue, minValue := vm.popStack(), vm.popStack()
+	low, ok := minValue.(int)
+	high, ok2 := maxValue.(int)
+	if !ok || !ok2 {
+		vm.fail(fmt.Errorf("randomInt expects int bounds, got %T and %T", minValue, maxValue))
+		return
+	}
+	if high < low {
+		vm.fail(fmt.Errorf("randomInt: max %d is less than min %d", high, low))
+		return
+	}
+	// The width of the range overflows an int64 only for the widest ranges,
+	// which the unsigned arithmetic handles
+	n := uint64(high) - uint64(low) + 1
+	if n == 0 {
+		vm.stack = append(vm.stack, int(vm.rand.Uint64()))
+		return
+	}
+	vm.stack = append(vm.stack, low+int(vm.rand.Uint64N(n)))
+}
+
+// choice runs OpChoice: the list on the stack is replaced by one of its
+// items
+func (vm *VM) choice() {
+	value := vm.popStack()
+	list, ok := value.(*List)
+	if !ok {
+		vm.fail(fmt.Errorf("choice expects a list, got %T", value))
+		return
+	}
+	if list.Len() == 0 {
+		vm.fail(fmt.Errorf("choice from an empty list"))
+		return
+	}
+	item, _ := list.Get(vm.rand.IntN(list.Len()))
+	vm.stack = append(vm.stack, item)
+}
+
+// uuid runs OpUUID, pushing a version 4 UUID in its canonical form
+func (vm *VM) uuid() {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], vm.rand.Uint64())
+	binary.BigEndian.PutUint64(b[8:], vm.rand.Uint64())
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+	vm.stack = append(vm.stack, id)
+}
@@ -0,0 +1,833 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// The register backend translates stack bytecode into three address
+// instructions. Every stack slot of a call frame becomes a register, so a
+// value's register is fixed by the stack depth at which it was pushed.
+// Constants, immediates and variables are not copied into registers at all:
+// instructions read them in place, which turns
+//
+//	OpGetLocal 0; OpPush 1; OpAdd; OpSetLocal 0
+//
+// into a single add that reads local 0 and the immediate 1 and writes local
+// 0. Instructions without a register form run through the stack dispatcher
+// with the frame's registers standing in for the value stack.
+
+type operandKind uint8
+
+const (
+	operandTemp operandKind = iota
+	operandLocal
+	operandGlobal
+	operandConstant
+	operandInt
+	operandBool
+)
+
+// operand is a value read or written by a register instruction. For
+// temporaries index is the register relative to the frame base, for
+// immediates it is the value itself.
+type operand struct {
+	kind  operandKind
+	index int
+}
+
+type registerOpcode uint8
+
+const (
+	regMove registerOpcode = iota
+	regAdd
+	regSub
+	regMul
+	regDiv
+	regEqual
+	regNotEqual
+	regAnd
+	regOr
+	regNot
+	regConcatString
+	regJump
+	regJumpIfFalse
+	regCall
+	regReturn
+	// regStack runs the source instruction on the stack dispatcher
+	regStack
+	// regEnd marks the end of the program
+	regEnd
+)
+
+// binaryRegisterOpcodes maps the stack instructions with a register form
+// that take two operands
+var binaryRegisterOpcodes = map[Opcode]registerOpcode{
+	OpAdd:          regAdd,
+	OpSub:          regSub,
+	OpMul:          regMul,
+	OpDiv:          regDiv,
+	OpEqual:        regEqual,
+	OpNotEqual:     regNotEqual,
+	OpAnd:          regAnd,
+	OpOr:           regOr,
+	OpConcatString: regConcatString,
+}
+
+type registerInstruction struct {
+	opcode      registerOpcode
+	dest        operand
+	left, right operand
+	// target is the jump address, the called function or, for regStack, the
+	// number of registers in use after the instruction
+	target int
+	// source is the address of the stack instruction this was translated
+	// from and depth the number of registers in use before it
+	source int
+	depth  int
+}
+
+type registerFunction struct {
+	address   int
+	frameSize int
+}
+
+type registerProgram struct {
+	instructions  []registerInstruction
+	functions     []registerFunction
+	mainFrameSize int
+}
+
+// registerFrame is the register backend's companion to Frame
+type registerFrame struct {
+	returnAddress int
+	base          int
+}
+
+var errUnknownResult = errors.New("function result count is not known yet")
+
+// translator converts stack bytecode into a registerProgram
+type translator struct {
+	source    []Instruction
+	functions []Function
+	constants int
+	// locals is the number of local slots of the code being analysed
+	locals int
+
+	// results holds how many values each function leaves on the stack when
+	// it returns, -1 while unknown
+	results []int
+	// depths holds the stack depth before each instruction, -1 where the
+	// instruction is unreachable
+	depths []int
+	labels []bool
+
+	code       []registerInstruction
+	vstack     []operand
+	blockStart int
+}
+
+// translateRegisters converts the program run by vm into register code. It
+// fails when the stack depth at some instruction cannot be determined
+// statically.
+func translateRegisters(vm *VM) (*registerProgram, error) {
+	t := &translator{
+		source:    vm.instructions,
+		functions: vm.functions,
+		constants: len(vm.constants),
+	}
+
+	if err := t.resolveResults(); err != nil {
+		return nil, err
+	}
+
+	t.depths = newDepths(len(t.source))
+	t.labels = make([]bool, len(t.source)+1)
+	program := &registerProgram{functions: make([]registerFunction, len(t.functions))}
+
+	if len(t.source) > 0 {
+		t.labels[0] = true
+		_, frameSize, err := t.analyse(0, 0, 0, t.depths, false)
+		if err != nil {
+			return nil, err
+		}
+		program.mainFrameSize = frameSize
+	}
+	for i, function := range t.functions {
+		t.labels[function.Address] = true
+		_, frameSize, err := t.analyse(function.Address, function.Arity, function.Locals, t.depths, false)
+		if err != nil {
+			return nil, fmt.Errorf("function %s: %w", function.Name, err)
+		}
+		program.functions[i].frameSize = frameSize
+	}
+
+	addresses := t.emitProgram()
+	for i := range t.code {
+		switch t.code[i].opcode {
+		case regJump, regJumpIfFalse:
+			t.code[i].target = addresses[t.code[i].target]
+		}
+	}
+	for i, function := range t.functions {
+		program.functions[i].address = addresses[function.Address]
+	}
+	program.instructions = t.code
+	return program, nil
+}
+
+func newDepths(n int) []int {
+	depths := make([]int, n+1)
+	for i := range depths {
+		depths[i] = -1
+	}
+	return depths
+}
+
+// resolveResults works out how many values every function returns. A call
+// to a function whose result is still unknown ends the path being analysed,
+// so recursive functions resolve through their non recursive returns on a
+// later pass.
+func (t *translator) resolveResults() error {
+	t.results = make([]int, len(t.functions))
+	for i := range t.results {
+		t.results[i] = -1
+	}
+	for _, function := range t.functions {
+		if function.Address < 0 || function.Address >= len(t.source) {
+			return fmt.Errorf("function %s has address %d out of range", function.Name, function.Address)
+		}
+		if function.Arity < 0 {
+			return fmt.Errorf("function %s has negative arity", function.Name)
+		}
+	}
+
+	for progress := true; progress; {
+		progress = false
+		for i, function := range t.functions {
+			if t.results[i] >= 0 {
+				continue
+			}
+			result, _, err := t.analyse(function.Address, function.Arity, function.Locals, newDepths(len(t.source)), true)
+			if err != nil {
+				return fmt.Errorf("function %s: %w", function.Name, err)
+			}
+			if result >= 0 {
+				t.results[i] = result
+				progress = true
+			}
+		}
+	}
+
+	// Whatever is left never returns, so the code after its calls is dead
+	for i := range t.results {
+		if t.results[i] < 0 {
+			t.results[i] = 0
+		}
+	}
+	return nil
+}
+
+// analyse walks the code reachable from entry, recording the stack depth
+// before each instruction in depths and checking local variables against the
+// number of locals of the code. It returns the depth at the function's
+// returns and the largest depth reached.
+func (t *translator) analyse(entry, depth, locals int, depths []int, optimistic bool) (int, int, error) {
+	t.locals = locals
+	result, maxDepth := -1, depth
+	if depths[entry] >= 0 && depths[entry] != depth {
+		return 0, 0, fmt.Errorf("inconsistent stack depth at %d", entry)
+	}
+	depths[entry] = depth
+
+	pending := []int{entry}
+	for len(pending) > 0 {
+		pc := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if pc == len(t.source) {
+			continue
+		}
+
+		instr := t.source[pc]
+		pops, pushes, err := t.stackEffect(instr)
+		if errors.Is(err, errUnknownResult) && optimistic {
+			continue
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("at %d: %w", pc, err)
+		}
+		before := depths[pc]
+		if before < pops {
+			return 0, 0, fmt.Errorf("stack underflow at %d", pc)
+		}
+		after := before - pops + pushes
+		maxDepth = max(maxDepth, after)
+
+		// A superinstruction's control flow is that of its second half
+		control := instr
+		if pair, ok := unfuse(instr); ok {
+			control = pair[1]
+		}
+
+		var successors []int
+		switch control.Opcode {
+		case OpReturn:
+			if result >= 0 && result != before {
+				return 0, 0, fmt.Errorf("returns leave %d and %d values", result, before)
+			}
+			result = before
+		case OpHalt:
+		case OpJump:
+			successors = []int{control.Operand}
+		case OpJumpIfFalse:
+			successors = []int{control.Operand, pc + 1}
+		default:
+			successors = []int{pc + 1}
+		}
+
+		for _, next := range successors {
+			if next < 0 || next > len(t.source) {
+				return 0, 0, fmt.Errorf("jump target %d out of range at %d", next, pc)
+			}
+			if next != pc+1 {
+				t.markLabel(next)
+			}
+			switch {
+			case depths[next] < 0:
+				depths[next] = after
+				pending = append(pending, next)
+			case depths[next] != after:
+				return 0, 0, fmt.Errorf("inconsistent stack depth at %d", next)
+			}
+		}
+	}
+	return result, maxDepth, nil
+}
+
+func (t *translator) markLabel(pc int) {
+	if t.labels != nil {
+		t.labels[pc] = true
+	}
+}
+
+// stackEffect returns how many values an instruction pops and pushes
+func (t *translator) stackEffect(instr Instruction) (int, int, error) {
+	if pair, ok := unfuse(instr); ok {
+		firstPops, firstPushes, err := t.stackEffect(pair[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		secondPops, secondPushes, err := t.stackEffect(pair[1])
+		if err != nil {
+			return 0, 0, err
+		}
+		return firstPops + max(secondPops-firstPushes, 0), secondPushes + max(firstPushes-secondPops, 0), nil
+	}
+
+	switch instr.Opcode {
+	case OpPush, OpTrue, OpFalse:
+		return 0, 1, nil
+	case OpConstant:
+		if instr.Operand < 0 || instr.Operand >= t.constants {
+			return 0, 0, fmt.Errorf("constant index %d out of range", instr.Operand)
+		}
+		return 0, 1, nil
+	case OpGetLocal, OpSetLocal:
+		if instr.Operand < 0 || instr.Operand >= t.locals {
+			return 0, 0, fmt.Errorf("local index %d out of range", instr.Operand)
+		}
+		if instr.Opcode == OpGetLocal {
+			return 0, 1, nil
+		}
+		return 1, 0, nil
+	case OpGetGlobal, OpSetGlobal:
+		if instr.Operand < 0 {
+			return 0, 0, fmt.Errorf("global index %d out of range", instr.Operand)
+		}
+		if instr.Opcode == OpGetGlobal {
+			return 0, 1, nil
+		}
+		return 1, 0, nil
+	case OpAdd, OpSub, OpMul, OpDiv, OpEqual, OpNotEqual, OpGreaterThan, OpLessThan,
+		OpGreaterThanOrEqual, OpLessThanOrEqual, OpAnd, OpOr, OpConcatString,
+		OpGetStringItem, OpGetMapItem, OpGetListItem, OpGetItem, OpSyscall, OpSend, OpSearch:
+		return 2, 1, nil
+	case OpNot, OpStringLength, OpSpawn, OpLLM, OpPrompt, OpRecall, OpSessionRecall, OpEmbed, OpReply:
+		return 1, 1, nil
+	case OpMCP:
+		return 3, 1, nil
+	case OpRemember, OpSessionRemember, OpIndex:
+		return 2, 0, nil
+	case OpForget, OpObserve:
+		return 1, 0, nil
+	case OpRecent, OpSession, OpSessionHistory:
+		return 0, 1, nil
+	case OpEnv:
+		return 1, 1, nil
+	case OpArgs:
+		return 0, 1, nil
+	case OpRandom:
+		return 0, 1, nil
+	case OpRandomInt:
+		return 2, 1, nil
+	case OpChoice:
+		return 1, 1, nil
+	case OpToInt:
+		return 1, 1, nil
+	case OpToFloat:
+		return 1, 1, nil
+	case OpToString:
+		return 1, 1, nil
+	case OpToBool:
+		return 1, 1, nil
+	case OpTypeOf:
+		return 1, 1, nil
+	case OpAssert:
+		return 2, 0, nil
+	case OpUUID:
+		return 0, 1, nil
+	case OpSQLQuery:
+		if instr.Operand < 2 || instr.Operand > 3 {
+			return 0, 0, fmt.Errorf("sqlQuery argument count %d out of range", instr.Operand)
+		}
+		return instr.Operand, 1, nil
+	case OpFormat:
+		return 2, 1, nil
+	case OpURLParse:
+		return 1, 1, nil
+	case OpURLEncode:
+		return 1, 1, nil
+	case OpQueryParam:
+		return 2, 1, nil
+	case OpYAMLParse:
+		return 1, 1, nil
+	case OpTOMLParse:
+		return 1, 1, nil
+	case OpMapList:
+		return 2, 1, nil
+	case OpFilter:
+		return 2, 1, nil
+	case OpReduce:
+		return 3, 1, nil
+	case OpSort:
+		return 1, 1, nil
+	case OpSelf:
+		return 0, 1, nil
+	case OpGetState, OpSetState:
+		if instr.Operand < 0 || instr.Operand >= t.constants {
+			return 0, 0, fmt.Errorf("constant index %d out of range", instr.Operand)
+		}
+		if instr.Opcode == OpGetState {
+			return 0, 1, nil
+		}
+		return 1, 0, nil
+	case OpDefineState:
+		return 2, 0, nil
+	case OpPop, OpJumpIfFalse, OpCreateAgent, OpSetAgentGoal, OpAddAgentCapability,
+		OpSetEventHandlerEvent, OpAddAgentEventHandler, OpAddFunctionArgument, OpAddAgentFunction,
+		OpSetAgentSupervision:
+		return 1, 0, nil
+	case OpHalt, OpJump, OpReturn, OpCreateFunction:
+		return 0, 0, nil
+	case OpCreateEventHandler:
+		return 0, 1, nil
+	case OpReceive:
+		if instr.Operand < 1 || instr.Operand > 2 {
+			return 0, 0, fmt.Errorf("receive argument count %d out of range", instr.Operand)
+		}
+		return instr.Operand, 1, nil
+	case OpPrint:
+		if instr.Operand < 0 {
+			return 0, 0, fmt.Errorf("print argument count %d out of range", instr.Operand)
+		}
+		return instr.Operand, 0, nil
+	case OpExec:
+		if instr.Operand < 1 || instr.Operand > 3 {
+			return 0, 0, fmt.Errorf("exec argument count %d out of range", instr.Operand)
+		}
+		return instr.Operand, 1, nil
+	case OpLog:
+		if instr.Operand < 1 || instr.Operand > 3 {
+			return 0, 0, fmt.Errorf("log argument count %d out of range", instr.Operand)
+		}
+		return instr.Operand, 0, nil
+	case OpEmit:
+		if instr.Operand < 1 || instr.Operand > 3 {
+			return 0, 0, fmt.Errorf("emit argument count %d out of range", instr.Operand)
+		}
+		return instr.Operand, 0, nil
+	case OpAsk:
+		if instr.Operand < 2 || instr.Operand > 3 {
+			return 0, 0, fmt.Errorf("ask argument count %d out of range", instr.Operand)
+		}
+		return instr.Operand, 1, nil
+	case OpCreateMap:
+		if instr.Operand < 0 {
+			return 0, 0, fmt.Errorf("negative map size %d", instr.Operand)
+		}
+		return instr.Operand * 2, 1, nil
+	case OpCreateList:
+		if instr.Operand < 0 {
+			return 0, 0, fmt.Errorf("negative list size %d", instr.Operand)
+		}
+		return instr.Operand, 1, nil
+	case OpAppendList:
+		return 2, 0, nil
+	case OpSetMapItem, OpSetListItem:
+		return 3, 0, nil
+	case OpCallBuiltin:
+		if instr.Operand < 0 {
+			return 0, 0, fmt.Errorf("negative argument count %d", instr.Operand)
+		}
+		return instr.Operand + 1, 1, nil
+	case OpCall:
+		if instr.Operand < 0 || instr.Operand >= len(t.functions) {
+			return 0, 0, fmt.Errorf("function index %d out of range", instr.Operand)
+		}
+		if t.results[instr.Operand] < 0 {
+			return 0, 0, errUnknownResult
+		}
+		return t.functions[instr.Operand].Arity, t.results[instr.Operand], nil
+	}
+	return 0, 0, fmt.Errorf("opcode %v has no register translation", instr.Opcode)
+}
+
+// emitProgram translates every reachable instruction in address order and
+// returns the register address of each stack address
+func (t *translator) emitProgram() []int {
+	addresses := make([]int, len(t.source)+1)
+	fallsThrough := false
+	for pc, instr := range t.source {
+		addresses[pc] = len(t.code)
+		if t.depths[pc] < 0 {
+			fallsThrough = false
+			continue
+		}
+		if t.labels[pc] || !fallsThrough {
+			if fallsThrough {
+				t.flush(pc)
+			}
+			addresses[pc] = len(t.code)
+			t.startBlock(t.depths[pc])
+		}
+		fallsThrough = t.emitInstruction(pc, instr)
+	}
+	if fallsThrough {
+		t.flush(len(t.source))
+	} else {
+		t.startBlock(t.depths[len(t.source)])
+	}
+	addresses[len(t.source)] = len(t.code)
+	t.emit(registerInstruction{opcode: regEnd, source: len(t.source)})
+	return addresses
+}
+
+// startBlock begins a basic block, where every stack slot is held in its
+// register
+func (t *translator) startBlock(depth int) {
+	t.vstack = t.vstack[:0]
+	for i := 0; i < max(depth, 0); i++ {
+		t.vstack = append(t.vstack, operand{kind: operandTemp, index: i})
+	}
+	t.blockStart = len(t.code)
+}
+
+func (t *translator) emit(instr registerInstruction) {
+	instr.depth = len(t.vstack)
+	t.code = append(t.code, instr)
+}
+
+func (t *translator) push(value operand) {
+	t.vstack = append(t.vstack, value)
+}
+
+func (t *translator) pop() operand {
+	value := t.vstack[len(t.vstack)-1]
+	t.vstack = t.vstack[:len(t.vstack)-1]
+	return value
+}
+
+// temp returns the register for the next value pushed
+func (t *translator) temp() operand {
+	return operand{kind: operandTemp, index: len(t.vstack)}
+}
+
+// flush copies every pending value into its register, as required before
+// control flow and instructions that use the registers as a stack
+func (t *translator) flush(pc int) {
+	for i, value := range t.vstack {
+		if value.kind == operandTemp && value.index == i {
+			continue
+		}
+		dest := operand{kind: operandTemp, index: i}
+		t.emit(registerInstruction{opcode: regMove, dest: dest, left: value, source: pc})
+		t.vstack[i] = dest
+	}
+}
+
+// flushVariable copies pending reads of a variable into registers before
+// the variable is overwritten
+func (t *translator) flushVariable(pc int, variable operand) {
+	for i, value := range t.vstack {
+		if value == variable {
+			dest := operand{kind: operandTemp, index: i}
+			t.emit(registerInstruction{opcode: regMove, dest: dest, left: value, source: pc})
+			t.vstack[i] = dest
+		}
+	}
+}
+
+// emitInstruction translates one stack instruction and reports whether
+// execution can fall through to the next one
+func (t *translator) emitInstruction(pc int, instr Instruction) bool {
+	if pair, ok := unfuse(instr); ok {
+		t.emitInstruction(pc, pair[0])
+		return t.emitInstruction(pc, pair[1])
+	}
+	if opcode, ok := binaryRegisterOpcodes[instr.Opcode]; ok {
+		right := t.pop()
+		left := t.pop()
+		dest := t.temp()
+		t.emit(registerInstruction{opcode: opcode, dest: dest, left: left, right: right, source: pc})
+		t.push(dest)
+		return true
+	}
+
+	switch instr.Opcode {
+	case OpPush:
+		t.push(operand{kind: operandInt, index: instr.Operand})
+	case OpTrue:
+		t.push(operand{kind: operandBool, index: 1})
+	case OpFalse:
+		t.push(operand{kind: operandBool, index: 0})
+	case OpConstant:
+		t.push(operand{kind: operandConstant, index: instr.Operand})
+	case OpGetLocal:
+		t.push(operand{kind: operandLocal, index: instr.Operand})
+	case OpGetGlobal:
+		t.push(operand{kind: operandGlobal, index: instr.Operand})
+	case OpPop:
+		t.pop()
+	case OpSetLocal, OpSetGlobal:
+		value := t.pop()
+		dest := operand{kind: operandLocal, index: instr.Operand}
+		if instr.Opcode == OpSetGlobal {
+			dest.kind = operandGlobal
+		}
+		t.flushVariable(pc, dest)
+		// Write the result of the previous instruction straight into the
+		// variable instead of going through its register. Only the value
+		// producing opcodes, which all come before regJump, can be retargeted.
+		if last := len(t.code) - 1; last >= t.blockStart && value == t.temp() && t.code[last].dest == value && t.code[last].opcode < regJump {
+			t.code[last].dest = dest
+		} else {
+			t.emit(registerInstruction{opcode: regMove, dest: dest, left: value, source: pc})
+		}
+	case OpNot:
+		value := t.pop()
+		dest := t.temp()
+		t.emit(registerInstruction{opcode: regNot, dest: dest, left: value, source: pc})
+		t.push(dest)
+	case OpJump:
+		t.flush(pc)
+		t.emit(registerInstruction{opcode: regJump, target: instr.Operand, source: pc})
+		return false
+	case OpJumpIfFalse:
+		condition := t.pop()
+		t.flush(pc)
+		t.emit(registerInstruction{opcode: regJumpIfFalse, left: condition, target: instr.Operand, source: pc})
+	case OpCall:
+		t.flush(pc)
+		arity := t.functions[instr.Operand].Arity
+		t.vstack = t.vstack[:len(t.vstack)-arity]
+		t.emit(registerInstruction{opcode: regCall, left: t.temp(), target: instr.Operand, source: pc})
+		for i := 0; i < t.results[instr.Operand]; i++ {
+			t.push(t.temp())
+		}
+	case OpReturn:
+		t.flush(pc)
+		t.emit(registerInstruction{opcode: regReturn, source: pc})
+		return false
+	default:
+		pops, pushes, _ := t.stackEffect(instr)
+		t.flush(pc)
+		after := len(t.vstack) - pops + pushes
+		t.emit(registerInstruction{opcode: regStack, target: after, source: pc})
+		t.vstack = t.vstack[:len(t.vstack)-pops]
+		for i := 0; i < pushes; i++ {
+			t.push(t.temp())
+		}
+		return instr.Opcode != OpHalt
+	}
+	return true
+}
+
+// runRegisters translates the program and runs it on the register backend.
+// It reports false without running anything when the program cannot be
+// translated.
+func (vm *VM) runRegisters() bool {
+	program, err := translateRegisters(vm)
+	if err != nil {
+		logger.Log.Warnw("Program cannot run on the register backend, using the stack backend", zap.Error(err))
+		return false
+	}
+
+	base, pc := 0, 0
+	frames := []registerFrame{}
+	if !vm.reserveRegisters(base, program.mainFrameSize) {
+		return true
+	}
+
+	for vm.running {
+		vm.safePoint()
+		if err := vm.checkLimits(); err != nil {
+			vm.fail(err)
+			break
+		}
+		instr := &program.instructions[pc]
+		vm.pc = instr.source
+		vm.executed++
+		pc++
+
+		switch instr.opcode {
+		case regMove:
+			vm.store(instr.dest, base, vm.load(instr.left, base))
+		case regAdd:
+			vm.store(instr.dest, base, vm.add(vm.load(instr.left, base), vm.load(instr.right, base)))
+		case regSub:
+			vm.store(instr.dest, base, vm.sub(vm.load(instr.left, base), vm.load(instr.right, base)))
+		case regMul:
+			vm.store(instr.dest, base, vm.mul(vm.load(instr.left, base), vm.load(instr.right, base)))
+		case regDiv:
+			vm.store(instr.dest, base, vm.div(vm.load(instr.left, base), vm.load(instr.right, base)))
+		case regEqual:
+			vm.store(instr.dest, base, valuesEqual(vm.load(instr.left, base), vm.load(instr.right, base)))
+		case regNotEqual:
+			vm.store(instr.dest, base, !valuesEqual(vm.load(instr.left, base), vm.load(instr.right, base)))
+		case regAnd:
+			vm.store(instr.dest, base, isTruthy(vm.load(instr.left, base)) && isTruthy(vm.load(instr.right, base)))
+		case regOr:
+			vm.store(instr.dest, base, isTruthy(vm.load(instr.left, base)) || isTruthy(vm.load(instr.right, base)))
+		case regNot:
+			vm.store(instr.dest, base, !isTruthy(vm.load(instr.left, base)))
+		case regConcatString:
+			vm.store(instr.dest, base, vm.concat(vm.load(instr.left, base), vm.load(instr.right, base)))
+		case regJump:
+			pc = instr.target
+		case regJumpIfFalse:
+			if !isTruthy(vm.load(instr.left, base)) {
+				pc = instr.target
+			}
+		case regCall:
+			if !vm.pushFrame(instr.source+1, instr.target) {
+				break
+			}
+			frames = append(frames, registerFrame{returnAddress: pc, base: base})
+			base += instr.left.index
+			function := program.functions[instr.target]
+			if !vm.reserveRegisters(base, function.frameSize) {
+				break
+			}
+			pc = function.address
+		case regReturn:
+			if len(frames) == 0 {
+				vm.running = false
+				vm.stack = vm.registers[:instr.depth]
+				logger.Log.Info("Return from main function, halting VM")
+				break
+			}
+			frame := frames[len(frames)-1]
+			frames = frames[:len(frames)-1]
+			vm.popFrame()
+			pc, base = frame.returnAddress, frame.base
+		case regStack:
+			vm.dispatchRegisters(instr, base)
+		case regEnd:
+			vm.running = false
+			vm.stack = vm.registers[base : base+instr.depth]
+			logger.Log.Infow("Reached end of instructions", zap.Int("pc", vm.pc))
+		}
+	}
+	return true
+}
+
+// reserveRegisters makes sure a frame of size registers starting at base
+// fits, enforcing the stack depth limit
+func (vm *VM) reserveRegisters(base, size int) bool {
+	if vm.maxStackDepth > 0 && base+size > vm.maxStackDepth {
+		vm.fail(fmt.Errorf("%w: more than %d values on the stack", ErrStackOverflow, vm.maxStackDepth))
+		return false
+	}
+	vm.recordStackDepth(base + size)
+	if need := base + size; need > len(vm.registers) {
+		vm.registers = append(vm.registers, make([]Value, need-len(vm.registers))...)
+	}
+	return true
+}
+
+// dispatchRegisters runs an instruction without a register form on the
+// stack dispatcher, using the frame's registers as the value stack
+func (vm *VM) dispatchRegisters(instr *registerInstruction, base int) {
+	vm.stack = vm.registers[base : base+instr.depth]
+	vm.dispatch(vm.instructions[instr.source])
+
+	// Instructions that fail to produce a value, such as a failed exec,
+	// leave nil behind so the registers stay where the translation put them
+	for len(vm.stack) < instr.target {
+		vm.stack = append(vm.stack, nil)
+	}
+	copy(vm.registers[base:], vm.stack[:instr.target])
+}
+
+// load reads the value of an operand
+func (vm *VM) load(value operand, base int) Value {
+	switch value.kind {
+	case operandTemp:
+		return vm.registers[base+value.index]
+	case operandLocal:
+		return vm.locals[vm.localBase+value.index]
+	case operandGlobal:
+		if value.index < len(vm.globals) {
+			return vm.globals[value.index]
+		}
+		return nil
+	case operandConstant:
+		return vm.constants[value.index]
+	case operandInt:
+		return value.index
+	case operandBool:
+		return value.index != 0
+	}
+	return nil
+}
+
+// store writes a value to a temporary or variable operand
+func (vm *VM) store(dest operand, base int, value Value) {
+	switch dest.kind {
+	case operandLocal:
+		vm.locals[vm.localBase+dest.index] = value
+	case operandGlobal:
+		vm.setGlobal(dest.index, value)
+	default:
+		vm.registers[base+dest.index] = value
+	}
+}
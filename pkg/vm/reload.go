@@ -0,0 +1,188 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// ErrReloadRejected is returned when a program cannot replace the running
+// one without restarting the VM
+var ErrReloadRejected = errors.New("reload rejected")
+
+// Reload replaces the program of a VM whose main program has finished with
+// program, typically the same source compiled again after an edit. Events
+// are not dispatched meanwhile, so every agent is paused while its handlers,
+// functions, goal, capabilities and supervision are swapped for those of its
+// declaration in program. Agents keep their state, mailbox and memory: state
+// variables the program adds start with their initial value, or the one the
+// state store saved. Timers follow the agents' new handlers.
+//
+// The main program is not run again, so the program must declare the same
+// agents in the same order and new state variables must be initialised with
+// literals. Other programs are rejected with ErrReloadRejected, as they are
+// while handlers wait on an ask since their code would be gone, and the VM
+// keeps running the old program.
+func (vm *VM) Reload(program *Program) (err error) {
+	if err := program.Validate(); err != nil {
+		return err
+	}
+	vm.do(func() {
+		err = vm.reload(program)
+	})
+	return err
+}
+
+func (vm *VM) reload(program *Program) error {
+	if vm.running || len(vm.callStack) > 0 {
+		return fmt.Errorf("%w: the main program has not finished", ErrReloadRejected)
+	}
+	if len(vm.asks) > 0 {
+		return fmt.Errorf("%w: %d handlers are waiting on asks", ErrReloadRejected, len(vm.asks))
+	}
+	old, err := declarations(vm.instructions, vm.constants, vm.functions)
+	if err != nil {
+		return err
+	}
+	decls, err := declarations(program.Instructions, program.Constants, program.Functions)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReloadRejected, err)
+	}
+	if err := compatible(old, decls); err != nil {
+		return fmt.Errorf("%w: %v", ErrReloadRejected, err)
+	}
+	for _, decl := range decls {
+		for _, handler := range decl.handlers {
+			if _, _, err := ParseTimerEvent(handler.Event); err != nil {
+				return fmt.Errorf("%w: agent %s: %v", ErrReloadRejected, decl.name, err)
+			}
+		}
+		if decl.supervision == "" {
+			continue
+		}
+		if _, err := ParseSupervision(decl.supervision); err != nil {
+			return fmt.Errorf("%w: agent %s: %v", ErrReloadRejected, decl.name, err)
+		}
+	}
+	for _, agent := range vm.Agents() {
+		decl := findDeclaration(decls, agent.Declaration)
+		for name, value := range decl.state {
+			if _, ok := agent.state[name]; !ok {
+				if _, isUnknown := value.(unknown); isUnknown {
+					return fmt.Errorf("%w: new state variable %s of agent %s is not initialised with a literal", ErrReloadRejected, name, agent.Declaration)
+				}
+			}
+		}
+	}
+
+	vm.instructions = program.Instructions
+	vm.functions = program.Functions
+	vm.constants = vm.strings.internConstants(program.Constants)
+	vm.constantBytes = sizeOfConstants(vm.constants)
+	// Both refer to addresses of the old program
+	vm.breakpoints = nil
+	if vm.profiler != nil {
+		WithProfiling()(vm)
+	}
+	for _, agent := range vm.Agents() {
+		vm.reloadAgent(agent, findDeclaration(decls, agent.Declaration))
+	}
+	logger.Log.Infow("Reloaded program", zap.Int("agents", len(decls)), zap.Int("functions", len(program.Functions)))
+	return nil
+}
+
+// compatible checks that a program declares the same agents as the running
+// one, in the same global slots
+func compatible(old, decls []*declaration) error {
+	for _, decl := range decls {
+		previous := findDeclaration(old, decl.name)
+		if previous == nil {
+			return fmt.Errorf("agent %s is new", decl.name)
+		}
+		if previous.slot != decl.slot {
+			return fmt.Errorf("agent %s moved from global %d to %d", decl.name, previous.slot, decl.slot)
+		}
+	}
+	for _, previous := range old {
+		if findDeclaration(decls, previous.name) == nil {
+			return fmt.Errorf("agent %s was removed", previous.name)
+		}
+	}
+	return nil
+}
+
+// reloadAgent gives an agent the parts of its new declaration and schedules
+// the timers of handlers it did not have before
+func (vm *VM) reloadAgent(agent *Agent, decl *declaration) {
+	var timers []string
+	for _, handler := range agent.Handlers {
+		if _, isTimer, _ := ParseTimerEvent(handler.Event); isTimer {
+			timers = append(timers, handler.Event)
+		}
+	}
+
+	agent.Goal = decl.goal
+	agent.Capabilities = append([]string(nil), decl.capabilities...)
+	agent.Handlers = append([]EventHandler(nil), decl.handlers...)
+	agent.Functions = append([]string(nil), decl.functions...)
+	agent.supervision = nil
+	if decl.supervision != "" {
+		supervision, _ := ParseSupervision(decl.supervision)
+		agent.supervision = &supervision
+	}
+	for name, value := range decl.state {
+		if _, isUnknown := value.(unknown); isUnknown {
+			continue
+		}
+		if agent.initial == nil {
+			agent.initial = make(map[string]Value)
+		}
+		agent.initial[name] = value
+		if _, ok := agent.state[name]; ok {
+			continue
+		}
+		if saved, ok := agent.saved[name]; ok {
+			value = saved
+		}
+		agent.state[name] = value
+	}
+
+	var current []string
+	for _, handler := range agent.Handlers {
+		spec, isTimer, _ := ParseTimerEvent(handler.Event)
+		if !isTimer {
+			continue
+		}
+		current = append(current, handler.Event)
+		if !slices.Contains(timers, handler.Event) && !agent.Stopped() {
+			vm.schedule(agent.Name, handler.Event, spec)
+		}
+	}
+	s := vm.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t := range s.timers {
+		if t.agent == agent.Name && !t.resume && !slices.Contains(current, t.event) {
+			t.cancel()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Agents have two kinds of memory. Long-term memory is a key/value store
+// written with remember(key, value), read with recall(key) and cleared
+// with forget(key). It is saved to the VM's StateStore along with the
+// agent's state, under the agent's name followed by MemoryStoreSuffix, so
+// it survives restarts. Short-term memory is a conversation buffer: observe
+// adds an entry and recent() returns the latest entries as a list, oldest
+// first. It holds the last DefaultShortTermMemory entries unless configured
+// with WithShortTermMemory and is lost when the agent is restarted.
+const (
+	MemoryStoreSuffix      = ":memory"
+	DefaultShortTermMemory = 32
+)
+
+// WithShortTermMemory sets how many entries agents' conversation buffers
+// hold before the oldest are dropped
+func WithShortTermMemory(n int) Option {
+	return func(vm *VM) {
+		vm.shortTermMemory = n
+	}
+}
+
+// AgentMemory returns an entry of an agent's long-term memory
+func (vm *VM) AgentMemory(agentName, key string) (Value, bool) {
+	var value Value
+	var ok bool
+	vm.do(func() {
+		agent, found := vm.Agent(agentName)
+		if !found {
+			return
+		}
+		value, ok = agent.memory[key]
+	})
+	return value, ok
+}
+
+// memoryAgent returns the agent whose handler is running for the memory
+// builtins, which have no agent to act on outside of handlers
+func (vm *VM) memoryAgent(builtin string) (*Agent, bool) {
+	if vm.self == nil {
+		vm.fail(fmt.Errorf("%s used outside of an agent's event handler", builtin))
+		return nil, false
+	}
+	return vm.self, true
+}
+
+// memoryKey pops the key of a long-term memory entry
+func (vm *VM) memoryKey(builtin string) (string, bool) {
+	value := vm.popStack()
+	key, ok := value.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("%s expects a string key, got %T", builtin, value))
+	}
+	return key, ok
+}
+
+// remember runs OpRemember: the key and the value on the stack are stored
+// in the agent's long-term memory
+func (vm *VM) remember() {
+	value := vm.popStack()
+	key, ok := vm.memoryKey("remember")
+	if !ok {
+		return
+	}
+	agent, ok := vm.memoryAgent("remember")
+	if !ok {
+		return
+	}
+	if agent.memory == nil {
+		agent.memory = make(map[string]Value)
+	}
+	agent.memory[key] = value
+	agent.memoryDirty = true
+}
+
+// recall runs OpRecall: the key on the stack is replaced by the value the
+// agent remembered under it, or nil
+func (vm *VM) recall() {
+	key, ok := vm.memoryKey("recall")
+	if !ok {
+		return
+	}
+	agent, ok := vm.memoryAgent("recall")
+	if !ok {
+		return
+	}
+	vm.stack = append(vm.stack, agent.memory[key])
+}
+
+// forget runs OpForget, removing the key on the stack from the agent's
+// long-term memory
+func (vm *VM) forget() {
+	key, ok := vm.memoryKey("forget")
+	if !ok {
+		return
+	}
+	agent, ok := vm.memoryAgent("forget")
+	if !ok {
+		return
+	}
+	if _, exists := agent.memory[key]; exists {
+		delete(agent.memory, key)
+		agent.memoryDirty = true
+	}
+}
+
+// observe runs OpObserve, adding the value on the stack to the agent's
+// conversation buffer
+func (vm *VM) observe() {
+	value := vm.popStack()
+	agent, ok := vm.memoryAgent("observe")
+	if !ok {
+		return
+	}
+	if vm.shortTermMemory <= 0 {
+		return
+	}
+	if len(agent.recent) >= vm.shortTermMemory {
+		n := copy(agent.recent, agent.recent[len(agent.recent)-vm.shortTermMemory+1:])
+		clear(agent.recent[n:])
+		agent.recent = agent.recent[:n]
+	}
+	agent.recent = append(agent.recent, value)
+}
+
+// recentEntries runs OpRecent, pushing the agent's conversation buffer as a
+// list
+func (vm *VM) recentEntries() {
+	agent, ok := vm.memoryAgent("recent")
+	if !ok {
+		return
+	}
+	l := NewList(agent.recent...)
+	vm.alloc(l)
+	vm.stack = append(vm.stack, l)
+}
+
+// loadMemory reads the agent's long-term memory from the store
+func (vm *VM) loadMemory(agent *Agent) error {
+	memory, err := vm.stateStore.Load(agent.Name + MemoryStoreSuffix)
+	if err != nil {
+		return err
+	}
+	for _, value := range memory {
+		vm.adopt(value)
+	}
+	agent.memory = memory
+	return nil
+}
+
+// saveMemory saves the agent's long-term memory if a handler changed it
+func (vm *VM) saveMemory(agent *Agent) error {
+	if !agent.memoryDirty {
+		return nil
+	}
+	memory := agent.memory
+	if memory == nil {
+		memory = map[string]Value{}
+	}
+	if err := vm.stateStore.Save(agent.Name+MemoryStoreSuffix, memory); err != nil {
+		return errors.Join(fmt.Errorf("saving the memory of agent %s", agent.Name), err)
+	}
+	agent.memoryDirty = false
+	return nil
+}
@@ -0,0 +1,40 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import "context"
+
+// Remote delivers events to agents running in other processes. Programs
+// reach them with emit("Agent", event, payload) when no local agent has
+// that name. They cannot ask them, which fails with ErrRemoteAsk.
+type Remote interface {
+	// Emit delivers the event to the named agent. It returns an error
+	// wrapping ErrUnknownAgent when no other process runs the agent and
+	// must not wait for the agent to handle the event, its handlers may
+	// emit events back to this VM. ctx carries the span context of the
+	// emitting handler when tracing is enabled and the session of its
+	// event, see SessionFromContext.
+	Emit(ctx context.Context, agent, event string, payload Value) error
+}
+
+// WithRemote delivers events emitted to agents that do not run in this VM
+// through remote
+func WithRemote(remote Remote) Option {
+	return func(vm *VM) {
+		vm.remote = remote
+	}
+}
@@ -0,0 +1,260 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Timer events are handled like any other event, the scheduler posts them
+// to the agent when they are due. on "every:30s" runs a handler every 30
+// seconds, on "after:5s" runs it once 5 seconds after the agent registered
+// it and on "cron:0 9 * * *" runs it whenever the cron expression matches.
+// Timers start when their handler is registered and are cancelled when the
+// agent stops.
+const (
+	EveryEventPrefix = "every:"
+	AfterEventPrefix = "after:"
+	CronEventPrefix  = "cron:"
+)
+
+// ScheduleCapability must be among the capabilities of agents with cron
+// handlers
+const ScheduleCapability = "schedule"
+
+// TimerSpec describes when a timer event fires
+type TimerSpec struct {
+	Interval time.Duration
+	// Repeat is set for every timers, after timers fire once
+	Repeat bool
+	// Cron is set for cron timers, which fire whenever it matches
+	Cron *CronSchedule
+}
+
+// next returns when a timer started at start is due next after now, or the
+// zero time if it is not due again. Interval timers are due at multiples of
+// their interval since the start, so they do not drift.
+func (spec TimerSpec) next(start, now time.Time) time.Time {
+	if spec.Cron != nil {
+		return spec.Cron.Next(now)
+	}
+	if !spec.Repeat {
+		if due := start.Add(spec.Interval); due.After(now) {
+			return due
+		}
+		return time.Time{}
+	}
+	return start.Add((now.Sub(start)/spec.Interval + 1) * spec.Interval)
+}
+
+// ParseTimerEvent reports whether an event name is a timer event and
+// returns its schedule. It fails for timer events whose duration or cron
+// expression is invalid.
+func ParseTimerEvent(event string) (TimerSpec, bool, error) {
+	var spec TimerSpec
+	var duration string
+	switch {
+	case strings.HasPrefix(event, EveryEventPrefix):
+		spec.Repeat = true
+		duration = strings.TrimPrefix(event, EveryEventPrefix)
+	case strings.HasPrefix(event, AfterEventPrefix):
+		duration = strings.TrimPrefix(event, AfterEventPrefix)
+	case strings.HasPrefix(event, CronEventPrefix):
+		cron, err := ParseCron(strings.TrimPrefix(event, CronEventPrefix))
+		if err != nil {
+			return spec, true, fmt.Errorf("timer event %q: %w", event, err)
+		}
+		spec.Cron = cron
+		return spec, true, nil
+	default:
+		return spec, false, nil
+	}
+	interval, err := time.ParseDuration(duration)
+	if err != nil {
+		return spec, true, fmt.Errorf("timer event %q: %w", event, err)
+	}
+	if interval <= 0 {
+		return spec, true, fmt.Errorf("timer event %q: duration must be positive", event)
+	}
+	spec.Interval = interval
+	return spec, true, nil
+}
+
+// scheduler tracks the timers of a VM, each timer runs in a goroutine of
+// its own and fires through the host command queue
+type scheduler struct {
+	mu     sync.Mutex
+	timers map[*timer]struct{}
+	// done is closed and replaced whenever the last timer finishes
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type timer struct {
+	agent string
+	event string
+	spec  TimerSpec
+	// resume marks the timer resuming an agent after a backoff
+	resume bool
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func (t *timer) cancel() {
+	t.once.Do(func() {
+		close(t.stop)
+	})
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		timers: make(map[*timer]struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// schedule starts a timer posting event to the agent
+func (vm *VM) schedule(agent, event string, spec TimerSpec) {
+	vm.startTimer(&timer{agent: agent, event: event, spec: spec, stop: make(chan struct{})})
+}
+
+// scheduleResume starts a timer resuming a suspended agent after delay
+func (vm *VM) scheduleResume(agent string, delay time.Duration) {
+	vm.startTimer(&timer{agent: agent, event: StartEvent, spec: TimerSpec{Interval: delay}, resume: true, stop: make(chan struct{})})
+}
+
+func (vm *VM) startTimer(t *timer) {
+	s := vm.scheduler
+	s.mu.Lock()
+	s.timers[t] = struct{}{}
+	s.mu.Unlock()
+	s.wg.Add(1)
+	logger.Log.Debugw("Scheduling timer", zap.String("agent", t.agent), zap.String("event", t.event))
+	go vm.runTimer(t, time.Now())
+}
+
+// runTimer fires a timer until it is cancelled or is not due any more. Due
+// times are computed from the schedule rather than from the previous firing,
+// so handlers taking a while do not make the timer drift and ticks missed
+// meanwhile are skipped rather than delivered in a burst.
+func (vm *VM) runTimer(t *timer, start time.Time) {
+	s := vm.scheduler
+	defer s.wg.Done()
+	defer s.remove(t)
+
+	due := t.spec.next(start, start)
+	if due.IsZero() {
+		return
+	}
+	clock := time.NewTimer(time.Until(due))
+	defer clock.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-clock.C:
+		}
+		vm.fireTimer(t)
+		// A timer can fire a little early, never schedule the same time twice
+		due = t.spec.next(start, maxTime(time.Now(), due))
+		if due.IsZero() {
+			return
+		}
+		clock.Reset(time.Until(due))
+	}
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// fireTimer posts a timer's event, dispatching it right away unless Run is
+// executing the program
+func (vm *VM) fireTimer(t *timer) {
+	vm.do(func() {
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+		if vm.err != nil {
+			return
+		}
+		vm.postEvent(Event{Agent: t.agent, Name: t.event, resume: t.resume})
+		if err := vm.hostDispatch(); err != nil {
+			logger.Log.Errorw("Timer event handler failed", zap.String("agent", t.agent), zap.String("event", t.event), zap.Error(err))
+		}
+	})
+}
+
+func (s *scheduler) remove(t *timer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.timers, t)
+	if len(s.timers) == 0 {
+		close(s.done)
+		s.done = make(chan struct{})
+	}
+}
+
+// cancel stops the timers of an agent, or all timers when agent is empty
+func (s *scheduler) cancel(agent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t := range s.timers {
+		if agent == "" || t.agent == agent {
+			t.cancel()
+		}
+	}
+}
+
+// Timers returns the number of scheduled timers
+func (vm *VM) Timers() int {
+	vm.scheduler.mu.Lock()
+	defer vm.scheduler.mu.Unlock()
+	return len(vm.scheduler.timers)
+}
+
+// WaitTimers blocks until no timers are scheduled any more or ctx is done.
+// Every timers only finish when their agent stops, so hosts running agents
+// with them typically wait until they are asked to shut down.
+func (vm *VM) WaitTimers(ctx context.Context) error {
+	for {
+		vm.scheduler.mu.Lock()
+		if len(vm.scheduler.timers) == 0 {
+			vm.scheduler.mu.Unlock()
+			return nil
+		}
+		done := vm.scheduler.done
+		vm.scheduler.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A session groups the events of one conversation, such as the messages of
+// a user chatting with the agents. Hosts start one by emitting an event
+// with EmitContext from a context carrying a session ID, see
+// ContextWithSession, and the events posted by the handlers of a session's
+// events belong to it as well. Handlers read the ID with session(), keep
+// values for the rest of the conversation with sessionRemember(key, value)
+// and sessionRecall(key), and get the events of the session so far, oldest
+// first, with sessionHistory(). Sessions are shared by every agent handling
+// their events, live in memory only and end when they have been idle for
+// the session timeout or with EndSession.
+const DefaultSessionTimeout = 30 * time.Minute
+
+// Session is the state of a conversation
+type Session struct {
+	ID      string
+	Started time.Time
+	// LastActive is when an event of the session was last dispatched
+	LastActive time.Time
+
+	memory map[string]Value
+	// history holds a map per dispatched event with its "event", "agent"
+	// and "payload", bounded like the agents' conversation buffers
+	history []Value
+}
+
+// SessionInfo describes a session
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Started    time.Time `json:"started"`
+	LastActive time.Time `json:"lastActive"`
+	Events     int       `json:"events"`
+}
+
+// WithSessionTimeout sets how long a session may go without events before
+// it ends. Zero keeps sessions until they are ended with EndSession.
+func WithSessionTimeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.sessionTimeout = d
+	}
+}
+
+type sessionKey struct{}
+
+// ContextWithSession returns a context carrying a session ID, the events
+// emitted with it by EmitContext belong to that session
+func ContextWithSession(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionKey{}, id)
+}
+
+// SessionFromContext returns the session ID ctx carries, empty if none
+func SessionFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionKey{}).(string)
+	return id
+}
+
+// Sessions describes the open sessions, ordered by ID
+func (vm *VM) Sessions() []SessionInfo {
+	var infos []SessionInfo
+	vm.do(func() {
+		vm.expireSessions()
+		for _, session := range vm.sessions {
+			infos = append(infos, SessionInfo{
+				ID:         session.ID,
+				Started:    session.Started,
+				LastActive: session.LastActive,
+				Events:     len(session.history),
+			})
+		}
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// EndSession discards a session's memory and history. Later events with its
+// ID start a new session.
+func (vm *VM) EndSession(id string) error {
+	var err error
+	vm.do(func() {
+		if _, ok := vm.sessions[id]; !ok {
+			err = fmt.Errorf("%w: %s", ErrUnknownSession, id)
+			return
+		}
+		delete(vm.sessions, id)
+	})
+	return err
+}
+
+// expireSessions ends the sessions idle for longer than the session timeout
+func (vm *VM) expireSessions() {
+	if vm.sessionTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	for id, session := range vm.sessions {
+		if now.Sub(session.LastActive) > vm.sessionTimeout {
+			delete(vm.sessions, id)
+		}
+	}
+}
+
+// touchSession records an event dispatched in its session, starting the
+// session if it is new
+func (vm *VM) touchSession(event Event) {
+	if event.Session == "" {
+		return
+	}
+	vm.expireSessions()
+	now := time.Now()
+	session, ok := vm.sessions[event.Session]
+	if !ok {
+		if vm.sessions == nil {
+			vm.sessions = make(map[string]*Session)
+		}
+		session = &Session{ID: event.Session, Started: now}
+		vm.sessions[event.Session] = session
+	}
+	session.LastActive = now
+	if vm.shortTermMemory <= 0 {
+		return
+	}
+
+	entry := NewMap()
+	entry.Set("event", event.Name)
+	entry.Set("agent", event.Agent)
+	entry.Set("payload", event.Payload)
+	if len(session.history) >= vm.shortTermMemory {
+		n := copy(session.history, session.history[len(session.history)-vm.shortTermMemory+1:])
+		clear(session.history[n:])
+		session.history = session.history[:n]
+	}
+	// The entry is in the history before it is allocated, which may
+	// collect garbage, so that the payload stays reachable
+	session.history = append(session.history, entry)
+	vm.alloc(entry)
+}
+
+// currentSession returns the session of the event being handled for the
+// session builtins, which fail outside of a session
+func (vm *VM) currentSession(builtin string) (*Session, bool) {
+	if vm.self == nil {
+		vm.fail(fmt.Errorf("%s used outside of an agent's event handler", builtin))
+		return nil, false
+	}
+	session, ok := vm.sessions[vm.event.Session]
+	if !ok {
+		vm.fail(fmt.Errorf("%s used while handling event %s, which belongs to no session", builtin, vm.event.Name))
+		return nil, false
+	}
+	return session, true
+}
+
+// sessionID runs OpSession, pushing the session ID of the event being
+// handled, or an empty string
+func (vm *VM) sessionID() {
+	if vm.self == nil {
+		vm.fail(fmt.Errorf("session used outside of an agent's event handler"))
+		return
+	}
+	vm.stack = append(vm.stack, vm.event.Session)
+}
+
+// sessionRemember runs OpSessionRemember: the key and the value on the
+// stack are stored in the session's memory
+func (vm *VM) sessionRemember() {
+	value := vm.popStack()
+	key, ok := vm.memoryKey("sessionRemember")
+	if !ok {
+		return
+	}
+	session, ok := vm.currentSession("sessionRemember")
+	if !ok {
+		return
+	}
+	if session.memory == nil {
+		session.memory = make(map[string]Value)
+	}
+	session.memory[key] = value
+}
+
+// sessionRecall runs OpSessionRecall: the key on the stack is replaced by
+// the value remembered under it in the session, or nil
+func (vm *VM) sessionRecall() {
+	key, ok := vm.memoryKey("sessionRecall")
+	if !ok {
+		return
+	}
+	session, ok := vm.currentSession("sessionRecall")
+	if !ok {
+		return
+	}
+	vm.stack = append(vm.stack, session.memory[key])
+}
+
+// sessionHistory runs OpSessionHistory, pushing the session's events as a
+// list
+func (vm *VM) sessionHistory() {
+	session, ok := vm.currentSession("sessionHistory")
+	if !ok {
+		return
+	}
+	l := NewList(session.history...)
+	vm.alloc(l)
+	vm.stack = append(vm.stack, l)
+}
+
+// references returns the session's memory and history for the garbage
+// collector
+func (s *Session) references() []Value {
+	references := append([]Value(nil), s.history...)
+	for _, value := range s.memory {
+		references = append(references, value)
+	}
+	return references
+}
@@ -0,0 +1,179 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultSQLTimeout is how long a sqlQuery may take by default
+const DefaultSQLTimeout = 30 * time.Second
+
+// SQLDatabase runs the queries of sqlQuery, *sql.DB implements it. Queries
+// run in read-only transactions that are always rolled back, so agents can
+// report on a database but not change it.
+type SQLDatabase interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// WithSQLDatabase makes db queryable as sqlQuery("name", query, params).
+// Programs only refer to connections by name, their DSNs and credentials
+// stay with the host.
+func WithSQLDatabase(name string, db SQLDatabase) Option {
+	return func(vm *VM) {
+		if vm.sqlDatabases == nil {
+			vm.sqlDatabases = make(map[string]SQLDatabase)
+		}
+		vm.sqlDatabases[name] = db
+	}
+}
+
+// WithSQLTimeout limits how long a single sqlQuery may take, zero removes
+// the limit. DefaultSQLTimeout applies otherwise.
+func WithSQLTimeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.sqlTimeout = d
+	}
+}
+
+// sqlQuery runs OpSQLQuery: the connection name, the query and optionally
+// a list of its parameters on the stack are replaced by the rows the query
+// returned, a list holding a map per row keyed by column name. Parameters
+// are passed to the driver separately from the query, never spliced into
+// it. Agents need SQLCapability to run queries.
+func (vm *VM) sqlQuery(argc int) {
+	var paramsValue Value
+	switch argc {
+	case 2:
+	case 3:
+		paramsValue = vm.popStack()
+	default:
+		vm.fail(fmt.Errorf("sqlQuery expects 2 or 3 arguments but got %d", argc))
+		return
+	}
+	query, ok := vm.popText("sqlQuery", "query")
+	if !ok {
+		return
+	}
+	name, ok := vm.popText("sqlQuery", "connection")
+	if !ok {
+		return
+	}
+	params, err := sqlParams(paramsValue)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	if !vm.requireCapability(SQLCapability, "query "+name) {
+		return
+	}
+	db, ok := vm.sqlDatabases[name]
+	if !ok {
+		vm.fail(fmt.Errorf("no sql connection named %s", name))
+		return
+	}
+
+	span := vm.startSpan("sql " + name)
+	defer span.Finish()
+	ctx := traceContext(context.Background(), span)
+	if vm.sqlTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vm.sqlTimeout)
+		defer cancel()
+	}
+	rows, err := runSQLQuery(ctx, db, query, params)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: query took longer than %s", ErrTimeout, vm.sqlTimeout)
+		}
+		span.SetError(err)
+		vm.fail(fmt.Errorf("sqlQuery %s: %w", name, err))
+		return
+	}
+	vm.adopt(rows)
+	vm.stack = append(vm.stack, rows)
+}
+
+// sqlParams converts the parameter list of sqlQuery, nil means none
+func sqlParams(value Value) ([]any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	list, ok := value.(*List)
+	if !ok {
+		return nil, fmt.Errorf("sqlQuery parameters must be a list, got %s", typeName(value))
+	}
+	params := make([]any, list.Len())
+	for i, item := range list.Items() {
+		switch item.(type) {
+		case nil, int, float64, string, bool:
+			params[i] = item
+		default:
+			return nil, fmt.Errorf("sqlQuery parameter %d cannot be %s", i+1, typeName(item))
+		}
+	}
+	return params, nil
+}
+
+// runSQLQuery runs query in a read-only transaction and collects its rows
+func runSQLQuery(ctx context.Context, db SQLDatabase, query string, params []any) (*List, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewList()
+	values := make([]any, len(columns))
+	scan := make([]any, len(columns))
+	for i := range values {
+		scan[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(scan...); err != nil {
+			return nil, err
+		}
+		row := NewMap()
+		for i, column := range columns {
+			row.Set(column, sqlValue(values[i]))
+		}
+		result.Append(row)
+	}
+	return result, rows.Err()
+}
+
+// sqlValue converts a column value returned by a driver
+func sqlValue(value any) Value {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return normaliseValue(value)
+}
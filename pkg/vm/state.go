@@ -0,0 +1,427 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// StateStore persists the state variables of agents. The VM loads an
+// agent's saved state when the agent is created and saves it after every
+// event handler that changed it, so long running agents continue where they
+// left off when the program is restarted. Stores are called from the
+// goroutine running the VM.
+type StateStore interface {
+	// Load returns the saved state of the named agent, or nil when none has
+	// been saved
+	Load(agent string) (map[string]Value, error)
+	// Save replaces the saved state of the named agent
+	Save(agent string, state map[string]Value) error
+}
+
+// WithStateStore checkpoints agents' state variables to store and restores
+// them from it. Spawned instances are restored by their numbered names, so
+// they keep their state as long as the program spawns them in the same
+// order.
+func WithStateStore(store StateStore) Option {
+	return func(vm *VM) {
+		vm.stateStore = store
+	}
+}
+
+// FileStore is a StateStore keeping each agent's state in a JSON file of
+// its own
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store writing to dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(agent string) string {
+	return filepath.Join(s.dir, url.PathEscape(agent)+".json")
+}
+
+// Load reads the agent's state file
+func (s *FileStore) Load(agent string) (map[string]Value, error) {
+	data, err := os.ReadFile(s.path(agent))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodeState(data)
+}
+
+// Save writes the agent's state file. The file is replaced atomically so a
+// crash while saving leaves the previous checkpoint intact.
+func (s *FileStore) Save(agent string, state map[string]Value) error {
+	data, err := EncodeState(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(agent))
+}
+
+// storedValue is the JSON form of a state value, tagged with its type so
+// ints and floats survive the round trip
+type storedValue struct {
+	Type    string        `json:"type"`
+	Value   any           `json:"value,omitempty"`
+	Items   []storedValue `json:"items,omitempty"`
+	Entries []storedEntry `json:"entries,omitempty"`
+}
+
+type storedEntry struct {
+	Key   storedValue `json:"key"`
+	Value storedValue `json:"value"`
+}
+
+// EncodeState serialises agent state as JSON. Agents and other runtime
+// objects cannot be persisted. Custom stores can use it to share the
+// format of FileStore.
+func EncodeState(state map[string]Value) ([]byte, error) {
+	stored := make(map[string]storedValue, len(state))
+	for name, value := range state {
+		sv, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("state variable %s: %w", name, err)
+		}
+		stored[name] = sv
+	}
+	return json.MarshalIndent(stored, "", "  ")
+}
+
+func encodeValue(value Value) (storedValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return storedValue{Type: "null"}, nil
+	case int:
+		return storedValue{Type: "int", Value: strconv.Itoa(v)}, nil
+	case float64:
+		return storedValue{Type: "float", Value: strconv.FormatFloat(v, 'g', -1, 64)}, nil
+	case string:
+		return storedValue{Type: "string", Value: v}, nil
+	case bool:
+		return storedValue{Type: "bool", Value: v}, nil
+	case *List:
+		sv := storedValue{Type: "list", Items: make([]storedValue, 0, v.Len())}
+		for _, item := range v.Items() {
+			stored, err := encodeValue(item)
+			if err != nil {
+				return storedValue{}, err
+			}
+			sv.Items = append(sv.Items, stored)
+		}
+		return sv, nil
+	case *Map:
+		sv := storedValue{Type: "map", Entries: make([]storedEntry, 0, v.Len())}
+		for _, key := range v.Keys() {
+			item, _ := v.Get(key)
+			storedKey, err := encodeValue(key)
+			if err != nil {
+				return storedValue{}, err
+			}
+			storedItem, err := encodeValue(item)
+			if err != nil {
+				return storedValue{}, err
+			}
+			sv.Entries = append(sv.Entries, storedEntry{Key: storedKey, Value: storedItem})
+		}
+		return sv, nil
+	}
+	return storedValue{}, fmt.Errorf("cannot serialise a value of type %T", value)
+}
+
+// MarshalValue serialises a single value in the format of EncodeState, such
+// as for sending it to another process
+func MarshalValue(value Value) ([]byte, error) {
+	sv, err := encodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sv)
+}
+
+// UnmarshalValue parses a value written by MarshalValue
+func UnmarshalValue(data []byte) (Value, error) {
+	var sv storedValue
+	if err := json.Unmarshal(data, &sv); err != nil {
+		return nil, err
+	}
+	return decodeValue(sv)
+}
+
+// DecodeState parses agent state written by EncodeState
+func DecodeState(data []byte) (map[string]Value, error) {
+	var stored map[string]storedValue
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	state := make(map[string]Value, len(stored))
+	for name, sv := range stored {
+		value, err := decodeValue(sv)
+		if err != nil {
+			return nil, fmt.Errorf("state variable %s: %w", name, err)
+		}
+		state[name] = value
+	}
+	return state, nil
+}
+
+func decodeValue(sv storedValue) (Value, error) {
+	switch sv.Type {
+	case "null":
+		return nil, nil
+	case "int", "float":
+		text, ok := sv.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("malformed %s", sv.Type)
+		}
+		if sv.Type == "int" {
+			return strconv.Atoi(text)
+		}
+		return strconv.ParseFloat(text, 64)
+	case "string":
+		text, ok := sv.Value.(string)
+		if !ok && sv.Value != nil {
+			return nil, errors.New("malformed string")
+		}
+		return text, nil
+	case "bool":
+		b, ok := sv.Value.(bool)
+		if !ok && sv.Value != nil {
+			return nil, errors.New("malformed bool")
+		}
+		return b, nil
+	case "list":
+		l := NewList()
+		for _, item := range sv.Items {
+			value, err := decodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			l.Append(value)
+		}
+		return l, nil
+	case "map":
+		m := NewMap()
+		for _, entry := range sv.Entries {
+			key, err := decodeValue(entry.Key)
+			if err != nil {
+				return nil, err
+			}
+			if !isValidMapKey(key) {
+				return nil, fmt.Errorf("invalid map key of type %T", key)
+			}
+			value, err := decodeValue(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+			m.Set(key, value)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown value type %q", sv.Type)
+}
+
+// AgentState returns the value of one of an agent's state variables
+func (vm *VM) AgentState(agentName, name string) (Value, bool) {
+	var value Value
+	var ok bool
+	vm.do(func() {
+		agent, found := vm.Agent(agentName)
+		if !found {
+			return
+		}
+		value, ok = agent.state[name]
+	})
+	return value, ok
+}
+
+// loadState reads the agent's saved state from the store, it is applied as
+// the agent's state variables are defined
+func (vm *VM) loadState(agent *Agent) bool {
+	agent.state = make(map[string]Value)
+	if vm.stateStore == nil {
+		return true
+	}
+	saved, err := vm.stateStore.Load(agent.Name)
+	if err != nil {
+		vm.fail(fmt.Errorf("loading the state of agent %s: %w", agent.Name, err))
+		return false
+	}
+	for _, value := range saved {
+		vm.adopt(value)
+	}
+	agent.saved = saved
+	if err := vm.loadMemory(agent); err != nil {
+		vm.fail(fmt.Errorf("loading the memory of agent %s: %w", agent.Name, err))
+		return false
+	}
+	return true
+}
+
+// defineState runs OpDefineState: the initial value and the name of a state
+// variable of the agent in the global slot are on the stack. A value saved
+// by an earlier run takes the place of the initial value.
+func (vm *VM) defineState(index int) {
+	name, ok := vm.popStack().(string)
+	value := vm.popStack()
+	if !ok {
+		vm.fail(fmt.Errorf("state variable of agent %d has no name", index))
+		return
+	}
+	agent, ok := vm.globalAgent(index)
+	if !ok {
+		return
+	}
+	if agent.initial == nil {
+		agent.initial = make(map[string]Value)
+	}
+	agent.initial[name] = value
+	if saved, ok := agent.saved[name]; ok {
+		value = saved
+	}
+	agent.state[name] = value
+}
+
+// spawnState gives a spawned instance its own copy of the declaration's
+// initial state, or the state it saved in an earlier run
+func (vm *VM) spawnState(agent *Agent, initial map[string]Value) bool {
+	if !vm.loadState(agent) {
+		return false
+	}
+	agent.initial = initial
+	for name, value := range initial {
+		if saved, ok := agent.saved[name]; ok {
+			agent.state[name] = saved
+		} else {
+			agent.state[name] = vm.copyValue(value)
+		}
+	}
+	return true
+}
+
+// stateName returns the state variable named by a constant operand
+func (vm *VM) stateName(index int) (string, bool) {
+	if vm.self == nil {
+		vm.fail(errors.New("agent state used outside of an agent's event handler"))
+		return "", false
+	}
+	if index < 0 || index >= len(vm.constants) {
+		vm.fail(fmt.Errorf("constant index %d out of range", index))
+		return "", false
+	}
+	name, ok := vm.constants[index].(string)
+	if !ok {
+		vm.fail(fmt.Errorf("constant %d is not a state variable name", index))
+		return "", false
+	}
+	if _, ok := vm.self.state[name]; !ok {
+		vm.fail(fmt.Errorf("agent %s has no state variable %s", vm.self.Name, name))
+		return "", false
+	}
+	return name, true
+}
+
+// checkpoint saves the agent's state and long-term memory if a handler
+// changed them
+func (vm *VM) checkpoint(agent *Agent) error {
+	if vm.stateStore == nil {
+		return nil
+	}
+	if err := vm.saveMemory(agent); err != nil {
+		return err
+	}
+	if !agent.dirty {
+		return nil
+	}
+	if err := vm.stateStore.Save(agent.Name, agent.state); err != nil {
+		return fmt.Errorf("saving the state of agent %s: %w", agent.Name, err)
+	}
+	agent.dirty = false
+	logger.Log.Debugw("Checkpointed agent state", zap.String("agent", agent.Name))
+	return nil
+}
+
+// copyValue returns a deep copy of lists and maps so instances do not share
+// their state
+func (vm *VM) copyValue(value Value) Value {
+	switch v := value.(type) {
+	case *List:
+		l := NewList()
+		for _, item := range v.Items() {
+			l.Append(vm.copyValue(item))
+		}
+		vm.alloc(l)
+		return l
+	case *Map:
+		m := NewMap()
+		for _, key := range v.Keys() {
+			item, _ := v.Get(key)
+			m.Set(key, vm.copyValue(item))
+		}
+		vm.alloc(m)
+		return m
+	}
+	return value
+}
+
+// adopt tracks the lists and maps of a restored value on the heap
+func (vm *VM) adopt(value Value) {
+	switch v := value.(type) {
+	case *List:
+		for _, item := range v.Items() {
+			vm.adopt(item)
+		}
+		vm.alloc(v)
+	case *Map:
+		for _, item := range v.References() {
+			vm.adopt(item)
+		}
+		vm.alloc(v)
+	}
+}
@@ -0,0 +1,264 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Strategy is what a supervisor does with an agent whose handlers keep
+// failing
+type Strategy int
+
+const (
+	// StrategyRestart resets the agent's state and mailbox and starts it
+	// again
+	StrategyRestart Strategy = iota
+	// StrategyBackoff suspends the agent and restarts it after a delay that
+	// doubles every time it fails again
+	StrategyBackoff
+	// StrategyEscalate hands the failure to the agent that spawned it and
+	// stops the failing agent
+	StrategyEscalate
+)
+
+var strategyNames = map[Strategy]string{
+	StrategyRestart:  "restart",
+	StrategyBackoff:  "backoff",
+	StrategyEscalate: "escalate",
+}
+
+func (s Strategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// EscalateEvent is delivered to the parent of an agent that escalates a
+// failure, with the same payload as the supervisor topics
+const EscalateEvent = "escalate"
+
+// Supervision transitions are published on the topic bus so any agent can
+// watch them, such as with on "topic:supervisor.*". Their payload is a map
+// holding the "agent", its "strategy", the failed "event", the error
+// "message", the number of "errors" and for backoffs the "delay".
+const (
+	SupervisorRestarted = TopicEventPrefix + "supervisor.restarted"
+	SupervisorBackoff   = TopicEventPrefix + "supervisor.backoff"
+	SupervisorEscalated = TopicEventPrefix + "supervisor.escalated"
+)
+
+// Supervision configures how an agent recovers from failing handlers. It is
+// declared in the agent with supervision: "backoff max=3 delay=1s", the
+// strategy followed by optional settings.
+type Supervision struct {
+	Strategy Strategy
+	// MaxErrors is the number of failures that trigger the strategy, 3 by
+	// default
+	MaxErrors int
+	// Within only counts failures that happened within this long of each
+	// other, zero counts every failure since the agent last started
+	Within time.Duration
+	// Delay is the first backoff, 1s by default, and MaxDelay the longest,
+	// 1m by default
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// ParseSupervision parses the supervision setting of an agent. The settings
+// are max=N, within=D and for backoff delay=D and max-delay=D, with D a Go
+// duration.
+func ParseSupervision(spec string) (Supervision, error) {
+	s := Supervision{MaxErrors: 3, Delay: time.Second, MaxDelay: time.Minute}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("supervision %q has no strategy", spec)
+	}
+	found := false
+	for strategy, name := range strategyNames {
+		if fields[0] == name {
+			s.Strategy, found = strategy, true
+		}
+	}
+	if !found {
+		return s, fmt.Errorf("supervision %q: unknown strategy %q, expected restart, backoff or escalate", spec, fields[0])
+	}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return s, fmt.Errorf("supervision %q: setting %q is not key=value", spec, field)
+		}
+		var err error
+		switch key {
+		case "max":
+			s.MaxErrors, err = strconv.Atoi(value)
+			if err == nil && s.MaxErrors < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "within":
+			s.Within, err = parsePositiveDuration(value)
+		case "delay", "max-delay":
+			if s.Strategy != StrategyBackoff {
+				return s, fmt.Errorf("supervision %q: %s only applies to backoff", spec, key)
+			}
+			if key == "delay" {
+				s.Delay, err = parsePositiveDuration(value)
+			} else {
+				s.MaxDelay, err = parsePositiveDuration(value)
+			}
+		default:
+			return s, fmt.Errorf("supervision %q: unknown setting %q", spec, key)
+		}
+		if err != nil {
+			return s, fmt.Errorf("supervision %q: %s: %w", spec, key, err)
+		}
+	}
+	if s.MaxDelay < s.Delay {
+		s.MaxDelay = s.Delay
+	}
+	return s, nil
+}
+
+func parsePositiveDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("duration must be positive")
+	}
+	return d, err
+}
+
+// setAgentSupervision runs OpSetAgentSupervision: the supervision setting
+// of the agent in the global slot is on the stack
+func (vm *VM) setAgentSupervision(index int) {
+	spec := fmt.Sprint(vm.popStack())
+	agent, ok := vm.globalAgent(index)
+	if !ok {
+		return
+	}
+	supervision, err := ParseSupervision(spec)
+	if err != nil {
+		vm.fail(err)
+		return
+	}
+	agent.supervision = &supervision
+}
+
+// supervise records a failed handler of a supervised agent and applies its
+// strategy once the agent has failed often enough. It reports false when
+// the failure could not be escalated because no parent handles it.
+func (vm *VM) supervise(agent *Agent, event Event, err error) bool {
+	s := agent.supervision
+	now := time.Now()
+	if s.Within > 0 {
+		recent := agent.failures[:0]
+		for _, failed := range agent.failures {
+			if now.Sub(failed) <= s.Within {
+				recent = append(recent, failed)
+			}
+		}
+		agent.failures = recent
+	}
+	agent.failures = append(agent.failures, now)
+	errorCount := len(agent.failures)
+	if errorCount < s.MaxErrors {
+		return true
+	}
+	agent.failures = agent.failures[:0]
+
+	info := NewMap()
+	info.Set("agent", agent.Name)
+	info.Set("strategy", s.Strategy.String())
+	info.Set("event", event.Name)
+	info.Set("message", err.Error())
+	info.Set("errors", errorCount)
+	vm.alloc(info)
+
+	switch s.Strategy {
+	case StrategyRestart:
+		vm.restartAgent(agent)
+		vm.postEvent(Event{Name: SupervisorRestarted, Payload: info})
+	case StrategyBackoff:
+		// The delay only keeps growing while the agent fails again soon
+		// after it was resumed
+		if now.Sub(agent.resumed) > s.MaxDelay {
+			agent.backoffs = 0
+		}
+		delay := s.Delay << agent.backoffs
+		if delay > s.MaxDelay || delay <= 0 {
+			delay = s.MaxDelay
+		} else {
+			agent.backoffs++
+		}
+		info.Set("delay", delay.String())
+		agent.suspended.Store(true)
+		vm.scheduleResume(agent.Name, delay)
+		logger.Log.Warnw("Agent suspended", zap.String("agent", agent.Name), zap.Duration("delay", delay))
+		vm.postEvent(Event{Name: SupervisorBackoff, Payload: info})
+	case StrategyEscalate:
+		parent := agent.parent
+		if parent == nil || parent.Stopped() || !parent.handles(EscalateEvent) {
+			return false
+		}
+		logger.Log.Warnw("Agent escalated its failure", zap.String("agent", agent.Name), zap.String("parent", parent.Name))
+		vm.postEvent(Event{Agent: parent.Name, Name: EscalateEvent, Payload: info})
+		vm.postEvent(Event{Agent: agent.Name, Name: StopEvent, stop: true})
+		vm.postEvent(Event{Name: SupervisorEscalated, Payload: info})
+	}
+	return true
+}
+
+// restartAgent resets an agent's state to its declared values, drops its
+// queued messages and conversation buffer and sends it the start event
+// again. Its long-term memory is kept.
+func (vm *VM) restartAgent(agent *Agent) {
+	for name, value := range agent.initial {
+		agent.state[name] = vm.copyValue(value)
+	}
+	agent.dirty = len(agent.initial) > 0
+	clear(agent.recent)
+	agent.recent = agent.recent[:0]
+	agent.mailbox.mu.Lock()
+	clear(agent.mailbox.messages)
+	agent.mailbox.messages = agent.mailbox.messages[:0]
+	agent.mailbox.mu.Unlock()
+	logger.Log.Infow("Restarting agent", zap.String("agent", agent.Name))
+	vm.postEvent(Event{Agent: agent.Name, Name: StartEvent})
+}
+
+// resumeAgent restarts an agent once its backoff has passed
+func (vm *VM) resumeAgent(name string) {
+	agent, ok := vm.Agent(name)
+	if !ok || agent.Stopped() || !agent.suspended.Load() {
+		return
+	}
+	agent.suspended.Store(false)
+	agent.resumed = time.Now()
+	vm.restartAgent(agent)
+
+	info := NewMap()
+	info.Set("agent", agent.Name)
+	info.Set("strategy", agent.supervision.Strategy.String())
+	vm.alloc(info)
+	vm.postEvent(Event{Name: SupervisorRestarted, Payload: info})
+}
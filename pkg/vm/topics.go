@@ -0,0 +1,112 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TopicEventPrefix marks events published on the topic bus. Agents publish
+// with emit("topic:deploys.prod", payload) and every agent with a matching
+// handler receives the message. Topics are dot separated, in a handler's
+// topic * matches a single segment and a trailing ** any number of
+// remaining segments, so on "topic:deploys.*" and on "topic:**" both
+// receive deploys.prod.
+const TopicEventPrefix = "topic:"
+
+// TopicMetrics counts the traffic of a single topic
+type TopicMetrics struct {
+	// Published counts the messages published to the topic
+	Published int
+	// Delivered counts the handlers the messages were delivered to
+	Delivered int
+	// Undelivered counts the messages no handler subscribed to
+	Undelivered int
+}
+
+// CheckTopicEvent validates the topic of a topic event. Patterns, which may
+// contain wildcards, are what handlers subscribe to, the topics messages
+// are published to must be concrete. Events without the topic prefix are
+// always valid.
+func CheckTopicEvent(event string, pattern bool) error {
+	topic, ok := strings.CutPrefix(event, TopicEventPrefix)
+	if !ok {
+		return nil
+	}
+	segments := strings.Split(topic, ".")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+			return fmt.Errorf("topic %q has an empty segment", topic)
+		case segment == "*" || segment == "**":
+			if !pattern {
+				return fmt.Errorf("cannot publish to topic %q, wildcards are only allowed in subscriptions", topic)
+			}
+			if segment == "**" && i != len(segments)-1 {
+				return fmt.Errorf("topic %q may only use ** as its last segment", topic)
+			}
+		case strings.Contains(segment, "*"):
+			return fmt.Errorf("topic %q mixes a wildcard with other characters in a segment", topic)
+		}
+	}
+	return nil
+}
+
+// handlerMatches reports whether a handler for the event pattern handles
+// the event
+func handlerMatches(pattern, event string) bool {
+	if pattern == event {
+		return true
+	}
+	patternTopic, ok := strings.CutPrefix(pattern, TopicEventPrefix)
+	if !ok {
+		return false
+	}
+	topic, ok := strings.CutPrefix(event, TopicEventPrefix)
+	return ok && matchTopic(strings.Split(patternTopic, "."), strings.Split(topic, "."))
+}
+
+func matchTopic(pattern, topic []string) bool {
+	for i, segment := range pattern {
+		if segment == "**" {
+			return true
+		}
+		if i >= len(topic) || (segment != "*" && segment != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// topicMetrics returns the counters of the topic of an event, or nil for
+// events that are not published on the bus
+func (vm *VM) topicMetrics(event string) *TopicMetrics {
+	topic, ok := strings.CutPrefix(event, TopicEventPrefix)
+	if !ok {
+		return nil
+	}
+	if vm.topics == nil {
+		vm.topics = make(map[string]*TopicMetrics)
+	}
+	metrics, ok := vm.topics[topic]
+	if !ok {
+		metrics = &TopicMetrics{}
+		vm.topics[topic] = metrics
+	}
+	return metrics
+}
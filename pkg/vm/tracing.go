@@ -0,0 +1,64 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+)
+
+// WithTracer records a span for every handler an agent runs, with child
+// spans for the exec, syscall, llm, embedding and mcp calls it makes. The
+// handlers of events posted by a handler are part of its trace, as are
+// those of events emitted with EmitContext from a context carrying a span
+// context.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(vm *VM) {
+		vm.tracer = tracer
+	}
+}
+
+// startHandlerSpan starts the span of an agent's handler for an event
+func (vm *VM) startHandlerSpan(agent *Agent, event Event) *tracing.Span {
+	if vm.tracer == nil {
+		return nil
+	}
+	span := vm.tracer.Start(agent.Name+" "+event.Name, tracing.KindConsumer, event.trace)
+	span.SetAttribute("mindscript.agent", agent.Name)
+	span.SetAttribute("mindscript.declaration", agent.Declaration)
+	span.SetAttribute("mindscript.event", event.Name)
+	return span
+}
+
+// startSpan starts the span of a call made by the running handler
+func (vm *VM) startSpan(name string) *tracing.Span {
+	if vm.tracer == nil {
+		return nil
+	}
+	span := vm.tracer.Start(name, tracing.KindClient, vm.span.SpanContext())
+	if vm.self != nil {
+		span.SetAttribute("mindscript.agent", vm.self.Name)
+	}
+	return span
+}
+
+// traceContext returns ctx carrying span, so that calls made with it
+// propagate the trace
+func traceContext(ctx context.Context, span *tracing.Span) context.Context {
+	return tracing.ContextWithSpanContext(ctx, span.SpanContext())
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// urlParse runs OpURLParse: the URL on the stack is replaced by a map of
+// its scheme, user, host, hostname, port, path, query, rawQuery and
+// fragment. query maps each parameter to its first value, queryParam reads
+// the others.
+func (vm *VM) urlParse() {
+	text, ok := vm.popText("urlParse", "url")
+	if !ok {
+		return
+	}
+	u, err := url.Parse(text)
+	if err != nil {
+		vm.fail(fmt.Errorf("urlParse: %w", err))
+		return
+	}
+	query := NewMap()
+	params := u.Query()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		query.Set(name, params.Get(name))
+	}
+
+	result := NewMap()
+	result.Set("scheme", u.Scheme)
+	result.Set("user", u.User.Username())
+	result.Set("host", u.Host)
+	result.Set("hostname", u.Hostname())
+	result.Set("port", u.Port())
+	result.Set("path", u.Path)
+	result.Set("query", query)
+	result.Set("rawQuery", u.RawQuery)
+	result.Set("fragment", u.Fragment)
+	vm.adopt(result)
+	vm.stack = append(vm.stack, result)
+}
+
+// urlEncode runs OpURLEncode: the value on the stack is replaced by its
+// URL encoding. Strings are escaped for use in a query, maps are encoded as
+// a query string with their keys sorted.
+func (vm *VM) urlEncode() {
+	value := vm.popStack()
+	switch v := value.(type) {
+	case string:
+		vm.stack = append(vm.stack, url.QueryEscape(v))
+	case *Map:
+		params := url.Values{}
+		for _, key := range v.Keys() {
+			item, _ := v.Get(key)
+			params.Set(toString(key), toString(item))
+		}
+		vm.stack = append(vm.stack, params.Encode())
+	default:
+		vm.fail(fmt.Errorf("urlEncode expects a string or a map, got %s", typeName(value)))
+	}
+}
+
+// queryParam runs OpQueryParam: the URL and the parameter name on the stack
+// are replaced by the parameter's first value, or nil when the URL has no
+// such parameter
+func (vm *VM) queryParam() {
+	name, ok := vm.popText("queryParam", "name")
+	if !ok {
+		return
+	}
+	text, ok := vm.popText("queryParam", "url")
+	if !ok {
+		return
+	}
+	u, err := url.Parse(text)
+	if err != nil {
+		vm.fail(fmt.Errorf("queryParam: %w", err))
+		return
+	}
+	params := u.Query()
+	if !params.Has(name) {
+		vm.stack = append(vm.stack, nil)
+		return
+	}
+	vm.stack = append(vm.stack, params.Get(name))
+}
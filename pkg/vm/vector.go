@@ -0,0 +1,263 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/llm"
+)
+
+// ErrNoEmbedder is returned when a program embeds text but the VM was
+// created without an embedder
+var ErrNoEmbedder = errors.New("no embedder configured")
+
+// Document is a text stored in a vector store along with its embedding
+type Document struct {
+	ID     string
+	Text   string
+	Vector []float64
+}
+
+// Match is a document found by a similarity search, Score is its cosine
+// similarity to the query
+type Match struct {
+	Document
+	Score float64
+}
+
+// VectorStore holds the documents agents index with the index builtin and
+// finds them again with search. Adapters for external databases implement
+// it, MemoryVectorStore is used when none is configured. All agents of a VM
+// share its store.
+type VectorStore interface {
+	// Upsert adds documents, replacing those with the same ID
+	Upsert(ctx context.Context, docs ...Document) error
+	// Query returns up to k documents most similar to vector, best first
+	Query(ctx context.Context, vector []float64, k int) ([]Match, error)
+}
+
+// WithEmbedder sets the embedder of the embed, index and search builtins
+func WithEmbedder(embedder llm.Embedder) Option {
+	return func(vm *VM) {
+		vm.embedder = embedder
+	}
+}
+
+// WithVectorStore sets the store of the index and search builtins
+func WithVectorStore(store VectorStore) Option {
+	return func(vm *VM) {
+		vm.vectors = store
+	}
+}
+
+// MemoryVectorStore is a VectorStore searching the documents it keeps in
+// memory exhaustively, which is fine for up to some thousands of documents
+type MemoryVectorStore struct {
+	mu   sync.RWMutex
+	ids  map[string]int
+	docs []Document
+}
+
+// NewMemoryVectorStore returns an empty store
+func NewMemoryVectorStore() *MemoryVectorStore {
+	return &MemoryVectorStore{ids: make(map[string]int)}
+}
+
+// Upsert adds the documents. Their vectors must have as many dimensions as
+// those already stored.
+func (s *MemoryVectorStore) Upsert(ctx context.Context, docs ...Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, doc := range docs {
+		if len(s.docs) > 0 && len(doc.Vector) != len(s.docs[0].Vector) {
+			return fmt.Errorf("document %s has %d dimensions, the store holds %d", doc.ID, len(doc.Vector), len(s.docs[0].Vector))
+		}
+		if i, ok := s.ids[doc.ID]; ok {
+			s.docs[i] = doc
+			continue
+		}
+		s.ids[doc.ID] = len(s.docs)
+		s.docs = append(s.docs, doc)
+	}
+	return nil
+}
+
+// Query ranks every document by its cosine similarity to vector
+func (s *MemoryVectorStore) Query(ctx context.Context, vector []float64, k int) ([]Match, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.docs) > 0 && len(vector) != len(s.docs[0].Vector) {
+		return nil, fmt.Errorf("query has %d dimensions, the store holds %d", len(vector), len(s.docs[0].Vector))
+	}
+	matches := make([]Match, len(s.docs))
+	for i, doc := range s.docs {
+		matches[i] = Match{Document: doc, Score: cosineSimilarity(vector, doc.Vector)}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if k < len(matches) {
+		matches = matches[:k]
+	}
+	return matches, nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// embedText embeds texts for a builtin. Agents need LLMCapability since the
+// texts are sent to the model's provider.
+func (vm *VM) embedText(builtin string, texts ...string) ([][]float64, bool) {
+	if !vm.requireCapability(LLMCapability, "call "+builtin) {
+		return nil, false
+	}
+	if vm.embedder == nil {
+		vm.fail(ErrNoEmbedder)
+		return nil, false
+	}
+	if !vm.checkTokens() {
+		return nil, false
+	}
+	span := vm.startSpan(builtin)
+	defer span.Finish()
+	ctx, cancel := vm.llmContext()
+	defer cancel()
+	start := time.Now()
+	resp, err := vm.embedder.Embed(traceContext(ctx, span), llm.EmbeddingRequest{Texts: texts})
+	metrics := &vm.metrics.LLM
+	metrics.Embeddings++
+	metrics.Latency += time.Since(start)
+	if err == nil && len(resp.Vectors) != len(texts) {
+		err = fmt.Errorf("embedder returned %d vectors for %d texts", len(resp.Vectors), len(texts))
+	}
+	if err != nil {
+		metrics.Failures++
+		span.SetError(err)
+		vm.fail(vm.llmError(builtin, err))
+		return nil, false
+	}
+	metrics.PromptTokens += resp.Usage.PromptTokens
+	vm.chargeTokens(resp.Usage.PromptTokens)
+	span.SetAttribute("gen_ai.usage.input_tokens", resp.Usage.PromptTokens)
+	return resp.Vectors, true
+}
+
+// popText pops a string argument of a builtin
+func (vm *VM) popText(builtin, argument string) (string, bool) {
+	value := vm.popStack()
+	text, ok := value.(string)
+	if !ok {
+		vm.fail(fmt.Errorf("%s %s must be a string, got %T", builtin, argument, value))
+	}
+	return text, ok
+}
+
+// embed runs OpEmbed: the text on the stack is replaced by its embedding,
+// a list of floats
+func (vm *VM) embed() {
+	text, ok := vm.popText("embed", "text")
+	if !ok {
+		return
+	}
+	vectors, ok := vm.embedText("embed", text)
+	if !ok {
+		return
+	}
+	l := NewList()
+	for _, x := range vectors[0] {
+		l.Append(x)
+	}
+	vm.alloc(l)
+	vm.stack = append(vm.stack, l)
+}
+
+// index runs OpIndex: the id and the text on the stack are embedded and
+// stored in the vector store
+func (vm *VM) index() {
+	text, ok := vm.popText("index", "text")
+	if !ok {
+		return
+	}
+	id, ok := vm.popText("index", "id")
+	if !ok {
+		return
+	}
+	vectors, ok := vm.embedText("index", text)
+	if !ok {
+		return
+	}
+	ctx, cancel := vm.llmContext()
+	defer cancel()
+	if err := vm.vectors.Upsert(ctx, Document{ID: id, Text: text, Vector: vectors[0]}); err != nil {
+		vm.fail(fmt.Errorf("index: %w", err))
+	}
+}
+
+// search runs OpSearch: the query and the number of results on the stack
+// are replaced by a list of the most similar documents, maps holding their
+// "id", "text" and "score"
+func (vm *VM) search() {
+	value := vm.popStack()
+	k, ok := value.(int)
+	if !ok || k < 0 {
+		vm.fail(fmt.Errorf("search limit must be a non-negative int, got %v", value))
+		return
+	}
+	query, ok := vm.popText("search", "query")
+	if !ok {
+		return
+	}
+	vectors, ok := vm.embedText("search", query)
+	if !ok {
+		return
+	}
+	ctx, cancel := vm.llmContext()
+	defer cancel()
+	matches, err := vm.vectors.Query(ctx, vectors[0], k)
+	if err != nil {
+		vm.fail(fmt.Errorf("search: %w", err))
+		return
+	}
+	results := NewList()
+	for _, match := range matches {
+		m := NewMap()
+		m.Set("id", match.ID)
+		m.Set("text", match.Text)
+		m.Set("score", match.Score)
+		vm.alloc(m)
+		results.Append(m)
+	}
+	vm.alloc(results)
+	vm.stack = append(vm.stack, results)
+}
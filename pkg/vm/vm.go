@@ -17,11 +17,20 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
-	"strings"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
+	"github.com/robert-cronin/mindscript-go/pkg/llm"
 	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
 	"go.uber.org/zap"
 )
 
@@ -37,6 +46,8 @@ const (
 	// Stack operations
 	OpPush
 	OpPop
+	OpTrue
+	OpFalse
 
 	// I/O operations
 	OpPrint
@@ -46,9 +57,12 @@ const (
 	OpJump
 	OpJumpIfFalse
 
-	// Variable operations
+	// Variable operations. Locals are relative to the current call frame,
+	// globals live in a table shared by the whole program.
 	OpSetLocal
 	OpGetLocal
+	OpSetGlobal
+	OpGetGlobal
 
 	// Function operations
 	OpCall
@@ -64,6 +78,24 @@ const (
 	OpCreateFunction
 	OpAddFunctionArgument
 	OpAddAgentFunction
+	OpSetAgentSupervision
+
+	// Agent messaging
+	OpSend
+	OpReceive
+	OpEmit
+	OpAsk
+	OpReply
+
+	// Agent instances
+	OpSpawn
+	OpSelf
+
+	// Agent state. OpDefineState takes the agent's global slot, the others
+	// the constant holding the state variable's name.
+	OpDefineState
+	OpGetState
+	OpSetState
 
 	// Comparison operations
 	OpEqual
@@ -80,18 +112,84 @@ const (
 
 	// Type-specific operations
 	OpConcatString
-	OpPushString
+	OpConstant
+	OpStringLength
+	OpGetStringItem
 
 	// Built-in function calls
 	OpSyscall
 	OpExec
 	OpLog
+	OpLLM
+	OpPrompt
+	OpEnv
+	OpArgs
+	OpRandom
+	OpRandomInt
+	OpChoice
+	OpUUID
+	OpToInt
+	OpToFloat
+	OpToString
+	OpToBool
+	OpTypeOf
+	OpFormat
+	OpURLParse
+	OpURLEncode
+	OpQueryParam
+	OpYAMLParse
+	OpTOMLParse
+	OpMapList
+	OpFilter
+	OpReduce
+	OpSort
+	OpAssert
+
+	// Agent memory operations
+	OpRemember
+	OpRecall
+	OpForget
+	OpObserve
+	OpRecent
+
+	// Session operations
+	OpSession
+	OpSessionRemember
+	OpSessionRecall
+	OpSessionHistory
+
+	// Similarity search operations
+	OpEmbed
+	OpIndex
+	OpSearch
+
+	// Tool operations
+	OpMCP
+	OpSQLQuery
 
 	// Data structure operations
 	OpCreateList
 	OpAppendList
 	OpGetListItem
 	OpSetListItem
+	OpCreateMap
+	OpSetMapItem
+	OpGetMapItem
+	// OpGetItem indexes a map, list or string, whichever is on the stack
+	OpGetItem
+
+	// Fused instructions, each replacing a common pair of instructions
+	OpGetLocalAdd
+	OpPushAdd
+	OpSetLocalGetLocal
+	OpJumpIfEqual
+	OpJumpIfNotEqual
+
+	// Native builtins registered with RegisterBuiltin
+	OpCallBuiltin
+
+	// opcodeCount must stay last, it is used to validate loaded bytecode
+	opcodeCount
 )
 
 type Instruction struct {
@@ -99,162 +197,1025 @@ type Instruction struct {
 	Operand int
 }
 
+// Frame is an entry on the call stack
+type Frame struct {
+	// ReturnAddress is where execution continues once the call returns
+	ReturnAddress int
+	// Function is the index of the called function in the function table
+	Function int
+	// Base is where the frame's local variables start in the locals stack
+	Base int
+}
+
+const (
+	// DefaultMaxStackDepth is the default limit on values held on the stack
+	DefaultMaxStackDepth = 1 << 16
+	// DefaultMaxCallDepth is the default limit on nested function calls
+	DefaultMaxCallDepth = 1024
+)
+
 type VM struct {
-	stack           []interface{}
-	locals          []interface{}
-	pc              int
-	instructions    []Instruction
-	running         bool
-	callStack       []int
-	stringConstants []string
+	stack []interface{}
+	// locals holds the local variables of every active frame, the current
+	// frame's start at localBase
+	locals       []interface{}
+	localBase    int
+	globals      []interface{}
+	pc           int
+	instructions []Instruction
+	constants    []Value
+	functions    []Function
+	running      bool
+	callStack    []Frame
+	err          error
+	policy       Policy
+	stdout       io.Writer
+	stderr       io.Writer
+
+	// Execution limits, zero means unlimited
+	maxInstructions int
+	timeout         time.Duration
+	maxStackDepth   int
+	maxCallDepth    int
+	maxMemory       int
+	// quota is the quota of agents without one in agentQuotas, keyed by
+	// declaration. handlerLimit is the value of executed at which the
+	// running handler exceeds its instruction quota, zero when unlimited.
+	quota        Quota
+	agentQuotas  map[string]Quota
+	handlerLimit int
+	// activitySize is how many entries each agent's activity log keeps and
+	// activitySeq numbers them
+	activitySize int
+	activitySeq  int
+
+	executed     int
+	deadline     time.Time
+	started      bool
+	metrics      Metrics
+	topics       map[string]*TopicMetrics
+	agentMetrics map[string]*AgentMetrics
+
+	breakpoints map[int]bool
+	traceFunc   TraceFunc
+	profiler    *profiler
+	pause       *pauseState
+	host        *hostQueue
+	scheduler   *scheduler
+
+	heap    *heap
+	strings *internTable
+	// constantBytes is the estimated size of the constant pool
+	constantBytes int
+
+	// agents holds the agents created so far by name, hosts may look them
+	// up while the VM runs
+	agents    map[string]*Agent
+	agentList []*Agent
+	// instances counts the agents created from each declaration
+	instances       map[string]int
+	agentsMu        sync.RWMutex
+	mailboxCapacity int
+	backpressure    Backpressure
+	// events holds the events waiting to be dispatched
+	events []Event
+	// dispatching is set while Run is responsible for dispatching events
+	dispatching bool
+	// self is the agent whose event handler is running and event the event
+	// it handles
+	self  *Agent
+	event Event
+	// calls counts the functions run by invoke or resume that are active
+	// and handlerCall is the count at which the running handler was
+	// entered, ask can only suspend the handler itself
+	calls       int
+	handlerCall int
+	// suspended is set by ask to the request the running handler waits on,
+	// asks holds the requests whose askers have not been resumed
+	suspended  *request
+	asks       map[*request]bool
+	askTimeout time.Duration
+	// stateStore persists agents' state variables, it is nil when state is
+	// only kept in memory
+	stateStore StateStore
+	// llm is the provider of the llm builtin
+	llm        llm.Provider
+	llmTimeout time.Duration
+	// templates caches the parsed prompt templates
+	templates map[string]*template.Template
+	// shortTermMemory is the size of agents' conversation buffers and of
+	// sessions' histories
+	shortTermMemory int
+	// args are the program's arguments
+	args []string
+	// rand is the source of the random builtins, seeded with seed when
+	// seeded is set
+	rand   *rand.Rand
+	seed   uint64
+	seeded bool
+	// sessions holds the open sessions by ID
+	sessions       map[string]*Session
+	sessionTimeout time.Duration
+	// embedder embeds texts for the vector store
+	embedder llm.Embedder
+	vectors  VectorStore
+	// remote delivers events to agents of other processes
+	remote Remote
+	// mcpServers are the servers whose tools mcp calls
+	mcpServers map[string]MCPClient
+	mcpTimeout time.Duration
+	// sqlDatabases are the connections sqlQuery reaches by name
+	sqlDatabases map[string]SQLDatabase
+	sqlTimeout   time.Duration
+	// tracer records spans of the agents' work, span is the span of the
+	// running handler
+	tracer *tracing.Tracer
+	span   *tracing.Span
+
+	backend Backend
+	// registers holds the frames of the register backend
+	registers []Value
+}
+
+// Option configures optional behaviour of a VM
+type Option func(*VM)
+
+// WithMaxInstructions stops execution with ErrInstructionBudgetExceeded once
+// more than n instructions have been executed
+func WithMaxInstructions(n int) Option {
+	return func(vm *VM) {
+		vm.maxInstructions = n
+	}
+}
+
+// WithTimeout stops execution with ErrTimeout once Run has been executing
+// for longer than d
+func WithTimeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.timeout = d
+	}
+}
+
+// WithMaxStackDepth limits the number of values on the stack, exceeding it
+// fails with ErrStackOverflow. Zero removes the limit.
+func WithMaxStackDepth(n int) Option {
+	return func(vm *VM) {
+		vm.maxStackDepth = n
+	}
 }
 
-func New(instructions []Instruction) *VM {
-	return &VM{
+// WithMaxCallDepth limits the number of nested function calls, exceeding it
+// fails with ErrStackOverflow. Zero removes the limit.
+func WithMaxCallDepth(n int) Option {
+	return func(vm *VM) {
+		vm.maxCallDepth = n
+	}
+}
+
+// TraceFunc is called before each instruction executes with its address,
+// the instruction and the current depth of the value stack
+type TraceFunc func(pc int, instr Instruction, stackDepth int)
+
+// WithTraceFunc installs a hook that is invoked on every executed instruction,
+// letting tools record execution traces
+func WithTraceFunc(fn TraceFunc) Option {
+	return func(vm *VM) {
+		vm.traceFunc = fn
+	}
+}
+
+// WithStdout sets where program output such as print and syscall output is
+// written, os.Stdout by default
+func WithStdout(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.stdout = w
+	}
+}
+
+// WithStderr sets where the error output of external commands is written,
+// os.Stderr by default
+func WithStderr(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.stderr = w
+	}
+}
+
+func New(program *Program, opts ...Option) *VM {
+	vm := &VM{
 		stack:           make([]interface{}, 0),
-		locals:          make([]interface{}, 256),
-		instructions:    instructions,
+		locals:          make([]interface{}, 0),
+		globals:         make([]interface{}, 0),
+		instructions:    program.Instructions,
+		constants:       program.Constants,
+		functions:       program.Functions,
 		running:         true,
-		callStack:       make([]int, 0),
-		stringConstants: make([]string, 0),
+		callStack:       make([]Frame, 0),
+		maxStackDepth:   DefaultMaxStackDepth,
+		maxCallDepth:    DefaultMaxCallDepth,
+		policy:          PermissivePolicy(),
+		stdout:          os.Stdout,
+		stderr:          os.Stderr,
+		heap:            newHeap(DefaultGCThreshold),
+		strings:         newInternTable(),
+		pause:           newPauseState(),
+		host:            newHostQueue(),
+		scheduler:       newScheduler(),
+		agents:          make(map[string]*Agent),
+		instances:       make(map[string]int),
+		mailboxCapacity: DefaultMailboxCapacity,
+		llmTimeout:      DefaultLLMTimeout,
+		shortTermMemory: DefaultShortTermMemory,
+		sessionTimeout:  DefaultSessionTimeout,
+		mcpTimeout:      DefaultMCPTimeout,
+		sqlTimeout:      DefaultSQLTimeout,
+		askTimeout:      DefaultAskTimeout,
+	}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	if vm.vectors == nil {
+		vm.vectors = NewMemoryVectorStore()
 	}
+	vm.seedRandom()
+	vm.constants = vm.strings.internConstants(vm.constants)
+	vm.constantBytes = sizeOfConstants(vm.constants)
+	return vm
 }
 
-// Run starts the VM and executes the bytecode instructions
-func (vm *VM) Run() {
+// Reset prepares the VM to run another program, keeping the options it was
+// created with and the memory it has already allocated. The stacks,
+// variables, heap and error of the previous run are cleared, as are
+// breakpoints and collected profiles since they refer to the old program.
+// Scheduled timers are cancelled. Pooling VMs with Reset avoids the
+// allocations of New for every run.
+func (vm *VM) Reset(program *Program) {
+	vm.scheduler.cancel("")
+	vm.scheduler.wg.Wait()
+
+	clear(vm.stack)
+	clear(vm.locals)
+	clear(vm.globals)
+	clear(vm.registers)
+	vm.stack = vm.stack[:0]
+	vm.locals = vm.locals[:0]
+	vm.globals = vm.globals[:0]
+	vm.callStack = vm.callStack[:0]
+	vm.localBase = 0
+
+	vm.instructions = program.Instructions
+	vm.functions = program.Functions
+	vm.strings.reset()
+	vm.constants = vm.strings.internConstants(program.Constants)
+	vm.constantBytes = sizeOfConstants(vm.constants)
+
+	vm.pc = 0
+	vm.running = true
+	vm.err = nil
+	vm.executed = 0
+	vm.metrics = Metrics{}
+	clear(vm.topics)
+	clear(vm.agentMetrics)
+	clear(vm.sessions)
+	if vm.seeded {
+		vm.seedRandom()
+	}
+	vm.started = false
+	vm.breakpoints = nil
+	vm.heap.reset()
+	vm.agentsMu.Lock()
+	clear(vm.agents)
+	clear(vm.instances)
+	clear(vm.agentList)
+	vm.agentList = vm.agentList[:0]
+	vm.agentsMu.Unlock()
+	clear(vm.events)
+	vm.events = vm.events[:0]
+	clear(vm.asks)
+	vm.suspended = nil
+	vm.self = nil
+	vm.event = Event{}
+	vm.templates = nil
+	if vm.profiler != nil {
+		WithProfiling()(vm)
+	}
+}
+
+// Extend runs code added to the VM's program, as the REPL does with every
+// input. program must begin with the instructions, constants and functions
+// the VM already has, the code from entry on is run like Run runs a program.
+// Globals, agents and the heap are kept while the stack and the error of the
+// previous run are cleared. Execution limits apply to each call separately.
+func (vm *VM) Extend(program *Program, entry int) error {
+	if err := vm.extendProgram(program, entry); err != nil {
+		return err
+	}
+
+	clear(vm.stack)
+	vm.stack = vm.stack[:0]
+	vm.callStack = vm.callStack[:0]
+	vm.localBase = 0
+
+	vm.pc = entry
+	vm.running = true
+	vm.err = nil
+	vm.metrics.Instructions += vm.executed
+	vm.executed = 0
+	vm.started = false
+	vm.suspended = nil
+	vm.self = nil
+	vm.event = Event{}
+	return vm.Run()
+}
+
+// extendProgram replaces the VM's program with program, which begins with
+// it, and checks that entry is in the added code
+func (vm *VM) extendProgram(program *Program, entry int) error {
+	if err := program.Validate(); err != nil {
+		return err
+	}
+	if len(program.Instructions) < len(vm.instructions) || len(program.Constants) < len(vm.constants) || len(program.Functions) < len(vm.functions) {
+		return fmt.Errorf("extended program is shorter than the running one")
+	}
+	if entry < len(vm.instructions) || entry > len(program.Instructions) {
+		return fmt.Errorf("entry %d is not in the added code", entry)
+	}
+	vm.instructions = program.Instructions
+	vm.functions = program.Functions
+	vm.constants = vm.strings.internConstants(program.Constants)
+	vm.constantBytes = sizeOfConstants(vm.constants)
+	return nil
+}
+
+// timeoutCheckInterval is how many instructions run between deadline checks,
+// reading the clock on every step would dominate execution time
+const timeoutCheckInterval = 1024
+
+// Run starts the VM and executes the bytecode instructions, then dispatches
+// the events posted while doing so to the agents' handlers until none are
+// left. It returns a *RuntimeError if execution fails or exceeds one of the
+// configured limits.
+func (vm *VM) Run() error {
+	vm.acquire()
+	defer vm.release()
 	logger.Log.Info("Starting VM execution")
-	for vm.running {
-		vm.step()
+	vm.start()
+	vm.dispatching = true
+	if !vm.useRegisters() || !vm.runRegisters() {
+		for vm.running {
+			vm.execute()
+		}
+	}
+	vm.dispatchEvents()
+	vm.dispatching = false
+	if vm.err != nil {
+		return vm.err
 	}
 	logger.Log.Info("VM execution completed")
+	return nil
+}
+
+// start prepares execution limits the first time the VM is driven
+func (vm *VM) start() {
+	if vm.started {
+		return
+	}
+	vm.started = true
+	if vm.timeout > 0 {
+		vm.deadline = time.Now().Add(vm.timeout)
+	}
+}
+
+// execute runs a single instruction, enforcing the configured limits
+func (vm *VM) execute() {
+	vm.safePoint()
+	if err := vm.checkLimits(); err != nil {
+		vm.fail(err)
+		return
+	}
+	sample, profiling := vm.beginProfile()
+	vm.step()
+	if profiling {
+		vm.recordProfile(sample)
+	}
+	vm.executed++
+	vm.recordStackDepth(len(vm.stack))
+	if vm.maxStackDepth > 0 && len(vm.stack) > vm.maxStackDepth {
+		vm.fail(fmt.Errorf("%w: more than %d values on the stack", ErrStackOverflow, vm.maxStackDepth))
+	}
+}
+
+// checkLimits returns an error when the instruction budget, the timeout,
+// the memory limit or the running agent's quota has been exceeded
+func (vm *VM) checkLimits() error {
+	if vm.maxInstructions > 0 && vm.executed >= vm.maxInstructions {
+		return fmt.Errorf("%w: executed %d instructions", ErrInstructionBudgetExceeded, vm.executed)
+	}
+	if vm.handlerLimit > 0 && vm.executed >= vm.handlerLimit {
+		return &QuotaError{Quota: "instructions", Limit: vm.self.quota.InstructionsPerEvent}
+	}
+	if vm.timeout > 0 && vm.executed%timeoutCheckInterval == 0 && time.Now().After(vm.deadline) {
+		return fmt.Errorf("%w after %s", ErrTimeout, vm.timeout)
+	}
+	if vm.maxMemory > 0 && vm.executed%memoryCheckInterval == 0 {
+		if err := vm.checkMemory(); err != nil {
+			return err
+		}
+	}
+	if vm.self != nil && vm.self.quota.Memory > 0 && vm.executed%memoryCheckInterval == 0 {
+		return vm.checkAgentMemory(vm.self)
+	}
+	return nil
+}
+
+// fail stops execution with a runtime error at the current instruction
+func (vm *VM) fail(err error) {
+	if vm.err != nil {
+		return
+	}
+	vm.err = &RuntimeError{PC: vm.pc, Err: err, CallChain: vm.callChain()}
+	vm.running = false
+	logger.Log.Debugw("Runtime error", zap.Error(vm.err))
 }
 
 func (vm *VM) step() {
 	if vm.pc >= len(vm.instructions) {
 		vm.running = false
-		logger.Log.Info("Reached end of instructions", zap.Int("pc", vm.pc))
+		logger.Log.Infow("Reached end of instructions", zap.Int("pc", vm.pc))
 		return
 	}
 
 	instr := vm.instructions[vm.pc]
-	logger.Log.Debug("Executing instruction", zap.Int("pc", vm.pc), zap.Any("instruction", instr))
+	if vm.traceFunc != nil {
+		vm.traceFunc(vm.pc, instr, len(vm.stack))
+	}
+	if vm.dispatch(instr) {
+		vm.pc++
+	}
+}
 
+// dispatch executes a single instruction and reports whether execution
+// continues with the next one. Jumps, calls and failures set the pc
+// themselves and return false.
+func (vm *VM) dispatch(instr Instruction) bool {
+	if vm.activitySize > 0 && vm.self != nil {
+		vm.recordBuiltin(instr)
+	}
 	switch instr.Opcode {
 	case OpAdd, OpSub, OpMul, OpDiv:
 		vm.executeBinaryOp(instr.Opcode)
 	case OpPush:
 		vm.stack = append(vm.stack, instr.Operand)
-		logger.Log.Debug("Pushed value to stack", zap.Any("value", instr.Operand))
 	case OpPop:
+		vm.popStack()
+	case OpTrue:
+		vm.stack = append(vm.stack, true)
+	case OpFalse:
+		vm.stack = append(vm.stack, false)
+	case OpAnd:
+		right := vm.popStack()
+		left := vm.popStack()
+		vm.stack = append(vm.stack, isTruthy(left) && isTruthy(right))
+	case OpOr:
+		right := vm.popStack()
+		left := vm.popStack()
+		vm.stack = append(vm.stack, isTruthy(left) || isTruthy(right))
+	case OpNot:
 		value := vm.popStack()
-		logger.Log.Debug("Popped value from stack", zap.Any("value", value))
+		vm.stack = append(vm.stack, !isTruthy(value))
+	case OpGreaterThan, OpLessThan, OpGreaterThanOrEqual, OpLessThanOrEqual:
+		right := vm.popStack()
+		left := vm.popStack()
+		result, ok := compareValues(instr.Opcode, left, right)
+		if !ok {
+			vm.fail(fmt.Errorf("cannot compare %T with %T", left, right))
+			return false
+		}
+		vm.stack = append(vm.stack, result)
+	case OpJump:
+		vm.pc = instr.Operand
+		return false
+	case OpJumpIfFalse:
+		condition := vm.popStack()
+		if !isTruthy(condition) {
+			vm.pc = instr.Operand
+			return false
+		}
 	case OpPrint:
-		value := vm.popStack()
-		fmt.Println(value)
-		logger.Log.Debug("Printed value", zap.Any("value", value))
+		vm.print(instr.Operand)
 	case OpSetLocal:
 		value := vm.popStack()
-		vm.locals[instr.Operand] = value
-		logger.Log.Debug("Set local variable", zap.Int("index", instr.Operand), zap.Any("value", value))
+		slot, ok := vm.localSlot(instr.Operand)
+		if !ok {
+			return false
+		}
+		vm.locals[slot] = value
 	case OpGetLocal:
-		value := vm.locals[instr.Operand]
+		slot, ok := vm.localSlot(instr.Operand)
+		if !ok {
+			return false
+		}
+		vm.stack = append(vm.stack, vm.locals[slot])
+	case OpSetGlobal:
+		value := vm.popStack()
+		if !vm.setGlobal(instr.Operand, value) {
+			return false
+		}
+	case OpGetGlobal:
+		value, ok := vm.getGlobal(instr.Operand)
+		if !ok {
+			return false
+		}
 		vm.stack = append(vm.stack, value)
-		logger.Log.Debug("Got local variable", zap.Int("index", instr.Operand), zap.Any("value", value))
 	case OpCall:
-		vm.callStack = append(vm.callStack, vm.pc+1)
-		vm.pc = instr.Operand
-		logger.Log.Debug("Function call", zap.Int("returnAddress", vm.pc+1), zap.Int("functionAddress", instr.Operand))
-		return
+		if instr.Operand < 0 || instr.Operand >= len(vm.functions) {
+			vm.fail(fmt.Errorf("function index %d out of range for %d functions", instr.Operand, len(vm.functions)))
+			return false
+		}
+		if vm.pushFrame(vm.pc+1, instr.Operand) {
+			vm.pc = vm.functions[instr.Operand].Address
+		}
+		return false
 	case OpReturn:
 		if len(vm.callStack) == 0 {
 			vm.running = false
 			logger.Log.Info("Return from main function, halting VM")
-			return
+			return false
 		}
-		vm.pc = vm.callStack[len(vm.callStack)-1]
-		vm.callStack = vm.callStack[:len(vm.callStack)-1]
-		logger.Log.Debug("Function return", zap.Int("returnAddress", vm.pc))
-		return
+		vm.pc = vm.popFrame()
+		return false
 	case OpHalt:
 		vm.running = false
 		logger.Log.Info("Halt instruction encountered, stopping VM")
 	case OpCreateAgent:
-		logger.Log.Debug("Creating agent", zap.Int("agentIndex", instr.Operand))
-		// TODO: Implement actual agent creation logic
+		logger.Log.Debugw("Creating agent", zap.Int("agentIndex", instr.Operand))
+		vm.createAgent(instr.Operand)
 	case OpSetAgentGoal:
 		goal := vm.popStack()
-		logger.Log.Debug("Setting agent goal", zap.Int("agentIndex", instr.Operand), zap.Any("goal", goal))
-		// TODO: Implement actual agent goal setting logic
+		logger.Log.Debugw("Setting agent goal", zap.Int("agentIndex", instr.Operand), zap.Any("goal", goal))
+		agent, ok := vm.globalAgent(instr.Operand)
+		if !ok {
+			return false
+		}
+		agent.Goal = fmt.Sprint(goal)
 	case OpAddAgentCapability:
 		capability := vm.popStack()
-		logger.Log.Debug("Adding agent capability", zap.Int("agentIndex", instr.Operand), zap.Any("capability", capability))
-		// TODO: Implement actual agent capability adding logic
+		logger.Log.Debugw("Adding agent capability", zap.Int("agentIndex", instr.Operand), zap.Any("capability", capability))
+		agent, ok := vm.globalAgent(instr.Operand)
+		if !ok {
+			return false
+		}
+		agent.Capabilities = append(agent.Capabilities, fmt.Sprint(capability))
 	case OpCreateEventHandler:
-		logger.Log.Debug("Creating event handler", zap.Int("handlerIndex", instr.Operand))
-		// TODO: Implement actual event handler creation logic
+		logger.Log.Debugw("Creating event handler", zap.Int("functionIndex", instr.Operand))
+		vm.createEventHandler(instr.Operand)
 	case OpSetEventHandlerEvent:
-		event := vm.popStack()
-		logger.Log.Debug("Setting event handler event", zap.Int("handlerIndex", instr.Operand), zap.Any("event", event))
-		// TODO: Implement actual event handler event setting logic
+		vm.setEventHandlerEvent()
 	case OpAddAgentEventHandler:
-		handlerIndex := vm.popStack()
-		logger.Log.Debug("Adding event handler to agent", zap.Int("agentIndex", instr.Operand), zap.Any("handlerIndex", handlerIndex))
-		// TODO: Implement actual logic to add event handler to agent
+		logger.Log.Debugw("Adding event handler to agent", zap.Int("agentIndex", instr.Operand))
+		vm.addAgentEventHandler(instr.Operand)
 	case OpCreateFunction:
-		logger.Log.Debug("Creating function", zap.Int("functionIndex", instr.Operand))
+		logger.Log.Debugw("Creating function", zap.Int("functionIndex", instr.Operand))
 		// TODO: Implement actual function creation logic
 	case OpAddFunctionArgument:
 		argName := vm.popStack()
-		logger.Log.Debug("Adding function argument", zap.Int("functionIndex", instr.Operand), zap.Any("argumentName", argName))
+		logger.Log.Debugw("Adding function argument", zap.Int("functionIndex", instr.Operand), zap.Any("argumentName", argName))
 		// TODO: Implement actual function argument adding logic
 	case OpAddAgentFunction:
-		functionIndex := vm.popStack()
-		logger.Log.Debug("Adding function to agent", zap.Int("agentIndex", instr.Operand), zap.Any("functionIndex", functionIndex))
-		// TODO: Implement actual logic to add function to agent
-	case OpSyscall:
-		command := vm.popStack().(string)
-		args := vm.popStack().(string)
-		logger.Log.Debug("Executing syscall", zap.String("command", command), zap.String("args", args))
-		cmd := exec.Command(command, strings.Split(args, " ")...)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			logger.Log.Error("Syscall failed", zap.Error(err))
-		} else {
-			logger.Log.Debug("Syscall output", zap.String("output", string(output)))
+		logger.Log.Debugw("Adding function to agent", zap.Int("agentIndex", instr.Operand))
+		vm.addAgentFunction(instr.Operand)
+	case OpSetAgentSupervision:
+		vm.setAgentSupervision(instr.Operand)
+	case OpSend:
+		vm.sendMessage()
+	case OpReceive:
+		vm.receiveMessage(instr.Operand)
+	case OpEmit:
+		vm.emit(instr.Operand)
+	case OpAsk:
+		vm.ask(instr.Operand)
+	case OpReply:
+		vm.replyTo()
+	case OpSpawn:
+		vm.spawn()
+	case OpSelf:
+		if vm.self == nil {
+			vm.fail(fmt.Errorf("self used outside of an agent's event handler"))
+			return false
 		}
+		vm.stack = append(vm.stack, vm.self)
+	case OpDefineState:
+		vm.defineState(instr.Operand)
+	case OpGetState:
+		name, ok := vm.stateName(instr.Operand)
+		if !ok {
+			return false
+		}
+		vm.stack = append(vm.stack, vm.self.state[name])
+	case OpSetState:
+		value := vm.popStack()
+		name, ok := vm.stateName(instr.Operand)
+		if !ok {
+			return false
+		}
+		vm.self.state[name] = value
+		vm.self.dirty = true
+	case OpSyscall:
+		vm.syscall()
 	case OpExec:
-		command := vm.popStack().(string)
-		args := vm.popStack().(string)
-		logger.Log.Debug("Executing external command", zap.String("command", command), zap.String("args", args))
-		cmd := exec.Command(command, strings.Split(args, " ")...)
-		output, err := cmd.CombinedOutput()
+		vm.exec(instr.Operand)
+	case OpLLM:
+		vm.callLLM()
+	case OpPrompt:
+		vm.renderPrompt()
+	case OpRemember:
+		vm.remember()
+	case OpRecall:
+		vm.recall()
+	case OpForget:
+		vm.forget()
+	case OpObserve:
+		vm.observe()
+	case OpRecent:
+		vm.recentEntries()
+	case OpSession:
+		vm.sessionID()
+	case OpSessionRemember:
+		vm.sessionRemember()
+	case OpSessionRecall:
+		vm.sessionRecall()
+	case OpSessionHistory:
+		vm.sessionHistory()
+	case OpEmbed:
+		vm.embed()
+	case OpIndex:
+		vm.index()
+	case OpSearch:
+		vm.search()
+	case OpMCP:
+		vm.callTool()
+	case OpEnv:
+		vm.readEnv()
+	case OpArgs:
+		vm.programArgs()
+	case OpRandom:
+		vm.random()
+	case OpRandomInt:
+		vm.randomInt()
+	case OpChoice:
+		vm.choice()
+	case OpToInt:
+		vm.convert("int")
+	case OpToFloat:
+		vm.convert("float")
+	case OpToString:
+		vm.convert("string")
+	case OpToBool:
+		vm.convert("bool")
+	case OpTypeOf:
+		vm.typeOf()
+	case OpAssert:
+		vm.assert()
+	case OpUUID:
+		vm.uuid()
+	case OpSQLQuery:
+		vm.sqlQuery(instr.Operand)
+	case OpFormat:
+		vm.format()
+	case OpURLParse:
+		vm.urlParse()
+	case OpURLEncode:
+		vm.urlEncode()
+	case OpQueryParam:
+		vm.queryParam()
+	case OpYAMLParse:
+		vm.parseDocument("yamlParse", ParseYAML)
+	case OpTOMLParse:
+		vm.parseDocument("tomlParse", ParseTOML)
+	case OpMapList:
+		vm.mapList()
+	case OpFilter:
+		vm.filterList()
+	case OpReduce:
+		vm.reduceList()
+	case OpSort:
+		vm.sortList()
+	case OpLog:
+		vm.log(instr.Operand)
+	case OpEqual:
+		right := vm.popStack()
+		left := vm.popStack()
+		vm.stack = append(vm.stack, valuesEqual(left, right))
+	case OpNotEqual:
+		right := vm.popStack()
+		left := vm.popStack()
+		vm.stack = append(vm.stack, !valuesEqual(left, right))
+	case OpConcatString:
+		right := vm.popStack()
+		left := vm.popStack()
+		vm.stack = append(vm.stack, vm.concat(left, right))
+	case OpStringLength:
+		str, ok := vm.popStack().(string)
+		if !ok {
+			vm.fail(errors.New("attempted to get length of a non-string value"))
+			return false
+		}
+		vm.stack = append(vm.stack, utf8.RuneCountInString(str))
+	case OpGetStringItem:
+		index, indexOk := vm.popStack().(int)
+		str, strOk := vm.popStack().(string)
+		if !indexOk || !strOk {
+			vm.fail(errors.New("string index requires a string and an int index"))
+			return false
+		}
+		runes := []rune(str)
+		if index < 0 || index >= len(runes) {
+			vm.fail(fmt.Errorf("string index %d out of range for length %d", index, len(runes)))
+			return false
+		}
+		vm.stack = append(vm.stack, vm.strings.intern(string(runes[index])))
+	case OpCreateList:
+		vm.createList(instr.Operand)
+	case OpAppendList:
+		value := vm.popStack()
+		l, ok := vm.popStack().(*List)
+		if !ok {
+			vm.fail(errors.New("attempted to append to a non-list value"))
+			return false
+		}
+		l.Append(value)
+	case OpGetListItem:
+		index, indexOk := vm.popStack().(int)
+		l, ok := vm.popStack().(*List)
+		if !ok || !indexOk {
+			vm.fail(errors.New("attempted to get item from a non-list value or with a non-int index"))
+			return false
+		}
+		value, ok := l.Get(index)
+		if !ok {
+			vm.fail(fmt.Errorf("list index %d out of range for length %d", index, l.Len()))
+			return false
+		}
+		vm.stack = append(vm.stack, value)
+	case OpSetListItem:
+		value := vm.popStack()
+		index, indexOk := vm.popStack().(int)
+		l, ok := vm.popStack().(*List)
+		if !ok || !indexOk {
+			vm.fail(errors.New("attempted to set item on a non-list value or with a non-int index"))
+			return false
+		}
+		if !l.Set(index, value) {
+			vm.fail(fmt.Errorf("list index %d out of range for length %d", index, l.Len()))
+			return false
+		}
+	case OpCreateMap:
+		vm.createMap(instr.Operand)
+	case OpSetMapItem:
+		value := vm.popStack()
+		key := vm.popStack()
+		m, ok := vm.popStack().(*Map)
+		if !ok {
+			vm.fail(errors.New("attempted to set item on a non-map value"))
+			return false
+		}
+		if !isValidMapKey(key) {
+			vm.fail(fmt.Errorf("invalid map key of type %T", key))
+			return false
+		}
+		m.Set(key, value)
+	case OpGetMapItem:
+		key := vm.popStack()
+		m, ok := vm.popStack().(*Map)
+		if !ok {
+			vm.fail(errors.New("attempted to get item from a non-map value"))
+			return false
+		}
+		value, _ := m.Get(key)
+		vm.stack = append(vm.stack, value)
+	case OpGetItem:
+		index := vm.popStack()
+		value, err := vm.getItem(vm.popStack(), index)
 		if err != nil {
-			logger.Log.Error("External command failed", zap.Error(err))
-		} else {
-			vm.stack = append(vm.stack, string(output))
-			logger.Log.Debug("External command output", zap.String("output", string(output)))
+			vm.fail(err)
+			return false
 		}
-	case OpLog:
-		message := vm.popStack()
-		logger.Log.Info("Log message", zap.Any("message", message))
-	case OpPushString:
-		stringValue := vm.getStringConstant(instr.Operand)
-		vm.stack = append(vm.stack, stringValue)
-		logger.Log.Debug("Pushed string to stack", zap.String("value", stringValue))
+		vm.stack = append(vm.stack, value)
+	case OpCallBuiltin:
+		vm.callBuiltin(instr.Operand)
+	case OpGetLocalAdd:
+		left := vm.popStack()
+		slot, ok := vm.localSlot(instr.Operand)
+		if !ok {
+			return false
+		}
+		vm.stack = append(vm.stack, vm.add(left, vm.locals[slot]))
+	case OpPushAdd:
+		left := vm.popStack()
+		vm.stack = append(vm.stack, vm.add(left, instr.Operand))
+	case OpSetLocalGetLocal:
+		value := vm.popStack()
+		slot, ok := vm.localSlot(instr.Operand)
+		if !ok {
+			return false
+		}
+		vm.locals[slot] = value
+		vm.stack = append(vm.stack, value)
+	case OpJumpIfEqual, OpJumpIfNotEqual:
+		right := vm.popStack()
+		left := vm.popStack()
+		if valuesEqual(left, right) == (instr.Opcode == OpJumpIfEqual) {
+			vm.pc = instr.Operand
+			return false
+		}
+	case OpConstant:
+		if instr.Operand < 0 || instr.Operand >= len(vm.constants) {
+			vm.fail(fmt.Errorf("constant index %d out of range for %d constants", instr.Operand, len(vm.constants)))
+			return false
+		}
+		value := vm.constants[instr.Operand]
+		vm.stack = append(vm.stack, value)
 	default:
-		logger.Log.Error("Unknown opcode", zap.Int("opcode", int(instr.Opcode)))
-		vm.running = false
+		vm.fail(fmt.Errorf("unknown opcode %v", instr.Opcode))
+	}
+
+	return true
+}
+
+// callChain returns the names of the functions on the call stack, outermost
+// first, starting with the top-level program
+func (vm *VM) callChain() []string {
+	chain := []string{"<main>"}
+	for _, frame := range vm.callStack {
+		if frame.Function >= 0 && frame.Function < len(vm.functions) {
+			chain = append(chain, vm.functions[frame.Function].Name)
+		} else {
+			chain = append(chain, fmt.Sprintf("<function %d>", frame.Function))
+		}
+	}
+	return chain
+}
+
+// pushFrame enters a function, reserving its local variables. It fails with
+// ErrStackOverflow when the call depth limit is reached.
+func (vm *VM) pushFrame(returnAddress int, function int) bool {
+	if vm.maxCallDepth > 0 && len(vm.callStack) >= vm.maxCallDepth {
+		vm.fail(fmt.Errorf("%w: call depth exceeded %d calling %s", ErrStackOverflow, vm.maxCallDepth, vm.functions[function].Name))
+		return false
+	}
+	vm.metrics.Calls++
+	base := len(vm.locals)
+	vm.callStack = append(vm.callStack, Frame{ReturnAddress: returnAddress, Function: function, Base: base})
+	for i := 0; i < vm.functions[function].Locals; i++ {
+		vm.locals = append(vm.locals, nil)
+	}
+	vm.localBase = base
+	return true
+}
+
+// popFrame leaves the current function, releasing its local variables, and
+// returns the address to continue at
+func (vm *VM) popFrame() int {
+	frame := vm.callStack[len(vm.callStack)-1]
+	vm.callStack = vm.callStack[:len(vm.callStack)-1]
+	clear(vm.locals[frame.Base:])
+	vm.locals = vm.locals[:frame.Base]
+	vm.localBase = 0
+	if len(vm.callStack) > 0 {
+		vm.localBase = vm.callStack[len(vm.callStack)-1].Base
+	}
+	return frame.ReturnAddress
+}
+
+// localSlot returns the position of a local of the current frame in the
+// locals stack
+func (vm *VM) localSlot(index int) (int, bool) {
+	slot := vm.localBase + index
+	if len(vm.callStack) == 0 || index < 0 || slot >= len(vm.locals) {
+		vm.fail(fmt.Errorf("local variable %d out of range", index))
+		return 0, false
+	}
+	return slot, true
+}
+
+// setGlobal stores a global, growing the globals table as needed
+func (vm *VM) setGlobal(index int, value Value) bool {
+	if index < 0 || index >= maxGlobals {
+		vm.fail(fmt.Errorf("global variable %d out of range", index))
+		return false
+	}
+	for index >= len(vm.globals) {
+		vm.globals = append(vm.globals, nil)
+	}
+	vm.globals[index] = value
+	return true
+}
+
+// getGlobal loads a global, globals that were never set are nil
+func (vm *VM) getGlobal(index int) (Value, bool) {
+	if index < 0 {
+		vm.fail(fmt.Errorf("global variable %d out of range", index))
+		return nil, false
+	}
+	if index >= len(vm.globals) {
+		return nil, true
+	}
+	return vm.globals[index], true
+}
+
+// createList builds a list from the top n values on the stack, the deepest
+// becoming the first item
+func (vm *VM) createList(n int) {
+	if n < 0 || len(vm.stack) < n {
+		vm.fail(fmt.Errorf("not enough values on the stack to create list of %d items", n))
+		return
+	}
+	l := NewList(vm.stack[len(vm.stack)-n:]...)
+	vm.alloc(l)
+	clear(vm.stack[len(vm.stack)-n:])
+	vm.stack = vm.stack[:len(vm.stack)-n]
+	vm.stack = append(vm.stack, l)
+}
+
+// createMap builds a map from the top pairs*2 values on the stack, which are
+// expected to be pushed as key, value, key, value, ...
+func (vm *VM) createMap(pairs int) {
+	if pairs < 0 || pairs > len(vm.stack)/2 {
+		vm.fail(fmt.Errorf("not enough values on the stack to create map of %d pairs", pairs))
+		return
+	}
+	entries := vm.stack[len(vm.stack)-pairs*2:]
+	m := NewMap()
+	vm.alloc(m)
+	for i := 0; i < len(entries); i += 2 {
+		if !isValidMapKey(entries[i]) {
+			vm.fail(fmt.Errorf("invalid map key of type %T", entries[i]))
+			return
+		}
+		m.Set(entries[i], entries[i+1])
 	}
+	vm.stack = vm.stack[:len(vm.stack)-pairs*2]
+	vm.stack = append(vm.stack, m)
+}
 
-	vm.pc++
+// getItem indexes a value whose type is only known at runtime, maps by key
+// and lists and strings by position
+func (vm *VM) getItem(container, index Value) (Value, error) {
+	switch c := container.(type) {
+	case *Map:
+		value, _ := c.Get(index)
+		return value, nil
+	case *List:
+		i, ok := index.(int)
+		if !ok {
+			return nil, fmt.Errorf("list index must be int but got %s", typeName(index))
+		}
+		value, ok := c.Get(i)
+		if !ok {
+			return nil, fmt.Errorf("list index %d out of range for length %d", i, c.Len())
+		}
+		return value, nil
+	case string:
+		i, ok := index.(int)
+		if !ok {
+			return nil, fmt.Errorf("string index must be int but got %s", typeName(index))
+		}
+		runes := []rune(c)
+		if i < 0 || i >= len(runes) {
+			return nil, fmt.Errorf("string index %d out of range for length %d", i, len(runes))
+		}
+		return vm.strings.intern(string(runes[i])), nil
+	}
+	return nil, fmt.Errorf("cannot index value of type %s", typeName(container))
 }
 
-func (vm *VM) getStringConstant(index int) string {
-	// TODO: Implement string constant retrieval logic
-	return fmt.Sprintf("String constant %d", index)
+// isTruthy reports whether a value counts as true in a condition. Booleans
+// are taken as is, numbers are true when non-zero, strings when non-empty and
+// nil is always false. Any other value is true.
+func isTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case *Map:
+		return v.Len() > 0
+	case *List:
+		return v.Len() > 0
+	default:
+		return true
+	}
 }
 
-// executeBinaryOp executes a binary operation
+// executeBinaryOp executes a binary operation. Int arithmetic is checked, a
+// result that does not fit in an int fails with ErrIntegerOverflow rather
+// than wrapping around, while float arithmetic follows IEEE 754 and never
+// fails. Arithmetic faults stop the VM with a runtime error.
 func (vm *VM) executeBinaryOp(opcode Opcode) {
 	right := vm.popStack()
 	left := vm.popStack()
@@ -278,8 +1239,7 @@ func (vm *VM) executeBinaryOp(opcode Opcode) {
 // popStack pops the top value from the stack
 func (vm *VM) popStack() interface{} {
 	if len(vm.stack) == 0 {
-		logger.Log.Error("Attempted to pop from empty stack")
-		vm.running = false
+		vm.fail(errors.New("attempted to pop from empty stack"))
 		return nil
 	}
 	value := vm.stack[len(vm.stack)-1]
@@ -287,12 +1247,81 @@ func (vm *VM) popStack() interface{} {
 	return value
 }
 
-func (vm *VM) add(a, b interface{}) interface{} {
+// valuesEqual compares two values, treating ints and floats as comparable
+// numbers. Maps and lists are only equal to themselves.
+func valuesEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case int:
+		if y, ok := b.(float64); ok {
+			return float64(x) == y
+		}
+	case float64:
+		if y, ok := b.(int); ok {
+			return x == float64(y)
+		}
+	}
+	switch a.(type) {
+	case nil, bool, int, float64, string, *Map, *List:
+		return a == b
+	}
+	return false
+}
+
+// compareValues applies an ordering opcode to two numbers or two strings.
+// An int compared with a float is converted to float first, so comparisons
+// involving NaN are always false.
+func compareValues(opcode Opcode, a, b interface{}) (bool, bool) {
 	switch x := a.(type) {
 	case int:
 		switch y := b.(type) {
 		case int:
+			return ordered(opcode, x, y), true
+		case float64:
+			return ordered(opcode, float64(x), y), true
+		}
+	case float64:
+		switch y := b.(type) {
+		case int:
+			return ordered(opcode, x, float64(y)), true
+		case float64:
+			return ordered(opcode, x, y), true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return ordered(opcode, x, y), true
+		}
+	}
+	return false, false
+}
+
+func ordered[T int | float64 | string](opcode Opcode, a, b T) bool {
+	switch opcode {
+	case OpGreaterThan:
+		return a > b
+	case OpLessThan:
+		return a < b
+	case OpGreaterThanOrEqual:
+		return a >= b
+	case OpLessThanOrEqual:
+		return a <= b
+	}
+	return false
+}
+
+func (vm *VM) add(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
 			return x + y
+		}
+	case int:
+		switch y := b.(type) {
+		case int:
+			sum := x + y
+			if (x > 0 && y > 0 && sum < 0) || (x < 0 && y < 0 && sum >= 0) {
+				return vm.overflow("+", x, y)
+			}
+			return sum
 		case float64:
 			return float64(x) + y
 		}
@@ -304,7 +1333,7 @@ func (vm *VM) add(a, b interface{}) interface{} {
 			return x + y
 		}
 	}
-	panic(fmt.Sprintf("Unsupported types for addition: %T and %T", a, b))
+	return vm.unsupported("addition", a, b)
 }
 
 func (vm *VM) sub(a, b interface{}) interface{} {
@@ -312,7 +1341,11 @@ func (vm *VM) sub(a, b interface{}) interface{} {
 	case int:
 		switch y := b.(type) {
 		case int:
-			return x - y
+			difference := x - y
+			if (x >= 0 && y < 0 && difference < 0) || (x < 0 && y > 0 && difference >= 0) {
+				return vm.overflow("-", x, y)
+			}
+			return difference
 		case float64:
 			return float64(x) - y
 		}
@@ -324,7 +1357,7 @@ func (vm *VM) sub(a, b interface{}) interface{} {
 			return x - y
 		}
 	}
-	panic(fmt.Sprintf("Unsupported types for subtraction: %T and %T", a, b))
+	return vm.unsupported("subtraction", a, b)
 }
 
 func (vm *VM) mul(a, b interface{}) interface{} {
@@ -332,7 +1365,11 @@ func (vm *VM) mul(a, b interface{}) interface{} {
 	case int:
 		switch y := b.(type) {
 		case int:
-			return x * y
+			product := x * y
+			if x != 0 && (product/x != y || (x == -1 && y == math.MinInt)) {
+				return vm.overflow("*", x, y)
+			}
+			return product
 		case float64:
 			return float64(x) * y
 		}
@@ -344,44 +1381,48 @@ func (vm *VM) mul(a, b interface{}) interface{} {
 			return x * y
 		}
 	}
-	panic(fmt.Sprintf("Unsupported types for multiplication: %T and %T", a, b))
+	return vm.unsupported("multiplication", a, b)
 }
 
+// div divides two numbers. Two ints give the truncated int quotient and
+// dividing an int by zero fails with ErrDivisionByZero. As soon as a float is
+// involved the result is a float, so dividing by zero gives +Inf, -Inf or NaN
+// instead.
 func (vm *VM) div(a, b interface{}) interface{} {
 	switch x := a.(type) {
 	case int:
 		switch y := b.(type) {
 		case int:
 			if y == 0 {
-				panic("Division by zero")
+				vm.fail(fmt.Errorf("%w: %d / 0", ErrDivisionByZero, x))
+				return nil
+			}
+			if x == math.MinInt && y == -1 {
+				return vm.overflow("/", x, y)
 			}
 			return x / y
 		case float64:
-			if y == 0 {
-				panic("Division by zero")
-			}
 			return float64(x) / y
 		}
 	case float64:
 		switch y := b.(type) {
 		case int:
-			if y == 0 {
-				panic("Division by zero")
-			}
 			return x / float64(y)
 		case float64:
-			if y == 0 {
-				panic("Division by zero")
-			}
 			return x / y
 		}
 	}
-	panic(fmt.Sprintf("Unsupported types for division: %T and %T", a, b))
+	return vm.unsupported("division", a, b)
 }
 
-func (vm *VM) AddStringConstant(s string) int {
-	vm.stringConstants = append(vm.stringConstants, s)
-	return len(vm.stringConstants) - 1
+func (vm *VM) overflow(operator string, x, y int) interface{} {
+	vm.fail(fmt.Errorf("%w: %d %s %d", ErrIntegerOverflow, x, operator, y))
+	return nil
+}
+
+func (vm *VM) unsupported(operation string, a, b interface{}) interface{} {
+	vm.fail(fmt.Errorf("unsupported types for %s: %T and %T", operation, a, b))
+	return nil
 }
 
 func (vm *VM) GetLastResult() interface{} {
@@ -0,0 +1,164 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// the watch package watches directories and delivers their changes to
+// agents as file:changed events
+package watch
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"go.uber.org/zap"
+)
+
+// ChangedEvent is delivered to every agent when a file in a watched
+// directory changes. Its payload is a map holding the file's "path" and the
+// "operation", one of the Op constants.
+const ChangedEvent = "file:changed"
+
+// Operations reported in the payload of ChangedEvent
+const (
+	OpCreate = "create"
+	OpWrite  = "write"
+	OpRemove = "remove"
+)
+
+// DefaultInterval is how often directories are scanned by default
+const DefaultInterval = time.Second
+
+// Change is a change to a file found by a scan
+type Change struct {
+	Path      string
+	Operation string
+}
+
+// Watcher finds the files created, written and removed in directories and
+// their subdirectories by scanning them periodically, which works the same
+// on every platform and filesystem, including network mounts
+type Watcher struct {
+	dirs     []string
+	interval time.Duration
+	files    map[string]fileInfo
+}
+
+type fileInfo struct {
+	modTime time.Time
+	size    int64
+}
+
+// New returns a watcher scanning dirs every interval, or every
+// DefaultInterval when interval is zero
+func New(dirs []string, interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Watcher{dirs: dirs, interval: interval}
+}
+
+// Scan compares the directories with the previous scan and returns the
+// changes ordered by path. The first scan records the files and reports no
+// changes.
+func (w *Watcher) Scan() ([]Change, error) {
+	files := make(map[string]fileInfo, len(w.files))
+	for _, dir := range w.dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Files removed while walking are reported by the next scan
+				if errors.Is(err, fs.ErrNotExist) && path != dir {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			files[path] = fileInfo{modTime: info.ModTime(), size: info.Size()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	previous := w.files
+	w.files = files
+	if previous == nil {
+		return nil, nil
+	}
+	var changes []Change
+	for path, info := range files {
+		old, ok := previous[path]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Path: path, Operation: OpCreate})
+		case info != old:
+			changes = append(changes, Change{Path: path, Operation: OpWrite})
+		}
+	}
+	for path := range previous {
+		if _, ok := files[path]; !ok {
+			changes = append(changes, Change{Path: path, Operation: OpRemove})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// Run scans the directories until ctx is done and emits their changes to
+// every agent of machine
+func (w *Watcher) Run(ctx context.Context, machine *vm.VM) error {
+	if _, err := w.Scan(); err != nil {
+		return err
+	}
+	logger.Log.Infow("Watching directories", zap.Strings("dirs", w.dirs), zap.Duration("interval", w.interval))
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		changes, err := w.Scan()
+		if err != nil {
+			logger.Log.Warnw("Error scanning watched directories", zap.Error(err))
+			continue
+		}
+		for _, change := range changes {
+			payload := vm.NewMap()
+			payload.Set("path", change.Path)
+			payload.Set("operation", change.Operation)
+			if err := machine.Emit("", ChangedEvent, payload); err != nil {
+				logger.Log.Warnw("Error delivering file change", zap.String("path", change.Path), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/pprof"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	profileOut string
+	profileTop int
+)
+
+func newProfileCmd() *cobra.Command {
+	profileCmd := &cobra.Command{
+		Use:   "profile program [-- args...]",
+		Short: "Run a program and report where it spends its time",
+		Long: `Profile runs a MindScript source file or compiled .mindc program like msc exec
+with the VM profiler, then reports the --top functions and event handlers
+it spent the most time in on stderr, apart from the program's output.
+
+The profile is written to --out in the format of pprof, with the executed
+instructions and the time spent in every call stack:
+
+  go tool pprof -top profile.pb.gz
+  go tool pprof -sample_index=instructions -http=:8080 profile.pb.gz`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runProfile,
+	}
+	profileCmd.Flags().StringVarP(&profileOut, "out", "o", "profile.pb.gz", "Write the pprof profile to this file")
+	profileCmd.Flags().IntVar(&profileTop, "top", 10, "Number of functions in the report (0 for all)")
+	addRuntimeFlags(profileCmd.Flags())
+	return profileCmd
+}
+
+// stackSampler adds every executed instruction and the time until the next
+// one to the call stack it ran in. The VM calls it from the goroutine
+// owning it, one instruction at a time.
+type stackSampler struct {
+	profile *pprof.Profile
+	// entries maps the address of every function to its name
+	entries map[int]string
+	// stack holds the functions being called, starting with the top level
+	stack []string
+	// previous is set once an instruction started at last, its time is
+	// added when the next one starts. returned is set if it was an OpReturn.
+	previous bool
+	last     time.Time
+	returned bool
+}
+
+func newStackSampler(program *vm.Program, profile *pprof.Profile) *stackSampler {
+	entries := make(map[int]string, len(program.Functions))
+	for _, function := range program.Functions {
+		entries[function.Address] = function.Name
+	}
+	// pprof hides names in angle brackets, like the <main> of the VM's
+	// profile, so the top level is named differently
+	return &stackSampler{profile: profile, entries: entries, stack: []string{"(main)"}}
+}
+
+func (s *stackSampler) sample(pc int, instr vm.Instruction, stackDepth int) {
+	now := time.Now()
+	s.flush(now)
+	// Calls begin at the address of a function, which handlers are entered
+	// at without an OpCall, and end at its OpReturn
+	if name, ok := s.entries[pc]; ok {
+		s.stack = append(s.stack, name)
+	}
+	s.profile.Add(s.stack, 1, 0)
+	s.previous, s.last = true, now
+	s.returned = instr.Opcode == vm.OpReturn
+}
+
+// flush adds the time of the previous instruction to its stack
+func (s *stackSampler) flush(now time.Time) {
+	if !s.previous {
+		return
+	}
+	s.profile.Add(s.stack, 0, now.Sub(s.last).Nanoseconds())
+	s.previous = false
+	if s.returned && len(s.stack) > 1 {
+		s.stack = s.stack[:len(s.stack)-1]
+	}
+}
+
+func runProfile(cmd *cobra.Command, args []string) {
+	initLogger()
+	path := args[0]
+	logger.Log.Infow("msc: Profiling program", zap.String("program", path), zap.String("out", profileOut))
+
+	bytecode, err := loadProgram(path)
+	if err != nil {
+		logger.Log.Errorw("Error loading program", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+
+	profile := pprof.New(path,
+		pprof.ValueType{Type: "instructions", Unit: "count"},
+		pprof.ValueType{Type: "cpu", Unit: "nanoseconds"})
+	sampler := newStackSampler(bytecode, profile)
+	// An option keeping the VM, whose profile is reported once it stopped
+	var machine *vm.VM
+	capture := func(v *vm.VM) { machine = v }
+	interrupted := func() (context.Context, context.CancelFunc) {
+		return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	}
+	start := time.Now()
+	runErr := executeProgram(bytecode, args[1:], interrupted, vm.WithProfiling(), vm.WithTraceFunc(sampler.sample), capture)
+	sampler.flush(time.Now())
+	profile.SetDuration(time.Since(start))
+	if runErr != nil {
+		// Slow failures are worth profiling too
+		logger.Log.Errorw("Error running program", zap.Error(runErr))
+	}
+
+	if err := writeFile(profileOut, func(f *os.File) error {
+		_, err := profile.WriteTo(f)
+		return err
+	}); err != nil {
+		logger.Log.Errorw("Error writing the profile", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	if machine != nil {
+		writeProfileReport(os.Stderr, machine.Profile(), profileTop)
+	}
+	if runErr != nil {
+		os.Exit(exitCode(runErr))
+	}
+}
+
+// writeProfileReport writes the top functions of a profile by time spent
+// in the functions themselves, all of them if top is 0
+func writeProfileReport(out io.Writer, profile *vm.Profile, top int) {
+	functions := profile.TopFunctions()
+	if top > 0 && len(functions) > top {
+		functions = functions[:top]
+	}
+	percent := func(d time.Duration) float64 {
+		if profile.Duration == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(profile.Duration)
+	}
+	fmt.Fprintf(out, "%d instructions in %s\n", profile.Instructions, profile.Duration.Round(time.Microsecond))
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "flat\tflat%%\tcum\tcum%%\tcalls\tinstructions\t\tfunction\n")
+	for _, f := range functions {
+		fmt.Fprintf(w, "%s\t%.1f%%\t%s\t%.1f%%\t%d\t%d\t\t%s\n",
+			f.Flat.Round(time.Microsecond), percent(f.Flat), f.Cumulative.Round(time.Microsecond), percent(f.Cumulative), f.Calls, f.Instructions, f.Name)
+	}
+	w.Flush()
+}
@@ -0,0 +1,189 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/watch"
+	"go.uber.org/zap"
+)
+
+// rebuildDelay is how long the input must stay unchanged after a change
+// before it is compiled again, so that an editor saving in several writes
+// causes a single rebuild
+const rebuildDelay = 100 * time.Millisecond
+
+// buildWatchFlag is the --watch flag of build, which turns on the watch mode.
+// Before it, --watch took the directories of --watch-dir, as it still does
+// on the other commands. Given a value other than a boolean, as in
+// --watch=DIR, it watches the directory like --watch-dir with a warning.
+type buildWatchFlag struct{}
+
+func (buildWatchFlag) String() string {
+	return strconv.FormatBool(watchInputs)
+}
+
+func (buildWatchFlag) Set(value string) error {
+	if on, err := strconv.ParseBool(value); err == nil {
+		watchInputs = on
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Flag --watch=%s has been deprecated, use --watch-dir %s or --watch for the watch mode\n", value, value)
+	watchDirs = append(watchDirs, value)
+	return nil
+}
+
+func (buildWatchFlag) Type() string {
+	return "bool"
+}
+
+// rebuildOnChange compiles and runs the inputs, then does so again every
+// time they change until interrupted. Directories, and the whole project
+// when building from its manifest, are watched for source files added to
+// them, glob patterns of --input only match the files they did at first.
+func rebuildOnChange(files []string, args []string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var watched []string
+	for _, input := range inputFiles {
+		if info, err := os.Stat(input); err == nil && info.IsDir() {
+			watched = append(watched, input)
+		}
+	}
+	if project != nil {
+		watched = append(watched, project.dir)
+	}
+	watcher := watch.New(append(watched, files...), watchInterval)
+	if _, err := watcher.Scan(); err != nil {
+		logger.Log.Errorw("Error watching the inputs", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			buildAndRun(runCtx, args)
+		}()
+
+		changed, ok := waitForChange(ctx, watcher)
+		cancel()
+		if !ok {
+			// A second interrupt kills a program that does not stop
+			stop()
+			<-done
+			return
+		}
+		select {
+		case <-done:
+		default:
+			rebuildStatus("%s changed, stopping the running program", changed)
+			<-done
+		}
+		rebuildStatus("%s changed, rebuilding", changed)
+	}
+}
+
+// buildAndRun compiles and runs the inputs once, reporting the outcome on
+// the status line
+func buildAndRun(ctx context.Context, args []string) {
+	start := time.Now()
+	files, err := buildFiles()
+	if err != nil {
+		rebuildStatus("build failed: %v, waiting for changes", err)
+		return
+	}
+	bytecode, err := buildProgram(files)
+	if err != nil {
+		rebuildStatus("build failed: %v, waiting for changes", err)
+		return
+	}
+	rebuildStatus("built %s in %s, running", outputFile, time.Since(start).Round(time.Microsecond))
+	err = executeProgram(bytecode, args, func() (context.Context, context.CancelFunc) {
+		return context.WithCancel(ctx)
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		rebuildStatus("program failed: %v, waiting for changes", err)
+		return
+	}
+	rebuildStatus("program finished, waiting for changes")
+}
+
+// waitForChange scans the inputs every --watch-interval until a source file
+// changes and they then stay unchanged for rebuildDelay, and returns the
+// path of the first changed file. Other files, such as the compiled
+// program, are ignored. It returns false if ctx is done first.
+func waitForChange(ctx context.Context, watcher *watch.Watcher) (string, bool) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-ticker.C:
+		}
+		changes, err := watcher.Scan()
+		changed := firstSourceChange(changes)
+		if err == nil && changed == "" {
+			continue
+		}
+		// Editors that replace files remove them for a moment
+		for err != nil || len(changes) > 0 {
+			select {
+			case <-ctx.Done():
+				return "", false
+			case <-time.After(rebuildDelay):
+			}
+			changes, err = watcher.Scan()
+			if changed == "" {
+				changed = firstSourceChange(changes)
+			}
+		}
+		if changed != "" {
+			return changed, true
+		}
+	}
+}
+
+// firstSourceChange returns the path of the first change to a source file
+func firstSourceChange(changes []watch.Change) string {
+	for _, change := range changes {
+		if filepath.Ext(change.Path) == ".ms" {
+			return change.Path
+		}
+	}
+	return ""
+}
+
+// rebuildStatus prints a status line of --watch on stderr, apart from the
+// program's output
+func rebuildStatus(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "[msc %s] %s\n", time.Now().Format(time.TimeOnly), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,482 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	// The sqlite3 driver, so that --sql can open sqlite3:path databases
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/robert-cronin/mindscript-go/pkg/broker"
+	"github.com/robert-cronin/mindscript-go/pkg/codegen"
+	"github.com/robert-cronin/mindscript-go/pkg/lexer"
+	"github.com/robert-cronin/mindscript-go/pkg/llm"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/mcp"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/remote"
+	"github.com/robert-cronin/mindscript-go/pkg/semantic"
+	"github.com/robert-cronin/mindscript-go/pkg/tracing"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/robert-cronin/mindscript-go/pkg/watch"
+	"go.uber.org/zap"
+)
+
+// compileSource parses, analyses and compiles MindScript source files as
+// one program, see analyseSource
+func compileSource(paths ...string) (*parser.Program, *vm.Program, error) {
+	program, st, err := analyseSource(paths...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return program, codegen.GenerateBytecode(program, st), nil
+}
+
+// analyseSource parses and analyses MindScript source files and links them
+// into one program holding their statements in order. Like the statements
+// of a file, each file may use what the files before it declare. Errors
+// name the file when there are several.
+func analyseSource(paths ...string) (*parser.Program, *semantic.SymbolTable, error) {
+	linked := &parser.Program{}
+	st := semantic.NewSymbolTable(nil)
+	for _, path := range paths {
+		fail := func(err error) (*parser.Program, *semantic.SymbolTable, error) {
+			if len(paths) > 1 {
+				err = fmt.Errorf("%s: %w", path, err)
+			}
+			return nil, nil, err
+		}
+		input, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		l := lexer.New(string(input))
+		p := parser.New(l)
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			return fail(withExitCode(exitParse, fmt.Errorf("parser errors: %s", strings.Join(p.Errors(), "; "))))
+		}
+		if err := st.Extend(program, l); err != nil {
+			return fail(withExitCode(exitSemantic, err))
+		}
+		linked.Statements = append(linked.Statements, program.Statements...)
+	}
+	return linked, st, nil
+}
+
+// expandInputs resolves the --input flags of build to source files. An
+// input is a .ms file, a directory whose .ms files other than tests are
+// taken in lexical order, or a glob pattern matching .ms files.
+func expandInputs(inputs []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(path string) error {
+		if filepath.Ext(path) != ".ms" {
+			return fmt.Errorf("%s is not a MindScript source file, expected the .ms extension", path)
+		}
+		if !seen[filepath.Clean(path)] {
+			seen[filepath.Clean(path)] = true
+			files = append(files, path)
+		}
+		return nil
+	}
+	for _, input := range inputs {
+		if strings.ContainsAny(input, "*?[") {
+			matches, err := filepath.Glob(input)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", input, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%s matches no files", input)
+			}
+			for _, match := range matches {
+				if err := add(match); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if err := add(input); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		entries, err := os.ReadDir(input)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || filepath.Ext(name) != ".ms" || strings.HasSuffix(name, "_test.ms") {
+				continue
+			}
+			found = true
+			add(filepath.Join(input, name))
+		}
+		if !found {
+			return nil, fmt.Errorf("%s holds no MindScript source files", input)
+		}
+	}
+	return files, nil
+}
+
+// defaultOutput names the compiled program of build after its input: a
+// source file with the .mindc extension, or a directory's name in the
+// current directory
+func defaultOutput(inputs, files []string) (string, error) {
+	if len(inputs) == 1 {
+		if info, err := os.Stat(inputs[0]); err == nil && info.IsDir() {
+			dir, err := filepath.Abs(inputs[0])
+			if err != nil {
+				return "", err
+			}
+			return filepath.Base(dir) + ".mindc", nil
+		}
+	}
+	if len(files) != 1 {
+		return "", errors.New("--output is needed to build several files")
+	}
+	return strings.TrimSuffix(files[0], ".ms") + ".mindc", nil
+}
+
+// loadProgram reads a compiled .mindc program or compiles a source file
+func loadProgram(path string) (*vm.Program, error) {
+	if filepath.Ext(path) != ".mindc" {
+		_, bytecode, err := compileSource(path)
+		return bytecode, err
+	}
+	return readProgram(path)
+}
+
+// readProgram reads a compiled .mindc program
+func readProgram(path string) (*vm.Program, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vm.ReadProgram(f)
+}
+
+// newVMOptions configures a VM from the command line flags. The returned
+// function closes the MCP servers and peers the VM talks to and exports
+// the remaining spans.
+func newVMOptions() ([]vm.Option, func(), error) {
+	var closers []func() error
+	closeAll := func() {
+		for _, close := range closers {
+			close()
+		}
+	}
+
+	backend, err := vm.ParseBackend(backendName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policy := vm.PermissivePolicy()
+	policy.AllowExec = !noExec
+	policy.AllowEnv = !noEnv
+	policy.ReadableEnv = readableEnv
+	policy.AllowedBinaries = allowedBinaries
+	policy.AllowedEnv = commandEnv
+	policy.WorkDir = workDir
+	policy.Timeout = execTimeout
+	policy.MaxOutput = maxExecOutput
+
+	opts := []vm.Option{
+		vm.WithMaxInstructions(maxInstructions),
+		vm.WithTimeout(timeout),
+		vm.WithMaxMemory(maxMemory),
+		vm.WithPolicy(policy),
+		vm.WithBackend(backend),
+	}
+	if quotaSpec != "" {
+		quota, err := vm.ParseQuota(quotaSpec)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, vm.WithQuota(quota))
+	}
+	for _, agentQuota := range agentQuotas {
+		name, spec, ok := strings.Cut(agentQuota, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("agent quota %q is not Name=quota", agentQuota)
+		}
+		quota, err := vm.ParseQuota(spec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("quota of %s: %w", name, err)
+		}
+		opts = append(opts, vm.WithAgentQuota(name, quota))
+	}
+	if seed != 0 {
+		opts = append(opts, vm.WithSeed(seed))
+	}
+	if logLevel == "debug" {
+		opts = append(opts, vm.WithTraceFunc(logInstruction))
+	}
+	if mcpStdio {
+		// stdout carries the messages of the MCP client
+		opts = append(opts, vm.WithStdout(os.Stderr))
+	}
+	if stateDir != "" {
+		store, err := vm.NewFileStore(stateDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening state directory: %w", err)
+		}
+		opts = append(opts, vm.WithStateStore(store))
+	}
+	llmConfig, err := newLLMConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring the llm provider: %w", err)
+	}
+	provider, err := llm.New(llmConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring the llm provider: %w", err)
+	}
+	if provider != nil {
+		opts = append(opts, vm.WithLLM(provider))
+	}
+	embedder, err := llm.NewEmbedder(llmConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring the embedder: %w", err)
+	}
+	if embedder != nil {
+		opts = append(opts, vm.WithEmbedder(embedder))
+	}
+	opts = append(opts, vm.WithLLMTimeout(llmTimeout), vm.WithAskTimeout(askTimeout), vm.WithSessionTimeout(sessionTimeout))
+	for _, server := range mcpServers {
+		name, client, err := mcp.ParseServer(server)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, client.Close)
+		opts = append(opts, vm.WithMCPServer(name, client))
+	}
+	for _, connection := range sqlConnections {
+		name, db, err := openSQLConnection(connection)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, db.Close)
+		opts = append(opts, vm.WithSQLDatabase(name, db))
+	}
+	opts = append(opts, vm.WithSQLTimeout(sqlTimeout))
+	if len(peerAddrs) > 0 {
+		peers, err := remote.NewPeers(peerAddrs)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("connecting to peers: %w", err)
+		}
+		closers = append(closers, peers.Close)
+		opts = append(opts, vm.WithRemote(peers))
+	}
+	traceConfig, err := newTraceConfig()
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("configuring tracing: %w", err)
+	}
+	tracer, err := tracing.New(traceConfig)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("configuring tracing: %w", err)
+	}
+	if tracer != nil {
+		closers = append(closers, func() error {
+			// Export the spans of the last handlers
+			ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+			defer cancel()
+			return tracer.Shutdown(ctx)
+		})
+		opts = append(opts, vm.WithTracer(tracer))
+	}
+	return opts, closeAll, nil
+}
+
+// traceShutdownTimeout bounds the export of the remaining spans on exit
+const traceShutdownTimeout = 5 * time.Second
+
+func newTraceConfig() (tracing.Config, error) {
+	cfg, err := tracing.ConfigFromEnv()
+	if err != nil {
+		return cfg, err
+	}
+	if traceEndpoint != "" {
+		cfg.Endpoint = traceEndpoint
+	}
+	if traceService != "" {
+		cfg.Service = traceService
+	}
+	return cfg, nil
+}
+
+// openSQLConnection opens a database given as name=driver:dsn. A DSN of the
+// form $VAR is read from the environment, keeping credentials off the
+// command line.
+func openSQLConnection(connection string) (string, *sql.DB, error) {
+	name, spec, ok := strings.Cut(connection, "=")
+	driver, dsn, ok2 := strings.Cut(spec, ":")
+	if !ok || !ok2 || name == "" || driver == "" {
+		return "", nil, fmt.Errorf("sql connection %q is not name=driver:dsn", connection)
+	}
+	if variable, ok := strings.CutPrefix(dsn, "$"); ok {
+		if dsn, ok = os.LookupEnv(variable); !ok {
+			return "", nil, fmt.Errorf("sql connection %s: $%s is not set", name, variable)
+		}
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return "", nil, fmt.Errorf("sql connection %s: %w", name, err)
+	}
+	return name, db, nil
+}
+
+// eventSources are the sources of external events configured on the
+// command line
+type eventSources struct {
+	listener      net.Listener
+	mcpListener   net.Listener
+	subscriptions []broker.Subscription
+}
+
+// openEventSources listens on the configured addresses and parses the
+// broker subscriptions
+func openEventSources() (*eventSources, error) {
+	s := &eventSources{}
+	var err error
+	for _, raw := range brokerURLs {
+		sub, err := broker.ParseSubscription(raw)
+		if err != nil {
+			return nil, err
+		}
+		s.subscriptions = append(s.subscriptions, sub)
+	}
+	if listenAddr != "" {
+		if s.listener, err = net.Listen("tcp", listenAddr); err != nil {
+			return nil, fmt.Errorf("listening for remote events: %w", err)
+		}
+	}
+	if mcpListenAddr != "" {
+		if s.mcpListener, err = net.Listen("tcp", mcpListenAddr); err != nil {
+			if s.listener != nil {
+				s.listener.Close()
+			}
+			return nil, fmt.Errorf("listening for MCP clients: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// active reports whether any source is configured
+func (s *eventSources) active() bool {
+	return len(s.subscriptions) > 0 || len(watchDirs) > 0 || s.listener != nil || s.mcpListener != nil || mcpStdio
+}
+
+// close stops listening when the program ends before the sources run
+func (s *eventSources) close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.mcpListener != nil {
+		s.mcpListener.Close()
+	}
+}
+
+// run delivers the events of every source to machine until ctx is done. The
+// returned WaitGroup is done once they have all stopped. stop is called
+// when the MCP client on stdin goes away.
+func (s *eventSources) run(ctx context.Context, stop func(), machine *vm.VM) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	if s.listener != nil {
+		server := remote.NewServer(machine)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Log.Infow("Accepting remote events", zap.Stringer("address", s.listener.Addr()))
+			if err := server.Serve(s.listener); err != nil {
+				logger.Log.Errorw("Error serving remote events", zap.Error(err))
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Stop()
+		}()
+	}
+	if s.mcpListener != nil {
+		server := &http.Server{Handler: mcp.NewServer(machine)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Log.Infow("Offering agent functions as MCP tools", zap.Stringer("address", s.mcpListener.Addr()))
+			if err := server.Serve(s.mcpListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Log.Errorw("Error serving MCP clients", zap.Error(err))
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+	}
+	if mcpStdio {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The program stops once the client closes stdin
+			defer stop()
+			if err := mcp.NewServer(machine).ServeStdio(ctx, os.Stdin, os.Stdout); err != nil {
+				logger.Log.Errorw("Error serving the MCP client", zap.Error(err))
+			}
+		}()
+	}
+	if len(watchDirs) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := watch.New(watchDirs, watchInterval).Run(ctx, machine); err != nil {
+				logger.Log.Errorw("Error watching directories", zap.Error(err))
+			}
+		}()
+	}
+	for _, sub := range s.subscriptions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := broker.Run(ctx, machine, sub); err != nil {
+				logger.Log.Errorw("Error subscribing to broker", zap.String("broker", sub.URL.Redacted()), zap.Error(err))
+			}
+		}()
+	}
+	return &wg
+}
@@ -0,0 +1,72 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+)
+
+const reportSource = `
+agent Reporter {
+    goal: "Report on open tickets";
+    capabilities: ["sql"];
+
+    behavior {
+        on "start" {
+            print(sqlQuery("reports", "select title, priority from tickets where status = ? order by priority", ["open"]));
+        }
+    }
+}
+`
+
+func TestSQLQuery(t *testing.T) {
+	dir := t.TempDir()
+	name, db, err := openSQLConnection("reports=sqlite3:" + filepath.Join(dir, "reports.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`create table tickets (title text, priority int, status text);
+		insert into tickets values ('printer on fire', 1, 'open'), ('typo', 3, 'open'), ('old', 2, 'closed');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "report.ms")
+	if err := os.WriteFile(path, []byte(reportSource), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, program, err := compileSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	machine := vm.New(program, vm.WithSQLDatabase(name, db), vm.WithStdout(&stdout))
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"title": printer on fire, "priority": 1}, {"title": typo, "priority": 3}]` + "\n"
+	if stdout.String() != want {
+		t.Errorf("got %q, want %q", stdout.String(), want)
+	}
+}
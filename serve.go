@@ -0,0 +1,340 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/codegen"
+	"github.com/robert-cronin/mindscript-go/pkg/control"
+	"github.com/robert-cronin/mindscript-go/pkg/k8s"
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/mcp"
+	"github.com/robert-cronin/mindscript-go/pkg/repl"
+	"github.com/robert-cronin/mindscript-go/pkg/semantic"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// runServe runs a program's agents until the process is interrupted. Control
+// requests in progress get up to --shutdown-timeout to finish, then the
+// event sources are stopped and so are the agents.
+func runServe(cmd *cobra.Command, args []string) {
+	initLogger()
+	paths, args := servedProgram(cmd, args)
+	logger.Log.Infow("msc: Starting server", zap.Strings("program", paths))
+
+	bytecode, attach, err := loadServedProgram(paths)
+	if err != nil {
+		logger.Log.Errorw("Error loading program", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	opts, closeOptions, err := newVMOptions()
+	if err != nil {
+		logger.Log.Errorw("Error configuring the VM", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	defer closeOptions()
+	sources, err := openEventSources()
+	if err != nil {
+		logger.Log.Errorw("Error configuring external events", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	status, err := newStatusReporter()
+	if err != nil {
+		logger.Log.Errorw("Error configuring status reports", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	listener, err := net.Listen("tcp", controlAddr)
+	if err != nil {
+		logger.Log.Errorw("Error listening for control requests", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	token, tokenFile, err := newControlToken(listener.Addr().String())
+	if err != nil {
+		logger.Log.Errorw("Error creating the control API token", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	defer os.Remove(tokenFile)
+
+	opts = append(opts, vm.WithActivityLog(activityLog), vm.WithArgs(args))
+	machine := vm.New(bytecode, opts...)
+	if err := machine.Run(); err != nil {
+		logger.Log.Errorw("Runtime error", zap.Error(err))
+		os.Exit(exitRuntime)
+	}
+	controlOpts := []control.Option{
+		control.WithToken(token),
+		control.WithAllowedOrigins(allowOrigins...),
+		control.WithHandler("/mcp", mcp.NewServer(machine, mcp.WithAllowedOrigins(allowOrigins...))),
+	}
+	var evaluator *repl.Evaluator
+	if attach != nil {
+		evaluator = repl.NewEvaluator(machine, attach.symbolTable, attach.generator)
+		controlOpts = append(controlOpts, control.WithEvaluator(evaluator))
+		logger.Log.Warnw("REPLs may attach and run code with the program's privileges", zap.String("address", controlAddr))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Handler: control.NewServer(machine, controlOpts...)}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		logger.Log.Infow("Serving the control API", zap.Stringer("address", listener.Addr()))
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log.Errorw("Error serving control requests", zap.Error(err))
+			stop()
+		}
+	}()
+	wg := sources.run(ctx, stop, machine)
+	if status != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k8s.ReportStatus(ctx, status.client, status.namespace, status.name, machine, k8sInterval)
+		}()
+	}
+	if reload {
+		if filepath.Ext(paths[0]) == ".mindc" {
+			logger.Log.Warnw("Compiled programs are not reloaded", zap.String("program", paths[0]))
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reloadOnChange(ctx, paths, machine, evaluator)
+			}()
+		}
+	}
+
+	<-ctx.Done()
+	logger.Log.Info("msc: Stopping server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Log.Warnw("Control requests still in progress were cancelled", zap.Error(err))
+		server.Close()
+	}
+	<-served
+	wg.Wait()
+	if err := machine.Shutdown(); err != nil {
+		logger.Log.Errorw("Runtime error while stopping agents", zap.Error(err))
+		closeOptions()
+		os.Exit(exitRuntime)
+	}
+	status.stopped(machine)
+	logger.Log.Info("msc: Server stopped")
+}
+
+// attachState is what inputs of attached REPLs are compiled after: the
+// analysis of the served program and the generator that compiled it
+type attachState struct {
+	symbolTable *semantic.SymbolTable
+	generator   *codegen.CodeGenerator
+}
+
+// servedProgram returns the files of the program to serve and the
+// arguments passed to it. Without a program before --, it is the
+// entrypoint of the project's manifest, which also sets the flags not given
+// on the command line.
+func servedProgram(cmd *cobra.Command, args []string) ([]string, []string) {
+	if len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+		return args[:1], args[1:]
+	}
+	if err := loadProject(cmd.Flags()); err != nil {
+		logger.Log.Errorw("Error reading the project manifest", zap.Error(err))
+		os.Exit(exitUsage)
+	}
+	logger.Log.Infow("Using project manifest", zap.String("path", project.path), zap.String("name", project.name))
+	files, err := project.files(entryName)
+	if err != nil {
+		logger.Log.Errorw("Error reading the project's sources", zap.Error(err))
+		os.Exit(exitUsage)
+	}
+	return files, args
+}
+
+// loadServedProgram loads the program to serve, a compiled program or
+// source files linked in order. With --allow-attach, source files are
+// compiled keeping what attached REPLs need, compiled programs cannot be
+// attached to.
+func loadServedProgram(paths []string) (*vm.Program, *attachState, error) {
+	if len(paths) == 1 && filepath.Ext(paths[0]) == ".mindc" {
+		if allowAttach {
+			logger.Log.Warnw("REPLs cannot attach to compiled programs", zap.String("program", paths[0]))
+		}
+		bytecode, err := readProgram(paths[0])
+		return bytecode, nil, err
+	}
+	if !allowAttach {
+		_, bytecode, err := compileSource(paths...)
+		return bytecode, nil, err
+	}
+	return compileAttachable(paths...)
+}
+
+// compileAttachable compiles source files like compileSource, keeping
+// their analysis and code generator
+func compileAttachable(paths ...string) (*vm.Program, *attachState, error) {
+	program, st, err := analyseSource(paths...)
+	if err != nil {
+		return nil, nil, err
+	}
+	generator := codegen.NewCodeGenerator(st)
+	return generator.Generate(program), &attachState{symbolTable: st, generator: generator}, nil
+}
+
+// newControlToken returns the bearer token of the control API on addr,
+// $MSC_CONTROL_TOKEN or a random one, and writes it to the file of
+// controlTokenFile readable by the user only
+func newControlToken(addr string) (string, string, error) {
+	token := os.Getenv(control.EnvToken)
+	if token == "" {
+		var err error
+		if token, err = control.NewToken(); err != nil {
+			return "", "", err
+		}
+	}
+	path, err := controlTokenFile(addr)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", "", err
+	}
+	logger.Log.Infow("Wrote the control API token", zap.String("path", path))
+	return token, path, nil
+}
+
+// controlTokenFile returns the file holding the token of the control API
+// listening on the port of addr, in the user's cache directory
+func controlTokenFile(addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("finding the cache directory, set $%s: %w", control.EnvToken, err)
+	}
+	return filepath.Join(dir, "mindscript", "control", port+".token"), nil
+}
+
+// statusReporter reports the status of the agents to a MindScript resource
+type statusReporter struct {
+	client    *k8s.Client
+	namespace string
+	name      string
+}
+
+// newStatusReporter configures the reports asked for with --k8s-status, it
+// returns nil when there are none
+func newStatusReporter() (*statusReporter, error) {
+	if k8sStatus == "" {
+		return nil, nil
+	}
+	namespace, name, ok := strings.Cut(k8sStatus, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("resource %q is not namespace/name", k8sStatus)
+	}
+	client, err := k8s.InCluster()
+	if errors.Is(err, k8s.ErrNotInCluster) {
+		logger.Log.Warnw("Not reporting status outside of a Kubernetes pod", zap.String("resource", k8sStatus))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &statusReporter{client: client, namespace: namespace, name: name}, nil
+}
+
+// stopped reports that the agents have been stopped
+func (r *statusReporter) stopped(machine *vm.VM) {
+	if r == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.client.PatchStatus(ctx, r.namespace, r.name, k8s.StatusOf(machine, k8s.PhaseStopped)); err != nil {
+		logger.Log.Warnw("Error reporting status to Kubernetes", zap.String("resource", k8sStatus), zap.Error(err))
+	}
+}
+
+// reloadOnChange recompiles the source files whenever one of them changes
+// and reloads machine with them until ctx is done. Programs that do not
+// compile or cannot be reloaded are logged and the agents keep running the
+// previous one. Attached REPLs, if evaluator is not nil, go on with the
+// reloaded program.
+func reloadOnChange(ctx context.Context, paths []string, machine *vm.VM, evaluator *repl.Evaluator) {
+	// The latest modification of the files, zero if one is missing
+	modified := func() time.Time {
+		var latest time.Time
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return time.Time{}
+			}
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+		return latest
+	}
+	last := modified()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := modified()
+		if current.IsZero() || current.Equal(last) {
+			continue
+		}
+		last = current
+		logger.Log.Infow("Reloading program", zap.Strings("program", paths))
+		bytecode, attach, err := compileAttachable(paths...)
+		if err != nil {
+			logger.Log.Errorw("Error compiling program, keeping the running one", zap.Error(err))
+			continue
+		}
+		if err := machine.Reload(bytecode); err != nil {
+			logger.Log.Errorw("Error reloading program, keeping the running one", zap.Error(err))
+			continue
+		}
+		if evaluator != nil {
+			evaluator.Reset(attach.symbolTable, attach.generator)
+		}
+	}
+}
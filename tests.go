@@ -0,0 +1,236 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/parser"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	testRun     string
+	testSeed    uint64
+	testTimeout time.Duration
+)
+
+func newTestCmd() *cobra.Command {
+	testCmd := &cobra.Command{
+		Use:   "test [paths...]",
+		Short: "Run the tests of MindScript programs",
+		Long: `Test runs the functions whose names start with test in the *_test.ms files
+of the given files and directories, the current directory by default.
+Every test gets a VM of its own that first runs the file's top level, with
+external commands and environment variables denied and random numbers
+seeded by --seed, so runs are reproducible. A test fails when an assert
+does not hold or it ends with a runtime error. msc exits with status 1 if
+any test failed.`,
+		Run: runTests,
+	}
+	testCmd.Flags().StringVar(&testRun, "run", "", "Only run the tests whose names match this regular expression")
+	testCmd.Flags().Uint64Var(&testSeed, "seed", 1, "Seed of random, randomInt, choice and uuid in tests")
+	testCmd.Flags().DurationVar(&testTimeout, "timeout", 10*time.Second, "Maximum time each test may take (0 for unlimited)")
+	return testCmd
+}
+
+// testResult is the outcome of a test
+type testResult struct {
+	name     string
+	err      error
+	duration time.Duration
+}
+
+func runTests(cmd *cobra.Command, args []string) {
+	if !cmd.Flags().Changed("loglevel") {
+		// The VM logs every run at info level
+		logLevel = "warn"
+	}
+	initLogger()
+
+	var filter *regexp.Regexp
+	if testRun != "" {
+		var err error
+		if filter, err = regexp.Compile(testRun); err != nil {
+			logger.Log.Errorw("Error parsing --run", zap.Error(err))
+			os.Exit(exitUsage)
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	files, err := findFiles(args, "_test.ms")
+	if err != nil {
+		logger.Log.Errorw("Error finding test files", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	if len(files) == 0 {
+		fmt.Println("no test files")
+		return
+	}
+
+	passed, failed := 0, 0
+	for _, file := range files {
+		start := time.Now()
+		results, err := runTestFile(file, filter)
+		if err != nil {
+			fmt.Printf("FAIL  %s  %s\n", file, err)
+			failed++
+			continue
+		}
+		fileFailed := 0
+		for _, result := range results {
+			if result.err == nil {
+				fmt.Printf("  PASS  %s (%s)\n", result.name, result.duration)
+				continue
+			}
+			fileFailed++
+			fmt.Printf("  FAIL  %s (%s)\n", result.name, result.duration)
+			fmt.Printf("        %s\n", describeFailure(result.err))
+		}
+		passed += len(results) - fileFailed
+		failed += fileFailed
+		status := "ok  "
+		if fileFailed > 0 {
+			status = "FAIL"
+		}
+		fmt.Printf("%s  %s  %d passed, %d failed (%s)\n", status, file, len(results)-fileFailed, fileFailed, time.Since(start))
+	}
+
+	if failed > 0 {
+		fmt.Printf("FAIL: %d of %d tests failed\n", failed, passed+failed)
+		os.Exit(exitFailure)
+	}
+	fmt.Printf("PASS: %d tests\n", passed)
+}
+
+// describeFailure explains why a test failed, a failed assert by its
+// message alone. Runtime errors already say they are one.
+func describeFailure(err error) string {
+	var runtimeErr *vm.RuntimeError
+	isRuntimeErr := errors.As(err, &runtimeErr)
+	switch {
+	case errors.Is(err, vm.ErrAssertionFailed) && isRuntimeErr:
+		return runtimeErr.Err.Error()
+	case errors.Is(err, vm.ErrAssertionFailed) || isRuntimeErr:
+		return err.Error()
+	}
+	return "runtime error: " + err.Error()
+}
+
+// runTestFile compiles a test file and runs its tests in order
+func runTestFile(path string, filter *regexp.Regexp) ([]testResult, error) {
+	program, bytecode, err := compileSource(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []testResult
+	for _, name := range namedFunctions(program, "test") {
+		if filter != nil && !filter.MatchString(name) {
+			continue
+		}
+		start := time.Now()
+		err := runTest(bytecode, name)
+		results = append(results, testResult{name: name, err: err, duration: time.Since(start)})
+	}
+	return results, nil
+}
+
+// runTest runs the top level of a program in a sandboxed VM of its own,
+// then calls the test function
+func runTest(bytecode *vm.Program, name string) error {
+	machine, err := newTestVM(bytecode)
+	if err != nil {
+		return err
+	}
+	defer machine.Shutdown()
+	_, err = machine.CallFunction(name)
+	return err
+}
+
+// newTestVM returns a sandboxed VM that has run the top level of a program,
+// with external commands and environment variables denied and random
+// numbers seeded by --seed. --timeout limits each call separately.
+func newTestVM(bytecode *vm.Program) (*vm.VM, error) {
+	machine := vm.New(bytecode,
+		vm.WithPolicy(vm.DenyPolicy()),
+		vm.WithSeed(testSeed),
+		vm.WithTimeout(testTimeout),
+	)
+	if err := machine.Run(); err != nil {
+		machine.Shutdown()
+		return nil, fmt.Errorf("running the top level: %w", err)
+	}
+	return machine, nil
+}
+
+// namedFunctions returns the names of the top-level functions of program
+// that start with prefix and take no arguments, in the order of the source
+func namedFunctions(program *parser.Program, prefix string) []string {
+	var names []string
+	for _, stmt := range program.Statements {
+		function, ok := stmt.(*parser.Function)
+		if !ok || !strings.HasPrefix(function.Name.Value, prefix) || len(function.Arguments) != 0 {
+			continue
+		}
+		names = append(names, function.Name.Value)
+	}
+	return names
+}
+
+// findFiles returns the files among paths and in the directories among
+// them whose names end with suffix, skipping hidden directories. Files
+// named explicitly are returned whatever their names.
+func findFiles(paths []string, suffix string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && path != "." && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && strings.HasSuffix(d.Name(), suffix) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
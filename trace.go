@@ -0,0 +1,208 @@
+/**
+ * Copyright 2024 Robert Cronin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/robert-cronin/mindscript-go/pkg/logger"
+	"github.com/robert-cronin/mindscript-go/pkg/vm"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	traceOut      string
+	traceFormat   string
+	traceMaxSteps int
+)
+
+// traceVersion is the version of the format of msc trace, raised when it
+// changes incompatibly
+const traceVersion = 1
+
+func newTraceCmd() *cobra.Command {
+	traceCmd := &cobra.Command{
+		Use:   "trace program [-- args...]",
+		Short: "Run a program recording every executed instruction",
+		Long: `Trace runs a MindScript source file or compiled .mindc program like msc exec,
+recording every instruction it executes, and writes the trace to --out.
+
+The json format holds the program as msc build --emit=json writes it, the
+seed and arguments it ran with, so that running it again with them takes
+the same path, and its steps as [pc, stack depth, nanoseconds since the
+start]. The chrome format holds the calls of functions and event handlers
+as trace events, for chrome://tracing or Perfetto.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runTrace,
+	}
+	traceCmd.Flags().StringVarP(&traceOut, "out", "o", "trace.json", "Write the trace to this file")
+	traceCmd.Flags().StringVar(&traceFormat, "format", "json", "Format of the trace (json, chrome)")
+	traceCmd.Flags().IntVar(&traceMaxSteps, "max-steps", 1_000_000, "Stop recording after this many instructions, the program runs on (0 for unlimited)")
+	addRuntimeFlags(traceCmd.Flags())
+	return traceCmd
+}
+
+// traceJSON is a trace in the json format
+type traceJSON struct {
+	Version int              `json:"version"`
+	Sources []sourceMetadata `json:"sources"`
+	Seed    uint64           `json:"seed"`
+	Args    []string         `json:"args"`
+	Program programJSON      `json:"program"`
+	// Steps are the executed instructions as [pc, stack depth, ns]
+	Steps [][3]int64 `json:"steps"`
+	// Dropped counts the steps past --max-steps, which were not recorded
+	Dropped int `json:"dropped"`
+}
+
+// chromeEvent is an event of the Trace Event Format, its timestamp in
+// microseconds
+type chromeEvent struct {
+	Name  string         `json:"name,omitempty"`
+	Phase string         `json:"ph"`
+	Time  float64        `json:"ts"`
+	PID   int            `json:"pid"`
+	TID   int            `json:"tid"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// recorder records the steps of a program. The VM calls it from the
+// goroutine owning it, one instruction at a time.
+type recorder struct {
+	program *vm.Program
+	start   time.Time
+	steps   [][3]int64
+	dropped int
+	// entries maps the address of every function to its index
+	entries map[int]int
+}
+
+func newRecorder(program *vm.Program) *recorder {
+	entries := make(map[int]int, len(program.Functions))
+	for i, function := range program.Functions {
+		entries[function.Address] = i
+	}
+	return &recorder{program: program, start: time.Now(), steps: [][3]int64{}, entries: entries}
+}
+
+func (r *recorder) record(pc int, instr vm.Instruction, stackDepth int) {
+	if traceMaxSteps > 0 && len(r.steps) >= traceMaxSteps {
+		r.dropped++
+		return
+	}
+	r.steps = append(r.steps, [3]int64{int64(pc), int64(stackDepth), time.Since(r.start).Nanoseconds()})
+}
+
+// chromeEvents returns the calls of the recorded steps as begin and end
+// events. A call begins at the address of a function, which handlers are
+// entered at without an OpCall, and ends at its OpReturn.
+func (r *recorder) chromeEvents() []chromeEvent {
+	events := []chromeEvent{{Name: "thread_name", Phase: "M", PID: 1, TID: 1, Args: map[string]any{"name": "vm"}}}
+	// calls holds the open calls, each with the step it began at
+	var calls []int
+	end := func(step int, ns int64) {
+		begin := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		events = append(events, chromeEvent{Phase: "E", Time: float64(ns) / 1e3, PID: 1, TID: 1, Args: map[string]any{"instructions": step - begin + 1}})
+	}
+	for i, step := range r.steps {
+		pc, ns := int(step[0]), step[2]
+		if function, ok := r.entries[pc]; ok {
+			calls = append(calls, i)
+			events = append(events, chromeEvent{Name: r.program.Functions[function].Name, Phase: "B", Time: float64(ns) / 1e3, PID: 1, TID: 1})
+		}
+		if r.program.Instructions[pc].Opcode == vm.OpReturn && len(calls) > 0 {
+			end(i, ns)
+		}
+	}
+	for len(calls) > 0 {
+		last := r.steps[len(r.steps)-1]
+		end(len(r.steps)-1, last[2])
+	}
+	return events
+}
+
+func runTrace(cmd *cobra.Command, args []string) {
+	initLogger()
+	if traceFormat != "json" && traceFormat != "chrome" {
+		logger.Log.Errorw("Error parsing --format", zap.Error(fmt.Errorf("unknown trace format %q, expected json or chrome", traceFormat)))
+		os.Exit(exitUsage)
+	}
+	path := args[0]
+	logger.Log.Infow("msc: Tracing program", zap.String("program", path), zap.String("out", traceOut))
+
+	bytecode, err := loadProgram(path)
+	if err != nil {
+		logger.Log.Errorw("Error loading program", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	if seed == 0 {
+		// Recorded so that the run can be repeated, never 0 which would
+		// seed randomly again
+		seed = rand.Uint64() | 1
+	}
+
+	r := newRecorder(bytecode)
+	interrupted := func() (context.Context, context.CancelFunc) {
+		return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	}
+	runErr := executeProgram(bytecode, args[1:], interrupted, vm.WithTraceFunc(r.record))
+	if runErr != nil {
+		// The trace of a failing run is the most interesting one
+		logger.Log.Errorw("Error running program", zap.Error(runErr))
+	}
+
+	var trace any
+	if traceFormat == "chrome" {
+		trace = map[string]any{"traceEvents": r.chromeEvents(), "displayTimeUnit": "ns"}
+	} else {
+		sources := []sourceMetadata{}
+		if filepath.Ext(path) != ".mindc" {
+			if source, err := newSourceMetadata(path); err == nil {
+				sources = append(sources, source)
+			}
+		}
+		trace = traceJSON{
+			Version: traceVersion,
+			Sources: sources,
+			Seed:    seed,
+			Args:    append([]string{}, args[1:]...),
+			Program: newProgramJSON(bytecode),
+			Steps:   r.steps,
+			Dropped: r.dropped,
+		}
+	}
+	if err := writeFile(traceOut, func(f *os.File) error {
+		return json.NewEncoder(f).Encode(trace)
+	}); err != nil {
+		logger.Log.Errorw("Error writing the trace", zap.Error(err))
+		os.Exit(exitFailure)
+	}
+	logger.Log.Infow("msc: Trace written", zap.Int("steps", len(r.steps)), zap.Int("dropped", r.dropped))
+	if runErr != nil {
+		os.Exit(exitCode(runErr))
+	}
+}